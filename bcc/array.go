@@ -0,0 +1,138 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <bcc/bpf_common.h>
+#include <bcc/libbpf.h>
+*/
+import "C"
+
+// ErrIndexOutOfRange is returned when an index is beyond the size of an
+// array table.
+var ErrIndexOutOfRange = errors.New("index out of range")
+
+// checkArray returns an error unless the table is an array indexed by
+// 32 bit integers.
+func (table *Table) checkArray(op mapOp) error {
+	if err := table.checkOp(op); err != nil {
+		return err
+	}
+	desc := table.Desc()
+	switch desc.MapType {
+	case MapTypeArray, MapTypePercpuArray, MapTypeProgArray, MapTypePerfEventArray, MapTypeCgroupArray, MapTypeArrayOfMaps:
+	default:
+		return fmt.Errorf("%v table %s is not an array: %w", desc.MapType, desc.Name, ErrOperationNotSupported)
+	}
+	if desc.KeySize != 4 {
+		return fmt.Errorf("array table %s has a key size of %d bytes, expected 4", desc.Name, desc.KeySize)
+	}
+	return nil
+}
+
+// GetAt returns the raw value at index of an array table.
+func (table *Table) GetAt(index uint32) ([]byte, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkArray(opLookup); err != nil {
+		return nil, err
+	}
+	leafSize, err := table.leafBufSize()
+	if err != nil {
+		return nil, err
+	}
+	leaf := make([]byte, leafSize)
+	if err := table.getAt(index, leaf); err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+func (table *Table) getAt(index uint32, leaf []byte) error {
+	fd := table.Desc().FD
+	if err := table.lookupElem(fd, unsafe.Pointer(&index), unsafe.Pointer(&leaf[0])); err != nil {
+		if err == syscall.ENOENT || err == syscall.E2BIG {
+			return fmt.Errorf("Table.GetAt: %d: %w", index, ErrIndexOutOfRange)
+		}
+		return fmt.Errorf("Table.GetAt: unable to lookup element (%d): %w", index, mapErrno(err))
+	}
+	return nil
+}
+
+// SetAt sets the raw value at index of an array table.
+func (table *Table) SetAt(index uint32, leaf []byte) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkArray(opUpdate); err != nil {
+		return err
+	}
+	leafSize, err := table.leafBufSize()
+	if err != nil {
+		return err
+	}
+	if len(leaf) != leafSize {
+		return fmt.Errorf("Table.SetAt: leaf size mismatch for table %s: got %d bytes, expected %d", table.Name(), len(leaf), leafSize)
+	}
+	fd := table.Desc().FD
+	if err := table.updateElem(fd, unsafe.Pointer(&index), unsafe.Pointer(&leaf[0]), uint64(UpdateAny)); err != nil {
+		if err == syscall.ENOENT || err == syscall.E2BIG {
+			return fmt.Errorf("Table.SetAt: %d: %w", index, ErrIndexOutOfRange)
+		}
+		return fmt.Errorf("Table.SetAt: unable to update element (%d): %w", index, mapErrno(err))
+	}
+	return nil
+}
+
+// All returns the raw values of all slots of an array table, in index
+// order.
+func (table *Table) All() ([][]byte, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkArray(opLookup); err != nil {
+		return nil, err
+	}
+	n, err := table.MaxEntries()
+	if err != nil {
+		return nil, err
+	}
+	leafSize, err := table.leafBufSize()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, int(n)*leafSize)
+	values := make([][]byte, n)
+	for i := range values {
+		values[i] = buf[i*leafSize : (i+1)*leafSize : (i+1)*leafSize]
+		if err := table.getAt(uint32(i), values[i]); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,190 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrAlreadyAttached is returned when attaching a program where
+// another one is attached through the module, or the same one again
+// with ModuleOptions.ErrorOnReattach.
+var ErrAlreadyAttached = errors.New("already attached")
+
+// AttachmentKind is the kind of an Attachment.
+type AttachmentKind int
+
+const (
+	AttachmentKprobe AttachmentKind = iota
+	AttachmentKretprobe
+	AttachmentUprobe
+	AttachmentUretprobe
+	AttachmentTracepoint
+	AttachmentRawTracepoint
+	AttachmentTrampoline
+	AttachmentIter
+	AttachmentPerfEvent
+	AttachmentCgroup
+	AttachmentSockProg
+	AttachmentFlowDissector
+)
+
+var attachmentKindNames = [...]string{
+	AttachmentKprobe:        "kprobe",
+	AttachmentKretprobe:     "kretprobe",
+	AttachmentUprobe:        "uprobe",
+	AttachmentUretprobe:     "uretprobe",
+	AttachmentTracepoint:    "tracepoint",
+	AttachmentRawTracepoint: "raw tracepoint",
+	AttachmentTrampoline:    "trampoline",
+	AttachmentIter:          "iterator",
+	AttachmentPerfEvent:     "perf event",
+	AttachmentCgroup:        "cgroup",
+	AttachmentSockProg:      "sock program",
+	AttachmentFlowDissector: "flow dissector",
+}
+
+func (k AttachmentKind) String() string {
+	if k >= 0 && int(k) < len(attachmentKindNames) {
+		return attachmentKindNames[k]
+	}
+	return fmt.Sprintf("AttachmentKind(%d)", int(k))
+}
+
+// Attachment is a program attached through a module. XDP programs and
+// tc filters outlive the module and aren't attachments of it.
+type Attachment struct {
+	Kind AttachmentKind
+	// Target is what the program is attached to: the function of
+	// kprobes and trampolines, "path:0xoffset" for uprobes, the
+	// tracepoint, "type:config" for perf events, the cgroup or network
+	// namespace path, or "map fd N" for sock programs.
+	Target string
+	// FD is the fd of the program.
+	FD         int
+	AttachedAt time.Time
+}
+
+// attachmentRecord is an attachment in the registry of a module, with
+// seq ordering the attachments.
+type attachmentRecord struct {
+	Attachment
+	seq uint64
+}
+
+// attachmentKey identifies an attachment by its kind and its key in
+// the map of the module tracking attachments of that kind.
+type attachmentKey struct {
+	kind AttachmentKind
+	id   string
+}
+
+// checkAttached returns whether the attachment of kind id is recorded,
+// and if so the error of attaching the program fd to it again. Callers
+// must hold bpf.mu.
+func (bpf *Module) checkAttached(kind AttachmentKind, id string, fd int) (bool, error) {
+	a, ok := bpf.attachments[attachmentKey{kind, id}]
+	switch {
+	case !ok:
+		return false, nil
+	case a.FD != fd:
+		return true, fmt.Errorf("failed to attach BPF %v %s: program fd %d is attached: %w", kind, a.Target, a.FD, ErrAlreadyAttached)
+	case bpf.errorOnReattach:
+		return true, fmt.Errorf("failed to attach BPF %v %s: %w", kind, a.Target, ErrAlreadyAttached)
+	}
+	return true, nil
+}
+
+// recordAttachment records the attachment of kind id of the program fd
+// to target. Callers must hold bpf.mu.
+func (bpf *Module) recordAttachment(kind AttachmentKind, id, target string, fd int) {
+	debugf("attached %v %s, program fd %d", kind, target, fd)
+	bpf.attachSeq++
+	bpf.attachments[attachmentKey{kind, id}] = attachmentRecord{
+		Attachment: Attachment{
+			Kind:       kind,
+			Target:     target,
+			FD:         fd,
+			AttachedAt: time.Now(),
+		},
+		seq: bpf.attachSeq,
+	}
+}
+
+// forgetAttachment removes the attachment of kind id from the
+// registry. Callers must hold bpf.mu.
+func (bpf *Module) forgetAttachment(kind AttachmentKind, id string) {
+	key := attachmentKey{kind, id}
+	if a, ok := bpf.attachments[key]; ok {
+		debugf("detached %v %s, program fd %d", kind, a.Target, a.FD)
+	}
+	delete(bpf.attachments, key)
+}
+
+// probeKind returns the kind of the kprobe or uprobe evName, entry or
+// ret as named by kprobeEventNames and uprobeEventName.
+func probeKind(evName string, entry, ret AttachmentKind) AttachmentKind {
+	if strings.HasPrefix(evName, "r_") {
+		return ret
+	}
+	return entry
+}
+
+// funcName returns the name of the function loaded as fd, or "fd N".
+// Callers must hold bpf.mu.
+func (bpf *Module) funcName(fd int) string {
+	for name, f := range bpf.funcs {
+		if f == fd {
+			return name
+		}
+	}
+	return fmt.Sprintf("fd %d", fd)
+}
+
+// Attachments returns the programs attached through the module, in
+// the order they were attached.
+func (bpf *Module) Attachments() ([]Attachment, error) {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return nil, ErrModuleClosed
+	}
+	records := make([]attachmentRecord, 0, len(bpf.attachments))
+	for _, r := range bpf.attachments {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].seq < records[j].seq })
+	attachments := make([]Attachment, len(records))
+	for i, r := range records {
+		attachments[i] = r.Attachment
+	}
+	return attachments, nil
+}
+
+// DetachAll detaches all the programs attached through the module,
+// leaving them loaded. It returns the first error but detaches all the
+// programs it can.
+func (bpf *Module) DetachAll() error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	return bpf.detachAll()
+}
@@ -0,0 +1,370 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// ErrNotSupported is returned when the running kernel lacks support for
+// a feature.
+var ErrNotSupported = errors.New("not supported by the kernel")
+
+// errnoENOTSUPP is the kernel-internal ENOTSUPP errno that
+// the bpf(2) syscall leaks to user space.
+const errnoENOTSUPP = syscall.Errno(524)
+
+// batchError maps the errno of a failed batch command to ErrNotSupported
+// on map types without batch support, and on kernels (< 5.6) without
+// batch commands. These fail with EINVAL, as invalid arguments do on
+// other kernels: EINVAL is only mapped if SupportsBatchOps is false.
+func batchError(err error) error {
+	switch err {
+	case syscall.ENOTSUP, errnoENOTSUPP:
+		return ErrNotSupported
+	case syscall.EINVAL:
+		if !SupportsBatchOps() {
+			return ErrNotSupported
+		}
+	}
+	return mapErrno(err)
+}
+
+// GetBatch returns all entries of the table, reading up to batchSize
+// entries per BPF_MAP_LOOKUP_BATCH call. The batches of hash tables hold
+// whole buckets: batchSize is doubled as needed for the largest. It
+// returns an error wrapping ErrNotSupported if the kernel doesn't
+// support batch operations.
+func (table *Table) GetBatch(batchSize int) ([]RawEntry, error) {
+	return table.getBatch("GetBatch", cmdLookupBatch, batchSize)
+}
+
+// getBatch reads all entries of the table with cmd, BPF_MAP_LOOKUP_BATCH
+// or BPF_MAP_LOOKUP_AND_DELETE_BATCH. On errors, the entries read so far
+// are returned along with the error.
+func (table *Table) getBatch(method string, cmd batchCmd, batchSize int) ([]RawEntry, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opLookup); err != nil {
+		return nil, err
+	}
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("Table.%s: invalid batch size %d", method, batchSize)
+	}
+	desc := table.Desc()
+	keySize := int(desc.KeySize)
+	leafSize, err := table.leafBufSize()
+	if err != nil {
+		return nil, err
+	}
+	// The batch token is opaque: a bucket for hash maps, an index for
+	// arrays. Size it for the largest of the two.
+	tokenSize := keySize
+	if tokenSize < 8 {
+		tokenSize = 8
+	}
+	var (
+		entries  []RawEntry
+		inBatch  []byte
+		outBatch = make([]byte, tokenSize)
+		keys     = make([]byte, batchSize*keySize)
+		values   = make([]byte, batchSize*leafSize)
+	)
+	for {
+		n, err := mapBatch(cmd, desc.FD, inBatch, outBatch, keys, values, batchSize, 0)
+		if err == syscall.ENOSPC && n == 0 {
+			// The next hash bucket holds more entries than a batch:
+			// grow it and read the bucket again.
+			batchSize *= 2
+			keys = make([]byte, batchSize*keySize)
+			values = make([]byte, batchSize*leafSize)
+			continue
+		}
+		if err != nil && err != syscall.ENOENT {
+			return entries, fmt.Errorf("Table.%s: %w", method, batchError(err))
+		}
+		for i := 0; i < n; i++ {
+			entries = append(entries, RawEntry{
+				Key:   append([]byte(nil), keys[i*keySize:(i+1)*keySize]...),
+				Value: append([]byte(nil), values[i*leafSize:(i+1)*leafSize]...),
+			})
+		}
+		// ENOENT signals that the last batch has been read.
+		if err == syscall.ENOENT {
+			return entries, nil
+		}
+		if inBatch == nil {
+			inBatch = make([]byte, tokenSize)
+		}
+		inBatch, outBatch = outBatch, inBatch
+	}
+}
+
+// SetBatch sets all the given raw entries with a single
+// BPF_MAP_UPDATE_BATCH call. flags is applied to every element (see
+// UpdateFlag). It returns an error wrapping ErrNotSupported if the
+// kernel doesn't support batch operations.
+func (table *Table) SetBatch(entries []RawEntry, flags uint64) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opUpdate); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	desc := table.Desc()
+	keySize := int(desc.KeySize)
+	leafSize, err := table.leafBufSize()
+	if err != nil {
+		return err
+	}
+	keys := make([]byte, 0, len(entries)*keySize)
+	values := make([]byte, 0, len(entries)*leafSize)
+	for _, e := range entries {
+		if len(e.Key) != keySize {
+			return fmt.Errorf("Table.SetBatch: key size mismatch for table %s: got %d bytes, expected %d", desc.Name, len(e.Key), keySize)
+		}
+		if len(e.Value) != leafSize {
+			return fmt.Errorf("Table.SetBatch: leaf size mismatch for table %s: got %d bytes, expected %d", desc.Name, len(e.Value), leafSize)
+		}
+		keys = append(keys, e.Key...)
+		values = append(values, e.Value...)
+	}
+	n, err := mapBatch(cmdUpdateBatch, desc.FD, nil, nil, keys, values, len(entries), flags)
+	if err != nil {
+		return fmt.Errorf("Table.SetBatch: updated %d of %d elements: %w", n, len(entries), batchError(err))
+	}
+	return nil
+}
+
+// DeleteBatch deletes all the given raw keys with a single
+// BPF_MAP_DELETE_BATCH call. It returns an error wrapping
+// ErrNotSupported if the kernel doesn't support batch operations.
+func (table *Table) DeleteBatch(keys [][]byte) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opDelete); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	desc := table.Desc()
+	keySize := int(desc.KeySize)
+	buf := make([]byte, 0, len(keys)*keySize)
+	for _, k := range keys {
+		if len(k) != keySize {
+			return fmt.Errorf("Table.DeleteBatch: key size mismatch for table %s: got %d bytes, expected %d", desc.Name, len(k), keySize)
+		}
+		buf = append(buf, k...)
+	}
+	n, err := mapBatch(cmdDeleteBatch, desc.FD, nil, nil, buf, nil, len(keys), 0)
+	if err != nil {
+		return fmt.Errorf("Table.DeleteBatch: deleted %d of %d elements: %w", n, len(keys), batchError(err))
+	}
+	return nil
+}
+
+// batchStrategy is how the helpers handling all the entries of a table
+// (Snapshot, DrainAll, DeleteAll and ZeroAll) go through them.
+type batchStrategy int
+
+const (
+	// strategyBatch reads or updates many entries per syscall with
+	// the BPF_MAP_*_BATCH commands.
+	strategyBatch batchStrategy = iota
+	// strategyElementwise walks the keys and reads or updates the
+	// entries one by one.
+	strategyElementwise
+)
+
+func (s batchStrategy) String() string {
+	if s == strategyBatch {
+		return "batch commands"
+	}
+	return "element-wise operations"
+}
+
+// batchCap is a key of Table.batchCaps: the support of a batch command
+// by a map.
+type batchCap struct {
+	fd  int
+	cmd batchCmd
+}
+
+// SetBatchOps sets whether Snapshot, SnapshotBytes, DrainAll, DeleteAll
+// and ZeroAll may use batch commands, which they do by default where
+// the kernel and the map type support them. Disabling them forces the
+// element-wise path, e.g. to compare both.
+func (table *Table) SetBatchOps(enabled bool) {
+	table.noBatchOps.Store(!enabled)
+}
+
+// dispatchBatch runs batch, which goes through the entries of the table
+// with cmd, or elementwise if batch commands are disabled or cmd is not
+// supported. Whether cmd is supported is remembered per map fd once
+// batch succeeds or fails with ErrNotSupported, in which case
+// elementwise runs in its place. The strategy used is logged at the
+// debug level, with op naming the caller.
+func (table *Table) dispatchBatch(op string, cmd batchCmd, batch, elementwise func() error) error {
+	key := batchCap{fd: table.Desc().FD, cmd: cmd}
+	supported, known := table.batchCaps.Load(key)
+	if !table.noBatchOps.Load() && (!known || supported.(bool)) {
+		err := batch()
+		if !errors.Is(err, ErrNotSupported) {
+			if err == nil {
+				table.batchCaps.Store(key, true)
+			}
+			debugf("table %s: %s: using %v", table.Name(), op, strategyBatch)
+			return err
+		}
+		table.batchCaps.Store(key, false)
+		debugf("table %s: %s: %v", table.Name(), op, err)
+	}
+	debugf("table %s: %s: using %v", table.Name(), op, strategyElementwise)
+	return elementwise()
+}
+
+// batchSize returns the number of entries to read per batch command.
+func (table *Table) batchSize() int {
+	leafSize, err := table.leafBufSize()
+	if err != nil {
+		leafSize = 0
+	}
+	max, err := table.MaxEntries()
+	if err != nil {
+		max = 0
+	}
+	return batchEntries(leafSize, max)
+}
+
+// batchEntries returns the number of entries to read per batch command
+// for values of leafSize bytes and a table of maxEntries entries (0 if
+// unknown): up to maxSnapshotBatch, fewer for values large enough that
+// the batch would take more than maxSnapshotBatchBytes, as the values of
+// all CPUs of a per-cpu table do, and no more than the table holds.
+func batchEntries(leafSize int, maxEntries uint64) int {
+	n := maxSnapshotBatch
+	if leafSize > 0 && n*leafSize > maxSnapshotBatchBytes {
+		n = maxSnapshotBatchBytes / leafSize
+		if n == 0 {
+			n = 1
+		}
+	}
+	if maxEntries > 0 && maxEntries < uint64(n) {
+		n = int(maxEntries)
+	}
+	return n
+}
+
+// deleteAllBatch deletes all entries of the table with
+// BPF_MAP_DELETE_BATCH, in batches of the keys of a walk: unlike
+// BPF_MAP_LOOKUP_AND_DELETE_BATCH, it copies no value. Deleting the key
+// the walk is at restarts it from the first key left, which may yield
+// keys deleted meanwhile again: these are skipped.
+func (table *Table) deleteAllBatch() error {
+	cur, err := table.newCursor()
+	if err != nil {
+		return fmt.Errorf("Table.DeleteAll: %w", err)
+	}
+	cur.keysOnly = true
+	keySize := len(cur.key)
+	keys := make([]byte, 0, table.batchSize()*keySize)
+	for {
+		more := cur.next()
+		if more {
+			keys = append(keys, cur.key...)
+		}
+		if len(keys) > 0 && (!more || len(keys) == cap(keys)) {
+			if err := table.deleteKeys(keys, keySize); err != nil {
+				return fmt.Errorf("Table.DeleteAll: %w", err)
+			}
+			keys = keys[:0]
+		}
+		if !more {
+			break
+		}
+	}
+	if cur.err != nil {
+		return fmt.Errorf("Table.DeleteAll: %w", cur.err)
+	}
+	return nil
+}
+
+// deleteKeys deletes keys, an array of keys of keySize bytes, with
+// BPF_MAP_DELETE_BATCH, skipping those already deleted.
+func (table *Table) deleteKeys(keys []byte, keySize int) error {
+	fd := table.Desc().FD
+	for len(keys) > 0 {
+		n, err := mapBatch(cmdDeleteBatch, fd, nil, nil, keys, nil, len(keys)/keySize, 0)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.ENOENT {
+			return fmt.Errorf("unable to delete elements: %w", batchError(err))
+		}
+		// The key following the ones deleted was deleted already:
+		// skip it.
+		keys = keys[(n+1)*keySize:]
+	}
+	return nil
+}
+
+// zeroAllBatch sets the values of all entries of the table to zero with
+// BPF_MAP_LOOKUP_BATCH to read the keys and BPF_MAP_UPDATE_BATCH to
+// update them, and returns the number of entries zeroed.
+func (table *Table) zeroAllBatch() (int, error) {
+	entries, err := table.getBatch("ZeroAll", cmdLookupBatch, table.batchSize())
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	desc := table.Desc()
+	keySize := int(desc.KeySize)
+	leafSize := len(entries[0].Value)
+	keys := make([]byte, 0, len(entries)*keySize)
+	for _, e := range entries {
+		keys = append(keys, e.Key...)
+	}
+	values := make([]byte, len(entries)*leafSize)
+	zeroed := 0
+	for len(keys) > 0 {
+		count := len(keys) / keySize
+		n, err := mapBatch(cmdUpdateBatch, desc.FD, nil, nil, keys, values, count, uint64(UpdateExist))
+		zeroed += n
+		if err == nil {
+			break
+		}
+		if err != syscall.ENOENT {
+			return zeroed, fmt.Errorf("Table.ZeroAll: unable to zero elements: %w", batchError(err))
+		}
+		// The key following the ones updated was deleted
+		// concurrently: skip it.
+		keys = keys[(n+1)*keySize:]
+		values = values[(n+1)*leafSize:]
+	}
+	return zeroed, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestDispatchBatch(t *testing.T) {
+	table := newFakeTable(nil)
+	var batches, elementwise int
+	batchErr := error(nil)
+	run := func() error {
+		return table.dispatchBatch("Test", cmdLookupBatch, func() error {
+			batches++
+			return batchErr
+		}, func() error {
+			elementwise++
+			return nil
+		})
+	}
+	check := func(wantBatches, wantElementwise int) {
+		t.Helper()
+		if batches != wantBatches || elementwise != wantElementwise {
+			t.Fatalf("got %d batch and %d element-wise runs, expected %d and %d", batches, elementwise, wantBatches, wantElementwise)
+		}
+	}
+
+	// Errors other than ErrNotSupported are returned and not cached.
+	batchErr = syscall.EPERM
+	if err := run(); err != syscall.EPERM {
+		t.Fatalf("got error %v, expected EPERM", err)
+	}
+	check(1, 0)
+
+	batchErr = fmt.Errorf("Table.Test: %w", ErrNotSupported)
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	check(2, 1)
+	// The lack of support is cached for the fd and command.
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	check(2, 2)
+	if err := table.dispatchBatch("Test", cmdLookupAndDeleteBatch, func() error {
+		batches++
+		return nil
+	}, func() error {
+		return errors.New("unexpected element-wise run")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check(3, 2)
+
+	// SetBatchOps(false) forces the element-wise path.
+	table = newFakeTable(nil)
+	table.SetBatchOps(false)
+	batchErr = nil
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	check(3, 3)
+	table.SetBatchOps(true)
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	check(4, 3)
+}
+
+func TestBatchEntries(t *testing.T) {
+	for _, tt := range []struct {
+		leafSize   int
+		maxEntries uint64
+		want       int
+	}{
+		{8, 0, maxSnapshotBatch},
+		{8, 1 << 20, maxSnapshotBatch},
+		{8, 100, 100},
+		{0, 0, maxSnapshotBatch},
+		// The values of 8 bytes of 512 CPUs.
+		{8 * 512, 0, 256},
+		{8 * 512, 100, 100},
+		{maxSnapshotBatchBytes * 2, 0, 1},
+	} {
+		if got := batchEntries(tt.leafSize, tt.maxEntries); got != tt.want {
+			t.Errorf("batchEntries(%d, %d) = %d, want %d", tt.leafSize, tt.maxEntries, got, tt.want)
+		}
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	featuresMu.Lock()
+	saved, probed := features["batch_ops"]
+	featuresMu.Unlock()
+	defer func() {
+		featuresMu.Lock()
+		defer featuresMu.Unlock()
+		if probed {
+			features["batch_ops"] = saved
+		} else {
+			delete(features, "batch_ops")
+		}
+	}()
+
+	for _, supported := range []bool{true, false} {
+		featuresMu.Lock()
+		features["batch_ops"] = supported
+		featuresMu.Unlock()
+		for _, tt := range []struct {
+			errno       syscall.Errno
+			unsupported bool
+		}{
+			{syscall.ENOTSUP, true},
+			{errnoENOTSUPP, true},
+			// Invalid arguments, unless the kernel lacks batch
+			// commands.
+			{syscall.EINVAL, !supported},
+			{syscall.EPERM, false},
+		} {
+			err := batchError(tt.errno)
+			if errors.Is(err, ErrNotSupported) != tt.unsupported {
+				t.Errorf("supported=%v: batchError(%v) = %v", supported, tt.errno, err)
+			}
+			if !tt.unsupported && !errors.Is(err, tt.errno) {
+				t.Errorf("supported=%v: batchError(%v) = %v, expected the errno", supported, tt.errno, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const vmlinuxBTFPath = "/sys/kernel/btf/vmlinux"
+
+const (
+	btfMagic     = 0xeb9f
+	btfHeaderLen = 24
+	btfTypeLen   = 12
+	btfKindFunc  = 12
+	btfVlenMask  = 0xffff
+)
+
+// btfKindExtra returns the size of the data following a BTF type of
+// kind kind with vlen members.
+func btfKindExtra(kind, vlen int) (int, error) {
+	switch kind {
+	case 2, 7, 8, 9, 10, 11, 12, 16, 18: // PTR, FWD, TYPEDEF, VOLATILE, CONST, RESTRICT, FUNC, FLOAT, TYPE_TAG
+		return 0, nil
+	case 1, 14, 17: // INT, VAR, DECL_TAG
+		return 4, nil
+	case 3: // ARRAY
+		return 12, nil
+	case 4, 5, 15, 19: // STRUCT, UNION, DATASEC, ENUM64
+		return vlen * 12, nil
+	case 6, 13: // ENUM, FUNC_PROTO
+		return vlen * 8, nil
+	default:
+		return 0, fmt.Errorf("unknown BTF kind %d", kind)
+	}
+}
+
+// parseBTFFuncs returns the ids of the FUNC types of the raw BTF data
+// by name.
+func parseBTFFuncs(data []byte) (map[string]uint32, error) {
+	if len(data) < btfHeaderLen {
+		return nil, errors.New("BTF data too short")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if binary.BigEndian.Uint16(data) == btfMagic {
+		order = binary.BigEndian
+	} else if order.Uint16(data) != btfMagic {
+		return nil, errors.New("invalid BTF magic")
+	}
+	hdrLen := order.Uint32(data[4:])
+	typeOff, typeLen := order.Uint32(data[8:]), order.Uint32(data[12:])
+	strOff, strLen := order.Uint32(data[16:]), order.Uint32(data[20:])
+	if uint64(hdrLen)+uint64(typeOff)+uint64(typeLen) > uint64(len(data)) ||
+		uint64(hdrLen)+uint64(strOff)+uint64(strLen) > uint64(len(data)) {
+		return nil, errors.New("BTF sections out of bounds")
+	}
+	types := data[hdrLen+typeOff : hdrLen+typeOff+typeLen]
+	strs := data[hdrLen+strOff : hdrLen+strOff+strLen]
+
+	funcs := make(map[string]uint32)
+	id := uint32(1)
+	for off := 0; off < len(types); id++ {
+		if off+btfTypeLen > len(types) {
+			return nil, fmt.Errorf("truncated BTF type %d", id)
+		}
+		nameOff := order.Uint32(types[off:])
+		info := order.Uint32(types[off+4:])
+		kind := int(info>>24) & 0x1f
+		vlen := int(info & btfVlenMask)
+		extra, err := btfKindExtra(kind, vlen)
+		if err != nil {
+			return nil, fmt.Errorf("BTF type %d: %v", id, err)
+		}
+		if kind == btfKindFunc && nameOff < uint32(len(strs)) {
+			name := strs[nameOff:]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			funcs[string(name)] = id
+		}
+		off += btfTypeLen + extra
+	}
+	return funcs, nil
+}
+
+var kernelBTF struct {
+	once  sync.Once
+	funcs map[string]uint32
+	err   error
+}
+
+// kernelBTFFuncID returns the BTF id of the kernel function fnName. It
+// returns an error wrapping ErrNotSupported if the kernel doesn't expose
+// its BTF, and ErrSymbolNotFound if the function isn't in it.
+func kernelBTFFuncID(fnName string) (uint32, error) {
+	kernelBTF.once.Do(func() {
+		data, err := ioutil.ReadFile(vmlinuxBTFPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = fmt.Errorf("%s: %w", vmlinuxBTFPath, ErrNotSupported)
+			}
+			kernelBTF.err = err
+			return
+		}
+		kernelBTF.funcs, kernelBTF.err = parseBTFFuncs(data)
+	})
+	if kernelBTF.err != nil {
+		return 0, kernelBTF.err
+	}
+	id, ok := kernelBTF.funcs[fnName]
+	if !ok {
+		return 0, fmt.Errorf("function %s not in kernel BTF: %w", fnName, ErrSymbolNotFound)
+	}
+	return id, nil
+}
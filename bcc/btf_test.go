@@ -0,0 +1,64 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseBTFFuncs(t *testing.T) {
+	le := binary.LittleEndian
+	strs := []byte("\x00int\x00do_foo\x00x\x00")
+	var types []byte
+	addType := func(nameOff uint32, kind, vlen int, sizeType uint32, extra []byte) {
+		b := make([]byte, 12)
+		le.PutUint32(b, nameOff)
+		le.PutUint32(b[4:], uint32(kind)<<24|uint32(vlen))
+		le.PutUint32(b[8:], sizeType)
+		types = append(types, b...)
+		types = append(types, extra...)
+	}
+	addType(1, 1, 0, 4, make([]byte, 4))  // [1] INT int
+	addType(0, 13, 1, 1, make([]byte, 8)) // [2] FUNC_PROTO (int x) -> int
+	addType(5, 12, 0, 2, nil)             // [3] FUNC do_foo
+	addType(0, 4, 2, 8, make([]byte, 24)) // [4] STRUCT with 2 members
+
+	hdr := make([]byte, btfHeaderLen)
+	le.PutUint16(hdr, btfMagic)
+	hdr[2] = 1
+	le.PutUint32(hdr[4:], btfHeaderLen)
+	le.PutUint32(hdr[8:], 0)
+	le.PutUint32(hdr[12:], uint32(len(types)))
+	le.PutUint32(hdr[16:], uint32(len(types)))
+	le.PutUint32(hdr[20:], uint32(len(strs)))
+	data := append(append(hdr, types...), strs...)
+
+	funcs, err := parseBTFFuncs(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(funcs) != 1 || funcs["do_foo"] != 3 {
+		t.Fatalf("unexpected funcs %v", funcs)
+	}
+
+	if _, err := parseBTFFuncs(data[:len(data)-len(strs)-4]); err == nil {
+		t.Fatal("expected error for truncated data")
+	}
+	data[0] = 0
+	if _, err := parseBTFFuncs(data); err == nil {
+		t.Fatal("expected error for invalid magic")
+	}
+}
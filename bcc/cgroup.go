@@ -0,0 +1,156 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// CgroupAttachType is the hook of a cgroup a program is attached to
+// (BPF_CGROUP_*).
+type CgroupAttachType uint32
+
+const (
+	CgroupInetIngress    CgroupAttachType = 0
+	CgroupInetEgress     CgroupAttachType = 1
+	CgroupInetSockCreate CgroupAttachType = 2
+	CgroupSockOps        CgroupAttachType = 3
+	CgroupDevice         CgroupAttachType = 6
+	CgroupInet4Bind      CgroupAttachType = 8
+	CgroupInet6Bind      CgroupAttachType = 9
+	CgroupInet4Connect   CgroupAttachType = 10
+	CgroupInet6Connect   CgroupAttachType = 11
+	CgroupInet4PostBind  CgroupAttachType = 12
+	CgroupInet6PostBind  CgroupAttachType = 13
+	CgroupUDP4Sendmsg    CgroupAttachType = 14
+	CgroupUDP6Sendmsg    CgroupAttachType = 15
+	CgroupSysctl         CgroupAttachType = 18
+	CgroupUDP4Recvmsg    CgroupAttachType = 19
+	CgroupUDP6Recvmsg    CgroupAttachType = 20
+	CgroupGetsockopt     CgroupAttachType = 21
+	CgroupSetsockopt     CgroupAttachType = 22
+)
+
+// Flags for AttachCgroup.
+const (
+	// CgroupAllowOverride lets programs attached to descendant
+	// cgroups override this one.
+	CgroupAllowOverride uint64 = 1 << 0
+	// CgroupAllowMulti lets multiple programs be attached to the same
+	// hook of the cgroup and its descendants.
+	CgroupAllowMulti uint64 = 1 << 1
+)
+
+// ErrNotCgroup2 is returned when a path is not a directory of a cgroup2
+// file system.
+var ErrNotCgroup2 = errors.New("not a cgroup2 directory")
+
+const cgroup2SuperMagic = 0x63677270
+
+// cgroupAttachment is a program attached to a cgroup through a module.
+type cgroupAttachment struct {
+	path       string
+	cgroupFD   int
+	progFD     int
+	attachType CgroupAttachType
+}
+
+// LoadCgroupSkb loads a program of type BPF_PROG_TYPE_CGROUP_SKB.
+func (bpf *Module) LoadCgroupSkb(name string) (int, error) {
+	return bpf.Load(name, ProgramTypeCgroupSKB, 0, 0)
+}
+
+// LoadCgroupSock loads a program of type BPF_PROG_TYPE_CGROUP_SOCK.
+func (bpf *Module) LoadCgroupSock(name string) (int, error) {
+	return bpf.Load(name, ProgramTypeCgroupSock, 0, 0)
+}
+
+// openCgroup opens the cgroup2 directory path.
+func openCgroup(path string) (int, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return -1, fmt.Errorf("%s: %v", path, err)
+	}
+	if fs.Type != cgroup2SuperMagic {
+		return -1, fmt.Errorf("%s: %w", path, ErrNotCgroup2)
+	}
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("%s: %v", path, err)
+	}
+	return fd, nil
+}
+
+// AttachCgroup attaches a cgroup program fd to the hook attachType of
+// the cgroup2 directory cgroupPath, with flags CgroupAllowOverride or
+// CgroupAllowMulti. The error wraps ErrNotCgroup2 if cgroupPath is not
+// a cgroup2 directory. Close detaches the program.
+func (bpf *Module) AttachCgroup(progFD int, attachType CgroupAttachType, cgroupPath string, flags uint64) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	id := fmt.Sprintf("%s:%d:%d", cgroupPath, attachType, progFD)
+	if attached, err := bpf.checkAttached(AttachmentCgroup, id, progFD); attached {
+		return err
+	}
+	cgroupFD, err := openCgroup(cgroupPath)
+	if err != nil {
+		return err
+	}
+	if err := progAttach(cgroupFD, progFD, uint32(attachType), uint32(flags)); err != nil {
+		syscall.Close(cgroupFD)
+		return fmt.Errorf("failed to attach BPF cgroup program to %s: %v", cgroupPath, err)
+	}
+	bpf.cgroups = append(bpf.cgroups, cgroupAttachment{
+		path:       cgroupPath,
+		cgroupFD:   cgroupFD,
+		progFD:     progFD,
+		attachType: attachType,
+	})
+	bpf.recordAttachment(AttachmentCgroup, id, cgroupPath, progFD)
+	return nil
+}
+
+// detachCgroup detaches the i-th cgroup attachment. Callers must hold
+// bpf.mu.
+func (bpf *Module) detachCgroup(i int) error {
+	a := bpf.cgroups[i]
+	bpf.cgroups = append(bpf.cgroups[:i], bpf.cgroups[i+1:]...)
+	bpf.forgetAttachment(AttachmentCgroup, fmt.Sprintf("%s:%d:%d", a.path, a.attachType, a.progFD))
+	defer syscall.Close(a.cgroupFD)
+	if err := progDetach(a.cgroupFD, a.progFD, uint32(a.attachType)); err != nil {
+		return fmt.Errorf("failed to detach BPF cgroup program from %s: %v", a.path, err)
+	}
+	return nil
+}
+
+// DetachCgroup detaches a cgroup program fd attached by AttachCgroup.
+func (bpf *Module) DetachCgroup(progFD int, attachType CgroupAttachType, cgroupPath string) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	for i, a := range bpf.cgroups {
+		if a.progFD == progFD && a.attachType == attachType && a.path == cgroupPath {
+			return bpf.detachCgroup(i)
+		}
+	}
+	return fmt.Errorf("no cgroup program attached to %s", cgroupPath)
+}
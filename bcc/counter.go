@@ -0,0 +1,76 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxIncrementRetries bounds the retries of Increment when the key is
+// concurrently created or deleted.
+const maxIncrementRetries = 64
+
+// Increment adds delta to the 8 byte unsigned value of key, creating
+// the entry with a value of delta if it is absent.
+//
+// The value is read and written back with BPF_EXIST, or created with
+// BPF_NOEXIST, retrying when the entry is concurrently deleted or
+// created. Increments from goroutines sharing the Table are serialized,
+// but the read-modify-write is not atomic with respect to BPF programs
+// or other processes: their updates between the lookup and the update
+// are lost. Per-cpu tables are not supported, since user space can
+// only update the values of all CPUs at once.
+func (table *Table) Increment(key []byte, delta uint64) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opUpdate); err != nil {
+		return err
+	}
+	desc := table.Desc()
+	if desc.MapType.IsPerCPU() {
+		return fmt.Errorf("Table.Increment: %v table %s: %w", desc.MapType, desc.Name, ErrOperationNotSupported)
+	}
+	if desc.LeafSize != 8 {
+		return fmt.Errorf("Table.Increment: table %s has a leaf size of %d bytes, expected 8", desc.Name, desc.LeafSize)
+	}
+
+	table.incMu.Lock()
+	defer table.incMu.Unlock()
+	leaf := make([]byte, 8)
+	for i := 0; i < maxIncrementRetries; i++ {
+		cur, err := table.GetBytes(key)
+		switch {
+		case errors.Is(err, ErrKeyNotFound):
+			byteOrder.PutUint64(leaf, delta)
+			err = table.SetBytesWithFlags(key, leaf, UpdateNoExist)
+			if errors.Is(err, ErrKeyExists) {
+				continue
+			}
+			return err
+		case err != nil:
+			return err
+		}
+		byteOrder.PutUint64(leaf, byteOrder.Uint64(cur)+delta)
+		err = table.SetBytesWithFlags(key, leaf, UpdateExist)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("Table.Increment: %x: too many concurrent updates", key)
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// MapSpec describes a map for CreateMap.
+type MapSpec struct {
+	Type       MapType
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+	// Flags are MapFlag* flags.
+	Flags uint32
+	// Name is the name of the map shown by bpftool, truncated to 15
+	// bytes and dropped on kernels not supporting map names.
+	Name string
+}
+
+// CreateMap creates a map from spec, without a module, e.g. a scratch
+// map or an inner map for a map of maps.
+//
+// The returned table is not backed by a module: as for
+// NewTableFromPinned, only the byte level operations are available,
+// and the string based ones return ErrNoModule. The table must be
+// closed with Close. The error wraps ErrPermission if the process
+// lacks the privileges to create maps.
+func CreateMap(spec MapSpec) (*Table, error) {
+	fd, err := mapCreate(spec.Type, spec.KeySize, spec.ValueSize, spec.MaxEntries, spec.Flags, spec.Name, 0, 0)
+	if err != nil {
+		if err == syscall.EPERM || err == syscall.EACCES {
+			err = mapErrno(err)
+		}
+		return nil, fmt.Errorf("CreateMap: unable to create %v map %s: %w", spec.Type, spec.Name, err)
+	}
+	table, err := newTableFromFD(fd, spec.Name)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("CreateMap: %v", err)
+	}
+	return table, nil
+}
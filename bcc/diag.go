@@ -0,0 +1,74 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// virtualMainFile is the file name bcc gives to modules compiled from
+// a string.
+const virtualMainFile = "/virtual/main.c"
+
+// Diagnostic is a message of the compiler.
+type Diagnostic struct {
+	File     string
+	Line     int
+	Col      int
+	Severity string // "error", "fatal error", "warning" or "note"
+	Message  string
+}
+
+// CompileError is returned when a module fails to compile.
+type CompileError struct {
+	// Diagnostics are the messages of the compiler, parsed from Output.
+	Diagnostics []Diagnostic
+	// Output is the raw output of the compiler.
+	Output string
+}
+
+func (e *CompileError) Error() string {
+	if e.Output == "" {
+		return "failed to compile BPF module"
+	}
+	return "failed to compile BPF module:\n" + e.Output
+}
+
+// /virtual/main.c:3:9: error: use of undeclared identifier 'x'
+var diagnosticRegexp = regexp.MustCompile(`^(.*?):(\d+):(\d+): (fatal error|error|warning|note): (.*)$`)
+
+// parseDiagnostics returns the diagnostics of the compiler output,
+// ignoring the source excerpts and caret lines following them. Line
+// numbers in file are shifted by -lineOffset, to account for code
+// prepended to the source.
+func parseDiagnostics(output, file string, lineOffset int) []Diagnostic {
+	var diags []Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		m := diagnosticRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		d := Diagnostic{File: m[1], Severity: m[4], Message: m[5]}
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Col, _ = strconv.Atoi(m[3])
+		if d.File == file && d.Line > lineOffset {
+			d.Line -= lineOffset
+		}
+		diags = append(diags, d)
+	}
+	return diags
+}
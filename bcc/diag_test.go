@@ -0,0 +1,76 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+const testCompilerOutput = `/virtual/main.c:5:9: error: use of undeclared identifier 'undefined_var'
+        return undefined_var;
+               ^
+/virtual/include/bcc/helpers.h:10:1: warning: unused function 'f' [-Wunused-function]
+/virtual/main.c:2:1: note: previous definition is here
+1 error generated.`
+
+func TestParseDiagnostics(t *testing.T) {
+	diags := parseDiagnostics(testCompilerOutput, virtualMainFile, 1)
+	expected := []Diagnostic{
+		{File: virtualMainFile, Line: 4, Col: 9, Severity: "error", Message: "use of undeclared identifier 'undefined_var'"},
+		{File: "/virtual/include/bcc/helpers.h", Line: 10, Col: 1, Severity: "warning", Message: "unused function 'f' [-Wunused-function]"},
+		{File: virtualMainFile, Line: 1, Col: 1, Severity: "note", Message: "previous definition is here"},
+	}
+	if !reflect.DeepEqual(diags, expected) {
+		t.Fatalf("unexpected diagnostics:\n%+v\nexpected:\n%+v", diags, expected)
+	}
+	err := &CompileError{Diagnostics: diags, Output: testCompilerOutput}
+	if err.Error() != "failed to compile BPF module:\n"+testCompilerOutput {
+		t.Fatalf("unexpected error %q", err.Error())
+	}
+}
+
+func TestCaptureStderr(t *testing.T) {
+	diags, err := captureStderr(func() {
+		syscall.Write(2, []byte("warning: captured\n"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diags != "warning: captured\n" {
+		t.Fatalf("got %q", diags)
+	}
+
+	// The standard error is restored if the call panics.
+	var before, after syscall.Stat_t
+	if err := syscall.Fstat(2, &before); err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the panic to propagate")
+			}
+		}()
+		captureStderr(func() { panic("compiler crash") })
+	}()
+	if err := syscall.Fstat(2, &after); err != nil {
+		t.Fatal(err)
+	}
+	if before.Dev != after.Dev || before.Ino != after.Ino {
+		t.Fatalf("standard error not restored after a panic")
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DumpOption configures the table dumps.
+type DumpOption func(*dumpOptions)
+
+type dumpOptions struct {
+	hex      bool
+	noHeader bool
+	comma    rune
+}
+
+// DumpHex dumps the raw keys and values as hex strings instead of
+// formatting them. It works on tables not backed by a module.
+func DumpHex() DumpOption {
+	return func(o *dumpOptions) {
+		o.hex = true
+	}
+}
+
+// DumpHeader sets whether DumpCSV writes a header row. It does by
+// default.
+func DumpHeader(enabled bool) DumpOption {
+	return func(o *dumpOptions) {
+		o.noHeader = !enabled
+	}
+}
+
+// DumpSeparator sets the field separator of DumpCSV, ',' by default.
+func DumpSeparator(comma rune) DumpOption {
+	return func(o *dumpOptions) {
+		o.comma = comma
+	}
+}
+
+func newDumpOptions(opts []DumpOption) dumpOptions {
+	o := dumpOptions{comma: ','}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// MarshalJSON encodes the entry as an object with "key", "value" and,
+// for per-cpu tables, "percpu" members.
+func (e Entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Key    string   `json:"key"`
+		Value  string   `json:"value"`
+		PerCPU []string `json:"percpu,omitempty"`
+	}{e.Key, e.Value, e.PerCPU})
+}
+
+// DumpJSON writes the entries of the table to w as a JSON array of
+// entries (see Entry.MarshalJSON), one per line. Entries are written
+// as the table is iterated, without reading it all first.
+func (table *Table) DumpJSON(w io.Writer, opts ...DumpOption) error {
+	o := newDumpOptions(opts)
+	bw := bufio.NewWriter(w)
+	sep := "[\n"
+	writeEntry := func(v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		bw.WriteString(sep)
+		_, err = bw.Write(b)
+		sep = ",\n"
+		return err
+	}
+
+	if o.hex {
+		if err := table.rlock(); err != nil {
+			return err
+		}
+		defer table.runlock()
+		if err := table.checkOp(opLookup); err != nil {
+			return err
+		}
+		cur, err := table.newCursor()
+		if err != nil {
+			return err
+		}
+		for cur.next() {
+			err := writeEntry(struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			}{hex.EncodeToString(cur.key), hex.EncodeToString(cur.leaf)})
+			if err != nil {
+				return fmt.Errorf("Table.DumpJSON: %v", err)
+			}
+		}
+		if cur.err != nil {
+			return fmt.Errorf("Table.DumpJSON: %w", cur.err)
+		}
+	} else {
+		it := table.Iterator()
+		for it.Next() {
+			if err := writeEntry(it.Entry()); err != nil {
+				return fmt.Errorf("Table.DumpJSON: %v", err)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return fmt.Errorf("Table.DumpJSON: %w", err)
+		}
+	}
+	if sep == "[\n" {
+		bw.WriteString("[")
+	}
+	bw.WriteString("\n]\n")
+	return bw.Flush()
+}
+
+// DumpCSV writes the entries of the table to w as CSV, one row per
+// entry. The columns are named after the fields of struct keys and
+// values as found in the key and leaf descriptions, or "key" and
+// "value" otherwise; struct values are split into one column per
+// field. With DumpHex, there is a "key" and a "value" column holding
+// the raw bytes.
+func (table *Table) DumpCSV(w io.Writer, opts ...DumpOption) error {
+	o := newDumpOptions(opts)
+	cw := csv.NewWriter(w)
+	cw.Comma = o.comma
+
+	if o.hex {
+		if err := table.rlock(); err != nil {
+			return err
+		}
+		defer table.runlock()
+		if err := table.checkOp(opLookup); err != nil {
+			return err
+		}
+		if !o.noHeader {
+			cw.Write([]string{"key", "value"})
+		}
+		cur, err := table.newCursor()
+		if err != nil {
+			return err
+		}
+		for cur.next() {
+			cw.Write([]string{hex.EncodeToString(cur.key), hex.EncodeToString(cur.leaf)})
+		}
+		if cur.err != nil {
+			return fmt.Errorf("Table.DumpCSV: %w", cur.err)
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkFormat(); err != nil {
+		return err
+	}
+	desc := table.Desc()
+	keyFields := descFieldNames(desc.KeyDesc)
+	leafFields := descFieldNames(desc.LeafDesc)
+	if desc.MapType.IsPerCPU() {
+		// The value is the list of the values of each CPU.
+		leafFields = nil
+	}
+	if !o.noHeader {
+		header := append([]string(nil), keyFields...)
+		if header == nil {
+			header = []string{"key"}
+		}
+		if leafFields == nil {
+			header = append(header, "value")
+		}
+		cw.Write(append(header, leafFields...))
+	}
+	it := table.Iterator()
+	for it.Next() {
+		e := it.Entry()
+		row, err := splitFormatted(e.Key, len(keyFields))
+		if err != nil {
+			return fmt.Errorf("Table.DumpCSV: key %s: %v", e.Key, err)
+		}
+		values, err := splitFormatted(e.Value, len(leafFields))
+		if err != nil {
+			return fmt.Errorf("Table.DumpCSV: value %s: %v", e.Value, err)
+		}
+		if err := cw.Write(append(row, values...)); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("Table.DumpCSV: %w", err)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// descFieldNames returns the names of the fields of a struct key or
+// leaf description, or nil if it doesn't describe a struct.
+func descFieldNames(desc string) []string {
+	var d interface{}
+	if json.Unmarshal([]byte(desc), &d) != nil {
+		return nil
+	}
+	// [name, [[field, type(, dims)], ...](, kind)]
+	st, ok := d.([]interface{})
+	if !ok || len(st) < 2 {
+		return nil
+	}
+	fields, ok := st[1].([]interface{})
+	if !ok {
+		return nil
+	}
+	var names []string
+	for _, f := range fields {
+		field, ok := f.([]interface{})
+		if !ok || len(field) == 0 {
+			return nil
+		}
+		name, _ := field[0].(string)
+		names = append(names, name)
+	}
+	return names
+}
+
+// splitFormatted splits a struct formatted by bcc as "{ a b c }" into
+// its n top level fields. Nested structs and arrays are kept whole. If
+// n is 0, s is returned as is.
+func splitFormatted(s string, n int) ([]string, error) {
+	if n == 0 {
+		return []string{s}, nil
+	}
+	inner := strings.TrimSpace(s)
+	if !strings.HasPrefix(inner, "{") || !strings.HasSuffix(inner, "}") {
+		return nil, fmt.Errorf("not a struct")
+	}
+	inner = inner[1 : len(inner)-1]
+	var (
+		fields  []string
+		depth   int
+		start   = -1
+		inQuote bool
+	)
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		if start < 0 {
+			if c == ' ' {
+				continue
+			}
+			start = i
+		}
+		switch {
+		case inQuote:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inQuote = false
+			}
+		case c == '"':
+			inQuote = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		case c == ' ' && depth == 0:
+			fields = append(fields, inner[start:i])
+			start = -1
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, inner[start:])
+	}
+	if len(fields) != n {
+		return nil, fmt.Errorf("got %d fields, expected %d", len(fields), n)
+	}
+	for i, f := range fields {
+		// char arrays are formatted as quoted strings.
+		if u, err := strconv.Unquote(f); err == nil && strings.HasPrefix(f, `"`) {
+			fields[i] = u
+		}
+	}
+	return fields, nil
+}
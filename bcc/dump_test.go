@@ -0,0 +1,91 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEntryMarshalJSON(t *testing.T) {
+	e := Entry{Key: `{ "comm\"" 0x1 }`, Value: "0x2"}
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"key":"{ \"comm\\\"\" 0x1 }","value":"0x2"}`; string(b) != want {
+		t.Fatalf("unexpected JSON %s, expected %s", b, want)
+	}
+	var decoded struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Key != e.Key || decoded.Value != e.Value {
+		t.Fatalf("unexpected round trip %+v", decoded)
+	}
+
+	e.PerCPU = []string{"0x1", "0x2"}
+	if b, err = json.Marshal(e); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"key":"{ \"comm\\\"\" 0x1 }","value":"0x2","percpu":["0x1","0x2"]}`; string(b) != want {
+		t.Fatalf("unexpected JSON %s, expected %s", b, want)
+	}
+}
+
+func TestSplitFormatted(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		n    int
+		want []string
+	}{
+		{"0x1", 0, []string{"0x1"}},
+		{"{ 0x2a 0x1f90 0x0 }", 3, []string{"0x2a", "0x1f90", "0x0"}},
+		{`{ "bash" [ 0x1 0x2 ] { 0x3 0x4 } }`, 3, []string{"bash", "[ 0x1 0x2 ]", "{ 0x3 0x4 }"}},
+		{`{ "a b" 0x1 }`, 2, []string{"a b", "0x1"}},
+	} {
+		got, err := splitFormatted(test.s, test.n)
+		if err != nil {
+			t.Fatalf("%q: %v", test.s, err)
+		}
+		if len(got) != len(test.want) {
+			t.Fatalf("%q: got %q, expected %q", test.s, got, test.want)
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Fatalf("%q: got %q, expected %q", test.s, got, test.want)
+			}
+		}
+	}
+	if _, err := splitFormatted("{ 0x1 0x2 }", 3); err == nil {
+		t.Fatal("expected error for field count mismatch")
+	}
+	if _, err := splitFormatted("0x1", 2); err == nil {
+		t.Fatal("expected error for non struct")
+	}
+}
+
+func TestDescFieldNames(t *testing.T) {
+	names := descFieldNames(`["key_t", [["pid", "unsigned int"], ["comm", "char", [16]]], "struct"]`)
+	if len(names) != 2 || names[0] != "pid" || names[1] != "comm" {
+		t.Fatalf("unexpected names %q", names)
+	}
+	if names := descFieldNames(`"unsigned int"`); names != nil {
+		t.Fatalf("unexpected names %q for a scalar", names)
+	}
+}
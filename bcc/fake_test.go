@@ -0,0 +1,140 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// fakeElems are element commands operating on the entries of an
+// in-memory map of the layout of desc instead of a BPF map: an array of
+// maxEntries values, whose entries can't be deleted, or a hash holding
+// up to maxEntries entries for any other map type.
+type fakeElems struct {
+	desc       TableDesc
+	maxEntries int
+	entries    map[string]*fakeEntry
+	n          int
+}
+
+type fakeEntry struct {
+	value   []byte
+	present bool
+}
+
+// newFakeElems returns the element commands of an empty hash, or of an
+// array of zero values, of keySize byte keys and leafSize byte values.
+func newFakeElems(mapType MapType, keySize, leafSize, maxEntries int) *fakeElems {
+	f := &fakeElems{
+		desc:       TableDesc{Name: "fake", FD: -1, KeySize: uint64(keySize), LeafSize: uint64(leafSize), MapType: mapType},
+		maxEntries: maxEntries,
+		entries:    make(map[string]*fakeEntry),
+	}
+	if mapType == MapTypeArray {
+		f.fill()
+	}
+	return f
+}
+
+// fill adds the entries of keys fakeKey(0) to fakeKey(maxEntries-1), of
+// zero values, to the map.
+func (f *fakeElems) fill() {
+	for i := 0; i < f.maxEntries; i++ {
+		f.entries[string(f.fakeKey(i))] = &fakeEntry{value: make([]byte, f.desc.LeafSize), present: true}
+	}
+	f.n = f.maxEntries
+}
+
+// fakeKey returns the key of index i: i as a u32 in host byte order,
+// padded with zeros to the key size.
+func (f *fakeElems) fakeKey(i int) []byte {
+	key := make([]byte, f.desc.KeySize)
+	byteOrder.PutUint32(key, uint32(i))
+	return key
+}
+
+func (f *fakeElems) entry(key unsafe.Pointer) *fakeEntry {
+	return f.entries[string(unsafe.Slice((*byte)(key), f.desc.KeySize))]
+}
+
+func (f *fakeElems) lookup(fd int, key, leaf unsafe.Pointer) error {
+	e := f.entry(key)
+	if e == nil || !e.present {
+		return syscall.ENOENT
+	}
+	copy(unsafe.Slice((*byte)(leaf), f.desc.LeafSize), e.value)
+	return nil
+}
+
+func (f *fakeElems) update(fd int, key, leaf unsafe.Pointer, flags uint64) error {
+	e := f.entry(key)
+	if e == nil || !e.present {
+		// The entries of arrays are always present.
+		if f.desc.MapType == MapTypeArray || f.n >= f.maxEntries {
+			return syscall.E2BIG
+		}
+		if e == nil {
+			e = &fakeEntry{value: make([]byte, f.desc.LeafSize)}
+			f.entries[string(unsafe.Slice((*byte)(key), f.desc.KeySize))] = e
+		}
+		e.present = true
+		f.n++
+	}
+	copy(e.value, unsafe.Slice((*byte)(leaf), f.desc.LeafSize))
+	return nil
+}
+
+func (f *fakeElems) delete(fd int, key unsafe.Pointer) error {
+	if f.desc.MapType == MapTypeArray {
+		return syscall.EINVAL
+	}
+	e := f.entry(key)
+	if e == nil || !e.present {
+		return syscall.ENOENT
+	}
+	e.present = false
+	f.n--
+	return nil
+}
+
+// fakeTables maps the tables of newFakeTable to their element commands.
+var fakeTables sync.Map
+
+func init() {
+	testElems = func(table *Table) elemOps {
+		if elems, ok := fakeTables.Load(table); ok {
+			return elems.(elemOps)
+		}
+		return nil
+	}
+}
+
+// newFakeTable returns a table not backed by a map, whose element
+// commands run on elems if set. Its layout is that of elems for
+// fakeElems, and a hash of 4 byte keys and 8 byte values otherwise.
+func newFakeTable(elems elemOps) *Table {
+	desc := TableDesc{Name: "fake", FD: -1, KeySize: 4, LeafSize: 8, MapType: MapTypeHash}
+	if f, ok := elems.(*fakeElems); ok {
+		desc = f.desc
+	}
+	table := &Table{ownFD: true, done: make(chan struct{})}
+	table.desc.Store(&desc)
+	if elems != nil {
+		fakeTables.Store(table, elems)
+	}
+	return table
+}
@@ -0,0 +1,210 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+// attachSKLookup is BPF_SK_LOOKUP.
+const attachSKLookup = 36
+
+// probeInsns is the smallest valid program, r0 = 0; exit.
+var probeInsns = []byte{
+	0xb7, 0, 0, 0, 0, 0, 0, 0,
+	0x95, 0, 0, 0, 0, 0, 0, 0,
+}
+
+var (
+	// featuresMu guards features, the results of the feature probes
+	// run so far by name.
+	featuresMu sync.Mutex
+	features   = make(map[string]bool)
+)
+
+// probeFeature returns the result of probe for the feature name,
+// running it only the first time.
+func probeFeature(name string, probe func() bool) bool {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	if ok, probed := features[name]; probed {
+		return ok
+	}
+	ok := probe()
+	features[name] = ok
+	return ok
+}
+
+// SupportsProgramType reports whether the kernel can load programs of
+// type pt, by loading the smallest one. Types needing BTF to load,
+// tracing, ext, lsm and struct_ops programs, are reported as not
+// supported; use LoadFentry or LoadIter and check for ErrNotSupported.
+//
+// As all the Supports functions, it needs the privileges to use
+// bpf(2), reports the feature as missing without them, and caches
+// its result for the life of the process.
+func SupportsProgramType(pt ProgramType) bool {
+	return probeFeature("prog_type:"+pt.String(), func() bool {
+		var attachType uint32
+		switch pt {
+		case ProgramTypeTracing, ProgramTypeExt, ProgramTypeLSM, ProgramTypeStructOps:
+			return false
+		case ProgramTypeCgroupSockAddr:
+			attachType = uint32(CgroupInet4Bind)
+		case ProgramTypeCgroupSockopt:
+			attachType = uint32(CgroupGetsockopt)
+		case ProgramTypeSKLookup:
+			attachType = attachSKLookup
+		}
+		license := C.CString("GPL")
+		defer C.free(unsafe.Pointer(license))
+		fd, err := progLoadBTF(pt, unsafe.Pointer(&probeInsns[0]), len(probeInsns)/8, license, kernelVersionCode(), 0, nil, attachType, 0)
+		if err != nil {
+			return false
+		}
+		syscall.Close(fd)
+		return true
+	})
+}
+
+// SupportsRawTracepoints reports whether the kernel has raw
+// tracepoints (Linux 4.17), for AttachRawTracepoint.
+func SupportsRawTracepoints() bool {
+	return SupportsProgramType(ProgramTypeRawTracepoint)
+}
+
+// probeMapAttrs returns the sizes, max entries and flags of the
+// smallest valid map of type mt.
+func probeMapAttrs(mt MapType) (keySize, valueSize, maxEntries, flags uint32) {
+	switch mt {
+	case MapTypeStackTrace:
+		return 4, 8, 1, 0
+	case MapTypeLPMTrie:
+		return 8, 4, 1, MapFlagNoPrealloc
+	case MapTypeCgroupStorage, MapTypePercpuCgroupStorage:
+		// struct bpf_cgroup_storage_key
+		return 16, 4, 0, 0
+	case MapTypeQueue, MapTypeStack:
+		return 0, 4, 1, 0
+	case MapTypeSkStorage:
+		return 4, 4, 0, MapFlagNoPrealloc
+	case MapTypeRingbuf:
+		return 0, 0, uint32(os.Getpagesize()), 0
+	}
+	return 4, 4, 1, 0
+}
+
+// SupportsMapType reports whether the kernel can create maps of type
+// mt, by creating the smallest one. Types needing BTF to be created,
+// sk_storage and struct_ops maps, are reported as not supported.
+func SupportsMapType(mt MapType) bool {
+	return probeFeature("map_type:"+mt.String(), func() bool {
+		if mt == MapTypeStructOps {
+			return false
+		}
+		var innerFD int
+		if mt == MapTypeArrayOfMaps || mt == MapTypeHashOfMaps {
+			var err error
+			if innerFD, err = mapCreate(MapTypeArray, 4, 4, 1, 0, "", 0, 0); err != nil {
+				return false
+			}
+			defer syscall.Close(innerFD)
+		}
+		keySize, valueSize, maxEntries, flags := probeMapAttrs(mt)
+		fd, err := mapCreate(mt, keySize, valueSize, maxEntries, flags, "", 0, uint32(innerFD))
+		if err != nil {
+			return false
+		}
+		syscall.Close(fd)
+		return true
+	})
+}
+
+// SupportsRingBuf reports whether the kernel has ring buffers (Linux
+// 5.8).
+func SupportsRingBuf() bool {
+	return SupportsMapType(MapTypeRingbuf)
+}
+
+// SupportsBatchOps reports whether the kernel has batch operations on
+// hash maps (Linux 5.6), for GetBatch, SetBatch and DeleteBatch.
+// Arrays gained them in the same release.
+func SupportsBatchOps() bool {
+	return probeFeature("batch_ops", func() bool {
+		fd, err := mapCreate(MapTypeHash, 4, 4, 1, 0, "", 0, 0)
+		if err != nil {
+			return false
+		}
+		defer syscall.Close(fd)
+		buf := make([]byte, 4)
+		_, err = mapBatch(cmdLookupBatch, fd, nil, buf, make([]byte, 4), make([]byte, 4), 1, 0)
+		// The map is empty.
+		return err == nil || err == syscall.ENOENT
+	})
+}
+
+// kernelVersionCode returns the version of the running kernel in the
+// LINUX_VERSION_CODE format, checked when loading kprobes before
+// Linux 5.0, or 0 if it can't be parsed.
+func kernelVersionCode() uint32 {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return 0
+	}
+	var b strings.Builder
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		b.WriteByte(byte(c))
+	}
+	return parseKernelVersion(b.String())
+}
+
+// parseKernelVersion returns the version of the kernel release, e.g.
+// "5.4.0-42-generic", in the LINUX_VERSION_CODE format, or 0.
+func parseKernelVersion(release string) uint32 {
+	var v [3]uint64
+	parts := strings.SplitN(release, ".", 3)
+	for i, p := range parts {
+		end := strings.IndexFunc(p, func(r rune) bool { return r < '0' || r > '9' })
+		if end >= 0 {
+			p = p[:end]
+		}
+		n, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			if i < 2 {
+				return 0
+			}
+			break
+		}
+		v[i] = n
+	}
+	if v[2] > 255 {
+		// Clamped as in KERNEL_VERSION since Linux 4.9.
+		v[2] = 255
+	}
+	return uint32(v[0]<<16 | v[1]<<8 | v[2])
+}
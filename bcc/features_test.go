@@ -0,0 +1,52 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import "testing"
+
+func TestParseKernelVersion(t *testing.T) {
+	for _, tt := range []struct {
+		release string
+		want    uint32
+	}{
+		{"5.4.0-42-generic", 0x050400},
+		{"4.19.128", 0x041380},
+		{"5.10", 0x050a00},
+		{"4.9.300-rc1", 0x0409ff},
+		{"6.1.0+", 0x060100},
+		{"", 0},
+		{"foo", 0},
+	} {
+		if got := parseKernelVersion(tt.release); got != tt.want {
+			t.Errorf("parseKernelVersion(%q) = %#x, want %#x", tt.release, got, tt.want)
+		}
+	}
+}
+
+func TestProbeFeature(t *testing.T) {
+	n := 0
+	probe := func() bool {
+		n++
+		return true
+	}
+	for i := 0; i < 3; i++ {
+		if !probeFeature("test_feature", probe) {
+			t.Fatal("expected the feature to be supported")
+		}
+	}
+	if n != 1 {
+		t.Fatalf("expected the probe to run once, ran %d times", n)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Field is a field of the key or leaf of a table, laid out as by clang
+// for the BPF target.
+type Field struct {
+	Name string
+	// CType is the C type of the field, e.g. "unsigned int",
+	// "char[16]" or "struct event".
+	CType string
+	// Size is the size of the field in bytes, and Offset its offset
+	// from the start of the key or leaf, also for nested fields.
+	Size   int
+	Offset int
+	// BitSize is the width of bitfields, stored at BitOffset bits from
+	// Offset in the Size bytes holding them, in the bit order of the
+	// host. It is zero for other fields.
+	BitSize   int
+	BitOffset int
+	// Fields are the fields of struct and union fields, or of the
+	// element of arrays of them.
+	Fields []Field
+}
+
+// KeyFields returns the fields of the key of the table, or a single
+// unnamed field if it isn't a struct.
+func (table *Table) KeyFields() ([]Field, error) {
+	return table.fields("KeyFields", func(desc TableDesc) (string, uint64) { return desc.KeyDesc, desc.KeySize })
+}
+
+// LeafFields returns the fields of the leaf of the table, or a single
+// unnamed field if it isn't a struct. The leaf of per-cpu tables is
+// that of a single cpu.
+func (table *Table) LeafFields() ([]Field, error) {
+	return table.fields("LeafFields", func(desc TableDesc) (string, uint64) { return desc.LeafDesc, desc.LeafSize })
+}
+
+func (table *Table) fields(method string, get func(TableDesc) (string, uint64)) ([]Field, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkFormat(); err != nil {
+		return nil, err
+	}
+	desc, size := get(table.Desc())
+	fields, err := parseFields(desc, int(size))
+	if err != nil {
+		return nil, fmt.Errorf("Table.%s: %s: %v", method, table.Name(), err)
+	}
+	return fields, nil
+}
+
+// parseFields parses the key or leaf description desc of bcc, checking
+// that its layout spans size bytes.
+func parseFields(desc string, size int) ([]Field, error) {
+	var d interface{}
+	if err := json.Unmarshal([]byte(desc), &d); err != nil {
+		return nil, fmt.Errorf("invalid description %q: %v", desc, err)
+	}
+	l, err := layoutDesc(d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid description %q: %v", desc, err)
+	}
+	if l.size != size {
+		return nil, fmt.Errorf("description %q lays out %d bytes, expected %d", desc, l.size, size)
+	}
+	if l.fields == nil {
+		return []Field{{CType: l.ctype, Size: l.size}}, nil
+	}
+	return l.fields, nil
+}
+
+// typeLayout is the layout of a type of a description.
+type typeLayout struct {
+	ctype       string
+	size, align int
+	fields      []Field
+}
+
+// extraSizes are the sizes of the C types besides the integers of
+// ctypeSizes.
+var extraSizes = map[string]int{
+	"__int128":          16,
+	"unsigned __int128": 16,
+	"float":             4,
+	"double":            8,
+	"long double":       16,
+}
+
+// layoutDesc returns the layout of the type described by d, either a
+// C type name or [name, [[field, type(, dims or bits)], ...](, kind)]
+// for structs and unions.
+func layoutDesc(d interface{}) (typeLayout, error) {
+	switch d := d.(type) {
+	case string:
+		return scalarLayout(d)
+	case []interface{}:
+		if len(d) < 2 {
+			return typeLayout{}, fmt.Errorf("invalid struct %v", d)
+		}
+		name, _ := d[0].(string)
+		members, ok := d[1].([]interface{})
+		if !ok {
+			return typeLayout{}, fmt.Errorf("invalid fields of struct %s", name)
+		}
+		kind := "struct"
+		if len(d) > 2 {
+			if kind, ok = d[2].(string); !ok {
+				return typeLayout{}, fmt.Errorf("invalid kind of struct %s", name)
+			}
+		}
+		return structLayout(name, kind, members)
+	}
+	return typeLayout{}, fmt.Errorf("invalid type %v", d)
+}
+
+func scalarLayout(ctype string) (typeLayout, error) {
+	size := ctypeSizes[ctype]
+	switch {
+	case size > 0:
+	case extraSizes[ctype] > 0:
+		size = extraSizes[ctype]
+	case strings.HasSuffix(ctype, "*"):
+		size = 8
+	case strings.HasPrefix(ctype, "enum "):
+		size = 4
+	default:
+		return typeLayout{}, fmt.Errorf("unknown type %q", ctype)
+	}
+	return typeLayout{ctype: ctype, size: size, align: size}, nil
+}
+
+// structLayout lays out the members of a struct or union as clang
+// does: each member is aligned to its alignment, unless the struct is
+// packed, and bitfields are packed in units of their type without
+// straddling them.
+func structLayout(name, kind string, members []interface{}) (typeLayout, error) {
+	packed := strings.HasSuffix(kind, "_packed")
+	kind = strings.TrimSuffix(kind, "_packed")
+	if kind != "struct" && kind != "union" {
+		return typeLayout{}, fmt.Errorf("unknown kind %q of struct %s", kind, name)
+	}
+	l := typeLayout{ctype: strings.TrimSpace(kind + " " + name), align: 1}
+	var bitPos int
+	for _, m := range members {
+		f, ok := m.([]interface{})
+		if !ok || len(f) < 2 {
+			return typeLayout{}, fmt.Errorf("invalid field %v of %s", m, l.ctype)
+		}
+		fieldName, ok := f[0].(string)
+		if !ok {
+			return typeLayout{}, fmt.Errorf("invalid field name %v of %s", f[0], l.ctype)
+		}
+		ft, err := layoutDesc(f[1])
+		if err != nil {
+			return typeLayout{}, fmt.Errorf("field %s of %s: %v", fieldName, l.ctype, err)
+		}
+		field := Field{Name: fieldName, CType: ft.ctype, Size: ft.size}
+		align := ft.align
+		if packed {
+			align = 1
+		}
+		bits, bitfield := 0, false
+		if len(f) > 2 {
+			switch extra := f[2].(type) {
+			case []interface{}:
+				// Array dimensions.
+				for _, dim := range extra {
+					n, ok := dim.(float64)
+					if !ok || n < 0 {
+						return typeLayout{}, fmt.Errorf("invalid dimension %v of field %s of %s", dim, fieldName, l.ctype)
+					}
+					field.CType += fmt.Sprintf("[%d]", int(n))
+					field.Size *= int(n)
+				}
+			case float64:
+				bits, bitfield = int(extra), true
+				if ft.fields != nil || bits < 0 || bits > ft.size*8 {
+					return typeLayout{}, fmt.Errorf("invalid bitfield %s of %s", fieldName, l.ctype)
+				}
+			default:
+				return typeLayout{}, fmt.Errorf("invalid field %v of %s", f, l.ctype)
+			}
+		}
+		if align > l.align {
+			l.align = align
+		}
+		switch {
+		case kind == "union":
+			field.BitSize = bits
+		case bitfield:
+			unitBits := ft.size * 8
+			if bits == 0 || (!packed && bitPos%unitBits+bits > unitBits) {
+				bitPos = alignUp(bitPos, unitBits)
+			}
+			if packed {
+				field.Offset = bitPos / 8
+			} else {
+				field.Offset = bitPos / unitBits * ft.size
+			}
+			field.BitOffset = bitPos - field.Offset*8
+			field.BitSize = bits
+			bitPos += bits
+		default:
+			bitPos = alignUp(alignUp(bitPos, 8)/8, align) * 8
+			field.Offset = bitPos / 8
+			bitPos += field.Size * 8
+		}
+		field.Fields = shiftFields(ft.fields, field.Offset)
+		if bitfield && bits == 0 {
+			// Zero width bitfields only align the next field.
+			continue
+		}
+		l.fields = append(l.fields, field)
+		if end := field.Offset + field.Size; kind == "union" && end > l.size {
+			l.size = end
+		}
+	}
+	if kind == "struct" {
+		l.size = alignUp(bitPos, 8) / 8
+	}
+	l.size = alignUp(l.size, l.align)
+	if l.fields == nil {
+		l.fields = []Field{}
+	}
+	return l, nil
+}
+
+// shiftFields returns a copy of fields offset by off.
+func shiftFields(fields []Field, off int) []Field {
+	if fields == nil {
+		return nil
+	}
+	shifted := make([]Field, len(fields))
+	for i, f := range fields {
+		f.Offset += off
+		f.Fields = shiftFields(f.Fields, off)
+		shifted[i] = f
+	}
+	return shifted
+}
+
+func alignUp(n, align int) int {
+	if align <= 1 {
+		return n
+	}
+	return (n + align - 1) / align * align
+}
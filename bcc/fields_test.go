@@ -0,0 +1,165 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		desc string
+		size int
+		want []Field
+	}{
+		{
+			name: "scalar",
+			desc: `"unsigned int"`,
+			size: 4,
+			want: []Field{{CType: "unsigned int", Size: 4}},
+		},
+		{
+			name: "struct",
+			desc: `["key_t",[["pid","unsigned int"],["comm","char",[16]]],"struct"]`,
+			size: 20,
+			want: []Field{
+				{Name: "pid", CType: "unsigned int", Size: 4},
+				{Name: "comm", CType: "char[16]", Size: 16, Offset: 4},
+			},
+		},
+		{
+			name: "padding",
+			desc: `["s",[["a","char"],["b","unsigned long long"],["c","short"]],"struct"]`,
+			size: 24,
+			want: []Field{
+				{Name: "a", CType: "char", Size: 1},
+				{Name: "b", CType: "unsigned long long", Size: 8, Offset: 8},
+				{Name: "c", CType: "short", Size: 2, Offset: 16},
+			},
+		},
+		{
+			name: "nested struct",
+			desc: `["outer",[["x","int"],["in",["inner",[["a","char"],["b","long"]],"struct"]],["y","char"]],"struct"]`,
+			size: 32,
+			want: []Field{
+				{Name: "x", CType: "int", Size: 4},
+				{Name: "in", CType: "struct inner", Size: 16, Offset: 8, Fields: []Field{
+					{Name: "a", CType: "char", Size: 1, Offset: 8},
+					{Name: "b", CType: "long", Size: 8, Offset: 16},
+				}},
+				{Name: "y", CType: "char", Size: 1, Offset: 24},
+			},
+		},
+		{
+			name: "union",
+			desc: `["u",[["i","int"],["c","char",[6]]],"union"]`,
+			size: 8,
+			want: []Field{
+				{Name: "i", CType: "int", Size: 4},
+				{Name: "c", CType: "char[6]", Size: 6},
+			},
+		},
+		{
+			name: "union in struct",
+			desc: `["s",[["tag","char"],["v",["",[["l","long"],["d","double"]],"union"]]],"struct"]`,
+			size: 16,
+			want: []Field{
+				{Name: "tag", CType: "char", Size: 1},
+				{Name: "v", CType: "union", Size: 8, Offset: 8, Fields: []Field{
+					{Name: "l", CType: "long", Size: 8, Offset: 8},
+					{Name: "d", CType: "double", Size: 8, Offset: 8},
+				}},
+			},
+		},
+		{
+			name: "array of structs",
+			desc: `["s",[["pts",["pt",[["x","short"],["y","short"]],"struct"],[3]]],"struct"]`,
+			size: 12,
+			want: []Field{
+				{Name: "pts", CType: "struct pt[3]", Size: 12, Fields: []Field{
+					{Name: "x", CType: "short", Size: 2},
+					{Name: "y", CType: "short", Size: 2, Offset: 2},
+				}},
+			},
+		},
+		{
+			name: "multidimensional array",
+			desc: `["m",[["grid","unsigned char",[2,3]]],"struct"]`,
+			size: 6,
+			want: []Field{
+				{Name: "grid", CType: "unsigned char[2][3]", Size: 6},
+			},
+		},
+		{
+			name: "bitfields",
+			desc: `["b",[["a","unsigned int",3],["b","unsigned int",30],["","unsigned int",0],["c","unsigned char"]],"struct"]`,
+			size: 12,
+			want: []Field{
+				{Name: "a", CType: "unsigned int", Size: 4, BitSize: 3},
+				{Name: "b", CType: "unsigned int", Size: 4, Offset: 4, BitSize: 30},
+				{Name: "c", CType: "unsigned char", Size: 1, Offset: 8},
+			},
+		},
+		{
+			name: "packed bitfields",
+			desc: `["b",[["a","unsigned char",3],["b","unsigned short",7]],"struct_packed"]`,
+			size: 2,
+			want: []Field{
+				{Name: "a", CType: "unsigned char", Size: 1, BitSize: 3},
+				{Name: "b", CType: "unsigned short", Size: 2, BitOffset: 3, BitSize: 7},
+			},
+		},
+		{
+			name: "packed",
+			desc: `["p",[["a","char"],["b","unsigned int"]],"struct_packed"]`,
+			size: 5,
+			want: []Field{
+				{Name: "a", CType: "char", Size: 1},
+				{Name: "b", CType: "unsigned int", Size: 4, Offset: 1},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFields(tt.desc, tt.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFieldsErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc string
+		size int
+	}{
+		{`["key_t",[["pid","unsigned int"]],"struct"]`, 8},
+		{`"struct foo *x"`, 4},
+		{`"widget"`, 4},
+		{`["s",[["a","int",[-1]]],"struct"]`, 0},
+		{`["s",[["a","int",40]],"struct"]`, 4},
+		{`["s",[["a","int"]],"class"]`, 4},
+		{`not json`, 4},
+	} {
+		if fields, err := parseFields(tt.desc, tt.size); err == nil {
+			t.Errorf("parseFields(%s, %d) = %+v, expected error", tt.desc, tt.size, fields)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// attachFlowDissector is the attach type of flow dissector programs
+// (BPF_FLOW_DISSECTOR).
+const attachFlowDissector = 17
+
+// defaultNetns is the network namespace of flow dissectors when none is
+// given.
+const defaultNetns = "/proc/self/ns/net"
+
+// flowDissectorAttachment is a flow dissector attached to a network
+// namespace through a module, with a link or, on kernels before 5.7,
+// with BPF_PROG_ATTACH to the namespace of the process.
+type flowDissectorAttachment struct {
+	progFD int
+	linkFD int // -1 without a link
+}
+
+// LoadFlowDissector loads a program of type
+// BPF_PROG_TYPE_FLOW_DISSECTOR.
+func (bpf *Module) LoadFlowDissector(name string) (int, error) {
+	return bpf.Load(name, ProgramTypeFlowDissector, 0, 0)
+}
+
+// sameNetns reports whether the network namespace files path1 and path2
+// are the same namespace.
+func sameNetns(path1, path2 string) (bool, error) {
+	var st1, st2 syscall.Stat_t
+	if err := syscall.Stat(path1, &st1); err != nil {
+		return false, fmt.Errorf("%s: %v", path1, err)
+	}
+	if err := syscall.Stat(path2, &st2); err != nil {
+		return false, fmt.Errorf("%s: %v", path2, err)
+	}
+	return st1.Dev == st2.Dev && st1.Ino == st2.Ino, nil
+}
+
+// AttachFlowDissector attaches a flow dissector fd to the network
+// namespace netnsPath, e.g. /var/run/netns/foo, or that of the process
+// if empty. Only one flow dissector can be attached per namespace.
+// Before Linux 5.7, flow dissectors can only be attached to the
+// namespace of the process, and it returns an error wrapping
+// ErrNotSupported before Linux 4.20. Close detaches the program.
+func (bpf *Module) AttachFlowDissector(progFD int, netnsPath string) error {
+	if netnsPath == "" {
+		netnsPath = defaultNetns
+	}
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	if attached, err := bpf.checkAttached(AttachmentFlowDissector, netnsPath, progFD); attached {
+		return err
+	}
+	nsFD, err := syscall.Open(netnsPath, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to attach BPF flow dissector: %s: %v", netnsPath, err)
+	}
+	defer syscall.Close(nsFD)
+	linkFD, err := linkCreate(progFD, nsFD, attachFlowDissector)
+	if err == nil {
+		bpf.flowDissectors[netnsPath] = flowDissectorAttachment{progFD: progFD, linkFD: linkFD}
+		bpf.recordAttachment(AttachmentFlowDissector, netnsPath, netnsPath, progFD)
+		return nil
+	}
+	if err != syscall.EINVAL {
+		return flowDissectorError(netnsPath, err)
+	}
+	// No links for network namespaces, attach to the namespace of the
+	// process.
+	same, err := sameNetns(netnsPath, defaultNetns)
+	if err != nil {
+		return fmt.Errorf("failed to attach BPF flow dissector: %v", err)
+	}
+	if !same {
+		return fmt.Errorf("failed to attach BPF flow dissector to %s: the kernel only attaches to the network namespace of the process: %w", netnsPath, ErrNotSupported)
+	}
+	if err := progAttach(0, progFD, attachFlowDissector, 0); err != nil {
+		return flowDissectorError(netnsPath, err)
+	}
+	bpf.flowDissectors[netnsPath] = flowDissectorAttachment{progFD: progFD, linkFD: -1}
+	bpf.recordAttachment(AttachmentFlowDissector, netnsPath, netnsPath, progFD)
+	return nil
+}
+
+// flowDissectorError returns the error for a flow dissector failing to
+// attach to netnsPath with errno err.
+func flowDissectorError(netnsPath string, err error) error {
+	switch err {
+	case syscall.EEXIST:
+		return fmt.Errorf("failed to attach BPF flow dissector: a flow dissector is already attached to network namespace %s, and only one can be", netnsPath)
+	case syscall.EINVAL:
+		// Also returned by kernels not knowing the attach type.
+		return fmt.Errorf("failed to attach BPF flow dissector to %s: %v: %w", netnsPath, err, ErrNotSupported)
+	}
+	return fmt.Errorf("failed to attach BPF flow dissector to %s: %v", netnsPath, err)
+}
+
+// detachFlowDissector detaches the flow dissector of netnsPath. Callers
+// must hold bpf.mu.
+func (bpf *Module) detachFlowDissector(netnsPath string) error {
+	a := bpf.flowDissectors[netnsPath]
+	delete(bpf.flowDissectors, netnsPath)
+	bpf.forgetAttachment(AttachmentFlowDissector, netnsPath)
+	if a.linkFD >= 0 {
+		return syscall.Close(a.linkFD)
+	}
+	if err := progDetach(0, a.progFD, attachFlowDissector); err != nil {
+		return fmt.Errorf("failed to detach BPF flow dissector from %s: %v", netnsPath, err)
+	}
+	return nil
+}
+
+// DetachFlowDissector detaches the flow dissector attached by
+// AttachFlowDissector to the network namespace netnsPath, or that of
+// the process if empty.
+func (bpf *Module) DetachFlowDissector(netnsPath string) error {
+	if netnsPath == "" {
+		netnsPath = defaultNetns
+	}
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	if _, ok := bpf.flowDissectors[netnsPath]; !ok {
+		return fmt.Errorf("no flow dissector attached to %s", netnsPath)
+	}
+	return bpf.detachFlowDissector(netnsPath)
+}
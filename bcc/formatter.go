@@ -0,0 +1,243 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// EntryFormatter formats the entries of a table with the names of the
+// fields of its key and leaf, e.g.
+//
+//	pid=6699 comm="sshd" count=4
+//
+// Char arrays are quoted up to their first NUL byte, pointers are
+// formatted in hex, and nested structs and arrays are enclosed in
+// braces and brackets. A key or leaf that isn't a struct is named key
+// or value. Each field of the leaf of per-cpu tables lists the values
+// of all possible CPUs.
+type EntryFormatter struct {
+	keyFields  []Field
+	leafFields []Field
+	// leafStride is the distance between the leaves of each CPU of
+	// per-cpu tables, or 0.
+	leafStride int
+}
+
+// NewEntryFormatter returns a formatter of the entries of table, see
+// Table.SetEntryFormatter.
+func NewEntryFormatter(table *Table) (*EntryFormatter, error) {
+	keyFields, err := table.KeyFields()
+	if err != nil {
+		return nil, err
+	}
+	leafFields, err := table.LeafFields()
+	if err != nil {
+		return nil, err
+	}
+	f := &EntryFormatter{keyFields: keyFields, leafFields: leafFields}
+	if desc := table.Desc(); desc.MapType.IsPerCPU() {
+		f.leafStride = alignUp(int(desc.LeafSize), 8)
+	}
+	return f, nil
+}
+
+// SetEntryFormatter sets the formatter of the entries returned by
+// GetEntry and the iterations of the table, which their String method
+// uses. Set nil, the default, to format them as key=Key value=Value.
+func (table *Table) SetEntryFormatter(f *EntryFormatter) {
+	table.entryFormatter.Store(f)
+}
+
+// String formats the entry with the formatter of its table, see
+// Table.SetEntryFormatter.
+func (e Entry) String() string {
+	if e.formatter != nil {
+		return e.formatter.Format(e)
+	}
+	return "key=" + e.Key + " value=" + e.Value
+}
+
+// Format returns the fields of the raw key and value of e.
+func (f *EntryFormatter) Format(e Entry) string {
+	var b []byte
+	b = appendFields(b, f.keyFields, e.KeyBytes, "key")
+	if f.leafStride == 0 {
+		b = append(b, ' ')
+		b = appendFields(b, f.leafFields, e.ValueBytes, "value")
+		return string(b)
+	}
+	for _, field := range namedFields(f.leafFields, "value") {
+		b = append(b, ' ')
+		b = append(b, field.Name...)
+		b = append(b, "=["...)
+		for cpu := 0; (cpu+1)*f.leafStride <= len(e.ValueBytes); cpu++ {
+			if cpu > 0 {
+				b = append(b, ' ')
+			}
+			b = appendField(b, field, e.ValueBytes[cpu*f.leafStride:])
+		}
+		b = append(b, ']')
+	}
+	return string(b)
+}
+
+// namedFields returns fields, naming a single unnamed field name.
+func namedFields(fields []Field, name string) []Field {
+	if len(fields) == 1 && fields[0].Name == "" {
+		return []Field{{Name: name, CType: fields[0].CType, Size: fields[0].Size}}
+	}
+	return fields
+}
+
+// appendFields appends name=value for each of the fields in data,
+// separated by spaces.
+func appendFields(b []byte, fields []Field, data []byte, name string) []byte {
+	for i, field := range namedFields(fields, name) {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = append(b, field.Name...)
+		b = append(b, '=')
+		b = appendField(b, field, data)
+	}
+	return b
+}
+
+// appendField appends the value of field in data, the key or leaf the
+// offset of the field is relative to.
+func appendField(b []byte, field Field, data []byte) []byte {
+	if field.Offset < 0 || field.Offset+field.Size > len(data) {
+		return append(b, '?')
+	}
+	elem, dims := splitArrayType(field.CType)
+	if len(dims) > 0 {
+		return appendArray(b, field, elem, dims, data)
+	}
+	raw := data[field.Offset : field.Offset+field.Size]
+	switch {
+	case field.Fields != nil:
+		b = append(b, '{')
+		b = appendFields(b, field.Fields, data, "")
+		return append(b, '}')
+	case field.BitSize > 0:
+		v := bitfieldValue(raw, field.BitOffset, field.BitSize)
+		if strings.HasPrefix(field.CType, "unsigned") || field.CType == "_Bool" {
+			return strconv.AppendUint(b, v, 10)
+		}
+		shift := 64 - uint(field.BitSize)
+		return strconv.AppendInt(b, int64(v<<shift)>>shift, 10)
+	case strings.HasSuffix(field.CType, "*"):
+		return append(append(b, "0x"...), strconv.FormatUint(readUint(raw), 16)...)
+	case field.CType == "float" && len(raw) == 4:
+		return strconv.AppendFloat(b, float64(math.Float32frombits(uint32(readUint(raw)))), 'g', -1, 32)
+	case field.CType == "double" && len(raw) == 8:
+		return strconv.AppendFloat(b, math.Float64frombits(readUint(raw)), 'g', -1, 64)
+	case len(raw) > 8 || len(raw) == 0 || strings.HasSuffix(field.CType, "double"):
+		return append(append(b, "0x"...), fmt.Sprintf("%x", raw)...)
+	case strings.HasPrefix(field.CType, "unsigned") || field.CType == "_Bool":
+		return strconv.AppendUint(b, readUint(raw), 10)
+	}
+	// Sign extend.
+	shift := 64 - 8*uint(len(raw))
+	return strconv.AppendInt(b, int64(readUint(raw)<<shift)>>shift, 10)
+}
+
+// appendArray appends the array field of elements of type elem and
+// dimensions dims.
+func appendArray(b []byte, field Field, elem string, dims []int, data []byte) []byte {
+	n := 1
+	for _, d := range dims {
+		n *= d
+	}
+	if n == 0 {
+		return append(b, "[]"...)
+	}
+	if len(dims) == 1 && elem == "char" {
+		raw := data[field.Offset : field.Offset+field.Size]
+		if i := bytes.IndexByte(raw, 0); i >= 0 {
+			raw = raw[:i]
+		}
+		return strconv.AppendQuote(b, string(raw))
+	}
+	size := field.Size / n * (n / dims[0])
+	sub := Field{CType: elem, Size: size, Fields: field.Fields}
+	if len(dims) > 1 {
+		sub.CType = elem + strings.TrimPrefix(field.CType, elem)[len(fmt.Sprintf("[%d]", dims[0])):]
+	}
+	b = append(b, '[')
+	for i := 0; i < dims[0]; i++ {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		// The offsets of the fields of the elements are those of the
+		// first one, shift the data instead.
+		sub.Offset = field.Offset
+		b = appendField(b, sub, data[i*size:])
+	}
+	return append(b, ']')
+}
+
+// splitArrayType splits an array type, e.g. "char[2][16]", into the
+// type of its elements and its dimensions.
+func splitArrayType(ctype string) (string, []int) {
+	i := strings.IndexByte(ctype, '[')
+	if i < 0 || !strings.HasSuffix(ctype, "]") {
+		return ctype, nil
+	}
+	var dims []int
+	for _, d := range strings.Split(ctype[i+1:len(ctype)-1], "][") {
+		n, err := strconv.Atoi(d)
+		if err != nil {
+			return ctype, nil
+		}
+		dims = append(dims, n)
+	}
+	return ctype[:i], dims
+}
+
+// readUint reads an unsigned integer of up to 8 bytes in the host byte
+// order.
+func readUint(b []byte) uint64 {
+	var buf [8]byte
+	if byteOrder == binary.BigEndian {
+		copy(buf[8-len(b):], b)
+		return binary.BigEndian.Uint64(buf[:])
+	}
+	copy(buf[:], b)
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// bitfieldValue returns the bitfield of bits bits at bitOff in raw.
+func bitfieldValue(raw []byte, bitOff, bits int) uint64 {
+	if len(raw) > 8 {
+		raw = raw[:8]
+	}
+	v := readUint(raw)
+	if byteOrder == binary.BigEndian {
+		v >>= uint(len(raw)*8 - bitOff - bits)
+	} else {
+		v >>= uint(bitOff)
+	}
+	if bits < 64 {
+		v &= 1<<uint(bits) - 1
+	}
+	return v
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import "testing"
+
+func mustParseFields(t *testing.T, desc string, size int) []Field {
+	t.Helper()
+	fields, err := parseFields(desc, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestEntryFormatter(t *testing.T) {
+	key := make([]byte, 20)
+	byteOrder.PutUint32(key, 6699)
+	copy(key[4:], "sshd")
+	leaf := make([]byte, 40)
+	byteOrder.PutUint64(leaf, 0xffffffff81000000)
+	byteOrder.PutUint32(leaf[8:], uint32(0xfffffffe))
+	byteOrder.PutUint16(leaf[12:], 1)
+	byteOrder.PutUint16(leaf[14:], 2)
+	byteOrder.PutUint16(leaf[16:], 3)
+	byteOrder.PutUint32(leaf[20:], 0x5|0x3<<3)
+	byteOrder.PutUint64(leaf[24:], 7)
+	copy(leaf[32:], "ab\"")
+	f := &EntryFormatter{
+		keyFields: mustParseFields(t, `["key_t",[["pid","unsigned int"],["comm","char",[16]]],"struct"]`, 20),
+		leafFields: mustParseFields(t, `["val_t",[`+
+			`["ip","void *"],`+
+			`["delta","int"],`+
+			`["ports","unsigned short",[3]],`+
+			`["flags",["",[["a","unsigned int",3],["b","int",2]],"struct"]],`+
+			`["n",["",[["count","unsigned long long"]],"struct"]],`+
+			`["tag","char",[8]]],"struct"]`, 40),
+	}
+	e := Entry{KeyBytes: key, ValueBytes: leaf}
+	want := `pid=6699 comm="sshd" ip=0xffffffff81000000 delta=-2 ports=[1 2 3] flags={a=5 b=-1} n={count=7} tag="ab\""`
+	if got := f.Format(e); got != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+	e.formatter = f
+	if got := e.String(); got != want {
+		t.Fatalf("String() = %s, want %s", got, want)
+	}
+}
+
+func TestEntryFormatterScalars(t *testing.T) {
+	f := &EntryFormatter{
+		keyFields:  mustParseFields(t, `"unsigned int"`, 4),
+		leafFields: mustParseFields(t, `"unsigned long long"`, 8),
+		leafStride: 8,
+	}
+	key := make([]byte, 4)
+	byteOrder.PutUint32(key, 1)
+	leaf := make([]byte, 16)
+	byteOrder.PutUint64(leaf, 10)
+	byteOrder.PutUint64(leaf[8:], 20)
+	if got, want := f.Format(Entry{KeyBytes: key, ValueBytes: leaf}), "key=1 value=[10 20]"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if got, want := (Entry{Key: "0x1", Value: "0xa"}).String(), "key=0x1 value=0xa"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestEntryFormatterArrays(t *testing.T) {
+	f := &EntryFormatter{
+		keyFields:  mustParseFields(t, `["k",[["grid","unsigned char",[2,3]],["pts",["pt",[["x","short"],["y","short"]],"struct"],[2]]],"struct"]`, 14),
+		leafFields: mustParseFields(t, `"int"`, 4),
+	}
+	key := []byte{1, 2, 3, 4, 5, 6, 0, 0, 0, 0, 0, 0, 0, 0}
+	byteOrder.PutUint16(key[6:], 7)
+	byteOrder.PutUint16(key[8:], 8)
+	byteOrder.PutUint16(key[10:], 9)
+	byteOrder.PutUint16(key[12:], 10)
+	want := "grid=[[1 2 3] [4 5 6]] pts=[{x=7 y=8} {x=9 y=10}] value=0"
+	if got := f.Format(Entry{KeyBytes: key, ValueBytes: make([]byte, 4)}); got != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+}
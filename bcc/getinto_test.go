@@ -0,0 +1,67 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGetIntoSetFrom(t *testing.T) {
+	table := newFakeTable(newFakeElems(MapTypeHash, 4, 8, 4))
+
+	key := []byte{1, 0, 0, 0}
+	value := make([]byte, 8)
+	if err := table.GetInto(key, value); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("got error %v, expected ErrKeyNotFound", err)
+	}
+	if err := table.SetFrom(key, []byte{1, 2, 3, 4, 5, 6, 7, 8}); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.GetInto(key, value); err != nil {
+		t.Fatal(err)
+	}
+	if value[0] != 1 || value[7] != 8 {
+		t.Fatalf("got value %x", value)
+	}
+	if err := table.GetInto(key, make([]byte, 4)); err == nil {
+		t.Fatal("expected a leaf size mismatch")
+	}
+	if err := table.SetFrom(key[:2], value); err == nil {
+		t.Fatal("expected a key size mismatch")
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := table.SetFrom(key, value); err != nil {
+			t.Fatal(err)
+		}
+		if err := table.GetInto(key, value); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("got %v allocations per GetInto and SetFrom, expected none", allocs)
+	}
+
+	table.SetRetryPolicy(RetryPolicy{MaxAttempts: 3})
+	allocs = testing.AllocsPerRun(100, func() {
+		if err := table.GetInto(key, value); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("got %v allocations per GetInto with a retry policy, expected none", allocs)
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// starsMax is the width of the distribution bars, as in bcc.
+const starsMax = 40
+
+// Bucket is a histogram bucket, counting the values from Low to High
+// inclusive.
+type Bucket struct {
+	Low   uint64
+	High  uint64
+	Count uint64
+}
+
+// HistogramSection is the histogram of the values of one secondary key,
+// for tables keyed by a struct with a trailing slot field.
+type HistogramSection struct {
+	Key     string
+	Buckets []Bucket
+}
+
+// Histogram wraps a table filled by BPF_HISTOGRAM and bpf_log2l(), as
+// in dist.increment(bpf_log2l(delta)).
+//
+// The table is keyed either by the slot (u32 or u64), or by a struct
+// whose last field is the slot and whose leading fields are a secondary
+// key, e.g.
+//
+//	typedef struct disk_key {
+//		char disk[32];
+//		u64 slot;
+//	} disk_key_t;
+//
+// The values must be unsigned integers, per-cpu tables are summed.
+type Histogram struct {
+	table *Table
+	// ValueType names the values in Print, e.g. "usecs".
+	ValueType string
+}
+
+// NewHistogram returns a log2 Histogram for table, labelling values
+// with valueType when printing.
+func NewHistogram(table *Table, valueType string) *Histogram {
+	return &Histogram{table: table, ValueType: valueType}
+}
+
+// Buckets returns the buckets of the histogram up to the last non-empty
+// one. The buckets of all secondary keys are added up.
+func (h *Histogram) Buckets() ([]Bucket, error) {
+	slots, err := readHistSlots(h.table)
+	if err != nil {
+		return nil, err
+	}
+	return log2Buckets(slots.total()), nil
+}
+
+// Sections returns the histograms of each secondary key, sorted by key.
+// Tables without a secondary key have a single section with an empty
+// key.
+func (h *Histogram) Sections() ([]HistogramSection, error) {
+	slots, err := readHistSlots(h.table)
+	if err != nil {
+		return nil, err
+	}
+	var sections []HistogramSection
+	for _, key := range slots.keys() {
+		sections = append(sections, HistogramSection{
+			Key:     key,
+			Buckets: log2Buckets(slots.counts[key]),
+		})
+	}
+	return sections, nil
+}
+
+// Print writes the histogram as a bar chart like bcc's
+// print_log2_hist. With a secondary key, a histogram is printed for
+// each key.
+func (h *Histogram) Print(w io.Writer) error {
+	slots, err := readHistSlots(h.table)
+	if err != nil {
+		return err
+	}
+	return slots.print(w, func(w io.Writer, counts map[uint64]uint64) error {
+		return printLog2Hist(w, h.ValueType, counts)
+	})
+}
+
+// log2Buckets expands the slot counts of a log2 histogram into buckets.
+// Slot i counts the values from 2^(i-1) to 2^i-1, slot 0 is unused.
+func log2Buckets(counts map[uint64]uint64) []Bucket {
+	var idxMax uint64
+	for i, c := range counts {
+		if c > 0 && i > idxMax && i <= 64 {
+			idxMax = i
+		}
+	}
+	var buckets []Bucket
+	for i := uint64(1); i <= idxMax; i++ {
+		low := uint64(1) << (i - 1)
+		high := uint64(1)<<i - 1
+		if low == high {
+			low--
+		}
+		buckets = append(buckets, Bucket{Low: low, High: high, Count: counts[i]})
+	}
+	return buckets
+}
+
+func printLog2Hist(w io.Writer, valueType string, counts map[uint64]uint64) error {
+	buckets := log2Buckets(counts)
+	if len(buckets) == 0 {
+		return nil
+	}
+	header := "     %-19s : count     distribution\n"
+	body := "%10d -> %-10d : %-8d |%-*s|\n"
+	stars := starsMax
+	if len(buckets) > 32 {
+		header = "               %-29s : count     distribution\n"
+		body = "%20d -> %-20d : %-8d |%-*s|\n"
+		stars = starsMax / 2
+	}
+	return printBuckets(w, fmt.Sprintf(header, valueType), body, stars, buckets)
+}
+
+func printBuckets(w io.Writer, header, body string, width int, buckets []Bucket) error {
+	var valMax uint64
+	for _, b := range buckets {
+		if b.Count > valMax {
+			valMax = b.Count
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	for _, b := range buckets {
+		fmt.Fprintf(&buf, body, b.Low, b.High, b.Count, width, histStars(b.Count, valMax, width))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// histStars returns the bar of val, scaled to width for valMax.
+func histStars(val, valMax uint64, width int) string {
+	if valMax == 0 {
+		return ""
+	}
+	n := int(float64(width) * float64(val) / float64(valMax))
+	if n > width {
+		n = width
+	}
+	return strings.Repeat("*", n)
+}
+
+// LinearHistogram wraps a table filled with linear buckets, as in
+// dist.increment(value / step). Keys and values are as for Histogram.
+type LinearHistogram struct {
+	table *Table
+	// Step is the width of the buckets.
+	Step uint64
+	// Unit names the values in Print, e.g. "msecs".
+	Unit string
+}
+
+// NewLinearHistogram returns a LinearHistogram for table, whose slot i
+// counts the values from i*step to (i+1)*step-1. A step of 0 is treated
+// as 1.
+func NewLinearHistogram(table *Table, step uint64, unit string) *LinearHistogram {
+	if step == 0 {
+		step = 1
+	}
+	return &LinearHistogram{table: table, Step: step, Unit: unit}
+}
+
+// Buckets returns the buckets of the histogram from the first to the
+// last non-empty one. The buckets of all secondary keys are added up.
+func (h *LinearHistogram) Buckets() ([]Bucket, error) {
+	slots, err := readHistSlots(h.table)
+	if err != nil {
+		return nil, err
+	}
+	return linearBuckets(slots.total(), h.Step), nil
+}
+
+// Sections returns the histograms of each secondary key, sorted by key.
+// Tables without a secondary key have a single section with an empty
+// key.
+func (h *LinearHistogram) Sections() ([]HistogramSection, error) {
+	slots, err := readHistSlots(h.table)
+	if err != nil {
+		return nil, err
+	}
+	var sections []HistogramSection
+	for _, key := range slots.keys() {
+		sections = append(sections, HistogramSection{
+			Key:     key,
+			Buckets: linearBuckets(slots.counts[key], h.Step),
+		})
+	}
+	return sections, nil
+}
+
+// Print writes the histogram as a bar chart like bcc's
+// print_linear_hist, leaving out the empty leading and trailing
+// buckets. Buckets wider than 1 are printed as ranges.
+func (h *LinearHistogram) Print(w io.Writer) error {
+	slots, err := readHistSlots(h.table)
+	if err != nil {
+		return err
+	}
+	return slots.print(w, func(w io.Writer, counts map[uint64]uint64) error {
+		return printLinearHist(w, h.Unit, counts, h.Step)
+	})
+}
+
+// linearBuckets returns the buckets of step wide slots from the first
+// to the last non-empty one.
+func linearBuckets(counts map[uint64]uint64, step uint64) []Bucket {
+	var idxMin, idxMax uint64
+	found := false
+	for i, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if !found || i < idxMin {
+			idxMin = i
+		}
+		if !found || i > idxMax {
+			idxMax = i
+		}
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	buckets := make([]Bucket, 0, idxMax-idxMin+1)
+	for i := idxMin; ; i++ {
+		buckets = append(buckets, Bucket{Low: i * step, High: (i+1)*step - 1, Count: counts[i]})
+		if i == idxMax {
+			break
+		}
+	}
+	return buckets
+}
+
+func printLinearHist(w io.Writer, unit string, counts map[uint64]uint64, step uint64) error {
+	buckets := linearBuckets(counts, step)
+	if len(buckets) == 0 {
+		return nil
+	}
+	if step > 1 {
+		return printBuckets(w, fmt.Sprintf("     %-19s : count     distribution\n", unit), "%10d -> %-10d : %-8d |%-*s|\n", starsMax, buckets)
+	}
+	var valMax uint64
+	for _, b := range buckets {
+		if b.Count > valMax {
+			valMax = b.Count
+		}
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "     %-13s : count     distribution\n", unit)
+	for _, b := range buckets {
+		fmt.Fprintf(&buf, "        %-10d : %-8d |%-*s|\n", b.Low, b.Count, starsMax, histStars(b.Count, valMax, starsMax))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// histSlots holds the slot counts of a histogram table per secondary
+// key.
+type histSlots struct {
+	// section is the name of the secondary key, empty if there is none.
+	section string
+	counts  map[string]map[uint64]uint64
+}
+
+func (s *histSlots) keys() []string {
+	keys := make([]string, 0, len(s.counts))
+	for k := range s.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *histSlots) total() map[uint64]uint64 {
+	total := make(map[uint64]uint64)
+	for _, counts := range s.counts {
+		for slot, c := range counts {
+			total[slot] += c
+		}
+	}
+	return total
+}
+
+// print prints the histogram of each secondary key with printHist,
+// preceded by a "<section> = <key>" line as in bcc.
+func (s *histSlots) print(w io.Writer, printHist func(io.Writer, map[uint64]uint64) error) error {
+	if s.section == "" {
+		return printHist(w, s.total())
+	}
+	for _, key := range s.keys() {
+		if _, err := fmt.Fprintf(w, "\n%s = %s\n", s.section, key); err != nil {
+			return err
+		}
+		if err := printHist(w, s.counts[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ctypeSizes are the sizes of the C integer types found in key
+// descriptions.
+var ctypeSizes = map[string]int{
+	"char":               1,
+	"signed char":        1,
+	"unsigned char":      1,
+	"_Bool":              1,
+	"short":              2,
+	"unsigned short":     2,
+	"int":                4,
+	"unsigned int":       4,
+	"long":               8,
+	"unsigned long":      8,
+	"long long":          8,
+	"unsigned long long": 8,
+}
+
+// histKeyLayout returns the name of the secondary key, a function
+// formatting it and the size of the slot for the key description of a
+// histogram table.
+func histKeyLayout(desc TableDesc) (section string, format func([]byte) string, slotSize int, err error) {
+	var keyDesc interface{}
+	if desc.KeyDesc != "" {
+		if err := json.Unmarshal([]byte(desc.KeyDesc), &keyDesc); err != nil {
+			return "", nil, 0, fmt.Errorf("invalid key description %q: %v", desc.KeyDesc, err)
+		}
+	}
+	// A struct is described as [name, [[field, type(, dims)], ...], kind].
+	st, ok := keyDesc.([]interface{})
+	if !ok || len(st) < 2 {
+		return "", nil, int(desc.KeySize), nil
+	}
+	fields, ok := st[1].([]interface{})
+	if !ok || len(fields) == 0 {
+		return "", nil, 0, fmt.Errorf("invalid key description %q", desc.KeyDesc)
+	}
+	fieldAt := func(i int) (name, typ string, array bool) {
+		f, _ := fields[i].([]interface{})
+		if len(f) > 0 {
+			name, _ = f[0].(string)
+		}
+		if len(f) > 1 {
+			typ, _ = f[1].(string)
+		}
+		return name, typ, len(f) > 2
+	}
+	_, slotType, _ := fieldAt(len(fields) - 1)
+	slotSize = ctypeSizes[slotType]
+	if slotSize == 0 {
+		return "", nil, 0, fmt.Errorf("unsupported slot type %q in key description %q", slotType, desc.KeyDesc)
+	}
+	if len(fields) == 1 {
+		return "", nil, slotSize, nil
+	}
+	var names []string
+	for i := 0; i < len(fields)-1; i++ {
+		name, _, _ := fieldAt(i)
+		names = append(names, name)
+	}
+	format = func(b []byte) string { return fmt.Sprintf("%x", b) }
+	if len(fields) == 2 {
+		_, typ, array := fieldAt(0)
+		switch size := ctypeSizes[typ]; {
+		case array && size == 1:
+			format = func(b []byte) string {
+				if i := bytes.IndexByte(b, 0); i >= 0 {
+					b = b[:i]
+				}
+				return string(b)
+			}
+		case !array && size > 0:
+			format = func(b []byte) string {
+				return strconv.FormatUint(sumValues([][]byte{b[:size]}), 10)
+			}
+		}
+	}
+	return strings.Join(names, ", "), format, slotSize, nil
+}
+
+// readHistSlots reads the slot counts of a histogram table.
+func readHistSlots(table *Table) (*histSlots, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opLookup); err != nil {
+		return nil, err
+	}
+	desc := table.Desc()
+	switch desc.LeafSize {
+	case 1, 2, 4, 8:
+	default:
+		return nil, fmt.Errorf("histogram table %s has a leaf size of %d bytes, expected an integer of 1, 2, 4 or 8 bytes", desc.Name, desc.LeafSize)
+	}
+	section, format, slotSize, err := histKeyLayout(desc)
+	if err != nil {
+		return nil, fmt.Errorf("histogram table %s: %v", desc.Name, err)
+	}
+	switch slotSize {
+	case 1, 2, 4, 8:
+	default:
+		return nil, fmt.Errorf("histogram table %s has a slot of %d bytes", desc.Name, slotSize)
+	}
+	if slotSize > int(desc.KeySize) {
+		return nil, fmt.Errorf("histogram table %s: slot larger than key", desc.Name)
+	}
+	cur, err := table.newCursor()
+	if err != nil {
+		return nil, err
+	}
+	slots := &histSlots{section: section, counts: make(map[string]map[uint64]uint64)}
+	for cur.next() {
+		slotOff := len(cur.key) - slotSize
+		slot := sumValues([][]byte{cur.key[slotOff:]})
+		var key string
+		if section != "" {
+			key = format(cur.key[:slotOff])
+		}
+		var count uint64
+		if desc.MapType.IsPerCPU() {
+			count = sumValues(table.splitPerCPU(cur.leaf))
+		} else {
+			count = sumValues([][]byte{cur.leaf[:desc.LeafSize]})
+		}
+		if slots.counts[key] == nil {
+			slots.counts[key] = make(map[uint64]uint64)
+		}
+		slots.counts[key][slot] += count
+	}
+	if cur.err != nil {
+		return nil, fmt.Errorf("histogram table %s: %w", desc.Name, cur.err)
+	}
+	return slots, nil
+}
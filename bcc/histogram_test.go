@@ -0,0 +1,126 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("output differs from %s:\n%s\nexpected:\n%s", path, got, want)
+	}
+}
+
+func TestPrintLog2Hist(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		counts map[uint64]uint64
+	}{
+		{"log2_hist", map[uint64]uint64{1: 3, 2: 10, 4: 25, 5: 7, 7: 1}},
+		{"log2_hist_wide", map[uint64]uint64{3: 2, 40: 8}},
+		{"log2_hist_empty", map[uint64]uint64{}},
+	} {
+		var buf bytes.Buffer
+		if err := printLog2Hist(&buf, "usecs", test.counts); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, test.name, buf.Bytes())
+	}
+}
+
+func TestPrintLog2HistSections(t *testing.T) {
+	slots := &histSlots{
+		section: "disk",
+		counts: map[string]map[uint64]uint64{
+			"sda":     {2: 4, 3: 6},
+			"nvme0n1": {1: 1, 5: 2},
+		},
+	}
+	var buf bytes.Buffer
+	err := slots.print(&buf, func(w io.Writer, counts map[uint64]uint64) error {
+		return printLog2Hist(w, "usecs", counts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "log2_hist_sections", buf.Bytes())
+}
+
+func TestPrintLinearHist(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		counts map[uint64]uint64
+		step   uint64
+	}{
+		{"linear_hist", map[uint64]uint64{3: 2, 4: 8, 6: 5}, 1},
+		{"linear_hist_step", map[uint64]uint64{0: 0, 2: 4, 3: 1, 5: 6, 9: 0}, 10},
+	} {
+		var buf bytes.Buffer
+		if err := printLinearHist(&buf, "msecs", test.counts, test.step); err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, test.name, buf.Bytes())
+	}
+}
+
+func TestLinearBuckets(t *testing.T) {
+	if buckets := linearBuckets(map[uint64]uint64{1: 0, 7: 0}, 5); buckets != nil {
+		t.Fatalf("expected no buckets, got %v", buckets)
+	}
+	buckets := linearBuckets(map[uint64]uint64{0: 0, 2: 1, 4: 3, 8: 0}, 5)
+	expected := []Bucket{{10, 14, 1}, {15, 19, 0}, {20, 24, 3}}
+	if len(buckets) != len(expected) {
+		t.Fatalf("unexpected buckets %v", buckets)
+	}
+	for i := range expected {
+		if buckets[i] != expected[i] {
+			t.Fatalf("bucket %d: got %+v, expected %+v", i, buckets[i], expected[i])
+		}
+	}
+}
+
+func TestLog2Buckets(t *testing.T) {
+	buckets := log2Buckets(map[uint64]uint64{1: 1, 3: 2, 64: 1})
+	if len(buckets) != 64 {
+		t.Fatalf("unexpected number of buckets %d", len(buckets))
+	}
+	for i, want := range []Bucket{{0, 1, 1}, {2, 3, 0}, {4, 7, 2}} {
+		if buckets[i] != want {
+			t.Fatalf("bucket %d: got %+v, expected %+v", i, buckets[i], want)
+		}
+	}
+	if last := buckets[63]; last.Low != 1<<63 || last.High != 1<<64-1 || last.Count != 1 {
+		t.Fatalf("unexpected last bucket %+v", last)
+	}
+}
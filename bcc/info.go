@@ -0,0 +1,117 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"encoding/hex"
+	"fmt"
+	"unsafe"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <stdlib.h>
+#include <bcc/bpf_common.h>
+#include <bcc/libbpf.h>
+*/
+import "C"
+
+// ProgInfo is the kernel's view of a loaded program.
+type ProgInfo struct {
+	ID   uint32
+	Type ProgramType
+	// Name is the name of the program, truncated to 15 bytes.
+	Name string
+	// Tag is the hex encoded hash of the program instructions.
+	Tag string
+	// InsnCount is the number of instructions of the program after
+	// the verifier rewrote them.
+	InsnCount int
+	// JitedSize is the size in bytes of the JIT compiled program, 0 if
+	// it's not compiled.
+	JitedSize uint32
+	// MapIDs are the ids of the maps used by the program.
+	MapIDs []uint32
+}
+
+// MapInfo is the kernel's view of a map.
+type MapInfo struct {
+	ID         uint32
+	Type       MapType
+	Name       string
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+	Flags      uint32
+}
+
+// GetProgInfo returns information about the program fd with
+// BPF_OBJ_GET_INFO_BY_FD (Linux 4.13).
+func GetProgInfo(fd int) (ProgInfo, error) {
+	var info C.struct_bpf_prog_info
+	infoLen := C.uint32_t(unsafe.Sizeof(info))
+	if r, err := C.bpf_obj_get_info(C.int(fd), unsafe.Pointer(&info), &infoLen); r != 0 {
+		return ProgInfo{}, fmt.Errorf("unable to get program info: %v", err)
+	}
+	p := ProgInfo{
+		ID:        uint32(info.id),
+		Type:      ProgramType(info._type),
+		Name:      C.GoString(&info.name[0]),
+		Tag:       hex.EncodeToString(C.GoBytes(unsafe.Pointer(&info.tag[0]), C.int(len(info.tag)))),
+		InsnCount: int(info.xlated_prog_len) / 8,
+		JitedSize: uint32(info.jited_prog_len),
+	}
+	if n := info.nr_map_ids; n > 0 {
+		// Query again with a buffer for the map ids.
+		ids := C.malloc(C.size_t(n) * 4)
+		defer C.free(ids)
+		info = C.struct_bpf_prog_info{}
+		info.nr_map_ids = n
+		info.map_ids = C.__u64(uintptr(ids))
+		infoLen = C.uint32_t(unsafe.Sizeof(info))
+		if r, err := C.bpf_obj_get_info(C.int(fd), unsafe.Pointer(&info), &infoLen); r != 0 {
+			return ProgInfo{}, fmt.Errorf("unable to get program map ids: %v", err)
+		}
+		if info.nr_map_ids < n {
+			// Maps can't be added to a loaded program, but
+			// better safe than sorry.
+			n = info.nr_map_ids
+		}
+		for _, id := range unsafe.Slice((*C.__u32)(ids), int(n)) {
+			p.MapIDs = append(p.MapIDs, uint32(id))
+		}
+	}
+	return p, nil
+}
+
+// GetMapInfo returns information about the map fd with
+// BPF_OBJ_GET_INFO_BY_FD (Linux 4.13).
+func GetMapInfo(fd int) (MapInfo, error) {
+	var info C.struct_bpf_map_info
+	infoLen := C.uint32_t(unsafe.Sizeof(info))
+	if r, err := C.bpf_obj_get_info(C.int(fd), unsafe.Pointer(&info), &infoLen); r != 0 {
+		return MapInfo{}, fmt.Errorf("unable to get map info: %v", err)
+	}
+	return MapInfo{
+		ID:         uint32(info.id),
+		Type:       MapType(info._type),
+		Name:       C.GoString(&info.name[0]),
+		KeySize:    uint32(info.key_size),
+		ValueSize:  uint32(info.value_size),
+		MaxEntries: uint32(info.max_entries),
+		Flags:      uint32(info.map_flags),
+	}, nil
+}
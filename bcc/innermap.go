@@ -0,0 +1,111 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <bcc/bpf_common.h>
+#include <bcc/libbpf.h>
+*/
+import "C"
+
+// checkMapOfMaps returns ErrOperationNotSupported unless the table is
+// a hash or array of maps.
+func (table *Table) checkMapOfMaps(op string) error {
+	if err := table.checkModule(); err != nil {
+		return err
+	}
+	switch mt := table.Type(); mt {
+	case MapTypeHashOfMaps, MapTypeArrayOfMaps:
+		return nil
+	default:
+		return fmt.Errorf("Table.%s on %v table %s: %w", op, mt, table.Name(), ErrOperationNotSupported)
+	}
+}
+
+// SetInnerMap stores inner at key in a hash or array of maps. The
+// inner map must be compatible with the inner map template the outer
+// map was created with. Replacing the inner map of a key is atomic for
+// the BPF programs using the outer map.
+func (table *Table) SetInnerMap(key []byte, inner *Table) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkMapOfMaps("SetInnerMap"); err != nil {
+		return err
+	}
+	if err := inner.rlock(); err != nil {
+		return err
+	}
+	defer inner.runlock()
+	if err := inner.checkModule(); err != nil {
+		return err
+	}
+	leaf := make([]byte, 4)
+	byteOrder.PutUint32(leaf, uint32(inner.Desc().FD))
+	return table.SetBytes(key, leaf)
+}
+
+// GetInnerMap returns the inner map stored at key in a hash or array
+// of maps. The map is opened by id, which requires Linux 4.13. The
+// returned table is not backed by a module (see NewTableFromPinned)
+// and must be closed with Close.
+func (table *Table) GetInnerMap(key []byte) (*Table, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkMapOfMaps("GetInnerMap"); err != nil {
+		return nil, err
+	}
+	desc := table.Desc()
+	if len(key) != int(desc.KeySize) {
+		return nil, fmt.Errorf("Table.GetInnerMap: key size mismatch for table %s: got %d bytes, expected %d", desc.Name, len(key), desc.KeySize)
+	}
+	// User space lookups in maps of maps return the id of the inner map.
+	leaf := make([]byte, 4)
+	r, err := C.bpf_lookup_elem(C.int(desc.FD), unsafe.Pointer(&key[0]), unsafe.Pointer(&leaf[0]))
+	if r != 0 {
+		switch err {
+		case syscall.ENOENT:
+			return nil, fmt.Errorf("Table.GetInnerMap: %x: %w", key, ErrKeyNotFound)
+		case syscall.ENOTSUP, errnoENOTSUPP:
+			return nil, fmt.Errorf("Table.GetInnerMap: lookup in %s: %w", desc.Name, ErrNotSupported)
+		}
+		return nil, fmt.Errorf("Table.GetInnerMap: unable to lookup element (%x): %w", key, mapErrno(err))
+	}
+	id := byteOrder.Uint32(leaf)
+	fd, err := mapGetFDByID(id)
+	if err != nil {
+		if err == syscall.EINVAL {
+			return nil, fmt.Errorf("Table.GetInnerMap: opening map by id: %w", ErrNotSupported)
+		}
+		return nil, fmt.Errorf("Table.GetInnerMap: unable to open map id %d: %v", id, err)
+	}
+	inner, err := newTableFromFD(fd, fmt.Sprintf("%s[%x]", desc.Name, key))
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Table.GetInnerMap: %v", err)
+	}
+	return inner, nil
+}
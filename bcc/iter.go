@@ -0,0 +1,111 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// iterFuncPrefix is the prefix of the functions declared with the
+// BPF_ITER(target) macro of bcc, e.g. bpf_iter__task.
+const iterFuncPrefix = "bpf_iter__"
+
+// iterSupported reports whether the kernel has BPF iterators (Linux
+// 5.8), looking for the bpf_map iterator in its BTF.
+func iterSupported() bool {
+	_, err := kernelBTFFuncID("bpf_iter_bpf_map")
+	return err == nil
+}
+
+// LoadIter loads the function name, declared with BPF_ITER(target)
+// e.g. BPF_ITER(task) for bpf_iter__task, as an iterator program of
+// the kernel objects target, and returns its fd. It returns an error
+// wrapping ErrNotSupported if the kernel lacks BTF or iterators (Linux
+// 5.8), and ErrSymbolNotFound if it has no such target.
+func (bpf *Module) LoadIter(name string) (int, error) {
+	target := strings.TrimPrefix(name, iterFuncPrefix)
+	if target == name || target == "" {
+		return -1, fmt.Errorf("function %s is not declared with BPF_ITER", name)
+	}
+	fd, err := bpf.loadTracing(name, "bpf_iter_"+target, attachTraceIter)
+	if errors.Is(err, ErrSymbolNotFound) && !iterSupported() {
+		return -1, fmt.Errorf("error loading BPF iterator %s: %w", name, ErrNotSupported)
+	}
+	return fd, err
+}
+
+// AttachIter attaches an iterator fd loaded with LoadIter and returns
+// the fd of the link, to be read with OpenIter. It can be attached
+// more than once. Close detaches it.
+func (bpf *Module) AttachIter(fd int) (int, error) {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return -1, ErrModuleClosed
+	}
+	linkFD, err := linkCreate(fd, 0, attachTraceIter)
+	if err != nil {
+		if err == syscall.EINVAL {
+			// Also returned by kernels not knowing the command.
+			return -1, fmt.Errorf("failed to attach BPF iterator: %v: %w", err, ErrNotSupported)
+		}
+		return -1, fmt.Errorf("failed to attach BPF iterator: %v", err)
+	}
+	bpf.iterLinks[linkFD] = true
+	bpf.recordAttachment(AttachmentIter, strconv.Itoa(linkFD), bpf.funcName(fd), fd)
+	return linkFD, nil
+}
+
+// DetachIter detaches the iterator link linkFD returned by AttachIter.
+// Readers already opened with OpenIter keep working.
+func (bpf *Module) DetachIter(linkFD int) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	if !bpf.iterLinks[linkFD] {
+		return fmt.Errorf("no iterator attached with link fd %d", linkFD)
+	}
+	delete(bpf.iterLinks, linkFD)
+	bpf.forgetAttachment(AttachmentIter, strconv.Itoa(linkFD))
+	return syscall.Close(linkFD)
+}
+
+// OpenIter returns a reader of the output of the iterator link linkFD
+// returned by AttachIter. Each reader runs the iterator program from
+// the start over the kernel objects as it's read, until EOF. It must be
+// closed by the caller.
+func (bpf *Module) OpenIter(linkFD int) (io.ReadCloser, error) {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return nil, ErrModuleClosed
+	}
+	if !bpf.iterLinks[linkFD] {
+		return nil, fmt.Errorf("no iterator attached with link fd %d", linkFD)
+	}
+	fd, err := iterCreate(linkFD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open BPF iterator: %v", err)
+	}
+	return os.NewFile(uintptr(fd), "bpf_iter"), nil
+}
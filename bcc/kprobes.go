@@ -0,0 +1,224 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// tracingDirs are the usual tracefs mount points, the one under
+// debugfs first as in bcc.
+var tracingDirs = []string{"/sys/kernel/debug/tracing", "/sys/kernel/tracing"}
+
+// tracingDir returns the first of tracingDirs where tracefs is mounted,
+// or the first one if none is.
+func tracingDir() string {
+	for _, dir := range tracingDirs {
+		if _, err := os.Stat(filepath.Join(dir, "events")); err == nil {
+			return dir
+		}
+	}
+	return tracingDirs[0]
+}
+
+// DefaultMaxKprobesMatching is the maximum number of functions
+// AttachKprobesMatching attaches to unless told otherwise.
+const DefaultMaxKprobesMatching = 1000
+
+// kprobeSkipRegexp matches functions that are not worth probing, as in
+// bcc: compiler generated cold parts, and perf functions that probing
+// would recurse into.
+var kprobeSkipRegexp = regexp.MustCompile(`\.cold(\.\d+)?$|^_kbl_addr_|^__perf|^perf_`)
+
+// matchFilterFunctions returns the functions matching re in r, in the
+// format of available_filter_functions, deduplicated and skipping
+// those not worth probing.
+func matchFilterFunctions(r io.Reader, re *regexp.Regexp) ([]string, error) {
+	var fns []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// vfs_read
+		// foo_init [foo]
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		fn := fields[0]
+		if seen[fn] || !re.MatchString(fn) || kprobeSkipRegexp.MatchString(fn) {
+			continue
+		}
+		seen[fn] = true
+		fns = append(fns, fn)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return fns, nil
+}
+
+// AttachKprobesMatching attaches a kprobe fd to the kernel functions
+// matching the regular expression pattern, e.g. "^tcp_", and returns
+// those attached. Functions that can't be probed are skipped. It fails
+// without attaching any probe if more than maxFuncs functions match, or
+// DefaultMaxKprobesMatching if maxFuncs is 0. Use DetachKprobes to
+// detach them.
+func (bpf *Module) AttachKprobesMatching(pattern string, fd int, maxFuncs int) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if maxFuncs <= 0 {
+		maxFuncs = DefaultMaxKprobesMatching
+	}
+	path := filepath.Join(tracingDir(), "available_filter_functions")
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fns, err := matchFilterFunctions(f, re)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	if len(fns) > maxFuncs {
+		return nil, fmt.Errorf("%d functions match %q, more than %d", len(fns), pattern, maxFuncs)
+	}
+	var attached []string
+	for _, fn := range fns {
+		if err := bpf.AttachKprobe(fn, fd, 0); err != nil {
+			if err == ErrModuleClosed {
+				return attached, err
+			}
+			continue
+		}
+		attached = append(attached, fn)
+	}
+	if len(attached) == 0 {
+		return nil, fmt.Errorf("no kprobe attached to the %d functions matching %q", len(fns), pattern)
+	}
+	return attached, nil
+}
+
+// DetachKprobes detaches the kprobes and kretprobes attached to the
+// functions fnNames, e.g. returned by AttachKprobesMatching. It returns
+// the first error but detaches all the probes it can.
+func (bpf *Module) DetachKprobes(fnNames []string) error {
+	var firstErr error
+	for _, fn := range fnNames {
+		if err := bpf.DetachKprobe(fn); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// kprobeProfileMisses returns the sum of the missed counts in r, in the
+// format of kprobe_profile, of the events created by bcc for evNames.
+func kprobeProfileMisses(r io.Reader, evNames []string) (uint64, bool, error) {
+	var (
+		missed uint64
+		found  bool
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// event                                  hits     missed
+		//   r_vfs_read_bcc_1234                   42          3
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		var match bool
+		for _, evName := range evNames {
+			if fields[0] == evName || isBCCEvent(fields[0], evName) {
+				match = true
+			}
+		}
+		if !match {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid missed count in %q: %v", scanner.Text(), err)
+		}
+		missed += n
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, false, err
+	}
+	return missed, found, nil
+}
+
+// isBCCEvent reports whether name is the name bcc gives to the event
+// evName it creates: evName_bcc_<pid>.
+func isBCCEvent(name, evName string) bool {
+	pid := strings.TrimPrefix(name, evName+"_bcc_")
+	if pid == name || pid == "" {
+		return false
+	}
+	_, err := strconv.ParseUint(pid, 10, 32)
+	return err == nil
+}
+
+// KprobeMissCount returns the number of times the kprobe and kretprobe
+// attached to fnName through the module missed, according to
+// kprobe_profile. Kretprobes miss returns when more than their
+// maxActive instances of the function run at the same time, see
+// AttachKretprobe. It returns an error wrapping ErrNotSupported if the
+// probes aren't listed, which is the case when the kernel creates them
+// with the kprobe perf PMU (Linux 4.17) rather than through
+// kprobe_events, bcc doing the latter with a non-zero maxActive.
+func (bpf *Module) KprobeMissCount(fnName string) (uint64, error) {
+	bpf.mu.Lock()
+	var evNames []string
+	if bpf.p != nil {
+		entry, ret := kprobeEventNames(fnName)
+		for _, evName := range []string{entry, ret} {
+			if _, ok := bpf.kprobes[evName]; ok {
+				evNames = append(evNames, evName)
+			}
+		}
+	}
+	closed := bpf.p == nil
+	bpf.mu.Unlock()
+	if closed {
+		return 0, ErrModuleClosed
+	}
+	if len(evNames) == 0 {
+		return 0, fmt.Errorf("no kprobe attached to %s", fnName)
+	}
+	path := filepath.Join(tracingDir(), "kprobe_profile")
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	missed, found, err := kprobeProfileMisses(f, evNames)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	if !found {
+		return 0, fmt.Errorf("kprobes of %s not in %s: %w", fnName, path, ErrNotSupported)
+	}
+	return missed, nil
+}
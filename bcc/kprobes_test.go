@@ -0,0 +1,61 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const testFilterFunctions = `tcp_v4_connect
+tcp_sendmsg
+tcp_sendmsg.cold
+udp_sendmsg
+perf_tcp_hook
+tcp_sendmsg
+tcp_foo_init [tcp_foo]
+`
+
+func TestMatchFilterFunctions(t *testing.T) {
+	fns, err := matchFilterFunctions(strings.NewReader(testFilterFunctions), regexp.MustCompile("^tcp_"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"tcp_v4_connect", "tcp_sendmsg", "tcp_foo_init"}
+	if !reflect.DeepEqual(fns, expected) {
+		t.Fatalf("expected %v, got %v", expected, fns)
+	}
+}
+
+const testKprobeProfile = `  p_vfs_read_bcc_1234                                     100               0
+  r_vfs_read_bcc_1234                                      90              10
+  r_vfs_write_bcc_1234                                     50               7
+  r_vfs_read_bcc_1234_foo                                   1               1
+`
+
+func TestKprobeProfileMisses(t *testing.T) {
+	missed, found, err := kprobeProfileMisses(strings.NewReader(testKprobeProfile), []string{"p_vfs_read", "r_vfs_read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || missed != 10 {
+		t.Fatalf("expected 10 misses, got %d (found %v)", missed, found)
+	}
+	if _, found, _ := kprobeProfileMisses(strings.NewReader(testKprobeProfile), []string{"r_vfs_open"}); found {
+		t.Fatal("expected no match for r_vfs_open")
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const kallsymsPath = "/proc/kallsyms"
+
+// ErrKernelModuleNotLoaded is returned when looking up a symbol of a
+// kernel module that isn't loaded.
+var ErrKernelModuleNotLoaded = errors.New("kernel module not loaded")
+
+// ksymRefreshInterval is the minimum interval between reloads of the
+// symbols on lookup misses.
+const ksymRefreshInterval = time.Second
+
+type ksym struct {
+	addr   uint64
+	name   string
+	module string
+}
+
+// KSymCache resolves kernel addresses to symbols and back with the
+// symbols of /proc/kallsyms. They are loaded on first use and reloaded
+// when a lookup misses, modules being loaded at runtime. A KSymCache
+// is safe for concurrent use.
+type KSymCache struct {
+	mu       sync.Mutex
+	path     string
+	syms     []ksym            // sorted by address
+	byName   map[string]uint64 // by name and "module:name"
+	modules  map[string]bool
+	loadedAt time.Time
+}
+
+// kernelSymbols is the cache used when none is given.
+var kernelSymbols KSymCache
+
+// NewKSymCache returns an empty KSymCache.
+func NewKSymCache() *KSymCache {
+	return &KSymCache{}
+}
+
+// Resolve returns the name of the kernel symbol containing addr, the
+// offset of addr into it and the module defining it, empty for the
+// kernel itself. It returns an empty name if the address isn't
+// resolved.
+func (c *KSymCache) Resolve(addr uint64) (name string, offset uint64, module string) {
+	sym, ok, err := c.resolve(addr)
+	if err != nil || !ok {
+		return "", 0, ""
+	}
+	return sym.name, addr - sym.addr, sym.module
+}
+
+// ReverseResolve returns the address of the kernel symbol name, which
+// may be given as "module:name" for a symbol of a kernel module. It
+// returns an error wrapping ErrKernelModuleNotLoaded if the module
+// isn't loaded, and ErrSymbolNotFound if there is no such symbol.
+func (c *KSymCache) ReverseResolve(name string) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fresh, err := c.ensureLoaded()
+	if err != nil {
+		return 0, err
+	}
+	addr, ok := c.byName[name]
+	if !ok && !fresh && c.refreshable() {
+		if err := c.load(); err != nil {
+			return 0, err
+		}
+		addr, ok = c.byName[name]
+	}
+	if !ok {
+		if i := strings.IndexByte(name, ':'); i >= 0 && !c.modules[name[:i]] {
+			return 0, fmt.Errorf("kernel symbol %s: %w", name, ErrKernelModuleNotLoaded)
+		}
+		return 0, fmt.Errorf("kernel symbol %s: %w", name, ErrSymbolNotFound)
+	}
+	return addr, nil
+}
+
+// WaitForSymbol waits for the kernel symbol name, e.g.
+// "nf_conntrack:nf_conntrack_in", to appear, as when its module is
+// loaded, and returns its address. It polls the symbols and returns
+// when found or ctx is done.
+func (c *KSymCache) WaitForSymbol(ctx context.Context, name string) (uint64, error) {
+	ticker := time.NewTicker(ksymRefreshInterval)
+	defer ticker.Stop()
+	for {
+		addr, err := c.ReverseResolve(name)
+		if err == nil || !errors.Is(err, ErrSymbolNotFound) && !errors.Is(err, ErrKernelModuleNotLoaded) {
+			return addr, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("waiting for kernel symbol %s: %w", name, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForSymbol waits for the kernel symbol name to appear in
+// /proc/kallsyms, see KSymCache.WaitForSymbol.
+func WaitForSymbol(ctx context.Context, name string) (uint64, error) {
+	return kernelSymbols.WaitForSymbol(ctx, name)
+}
+
+// resolve returns the symbol containing addr.
+func (c *KSymCache) resolve(addr uint64) (ksym, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fresh, err := c.ensureLoaded()
+	if err != nil {
+		return ksym{}, false, err
+	}
+	search := func() int {
+		return sort.Search(len(c.syms), func(i int) bool {
+			return c.syms[i].addr > addr
+		})
+	}
+	i := search()
+	// Past the last symbol, addr may be in a module loaded since.
+	if (i == 0 || i == len(c.syms)) && !fresh && c.refreshable() {
+		if err := c.load(); err != nil {
+			return ksym{}, false, err
+		}
+		i = search()
+	}
+	if i == 0 {
+		return ksym{}, false, nil
+	}
+	return c.syms[i-1], true, nil
+}
+
+// ensureLoaded loads the symbols on first use, reporting whether it
+// did.
+func (c *KSymCache) ensureLoaded() (bool, error) {
+	if c.syms != nil {
+		return false, nil
+	}
+	return true, c.load()
+}
+
+// refreshable reports whether the symbols may be reloaded after a
+// miss. Reloads are rate limited as misses are common, e.g. for user
+// space addresses.
+func (c *KSymCache) refreshable() bool {
+	return time.Since(c.loadedAt) >= ksymRefreshInterval
+}
+
+func (c *KSymCache) load() error {
+	path := c.path
+	if path == "" {
+		path = kallsymsPath
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	syms, err := parseKallsyms(f)
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	byName := make(map[string]uint64, len(syms))
+	modules := make(map[string]bool)
+	for _, sym := range syms {
+		if _, ok := byName[sym.name]; !ok {
+			byName[sym.name] = sym.addr
+		}
+		if sym.module != "" {
+			modules[sym.module] = true
+			modName := sym.module + ":" + sym.name
+			if _, ok := byName[modName]; !ok {
+				byName[modName] = sym.addr
+			}
+		}
+	}
+	c.syms, c.byName, c.modules = syms, byName, modules
+	c.loadedAt = time.Now()
+	return nil
+}
+
+// parseKallsyms parses symbols in the format of /proc/kallsyms and
+// returns them sorted by address. Symbols with a zero address are
+// skipped, the kernel hides all addresses that way under kptr_restrict.
+func parseKallsyms(r io.Reader) ([]ksym, error) {
+	var syms []ksym
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// ffffffff81000000 T _text
+		// ffffffffc0a01000 t foo	[mod]
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address in %q: %v", scanner.Text(), err)
+		}
+		if addr == 0 {
+			continue
+		}
+		sym := ksym{addr: addr, name: fields[2]}
+		if len(fields) > 3 {
+			sym.module = strings.Trim(fields[3], "[]")
+		}
+		syms = append(syms, sym)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(syms) == 0 {
+		return nil, errors.New("no symbol addresses, check kernel.kptr_restrict")
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		return syms[i].addr < syms[j].addr
+	})
+	return syms, nil
+}
+
+// checkModuleSymbol checks that the kernel module of fnName, if given
+// as "module:function", is loaded and has the function, for a helpful
+// error before attaching a kprobe. Failures to read the symbols are
+// left to the kernel to report.
+func checkModuleSymbol(fnName string) error {
+	if !strings.Contains(fnName, ":") {
+		return nil
+	}
+	_, err := kernelSymbols.ReverseResolve(fnName)
+	if errors.Is(err, ErrKernelModuleNotLoaded) {
+		return fmt.Errorf("failed to attach BPF kprobe: %w, load it or wait for it with WaitForSymbol", err)
+	}
+	if errors.Is(err, ErrSymbolNotFound) {
+		return fmt.Errorf("failed to attach BPF kprobe: %w", err)
+	}
+	return nil
+}
+
+// syscallPrefixes are the prefixes of the syscall functions of the
+// kernels, depending on the version and architecture, as in bcc.
+var syscallPrefixes = []string{
+	"sys_",
+	"__x64_sys_",
+	"__x32_compat_sys_",
+	"__ia32_compat_sys_",
+	"__arm64_sys_",
+	"__s390x_sys_",
+	"__s390_sys_",
+}
+
+var syscallPrefix struct {
+	once   sync.Once
+	prefix string
+}
+
+// findSyscallPrefix returns the prefix of the syscall functions in the
+// symbols of c, "sys_" if none is found.
+func findSyscallPrefix(c *KSymCache) string {
+	for _, prefix := range syscallPrefixes {
+		if _, err := c.ReverseResolve(prefix + "bpf"); err == nil {
+			return prefix
+		}
+	}
+	return syscallPrefixes[0]
+}
+
+// GetSyscallFnName returns the name of the kernel function of the
+// syscall name, e.g. "__x64_sys_clone" for "clone" on x86_64 since
+// Linux 4.17, for kprobes. The prefix is looked up in /proc/kallsyms
+// once.
+func (bpf *Module) GetSyscallFnName(name string) string {
+	syscallPrefix.once.Do(func() {
+		syscallPrefix.prefix = findSyscallPrefix(&kernelSymbols)
+	})
+	return syscallPrefix.prefix + strings.TrimPrefix(name, "sys_")
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testKallsyms = `ffffffff81000000 T _text
+ffffffff81000100 T do_one
+ffffffff81000200 t do_two
+ffffffffc0001000 t mod_fn	[mod1]
+`
+
+func TestKSymCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kallsyms")
+	if err := ioutil.WriteFile(path, []byte(testKallsyms), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &KSymCache{path: path}
+
+	for _, tt := range []struct {
+		addr   uint64
+		name   string
+		offset uint64
+		module string
+	}{
+		{0xffffffff81000100, "do_one", 0, ""},
+		{0xffffffff81000180, "do_one", 0x80, ""},
+		{0xffffffff81000200, "do_two", 0, ""},
+		{0xffffffffc0001010, "mod_fn", 0x10, "mod1"},
+		{0x1000, "", 0, ""},
+	} {
+		name, offset, module := c.Resolve(tt.addr)
+		if name != tt.name || offset != tt.offset || module != tt.module {
+			t.Errorf("Resolve(%x) = %q, %x, %q, expected %q, %x, %q", tt.addr, name, offset, module, tt.name, tt.offset, tt.module)
+		}
+	}
+
+	addr, err := c.ReverseResolve("do_two")
+	if err != nil || addr != 0xffffffff81000200 {
+		t.Fatalf("ReverseResolve(do_two) = %x, %v", addr, err)
+	}
+	if _, err := c.ReverseResolve("mod2_fn"); !errors.Is(err, ErrSymbolNotFound) {
+		t.Fatalf("expected ErrSymbolNotFound, got %v", err)
+	}
+
+	// Load a module and let the cache be refreshed on the next miss.
+	if err := ioutil.WriteFile(path, []byte(testKallsyms+"ffffffffc0002000 t mod2_fn\t[mod2]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.loadedAt = time.Time{}
+	if name, _, module := c.Resolve(0xffffffffc0002004); name != "mod2_fn" || module != "mod2" {
+		t.Fatalf("expected mod2_fn [mod2] after refresh, got %s [%s]", name, module)
+	}
+	c.loadedAt = time.Time{}
+	if addr, err := c.ReverseResolve("mod2_fn"); err != nil || addr != 0xffffffffc0002000 {
+		t.Fatalf("ReverseResolve(mod2_fn) = %x, %v", addr, err)
+	}
+}
+
+func TestKSymCacheModuleSymbols(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kallsyms")
+	if err := ioutil.WriteFile(path, []byte(testKallsyms), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &KSymCache{path: path}
+
+	if addr, err := c.ReverseResolve("mod1:mod_fn"); err != nil || addr != 0xffffffffc0001000 {
+		t.Fatalf("ReverseResolve(mod1:mod_fn) = %x, %v", addr, err)
+	}
+	if _, err := c.ReverseResolve("mod1:do_one"); !errors.Is(err, ErrSymbolNotFound) {
+		t.Fatalf("expected ErrSymbolNotFound, got %v", err)
+	}
+	if _, err := c.ReverseResolve("mod2:mod2_fn"); !errors.Is(err, ErrKernelModuleNotLoaded) {
+		t.Fatalf("expected ErrKernelModuleNotLoaded, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.WaitForSymbol(ctx, "mod2:mod2_fn"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Load the module while waiting.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ioutil.WriteFile(path, []byte(testKallsyms+"ffffffffc0002000 t mod2_fn\t[mod2]\n"), 0644)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if addr, err := c.WaitForSymbol(ctx, "mod2:mod2_fn"); err != nil || addr != 0xffffffffc0002000 {
+		t.Fatalf("WaitForSymbol(mod2:mod2_fn) = %x, %v", addr, err)
+	}
+}
+
+func TestFindSyscallPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksym")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kallsyms")
+	for _, prefix := range syscallPrefixes {
+		kallsyms := testKallsyms + "ffffffff81001000 T " + prefix + "bpf\n"
+		if err := ioutil.WriteFile(path, []byte(kallsyms), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if p := findSyscallPrefix(&KSymCache{path: path}); p != prefix {
+			t.Errorf("expected prefix %s, got %s", prefix, p)
+		}
+	}
+	if err := ioutil.WriteFile(path, []byte(testKallsyms), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if p := findSyscallPrefix(&KSymCache{path: path}); p != "sys_" {
+		t.Errorf("expected default prefix sys_, got %s", p)
+	}
+}
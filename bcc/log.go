@@ -0,0 +1,62 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import "sync/atomic"
+
+// Logger receives the warnings and debug messages of the package, e.g.
+// a *log.Logger. Messages start with "bcc: warning: " or
+// "bcc: debug: ".
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{}) {}
+
+// logger is the Logger set with SetLogger, boxed so that it can be
+// stored atomically.
+var logger atomic.Value
+
+func init() {
+	logger.Store(loggerBox{nopLogger{}})
+}
+
+type loggerBox struct {
+	Logger
+}
+
+// SetLogger sets the logger of the package, or discards the messages
+// if l is nil, the default. Messages report what the package otherwise
+// handles silently: entries skipped while iterating over tables,
+// iterations stopped by errors on channels, attachments and detach
+// failures, and compiler warnings. The compiler output of modules
+// created with debug flags, e.g. by NewModule, is logged as debug
+// messages.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	logger.Store(loggerBox{l})
+}
+
+func warnf(format string, v ...interface{}) {
+	logger.Load().(loggerBox).Printf("bcc: warning: "+format, v...)
+}
+
+func debugf(format string, v ...interface{}) {
+	logger.Load().(loggerBox).Printf("bcc: debug: "+format, v...)
+}
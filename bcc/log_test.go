@@ -0,0 +1,43 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"testing"
+)
+
+type recordLogger []string
+
+func (l *recordLogger) Printf(format string, v ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestSetLogger(t *testing.T) {
+	var l recordLogger
+	SetLogger(&l)
+	defer SetLogger(nil)
+	warnf("table %s: %v", "foo", 42)
+	debugf("bar")
+	want := []string{"bcc: warning: table foo: 42", "bcc: debug: bar"}
+	if fmt.Sprint(l) != fmt.Sprint(want) {
+		t.Fatalf("logged %q, want %q", l, want)
+	}
+	SetLogger(nil)
+	warnf("discarded")
+	if len(l) != 2 {
+		t.Fatalf("expected no message after SetLogger(nil), got %q", l[2:])
+	}
+}
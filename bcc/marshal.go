@@ -0,0 +1,246 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// BinaryKey is implemented by key types that encode themselves to the
+// raw bytes of a table key, e.g. because they hold fields that
+// encoding/binary can't express. The encoded key must still be exactly
+// key_size bytes.
+type BinaryKey interface {
+	MarshalBPF() ([]byte, error)
+	UnmarshalBPF([]byte) error
+}
+
+// BinaryValue is like BinaryKey, for values.
+type BinaryValue interface {
+	MarshalBPF() ([]byte, error)
+	UnmarshalBPF([]byte) error
+}
+
+type bpfMarshaler interface {
+	MarshalBPF() ([]byte, error)
+}
+
+type bpfUnmarshaler interface {
+	UnmarshalBPF([]byte) error
+}
+
+// marshalBPF encodes v with its MarshalBPF method if it has one, like
+// encoding/binary otherwise (see encodeBinary). v should be a pointer,
+// so that methods with pointer receivers are found.
+func marshalBPF(v interface{}, order binary.ByteOrder) ([]byte, error) {
+	if m, ok := v.(bpfMarshaler); ok {
+		return m.MarshalBPF()
+	}
+	return encodeBinary(v, order)
+}
+
+// unmarshalBPF decodes b into the pointer v with its UnmarshalBPF
+// method if it has one, like encoding/binary otherwise.
+func unmarshalBPF(b []byte, v interface{}, order binary.ByteOrder) error {
+	if u, ok := v.(bpfUnmarshaler); ok {
+		return u.UnmarshalBPF(b)
+	}
+	return decodeBinary(b, v, order)
+}
+
+// bigEndianTag marks struct fields stored in network byte order, like
+// __be16 and __be32 fields on the C side:
+//
+//	type flow struct {
+//		Addr uint32 `bpf:"be"`
+//		Port uint16 `bpf:"be"`
+//		Pad  uint16
+//	}
+const bigEndianTag = "be"
+
+// fieldOrder returns the byte order of the struct field f.
+func fieldOrder(f reflect.StructField, order binary.ByteOrder) binary.ByteOrder {
+	if f.Tag.Get("bpf") == bigEndianTag {
+		return binary.BigEndian
+	}
+	return order
+}
+
+// encodeBinary encodes v like binary.Write, except that struct fields
+// tagged `bpf:"be"` are encoded in big endian byte order.
+func encodeBinary(v interface{}, order binary.ByteOrder) ([]byte, error) {
+	size := binary.Size(v)
+	if size < 0 {
+		return nil, fmt.Errorf("cannot encode %T: not a fixed size type", v)
+	}
+	return appendBinary(make([]byte, 0, size), reflect.Indirect(reflect.ValueOf(v)), order)
+}
+
+func appendBinary(b []byte, v reflect.Value, order binary.ByteOrder) ([]byte, error) {
+	var tmp [8]byte
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case reflect.Int8, reflect.Uint8:
+		return append(b, byte(intBits(v))), nil
+	case reflect.Int16, reflect.Uint16:
+		order.PutUint16(tmp[:], uint16(intBits(v)))
+		return append(b, tmp[:2]...), nil
+	case reflect.Int32, reflect.Uint32:
+		order.PutUint32(tmp[:], uint32(intBits(v)))
+		return append(b, tmp[:4]...), nil
+	case reflect.Int64, reflect.Uint64:
+		order.PutUint64(tmp[:], intBits(v))
+		return append(b, tmp[:8]...), nil
+	case reflect.Float32:
+		order.PutUint32(tmp[:], math.Float32bits(float32(v.Float())))
+		return append(b, tmp[:4]...), nil
+	case reflect.Float64:
+		order.PutUint64(tmp[:], math.Float64bits(v.Float()))
+		return append(b, tmp[:8]...), nil
+	case reflect.Array:
+		var err error
+		for i := 0; i < v.Len(); i++ {
+			if b, err = appendBinary(b, v.Index(i), order); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Struct:
+		t := v.Type()
+		var err error
+		for i := 0; i < v.NumField(); i++ {
+			f := t.Field(i)
+			fv := v.Field(i)
+			if f.Name == "_" {
+				// Blank fields are padding, encoded as zeroes.
+				fv = reflect.Zero(f.Type)
+			}
+			if b, err = appendBinary(b, fv, fieldOrder(f, order)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("cannot encode %v", v.Type())
+}
+
+func intBits(v reflect.Value) uint64 {
+	switch v.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(v.Int())
+	}
+	return v.Uint()
+}
+
+// decodeBinary decodes b into the pointer v like binary.Read, except
+// that struct fields tagged `bpf:"be"` are decoded in big endian byte
+// order.
+func decodeBinary(b []byte, v interface{}, order binary.ByteOrder) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("cannot decode into %T: not a non-nil pointer", v)
+	}
+	size := binary.Size(v)
+	if size < 0 {
+		return fmt.Errorf("cannot decode into %T: not a fixed size type", v)
+	}
+	if len(b) < size {
+		return fmt.Errorf("cannot decode %d bytes into %T of %d bytes", len(b), v, size)
+	}
+	_, err := readBinary(b, rv.Elem(), order)
+	return err
+}
+
+// readBinary decodes the start of b into v and returns the rest of b.
+func readBinary(b []byte, v reflect.Value, order binary.ByteOrder) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(b[0] != 0)
+		return b[1:], nil
+	case reflect.Int8, reflect.Uint8:
+		setIntBits(v, uint64(b[0]))
+		return b[1:], nil
+	case reflect.Int16, reflect.Uint16:
+		setIntBits(v, uint64(order.Uint16(b)))
+		return b[2:], nil
+	case reflect.Int32, reflect.Uint32:
+		setIntBits(v, uint64(order.Uint32(b)))
+		return b[4:], nil
+	case reflect.Int64, reflect.Uint64:
+		setIntBits(v, order.Uint64(b))
+		return b[8:], nil
+	case reflect.Float32:
+		v.SetFloat(float64(math.Float32frombits(order.Uint32(b))))
+		return b[4:], nil
+	case reflect.Float64:
+		v.SetFloat(math.Float64frombits(order.Uint64(b)))
+		return b[8:], nil
+	case reflect.Array:
+		var err error
+		for i := 0; i < v.Len(); i++ {
+			if b, err = readBinary(b, v.Index(i), order); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Struct:
+		t := v.Type()
+		var err error
+		for i := 0; i < v.NumField(); i++ {
+			f := t.Field(i)
+			if f.Name == "_" {
+				b = b[binary.Size(reflect.Zero(f.Type).Interface()):]
+				continue
+			}
+			if !v.Field(i).CanSet() {
+				return nil, fmt.Errorf("cannot decode into unexported field %s of %v", f.Name, t)
+			}
+			if b, err = readBinary(b, v.Field(i), fieldOrder(f, order)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("cannot decode into %v", v.Type())
+}
+
+func setIntBits(v reflect.Value, bits uint64) {
+	switch v.Kind() {
+	case reflect.Int8:
+		v.SetInt(int64(int8(bits)))
+	case reflect.Int16:
+		v.SetInt(int64(int16(bits)))
+	case reflect.Int32:
+		v.SetInt(int64(int32(bits)))
+	case reflect.Int64:
+		v.SetInt(int64(bits))
+	default:
+		v.SetUint(bits)
+	}
+}
+
+// hasBPFMarshaler reports whether the pointer v implements both methods
+// of BinaryKey and BinaryValue.
+func hasBPFMarshaler(v interface{}) bool {
+	_, ok := v.(BinaryKey)
+	return ok
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// flowKey holds a port in network byte order followed by padding.
+type flowKey struct {
+	Port uint16
+}
+
+func (k *flowKey) MarshalBPF() ([]byte, error) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, k.Port)
+	return b, nil
+}
+
+func (k *flowKey) UnmarshalBPF(b []byte) error {
+	k.Port = binary.BigEndian.Uint16(b)
+	return nil
+}
+
+func TestMarshalBPF(t *testing.T) {
+	key := flowKey{Port: 0x1f90}
+	if !hasBPFMarshaler(&key) {
+		t.Fatal("*flowKey should implement BinaryKey")
+	}
+	b, err := marshalBPF(&key, binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte{0x1f, 0x90, 0, 0}) {
+		t.Fatalf("unexpected encoding %x", b)
+	}
+	var got flowKey
+	if err := unmarshalBPF(b, &got, binary.LittleEndian); err != nil {
+		t.Fatal(err)
+	}
+	if got != key {
+		t.Fatalf("unexpected key %+v", got)
+	}
+
+	// Types without the methods use encoding/binary.
+	v := uint32(0x01020304)
+	if b, err = marshalBPF(&v, binary.LittleEndian); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte{4, 3, 2, 1}) {
+		t.Fatalf("unexpected encoding %x", b)
+	}
+}
+
+func TestCheckFixedSize(t *testing.T) {
+	var (
+		arr [16]byte
+		n   uint64
+		s   = struct {
+			A uint8
+			_ uint8
+			B uint16
+		}{}
+	)
+	for _, v := range []interface{}{&arr, arr, &n, n, &s} {
+		if err := checkFixedSize(v); err != nil {
+			t.Fatalf("%T: %v", v, err)
+		}
+	}
+	str := "key"
+	for _, v := range []interface{}{[]byte{1}, "key", &str, []uint32{1}, nil} {
+		if err := checkFixedSize(v); err == nil {
+			t.Fatalf("%T: expected an error", v)
+		}
+	}
+}
+
+type beFlow struct {
+	Addr  uint32
+	Port  uint16 `bpf:"be"`
+	_     uint16
+	Bytes int64
+	Proto [2]uint16 `bpf:"be"`
+}
+
+func TestEncodeBigEndianTag(t *testing.T) {
+	flow := beFlow{Addr: 0x0a000001, Port: 8080, Bytes: -2, Proto: [2]uint16{1, 0x0203}}
+	for _, test := range []struct {
+		order binary.ByteOrder
+		want  []byte
+	}{
+		{binary.LittleEndian, []byte{
+			0x01, 0x00, 0x00, 0x0a,
+			0x1f, 0x90, 0, 0,
+			0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0x00, 0x01, 0x02, 0x03,
+		}},
+		{binary.BigEndian, []byte{
+			0x0a, 0x00, 0x00, 0x01,
+			0x1f, 0x90, 0, 0,
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe,
+			0x00, 0x01, 0x02, 0x03,
+		}},
+	} {
+		b, err := marshalBPF(&flow, test.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, test.want) {
+			t.Fatalf("%v: unexpected encoding %x, expected %x", test.order, b, test.want)
+		}
+		var got beFlow
+		if err := unmarshalBPF(b, &got, test.order); err != nil {
+			t.Fatal(err)
+		}
+		if got != flow {
+			t.Fatalf("%v: unexpected decoded value %+v, expected %+v", test.order, got, flow)
+		}
+	}
+}
+
+func TestGetHostByteOrder(t *testing.T) {
+	order := GetHostByteOrder()
+	if order != binary.LittleEndian && order != binary.BigEndian {
+		t.Fatalf("unexpected byte order %v", order)
+	}
+}
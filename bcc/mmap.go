@@ -0,0 +1,136 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// MappedArray is an array table mapped in memory by Table.Mmap. Its
+// values are read and written with memory accesses rather than
+// syscalls, sharing the memory of BPF programs: use ReadUint64 and
+// StoreUint64, or atomic operations on the views of At, for values
+// that programs update concurrently.
+//
+// The mapping keeps the map alive after the module is closed, until
+// Close. A MappedArray must not be used after Close.
+type MappedArray struct {
+	mem       []byte
+	stride    int
+	valueSize int
+	len       uint32
+}
+
+// Mmap maps the values of an array table in memory. The table must be
+// an array (not a per-cpu array) created with MapFlagMmapable, e.g.
+// with RecreateWithFlags or declared with the BPF_F_TABLE macro of bcc
+// and BPF_F_MMAPABLE (Linux 5.5).
+func (table *Table) Mmap() (*MappedArray, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opLookup); err != nil {
+		return nil, err
+	}
+	desc := table.Desc()
+	switch desc.MapType {
+	case MapTypeArray:
+	case MapTypePercpuArray:
+		return nil, fmt.Errorf("Table.Mmap: per-cpu array table %s can't be mapped, its values live in per-cpu memory: %w", desc.Name, ErrOperationNotSupported)
+	default:
+		return nil, fmt.Errorf("Table.Mmap: %v table %s is not an array: %w", desc.MapType, desc.Name, ErrOperationNotSupported)
+	}
+	info, err := GetMapInfo(desc.FD)
+	if err != nil {
+		return nil, fmt.Errorf("Table.Mmap: %v", err)
+	}
+	if info.Flags&MapFlagMmapable == 0 {
+		return nil, fmt.Errorf("Table.Mmap: array table %s was not created with MapFlagMmapable: %w", desc.Name, ErrOperationNotSupported)
+	}
+	if info.MaxEntries == 0 {
+		return nil, fmt.Errorf("Table.Mmap: array table %s has no entries", desc.Name)
+	}
+	// The kernel lays the values out 8-byte aligned, and maps whole
+	// pages.
+	stride := (int(info.ValueSize) + 7) &^ 7
+	pageSize := os.Getpagesize()
+	size := (stride*int(info.MaxEntries) + pageSize - 1) / pageSize * pageSize
+	mem, err := syscall.Mmap(desc.FD, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("Table.Mmap: unable to map table %s: %w", desc.Name, mapErrno(err))
+	}
+	return &MappedArray{
+		mem:       mem,
+		stride:    stride,
+		valueSize: int(info.ValueSize),
+		len:       info.MaxEntries,
+	}, nil
+}
+
+// Len returns the number of values of the array.
+func (m *MappedArray) Len() int {
+	return int(m.len)
+}
+
+// At returns the value at index, a view of the mapped memory valid
+// until Close. It panics if index is out of range.
+func (m *MappedArray) At(index uint32) []byte {
+	if index >= m.len {
+		panic(fmt.Sprintf("bcc: MappedArray index %d out of range [0:%d]", index, m.len))
+	}
+	off := int(index) * m.stride
+	return m.mem[off : off+m.valueSize : off+m.valueSize]
+}
+
+// uint64At returns a pointer to the first 8 bytes of the value at
+// index, which are 8-byte aligned.
+func (m *MappedArray) uint64At(index uint32) *uint64 {
+	if m.valueSize < 8 {
+		panic(fmt.Sprintf("bcc: MappedArray values of %d bytes don't hold a uint64", m.valueSize))
+	}
+	return (*uint64)(unsafe.Pointer(&m.At(index)[0]))
+}
+
+// ReadUint64 atomically loads the first 8 bytes of the value at index,
+// in host byte order. It panics if index is out of range or the values
+// are smaller than 8 bytes.
+func (m *MappedArray) ReadUint64(index uint32) uint64 {
+	return atomic.LoadUint64(m.uint64At(index))
+}
+
+// StoreUint64 atomically stores v in host byte order into the first 8
+// bytes of the value at index. It panics if index is out of range or
+// the values are smaller than 8 bytes.
+func (m *MappedArray) StoreUint64(index uint32, v uint64) {
+	atomic.StoreUint64(m.uint64At(index), v)
+}
+
+// Close unmaps the array.
+func (m *MappedArray) Close() error {
+	if m.mem == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.mem)
+	m.mem, m.len = nil, 0
+	if err != nil {
+		return fmt.Errorf("MappedArray.Close: %w", err)
+	}
+	return nil
+}
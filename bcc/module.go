@@ -16,12 +16,18 @@ package bcc
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"regexp"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"unsafe"
+
+	"github.com/iovisor/gobpf/pkg/cpuonline"
 )
 
 /*
@@ -29,22 +35,125 @@ import (
 #cgo LDFLAGS: -lbcc
 #include <bcc/bpf_common.h>
 #include <bcc/libbpf.h>
-void perf_reader_free(void *ptr);
 */
 import "C"
 
-// Module type
+// Module type. A Module may be used from multiple goroutines.
 type Module struct {
-	p       unsafe.Pointer
+	p unsafe.Pointer
+
+	// closeMu is held for reading by the tables of the module while
+	// they use it, and for writing by Close.
+	closeMu sync.RWMutex
+	// done is closed by Close, stopping the iterations sending to
+	// channels no longer read.
+	done chan struct{}
+
+	// mu guards the maps below.
+	mu      sync.Mutex
 	funcs   map[string]int
-	kprobes map[string]unsafe.Pointer
-	uprobes map[string]unsafe.Pointer
+	kprobes map[string]int
+	uprobes map[string]int
+	// tracepoints maps tracepoint names to the fds of their perf
+	// events.
+	tracepoints map[string]int
+	// rawTracepoints maps raw tracepoint names to the fds holding
+	// the attachments.
+	rawTracepoints map[string]int
+	// trampolines maps the fds of fentry and fexit programs to the
+	// fds holding their attachments.
+	trampolines map[int]int
+	// iterLinks are the fds of the links of the iterators attached.
+	iterLinks map[int]bool
+	// perfEvents maps perf event types and configs to the fds of the
+	// events, one per cpu attached to.
+	perfEvents map[perfEventKey][]int
+	cgroups    []cgroupAttachment
+	// sockAttachments are the programs attached to sockmaps.
+	sockAttachments []sockAttachment
+	// flowDissectors maps network namespace paths to the flow
+	// dissectors attached to them.
+	flowDissectors map[string]flowDissectorAttachment
+	usdt           []*USDTContext
+	// attachments is the registry of all the attachments above,
+	// attachSeq numbering them in order.
+	attachments map[attachmentKey]attachmentRecord
+	attachSeq   uint64
+	// errorOnReattach is ModuleOptions.ErrorOnReattach.
+	errorOnReattach bool
+	// verifierLogs maps the names of the functions loaded to their
+	// verifier logs, if not empty.
+	verifierLogs map[string]string
+	// ownedFDs are the fds given with TakeOwnership.
+	ownedFDs []int
+
+	logLevel int
+	logSize  uint
+}
+
+type perfEventKey struct {
+	evType, evConfig int
+}
+
+func (k perfEventKey) String() string {
+	return fmt.Sprintf("%d:%d", k.evType, k.evConfig)
 }
 
 type compileRequest struct {
 	code   string
+	file   string
 	cflags []string
-	rspCh  chan *Module
+	usdt   []*USDTContext
+	opts   ModuleOptions
+	rspCh  chan compileResult
+}
+
+// Debug flags of ModuleOptions, DEBUG_* in bcc. The output written while
+// compiling is logged as debug messages (see SetLogger), the output of
+// later steps, e.g. verifier logs, goes to the standard error.
+const (
+	// DebugLLVMIR prints the LLVM IR of the module.
+	DebugLLVMIR = 0x1
+	// DebugBPF prints the BPF instructions of the module, and the
+	// verifier log of the programs loaded.
+	DebugBPF = 0x2
+	// DebugPreprocessor prints the preprocessed source.
+	DebugPreprocessor = 0x4
+	// DebugSource prints the BPF instructions interleaved with the
+	// source lines, with DebugBPF.
+	DebugSource = 0x8
+	// DebugBPFRegisterState prints the register state of the verifier
+	// for all instructions, with DebugBPF.
+	DebugBPFRegisterState = 0x10
+	// DebugBTF prints the BTF debug information.
+	DebugBTF = 0x20
+)
+
+// ModuleOptions are the options of NewModuleWithOptions.
+type ModuleOptions struct {
+	// Debug is a combination of the Debug* flags.
+	Debug uint
+	// VerifierLogSize is the size of the verifier log buffer of the
+	// programs loaded, when not given to Load. Large programs need
+	// more than the default 64KiB for the log not to be truncated.
+	VerifierLogSize uint
+	// VerifierLogLevel is the verifier log level of the programs
+	// loaded, when not given to Load. Unless it's set, the kernel
+	// only logs when rejecting programs.
+	VerifierLogLevel int
+	// ErrorOnReattach makes attaching a program again where it's
+	// already attached through the module return an error wrapping
+	// ErrAlreadyAttached, instead of doing nothing.
+	ErrorOnReattach bool
+}
+
+// legacyDebugFlags are the debug flags of the modules created by
+// NewModule and NewModuleFromFile.
+const legacyDebugFlags = DebugBPF
+
+type compileResult struct {
+	module *Module
+	err    error
 }
 
 const (
@@ -52,6 +161,29 @@ const (
 	BPF_PROBE_RETURN
 )
 
+// Perf event types and configs for AttachPerfEvent, from
+// linux/perf_event.h.
+const (
+	PerfTypeHardware = 0
+	PerfTypeSoftware = 1
+	PerfTypeHWCache  = 3
+
+	// Configs of PerfTypeHardware.
+	PerfCountHWCPUCycles       = 0
+	PerfCountHWInstructions    = 1
+	PerfCountHWCacheReferences = 2
+	PerfCountHWCacheMisses     = 3
+
+	// Configs of PerfTypeSoftware.
+	PerfCountSWCPUClock  = 0
+	PerfCountSWTaskClock = 1
+
+	// Config of PerfTypeHWCache for last level cache read misses:
+	// PERF_COUNT_HW_CACHE_LL | PERF_COUNT_HW_CACHE_OP_READ << 8 |
+	// PERF_COUNT_HW_CACHE_RESULT_MISS << 16.
+	PerfCountHWCacheLLReadMiss = 2 | 0<<8 | 1<<16
+)
+
 var (
 	defaultCflags []string
 	compileCh     chan compileRequest
@@ -66,8 +198,19 @@ func bpfInit() {
 	go compile()
 }
 
-// NewModule constructor
-func newModule(code string, cflags []string) *Module {
+// newModule compiles the code, or the file if code is empty, of req
+// into a module.
+func newModule(req compileRequest) (*Module, error) {
+	code, file, cflags := req.code, req.file, req.cflags
+	prepended := 0
+	if len(req.usdt) > 0 {
+		args, err := usdtGenArgs(req.usdt)
+		if err != nil {
+			return nil, err
+		}
+		code = args + code
+		prepended = strings.Count(args, "\n")
+	}
 	cflagsC := make([]*C.char, len(defaultCflags)+len(cflags))
 	defer func() {
 		for _, cflag := range cflagsC {
@@ -80,79 +223,332 @@ func newModule(code string, cflags []string) *Module {
 	for i, cflag := range defaultCflags {
 		cflagsC[len(cflags)+i] = C.CString(cflag)
 	}
-	cs := C.CString(code)
-	defer C.free(unsafe.Pointer(cs))
-	c := C.bpf_module_create_c_from_string(cs, 2, (**C.char)(&cflagsC[0]), C.int(len(cflagsC)))
+	var c unsafe.Pointer
+	var diags string
+	var err error
+	if file != "" {
+		fileCS := C.CString(file)
+		defer C.free(unsafe.Pointer(fileCS))
+		diags, err = captureStderr(func() {
+			c = C.bpf_module_create_c(fileCS, C.uint(req.opts.Debug), (**C.char)(&cflagsC[0]), C.int(len(cflagsC)))
+		})
+	} else {
+		cs := C.CString(code)
+		defer C.free(unsafe.Pointer(cs))
+		diags, err = captureStderr(func() {
+			c = C.bpf_module_create_c_from_string(cs, C.uint(req.opts.Debug), (**C.char)(&cflagsC[0]), C.int(len(cflagsC)))
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to capture compiler output: %v", err)
+	}
 	if c == nil {
-		return nil
+		mainFile := file
+		if mainFile == "" {
+			mainFile = virtualMainFile
+		}
+		diags = strings.TrimSpace(diags)
+		return nil, &CompileError{
+			Diagnostics: parseDiagnostics(diags, mainFile, prepended),
+			Output:      diags,
+		}
+	}
+	// Pass warnings through, with the output of the debug flags.
+	if diags = strings.TrimSpace(diags); diags != "" {
+		if req.opts.Debug != 0 {
+			debugf("compiler output:\n%s", diags)
+		} else {
+			warnf("compiler output:\n%s", diags)
+		}
 	}
-	return &Module{
-		p:       c,
-		funcs:   make(map[string]int),
-		kprobes: make(map[string]unsafe.Pointer),
-		uprobes: make(map[string]unsafe.Pointer),
+	m := &Module{
+		p:               c,
+		done:            make(chan struct{}),
+		funcs:           make(map[string]int),
+		kprobes:         make(map[string]int),
+		uprobes:         make(map[string]int),
+		tracepoints:     make(map[string]int),
+		rawTracepoints:  make(map[string]int),
+		trampolines:     make(map[int]int),
+		iterLinks:       make(map[int]bool),
+		flowDissectors:  make(map[string]flowDissectorAttachment),
+		perfEvents:      make(map[perfEventKey][]int),
+		usdt:            req.usdt,
+		attachments:     make(map[attachmentKey]attachmentRecord),
+		errorOnReattach: req.opts.ErrorOnReattach,
+		verifierLogs:    make(map[string]string),
+		logLevel:        req.opts.VerifierLogLevel,
+		logSize:         req.opts.VerifierLogSize,
 	}
+	runtime.SetFinalizer(m, (*Module).Close)
+	return m, nil
+}
+
+// stderrMu serializes captureStderr.
+var stderrMu sync.Mutex
+
+// captureStderr runs f, a call into bcc, with the standard error of the
+// process redirected, and returns what was written to it: clang prints
+// the compiler diagnostics there, bcc has no API returning them. f runs
+// on a locked OS thread and the redirection only lasts for the call,
+// and is undone even if f panics, but file descriptor 2 is shared by
+// the whole process: whatever else writes to it meanwhile, other
+// goroutines as well as a crashing Go runtime, is captured too. Callers
+// must not write to the standard error while compiling.
+func captureStderr(f func()) (diags string, err error) {
+	stderrMu.Lock()
+	defer stderrMu.Unlock()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	saved, err := syscall.Dup(2)
+	if err != nil {
+		w.Close()
+		return "", err
+	}
+	defer syscall.Close(saved)
+	if err := syscall.Dup3(int(w.Fd()), 2, 0); err != nil {
+		w.Close()
+		return "", err
+	}
+	out := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- b
+	}()
+	defer func() {
+		if rerr := syscall.Dup3(saved, 2, 0); err == nil {
+			err = rerr
+		}
+		// The read ends once no descriptor refers to w.
+		w.Close()
+		diags = string(<-out)
+	}()
+	f()
+	return "", nil
 }
 
 // NewModule asynchronously compiles the code, generates a new BPF
-// module and returns it.
-func NewModule(code string, cflags []string) *Module {
+// module and returns it. If compilation fails, the returned error holds
+// the compiler diagnostics. The code fetching the arguments of the
+// probes enabled in usdtContexts is compiled in; the module takes
+// ownership of the contexts, attach the probes with AttachUSDT.
+func NewModule(code string, cflags []string, usdtContexts ...*USDTContext) (*Module, error) {
+	return compileModule(compileRequest{
+		code:   code,
+		cflags: cflags,
+		usdt:   usdtContexts,
+		opts:   ModuleOptions{Debug: legacyDebugFlags},
+	})
+}
+
+// NewModuleWithOptions is like NewModule with the given options.
+func NewModuleWithOptions(code string, cflags []string, opts ModuleOptions, usdtContexts ...*USDTContext) (*Module, error) {
+	return compileModule(compileRequest{code: code, cflags: cflags, usdt: usdtContexts, opts: opts})
+}
+
+// NewModuleFromFile is like NewModule but compiles the source file at
+// path. Includes with quotes are relative to the directory of the file.
+func NewModuleFromFile(path string, cflags []string) (*Module, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return compileModule(compileRequest{
+		file:   path,
+		cflags: cflags,
+		opts:   ModuleOptions{Debug: legacyDebugFlags},
+	})
+}
+
+func compileModule(req compileRequest) (*Module, error) {
 	bpfInitOnce.Do(bpfInit)
-	ch := make(chan *Module)
-	compileCh <- compileRequest{code, cflags, ch}
-	return <-ch
+	req.rspCh = make(chan compileResult)
+	compileCh <- req
+	res := <-req.rspCh
+	return res.module, res.err
 }
 
 func compile() {
 	for {
 		req := <-compileCh
-		req.rspCh <- newModule(req.code, req.cflags)
+		m, err := newModule(req)
+		req.rspCh <- compileResult{m, err}
 	}
 }
 
-// Close takes care of closing all kprobes opened by this modules and
-// destroys the underlying libbpf module.
-func (bpf *Module) Close() {
+// Close detaches all kprobes, uprobes, raw tracepoints, trampolines,
+// perf events and cgroup programs attached through the module, closes
+// the programs it loaded and the fds given with TakeOwnership, and
+// destroys the underlying libbpf module. Close waits for the table
+// operations in progress to complete; operations started meanwhile or
+// afterwards return ErrModuleClosed. Closing a closed module is a
+// no-op. A finalizer closes modules that are no longer referenced, but
+// callers should not rely on it: probes stay attached until then.
+func (bpf *Module) Close() error {
+	bpf.closeMu.Lock()
+	defer bpf.closeMu.Unlock()
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return nil
+	}
+	runtime.SetFinalizer(bpf, nil)
+	firstErr := bpf.detachAll()
+	for k, fd := range bpf.funcs {
+		syscall.Close(fd)
+		delete(bpf.funcs, k)
+	}
+	for _, fd := range bpf.ownedFDs {
+		syscall.Close(fd)
+	}
+	bpf.ownedFDs = nil
+	for _, u := range bpf.usdt {
+		u.Close()
+	}
+	bpf.usdt = nil
 	C.bpf_module_destroy(bpf.p)
-	for k, v := range bpf.kprobes {
-		C.perf_reader_free(v)
-		evNameCS := C.CString(k)
-		C.bpf_detach_kprobe(evNameCS)
-		C.free(unsafe.Pointer(evNameCS))
-	}
-	for k, v := range bpf.uprobes {
-		C.perf_reader_free(v)
-		evNameCS := C.CString(k)
-		C.bpf_detach_uprobe(evNameCS)
-		C.free(unsafe.Pointer(evNameCS))
-	}
-	for _, fd := range bpf.funcs {
+	bpf.p = nil
+	close(bpf.done)
+	return firstErr
+}
+
+// detachAll detaches all the programs attached through the module.
+// Callers must hold bpf.mu.
+func (bpf *Module) detachAll() error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil {
+			warnf("%v", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	for k := range bpf.kprobes {
+		keep(bpf.detachKprobe(k))
+	}
+	for k := range bpf.uprobes {
+		keep(bpf.detachUprobe(k))
+	}
+	for k := range bpf.tracepoints {
+		keep(bpf.detachTracepoint(k))
+	}
+	for k, fd := range bpf.rawTracepoints {
 		syscall.Close(fd)
+		delete(bpf.rawTracepoints, k)
+	}
+	for k, fd := range bpf.trampolines {
+		syscall.Close(fd)
+		delete(bpf.trampolines, k)
+	}
+	for fd := range bpf.iterLinks {
+		syscall.Close(fd)
+		delete(bpf.iterLinks, fd)
+	}
+	for k, fds := range bpf.perfEvents {
+		for _, fd := range fds {
+			C.bpf_close_perf_event_fd(C.int(fd))
+		}
+		delete(bpf.perfEvents, k)
+	}
+	for len(bpf.cgroups) > 0 {
+		keep(bpf.detachCgroup(len(bpf.cgroups) - 1))
 	}
+	for len(bpf.sockAttachments) > 0 {
+		keep(bpf.detachSockProg(len(bpf.sockAttachments) - 1))
+	}
+	for k := range bpf.flowDissectors {
+		keep(bpf.detachFlowDissector(k))
+	}
+	for key := range bpf.attachments {
+		bpf.forgetAttachment(key.kind, key.id)
+	}
+	return firstErr
 }
 
 // LoadNet loads a program of type BPF_PROG_TYPE_SCHED_ACT.
 func (bpf *Module) LoadNet(name string) (int, error) {
-	return bpf.Load(name, C.BPF_PROG_TYPE_SCHED_ACT)
+	return bpf.Load(name, ProgramTypeSchedACT, 0, 0)
 }
 
 // LoadKprobe loads a program of type BPF_PROG_TYPE_KPROBE.
 func (bpf *Module) LoadKprobe(name string) (int, error) {
-	return bpf.Load(name, C.BPF_PROG_TYPE_KPROBE)
+	return bpf.Load(name, ProgramTypeKprobe, 0, 0)
 }
 
 // LoadUprobe loads a program of type BPF_PROG_TYPE_KPROBE.
 func (bpf *Module) LoadUprobe(name string) (int, error) {
-	return bpf.Load(name, C.BPF_PROG_TYPE_KPROBE)
+	return bpf.Load(name, ProgramTypeKprobe, 0, 0)
+}
+
+// LoadPerfEvent loads a program of type BPF_PROG_TYPE_PERF_EVENT.
+func (bpf *Module) LoadPerfEvent(name string) (int, error) {
+	return bpf.Load(name, ProgramTypePerfEvent, 0, 0)
+}
+
+// LoadTracepoint loads a program of type BPF_PROG_TYPE_TRACEPOINT.
+func (bpf *Module) LoadTracepoint(name string) (int, error) {
+	return bpf.Load(name, ProgramTypeTracepoint, 0, 0)
 }
 
-// Load a program.
-func (bpf *Module) Load(name string, progType int) (int, error) {
+// LoadRawTracepoint loads a program of type BPF_PROG_TYPE_RAW_TRACEPOINT.
+func (bpf *Module) LoadRawTracepoint(name string) (int, error) {
+	return bpf.Load(name, ProgramTypeRawTracepoint, 0, 0)
+}
+
+// defaultLogSize is the size of the verifier log buffer when neither
+// Load nor the module options give one.
+const defaultLogSize = 65536
+
+// Load loads the function name of the module as a program of type
+// progType and returns its fd. logLevel is passed to the verifier, and
+// logSize is the size of the buffer for its log; zero values default
+// to those of the ModuleOptions, and to level 0 and 64KiB. If the
+// verifier rejects the program, the error includes its log; with a
+// zero logLevel, loading is retried with level 1 to get one. The log
+// is also available from VerifierLog. Programs are loaded once per
+// module, and closed by Close.
+func (bpf *Module) Load(name string, progType ProgramType, logLevel int, logSize uint) (int, error) {
+	return bpf.LoadWithOptions(name, progType, LoadOptions{LogLevel: logLevel, LogSize: logSize})
+}
+
+// LoadOptions are the options of LoadWithOptions.
+type LoadOptions struct {
+	// LogLevel and LogSize are the verifier log level and buffer
+	// size, as with Load.
+	LogLevel int
+	LogSize  uint
+	// IfName or IfIndex is the network device to bind the program to
+	// for hardware offload, e.g. a SmartNIC, for XDP programs attached
+	// with XDPFlagsHWMode. The program is then verified and translated
+	// by the driver, and only runs on the device. Offloaded programs
+	// can only use maps bound to the same device, while bcc creates the
+	// maps of the module on the host when compiling it; see
+	// Table.RecreateOnDevice to create maps on the device.
+	IfName  string
+	IfIndex int
+}
+
+// LoadWithOptions loads the function name of the module as a program
+// of type progType with opts and returns its fd, as Load does. Loading
+// for a device returns an error wrapping ErrInterfaceNotFound if it
+// doesn't exist, and ErrNotSupported if it or the kernel lacks offload
+// support. Programs are loaded once per module whatever the options.
+func (bpf *Module) LoadWithOptions(name string, progType ProgramType, opts LoadOptions) (int, error) {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return -1, ErrModuleClosed
+	}
 	fd, ok := bpf.funcs[name]
 	if ok {
 		return fd, nil
 	}
-	fd, err := bpf.load(name, progType)
+	fd, err := bpf.load(name, progType, opts)
 	if err != nil {
 		return -1, err
 	}
@@ -160,7 +556,7 @@ func (bpf *Module) Load(name string, progType int) (int, error) {
 	return fd, nil
 }
 
-func (bpf *Module) load(name string, progType int) (int, error) {
+func (bpf *Module) load(name string, progType ProgramType, opts LoadOptions) (int, error) {
 	nameCS := C.CString(name)
 	defer C.free(unsafe.Pointer(nameCS))
 	start := (*C.struct_bpf_insn)(C.bpf_function_start(bpf.p, nameCS))
@@ -170,85 +566,506 @@ func (bpf *Module) load(name string, progType int) (int, error) {
 	if start == nil {
 		return -1, fmt.Errorf("Module: unable to find %s", name)
 	}
-	logbuf := make([]byte, 65536)
+	var devNameCS *C.char
+	if opts.IfName != "" || opts.IfIndex != 0 {
+		devName, _, err := offloadDevice(opts.IfName, opts.IfIndex)
+		if err != nil {
+			return -1, fmt.Errorf("error loading BPF program %s: %w", name, err)
+		}
+		devNameCS = C.CString(devName)
+		defer C.free(unsafe.Pointer(devNameCS))
+	}
+	logLevel := opts.LogLevel
+	if logLevel == 0 {
+		logLevel = bpf.logLevel
+	}
+	logbuf := make([]byte, bpf.verifierLogSize(opts.LogSize))
 	logbufP := (*C.char)(unsafe.Pointer(&logbuf[0]))
-	fd, err := C.bpf_prog_load(uint32(progType), start, size, license, version, logbufP, C.uint(len(logbuf)))
+	fd, err := C.bcc_func_load(bpf.p, C.int(progType), nameCS, start, size, license, version, C.int(logLevel), logbufP, C.uint(len(logbuf)), devNameCS)
+	if fd < 0 && logLevel == 0 {
+		logLevel = 1
+		fd, err = C.bcc_func_load(bpf.p, C.int(progType), nameCS, start, size, license, version, C.int(logLevel), logbufP, C.uint(len(logbuf)), devNameCS)
+	}
+	bpf.setVerifierLog(name, logbuf)
 	if fd < 0 {
-		msg := string(logbuf[:bytes.IndexByte(logbuf, 0)])
-		if len(msg) > 0 {
-			return -1, fmt.Errorf("error loading BPF program:\n%s", msg)
+		// Without a verifier log, the device rejected the program.
+		if devNameCS != nil && logbuf[0] == 0 && isOffloadNotSupported(err) {
+			return -1, fmt.Errorf("error loading BPF program %s for device %s: %v: %w", name, C.GoString(devNameCS), err, ErrNotSupported)
 		}
-		return -1, fmt.Errorf("error loading BPF program: %v", err)
+		return -1, loadError(name, progType, logbuf, err)
 	}
 	return int(fd), nil
 }
 
-var kprobeRegexp = regexp.MustCompile("[+.]")
+// verifierLogSize returns the size of the verifier log buffer for a
+// load given logSize.
+func (bpf *Module) verifierLogSize(logSize uint) uint {
+	switch {
+	case logSize != 0:
+		return logSize
+	case bpf.logSize != 0:
+		return bpf.logSize
+	}
+	return defaultLogSize
+}
+
+// setVerifierLog records the verifier log in logbuf of the function
+// name. Callers must hold bpf.mu.
+func (bpf *Module) setVerifierLog(name string, logbuf []byte) {
+	if i := bytes.IndexByte(logbuf, 0); i >= 0 {
+		logbuf = logbuf[:i]
+	}
+	if len(logbuf) == 0 {
+		delete(bpf.verifierLogs, name)
+		return
+	}
+	bpf.verifierLogs[name] = string(logbuf)
+}
+
+// VerifierLog returns the verifier log of the last load of the
+// function name, successful or not. It's empty for programs loaded
+// with log level 0, see ModuleOptions.VerifierLogLevel.
+func (bpf *Module) VerifierLog(name string) (string, error) {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return "", ErrModuleClosed
+	}
+	log, ok := bpf.verifierLogs[name]
+	if _, loaded := bpf.funcs[name]; !ok && !loaded {
+		return "", fmt.Errorf("function %s not loaded", name)
+	}
+	return log, nil
+}
+
+// loadError returns the error for a program rejected with errno err,
+// including the verifier log in logbuf.
+func loadError(name string, progType ProgramType, logbuf []byte, err error) error {
+	msg := logbuf
+	if i := bytes.IndexByte(logbuf, 0); i >= 0 {
+		msg = logbuf[:i]
+	}
+	if len(msg) > 0 {
+		if err == syscall.ENOSPC {
+			return fmt.Errorf("error loading BPF program %s (%v, verifier log truncated to %d bytes):\n%s", name, progType, len(logbuf), msg)
+		}
+		return fmt.Errorf("error loading BPF program %s (%v):\n%s", name, progType, msg)
+	}
+	return fmt.Errorf("error loading BPF program %s (%v): %v", name, progType, err)
+}
+
+var kprobeRegexp = regexp.MustCompile("[+.:]")
 var uprobeRegexp = regexp.MustCompile("[^a-zA-Z0-9_]")
 
-func (bpf *Module) attachProbe(evName string, attachType uint32, fnName string, fd int) error {
-	if _, ok := bpf.kprobes[evName]; ok {
-		return nil
+func (bpf *Module) attachProbe(evName string, attachType uint32, fnName string, fd, maxActive int) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	kind := probeKind(evName, AttachmentKprobe, AttachmentKretprobe)
+	if attached, err := bpf.checkAttached(kind, evName, fd); attached {
+		return err
 	}
 
 	evNameCS := C.CString(evName)
 	fnNameCS := C.CString(fnName)
-	res, err := C.bpf_attach_kprobe(C.int(fd), attachType, evNameCS, fnNameCS, -1, 0, -1, nil, nil)
+	res, err := C.bpf_attach_kprobe(C.int(fd), attachType, evNameCS, fnNameCS, 0, C.int(maxActive))
 	C.free(unsafe.Pointer(evNameCS))
 	C.free(unsafe.Pointer(fnNameCS))
 
-	if res == nil {
+	if res < 0 {
 		return fmt.Errorf("failed to attach BPF kprobe: %v", err)
 	}
-	bpf.kprobes[evName] = res
+	bpf.kprobes[evName] = int(res)
+	bpf.recordAttachment(kind, evName, fnName, fd)
+	return nil
+}
+
+// detachKprobe closes and detaches the kprobe evName. Callers must hold
+// bpf.mu.
+func (bpf *Module) detachKprobe(evName string) error {
+	C.bpf_close_perf_event_fd(C.int(bpf.kprobes[evName]))
+	delete(bpf.kprobes, evName)
+	bpf.forgetAttachment(probeKind(evName, AttachmentKprobe, AttachmentKretprobe), evName)
+	evNameCS := C.CString(evName)
+	defer C.free(unsafe.Pointer(evNameCS))
+	if r, err := C.bpf_detach_kprobe(evNameCS); r < 0 {
+		return fmt.Errorf("failed to detach BPF kprobe %s: %v", evName, err)
+	}
 	return nil
 }
 
 func (bpf *Module) attachUProbe(evName string, attachType uint32, path string, addr uint64, fd, pid int) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	kind := probeKind(evName, AttachmentUprobe, AttachmentUretprobe)
+	if attached, err := bpf.checkAttached(kind, evName, fd); attached {
+		return err
+	}
 	evNameCS := C.CString(evName)
 	binaryPathCS := C.CString(path)
-	res, err := C.bpf_attach_uprobe(C.int(fd), attachType, evNameCS, binaryPathCS, (C.uint64_t)(addr), (C.pid_t)(pid), 0, -1, nil, nil)
+	res, err := C.bpf_attach_uprobe(C.int(fd), attachType, evNameCS, binaryPathCS, (C.uint64_t)(addr), (C.pid_t)(pid))
 	C.free(unsafe.Pointer(evNameCS))
 	C.free(unsafe.Pointer(binaryPathCS))
 
-	if res == nil {
+	if res < 0 {
 		return fmt.Errorf("failed to attach BPF uprobe: %v", err)
 	}
-	bpf.uprobes[evName] = res
+	bpf.uprobes[evName] = int(res)
+	bpf.recordAttachment(kind, evName, fmt.Sprintf("%s:0x%x", path, addr), fd)
 	return nil
 }
 
-// AttachKprobe attaches a kprobe fd to a function.
-func (bpf *Module) AttachKprobe(fnName string, fd int) error {
-	evName := "p_" + kprobeRegexp.ReplaceAllString(fnName, "_")
+// detachUprobe closes and detaches the uprobe evName. Callers must hold
+// bpf.mu.
+func (bpf *Module) detachUprobe(evName string) error {
+	C.bpf_close_perf_event_fd(C.int(bpf.uprobes[evName]))
+	delete(bpf.uprobes, evName)
+	bpf.forgetAttachment(probeKind(evName, AttachmentUprobe, AttachmentUretprobe), evName)
+	evNameCS := C.CString(evName)
+	defer C.free(unsafe.Pointer(evNameCS))
+	if r, err := C.bpf_detach_uprobe(evNameCS); r < 0 {
+		return fmt.Errorf("failed to detach BPF uprobe %s: %v", evName, err)
+	}
+	return nil
+}
 
-	return bpf.attachProbe(evName, BPF_PROBE_ENTRY, fnName, fd)
+func uprobeEventName(prefix, path string, addr uint64) string {
+	return fmt.Sprintf("%s_%s_0x%x", prefix, uprobeRegexp.ReplaceAllString(path, "_"), addr)
 }
 
-// AttachKretprobe attaches a kretprobe fd to a function.
-func (bpf *Module) AttachKretprobe(fnName string, fd int) error {
-	evName := "r_" + kprobeRegexp.ReplaceAllString(fnName, "_")
+func (bpf *Module) detachUprobeEvent(evName string) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	if _, ok := bpf.uprobes[evName]; !ok {
+		return fmt.Errorf("no uprobe %s attached", evName)
+	}
+	return bpf.detachUprobe(evName)
+}
 
-	return bpf.attachProbe(evName, BPF_PROBE_RETURN, fnName, fd)
+func kprobeEventNames(fnName string) (entry, ret string) {
+	name := kprobeRegexp.ReplaceAllString(fnName, "_")
+	return "p_" + name, "r_" + name
+}
+
+// KprobeFlag modifies the function name given to the kprobe methods.
+type KprobeFlag int
+
+const (
+	// KprobeSyscall translates the bare syscall name given, e.g.
+	// "clone", to the name of its function with GetSyscallFnName.
+	KprobeSyscall KprobeFlag = 1 << iota
+)
+
+// kprobeFnName returns the name of the function to probe for fnName
+// and flags.
+func (bpf *Module) kprobeFnName(fnName string, flags []KprobeFlag) string {
+	var f KprobeFlag
+	for _, flag := range flags {
+		f |= flag
+	}
+	if f&KprobeSyscall != 0 {
+		return bpf.GetSyscallFnName(fnName)
+	}
+	return fnName
+}
+
+// AttachKprobe attaches a kprobe fd to a function. The function of a
+// kernel module can be given as "module:function", and the module must
+// be loaded, see WaitForSymbol. maxActive is only meaningful for
+// kretprobes and ignored.
+func (bpf *Module) AttachKprobe(fnName string, fd int, maxActive int, flags ...KprobeFlag) error {
+	fnName = bpf.kprobeFnName(fnName, flags)
+	if err := checkModuleSymbol(fnName); err != nil {
+		return err
+	}
+	evName, _ := kprobeEventNames(fnName)
+
+	return bpf.attachProbe(evName, BPF_PROBE_ENTRY, fnName, fd, 0)
+}
+
+// AttachKretprobe attaches a kretprobe fd to a function, which can be
+// given as "module:function" as with AttachKprobe. maxActive is the
+// number of instances of the function that can be probed at the same
+// time, for recursive or sleeping functions. Pass 0 for the kernel
+// default.
+func (bpf *Module) AttachKretprobe(fnName string, fd int, maxActive int, flags ...KprobeFlag) error {
+	fnName = bpf.kprobeFnName(fnName, flags)
+	if err := checkModuleSymbol(fnName); err != nil {
+		return err
+	}
+	_, evName := kprobeEventNames(fnName)
+
+	return bpf.attachProbe(evName, BPF_PROBE_RETURN, fnName, fd, maxActive)
+}
+
+// DetachKprobe detaches the kprobe and kretprobe attached to a function
+// through the module, with the flags given when attaching.
+func (bpf *Module) DetachKprobe(fnName string, flags ...KprobeFlag) error {
+	fnName = bpf.kprobeFnName(fnName, flags)
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	var (
+		found    bool
+		firstErr error
+	)
+	entry, ret := kprobeEventNames(fnName)
+	for _, evName := range []string{entry, ret} {
+		if _, ok := bpf.kprobes[evName]; !ok {
+			continue
+		}
+		found = true
+		if err := bpf.detachKprobe(evName); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if !found {
+		return fmt.Errorf("no kprobe attached to %s", fnName)
+	}
+	return firstErr
+}
+
+// AttachTracepoint attaches a tracepoint fd to the tracepoint tpName,
+// "category:name", e.g. "sched:sched_switch". If the kernel doesn't
+// have the tracepoint, it returns an error wrapping
+// ErrTracepointNotFound naming the closest matching ones.
+func (bpf *Module) AttachTracepoint(tpName string, fd int) error {
+	category, name, err := splitTracepoint(tpName)
+	if err != nil {
+		return err
+	}
+	if err := checkTracepoint(tpName); err != nil {
+		return err
+	}
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	if attached, err := bpf.checkAttached(AttachmentTracepoint, tpName, fd); attached {
+		return err
+	}
+	categoryCS := C.CString(category)
+	nameCS := C.CString(name)
+	res, err := C.bpf_attach_tracepoint(C.int(fd), categoryCS, nameCS)
+	C.free(unsafe.Pointer(categoryCS))
+	C.free(unsafe.Pointer(nameCS))
+	if res < 0 {
+		return fmt.Errorf("failed to attach BPF tracepoint %s: %v", tpName, err)
+	}
+	bpf.tracepoints[tpName] = int(res)
+	bpf.recordAttachment(AttachmentTracepoint, tpName, tpName, fd)
+	return nil
+}
+
+// detachTracepoint closes and detaches the tracepoint tpName. Callers
+// must hold bpf.mu.
+func (bpf *Module) detachTracepoint(tpName string) error {
+	C.bpf_close_perf_event_fd(C.int(bpf.tracepoints[tpName]))
+	delete(bpf.tracepoints, tpName)
+	bpf.forgetAttachment(AttachmentTracepoint, tpName)
+	category, name, _ := splitTracepoint(tpName)
+	categoryCS := C.CString(category)
+	defer C.free(unsafe.Pointer(categoryCS))
+	nameCS := C.CString(name)
+	defer C.free(unsafe.Pointer(nameCS))
+	if r, err := C.bpf_detach_tracepoint(categoryCS, nameCS); r < 0 {
+		return fmt.Errorf("failed to detach BPF tracepoint %s: %v", tpName, err)
+	}
+	return nil
+}
+
+// DetachTracepoint detaches the tracepoint tpName attached through the
+// module.
+func (bpf *Module) DetachTracepoint(tpName string) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	if _, ok := bpf.tracepoints[tpName]; !ok {
+		return fmt.Errorf("no tracepoint attached to %s", tpName)
+	}
+	return bpf.detachTracepoint(tpName)
+}
+
+// AttachRawTracepoint attaches a raw tracepoint fd to the tracepoint
+// tpName, e.g. "sched_switch". It returns an error wrapping
+// ErrNotSupported if the kernel lacks raw tracepoints (Linux 4.17).
+func (bpf *Module) AttachRawTracepoint(tpName string, fd int) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	if attached, err := bpf.checkAttached(AttachmentRawTracepoint, tpName, fd); attached {
+		return err
+	}
+	tpFD, err := rawTracepointOpen(tpName, fd)
+	if err != nil {
+		if err == syscall.EINVAL {
+			// Also returned by kernels not knowing the command.
+			return fmt.Errorf("failed to attach BPF raw tracepoint %s: %v: %w", tpName, err, ErrNotSupported)
+		}
+		return fmt.Errorf("failed to attach BPF raw tracepoint %s: %v", tpName, err)
+	}
+	bpf.rawTracepoints[tpName] = tpFD
+	bpf.recordAttachment(AttachmentRawTracepoint, tpName, tpName, fd)
+	return nil
+}
+
+// DetachRawTracepoint detaches the raw tracepoint tpName attached
+// through the module.
+func (bpf *Module) DetachRawTracepoint(tpName string) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	fd, ok := bpf.rawTracepoints[tpName]
+	if !ok {
+		return fmt.Errorf("no raw tracepoint attached to %s", tpName)
+	}
+	delete(bpf.rawTracepoints, tpName)
+	bpf.forgetAttachment(AttachmentRawTracepoint, tpName)
+	return syscall.Close(fd)
+}
+
+// AttachPerfEvent attaches a perf event fd to the perf event of type
+// evType and config evConfig, such as PerfTypeHardware and
+// PerfCountHWCPUCycles, sampled every samplePeriod events or
+// sampleFreq times per second. A pid can be given to attach to, or -1
+// to attach to all processes. If cpu is -1, the program is attached on
+// every online cpu.
+func (bpf *Module) AttachPerfEvent(evType, evConfig int, samplePeriod, sampleFreq uint64, pid, cpu, groupFD, progFD int) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	key := perfEventKey{evType, evConfig}
+	if attached, err := bpf.checkAttached(AttachmentPerfEvent, key.String(), progFD); attached {
+		return err
+	}
+	cpus := []uint{uint(cpu)}
+	if cpu < 0 {
+		var err error
+		if cpus, err = cpuonline.Get(); err != nil {
+			return fmt.Errorf("failed to determine online cpus: %v", err)
+		}
+	}
+	var fds []int
+	for _, c := range cpus {
+		fd, err := C.bpf_attach_perf_event(C.int(progFD), C.uint32_t(evType), C.uint32_t(evConfig), C.uint64_t(samplePeriod), C.uint64_t(sampleFreq), C.pid_t(pid), C.int(c), C.int(groupFD))
+		if fd < 0 {
+			for _, fd := range fds {
+				C.bpf_close_perf_event_fd(C.int(fd))
+			}
+			return fmt.Errorf("failed to attach BPF perf event type %d config %d on cpu %d: %v", evType, evConfig, c, err)
+		}
+		fds = append(fds, int(fd))
+	}
+	bpf.perfEvents[key] = fds
+	bpf.recordAttachment(AttachmentPerfEvent, key.String(), key.String(), progFD)
+	return nil
+}
+
+// DetachPerfEvent detaches the perf event of type evType and config
+// evConfig attached through the module.
+func (bpf *Module) DetachPerfEvent(evType, evConfig int) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	key := perfEventKey{evType, evConfig}
+	fds, ok := bpf.perfEvents[key]
+	if !ok {
+		return fmt.Errorf("no perf event type %d config %d attached", evType, evConfig)
+	}
+	delete(bpf.perfEvents, key)
+	bpf.forgetAttachment(AttachmentPerfEvent, key.String())
+	var firstErr error
+	for _, fd := range fds {
+		if r, err := C.bpf_close_perf_event_fd(C.int(fd)); r < 0 && firstErr == nil {
+			firstErr = fmt.Errorf("failed to detach BPF perf event type %d config %d: %v", evType, evConfig, err)
+		}
+	}
+	return firstErr
 }
 
 // AttachUprobe attaches a uprobe fd to the symbol in the library or binary 'name'
 // The 'name' argument can be given as either a full library path (/usr/lib/..),
 // a library without the lib prefix, or as a binary with full path (/bin/bash)
+// The symbol can be followed by an offset, as in "SSL_write+0x10".
 // A pid can be given to attach to, or -1 to attach to all processes
+// The error wraps ErrSymbolNotFound if the symbol can't be resolved.
 //
 // Presently attempts to trace processes running in a different namespace
 // to the tracer will fail due to limitations around namespace-switching
 // in multi-threaded programs (such as Go programs)
 func (bpf *Module) AttachUprobe(name, symbol string, fd, pid int) error {
-	path, addr, err := resolveSymbolPath(name, symbol, 0x0, pid)
+	path, addr, err := resolveSymbolOffset(name, symbol, pid)
 	if err != nil {
 		return err
 	}
-	evName := fmt.Sprintf("p_%s_0x%x", uprobeRegexp.ReplaceAllString(path, "_"), addr)
+	evName := uprobeEventName("p", path, addr)
 	return bpf.attachUProbe(evName, BPF_PROBE_ENTRY, path, addr, fd, pid)
 }
 
+// DetachUprobe detaches the uprobe attached to the symbol in the library
+// or binary 'name' by AttachUprobe.
+func (bpf *Module) DetachUprobe(name, symbol string, pid int) error {
+	path, addr, err := resolveSymbolOffset(name, symbol, pid)
+	if err != nil {
+		return err
+	}
+	return bpf.detachUprobeEvent(uprobeEventName("p", path, addr))
+}
+
+// AttachUprobeAtOffset attaches a uprobe fd at a file offset of the
+// library or binary at path, without resolving any symbol. The offset
+// must lie within an executable segment of the file.
+// A pid can be given to attach to, or -1 to attach to all processes
+func (bpf *Module) AttachUprobeAtOffset(path string, offset uint64, fd, pid int) error {
+	if err := checkExecOffset(path, offset); err != nil {
+		return err
+	}
+	evName := uprobeEventName("p", path, offset)
+	return bpf.attachUProbe(evName, BPF_PROBE_ENTRY, path, offset, fd, pid)
+}
+
+// AttachUSDT loads the functions enabled on the probes of the USDT
+// contexts of the module and attaches them as uprobes.
+func (bpf *Module) AttachUSDT() error {
+	bpf.mu.Lock()
+	contexts := bpf.usdt
+	bpf.mu.Unlock()
+	for _, u := range contexts {
+		for _, up := range u.uprobes() {
+			fd, err := bpf.LoadUprobe(up.fnName)
+			if err != nil {
+				return err
+			}
+			evName := uprobeEventName("p", up.binPath, up.addr)
+			if err := bpf.attachUProbe(evName, BPF_PROBE_ENTRY, up.binPath, up.addr, fd, up.pid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // AttachMatchingUprobes attaches a uprobe fd to all symbols in the library or binary
 // 'name' that match a given pattern.
 // The 'name' argument can be given as either a full library path (/usr/lib/..),
@@ -277,20 +1094,32 @@ func (bpf *Module) AttachMatchingUprobes(name, match string, fd, pid int) error
 // AttachUretprobe attaches a uretprobe fd to the symbol in the library or binary 'name'
 // The 'name' argument can be given as either a full library path (/usr/lib/..),
 // a library without the lib prefix, or as a binary with full path (/bin/bash)
+// The symbol can be followed by an offset, as in "SSL_write+0x10".
 // A pid can be given to attach to, or -1 to attach to all processes
+// The error wraps ErrSymbolNotFound if the symbol can't be resolved.
 //
 // Presently attempts to trace processes running in a different namespace
 // to the tracer will fail due to limitations around namespace-switching
 // in multi-threaded programs (such as Go programs)
 func (bpf *Module) AttachUretprobe(name, symbol string, fd, pid int) error {
-	path, addr, err := resolveSymbolPath(name, symbol, 0x0, pid)
+	path, addr, err := resolveSymbolOffset(name, symbol, pid)
 	if err != nil {
 		return err
 	}
-	evName := fmt.Sprintf("p_%s_0x%x", uprobeRegexp.ReplaceAllString(path, "_"), addr)
+	evName := uprobeEventName("r", path, addr)
 	return bpf.attachUProbe(evName, BPF_PROBE_RETURN, path, addr, fd, pid)
 }
 
+// DetachUretprobe detaches the uretprobe attached to the symbol in the
+// library or binary 'name' by AttachUretprobe.
+func (bpf *Module) DetachUretprobe(name, symbol string, pid int) error {
+	path, addr, err := resolveSymbolOffset(name, symbol, pid)
+	if err != nil {
+		return err
+	}
+	return bpf.detachUprobeEvent(uprobeEventName("r", path, addr))
+}
+
 // AttachMatchingUretprobes attaches a uretprobe fd to all symbols in the library or binary
 // 'name' that match a given pattern.
 // The 'name' argument can be given as either a full library path (/usr/lib/..),
@@ -316,21 +1145,110 @@ func (bpf *Module) AttachMatchingUretprobes(name, match string, fd, pid int) err
 	return nil
 }
 
-// TableSize returns the number of tables in the module.
+// FuncDesc describes a function of a module.
+type FuncDesc struct {
+	Name string
+	// Size is the size of the function in bytes.
+	Size uint64
+	// Loaded reports whether the function has been loaded as a
+	// program, FD then being its fd.
+	Loaded bool
+	FD     int
+}
+
+// Tables returns the tables of the module.
+func (bpf *Module) Tables() ([]*Table, error) {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return nil, ErrModuleClosed
+	}
+	n := C.bpf_num_tables(bpf.p)
+	tables := make([]*Table, 0, int(n))
+	for id := C.size_t(0); id < n; id++ {
+		tables = append(tables, NewTable(uint64(id), bpf))
+	}
+	return tables, nil
+}
+
+// Functions returns the functions of the module.
+func (bpf *Module) Functions() ([]FuncDesc, error) {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return nil, ErrModuleClosed
+	}
+	n := C.bpf_num_functions(bpf.p)
+	funcs := make([]FuncDesc, 0, int(n))
+	for id := C.size_t(0); id < n; id++ {
+		name := C.GoString(C.bpf_function_name(bpf.p, id))
+		fd, loaded := bpf.funcs[name]
+		if !loaded {
+			fd = -1
+		}
+		funcs = append(funcs, FuncDesc{
+			Name:   name,
+			Size:   uint64(C.bpf_function_size_id(bpf.p, id)),
+			Loaded: loaded,
+			FD:     fd,
+		})
+	}
+	return funcs, nil
+}
+
+// TableSize returns the number of tables in the module, or 0 if it's
+// closed.
 func (bpf *Module) TableSize() uint64 {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return 0
+	}
 	size := C.bpf_num_tables(bpf.p)
 	return uint64(size)
 }
 
-// TableId returns the id of a table.
-func (bpf *Module) TableId(name string) C.size_t {
+// TableId returns the id of a table, or 0 if the module is closed. See
+// TableByName to check that the table exists.
+func (bpf *Module) TableId(name string) uint64 {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return 0
+	}
+	cs := C.CString(name)
+	defer C.free(unsafe.Pointer(cs))
+	return uint64(C.bpf_table_id(bpf.p, cs))
+}
+
+// TableByName returns the table with the given name. It returns an
+// error wrapping ErrTableNotFound if the module has no such table.
+func (bpf *Module) TableByName(name string) (*Table, error) {
+	// Like table operations, fail rather than wait for a pending Close.
+	if !bpf.closeMu.TryRLock() {
+		return nil, ErrModuleClosed
+	}
+	defer bpf.closeMu.RUnlock()
+	if bpf.p == nil {
+		return nil, ErrModuleClosed
+	}
 	cs := C.CString(name)
 	defer C.free(unsafe.Pointer(cs))
-	return C.bpf_table_id(bpf.p, cs)
+	id := C.bpf_table_id(bpf.p, cs)
+	if id >= C.bpf_num_tables(bpf.p) {
+		return nil, fmt.Errorf("table %s: %w", name, ErrTableNotFound)
+	}
+	return NewTable(uint64(id), bpf), nil
 }
 
-// TableDesc returns a map with table properties (name, fd, ...).
+// TableDesc returns a map with table properties (name, fd, ...), or nil
+// if the module is closed.
 func (bpf *Module) TableDesc(id uint64) map[string]interface{} {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return nil
+	}
 	i := C.size_t(id)
 	return map[string]interface{}{
 		"name":      C.GoString(C.bpf_table_name(bpf.p, i)),
@@ -346,32 +1264,78 @@ func (bpf *Module) TableDesc(id uint64) map[string]interface{} {
 func (bpf *Module) TableIter() <-chan map[string]interface{} {
 	ch := make(chan map[string]interface{})
 	go func() {
-		size := C.bpf_num_tables(bpf.p)
-		for i := C.size_t(0); i < size; i++ {
-			ch <- bpf.TableDesc(uint64(i))
+		defer close(ch)
+		// The channel is closed early if the module is closed.
+		for i := uint64(0); i < bpf.TableSize(); i++ {
+			desc := bpf.TableDesc(i)
+			if desc == nil {
+				return
+			}
+			ch <- desc
 		}
-		close(ch)
 	}()
 	return ch
 }
 
-func (bpf *Module) attachXDP(devName string, fd int) error {
-	devNameCS := C.CString(devName)
-	res, err := C.bpf_attach_xdp(devNameCS, C.int(fd))
-	defer C.free(unsafe.Pointer(devNameCS))
+// XDPFlags are flags for AttachXDP and RemoveXDP (XDP_FLAGS_*).
+type XDPFlags uint32
+
+const (
+	// XDPFlagsUpdateIfNoExist fails AttachXDP if a program is already
+	// attached, instead of replacing it.
+	XDPFlagsUpdateIfNoExist XDPFlags = 1 << iota
+	// XDPFlagsSKBMode attaches in generic mode, supported by all
+	// drivers.
+	XDPFlagsSKBMode
+	// XDPFlagsDrvMode attaches in native mode, in the driver.
+	XDPFlagsDrvMode
+	// XDPFlagsHWMode offloads the program to the NIC.
+	XDPFlagsHWMode
+)
+
+// ErrXDPNotSupported is returned when the driver of an interface
+// doesn't support the requested XDP mode.
+var ErrXDPNotSupported = errors.New("XDP mode not supported by the driver")
+
+const (
+	iflaXDP      = 43
+	iflaXDPFD    = 1
+	iflaXDPFlags = 3
+)
 
-	if res != 0 || err != nil {
+func (bpf *Module) attachXDP(devName string, fd int, flags XDPFlags) error {
+	index, err := interfaceIndex(devName)
+	if err != nil {
+		return err
+	}
+	req := newNlRequest(syscall.RTM_SETLINK, 0, ifInfoMsg(index))
+	req.beginNest(iflaXDP)
+	req.addUint32(iflaXDPFD, uint32(int32(fd)))
+	if flags != 0 {
+		req.addUint32(iflaXDPFlags, uint32(flags))
+	}
+	req.endNest()
+	switch err := req.execute(); err {
+	case nil:
+		return nil
+	case syscall.EOPNOTSUPP:
+		return fmt.Errorf("failed to attach BPF xdp to device %v: %w", devName, ErrXDPNotSupported)
+	default:
 		return fmt.Errorf("failed to attach BPF xdp to device %v: %v", devName, err)
 	}
-	return nil
 }
 
-// AttachXDP attaches a xdp fd to a device.
-func (bpf *Module) AttachXDP(devName string, fd int) error {
-	return bpf.attachXDP(devName, fd)
+// AttachXDP attaches a xdp fd to a device, replacing any program
+// attached with the same mode unless flags include
+// XDPFlagsUpdateIfNoExist. The error wraps ErrInterfaceNotFound if the
+// device doesn't exist, and ErrXDPNotSupported if its driver doesn't
+// support the mode.
+func (bpf *Module) AttachXDP(devName string, fd int, flags XDPFlags) error {
+	return bpf.attachXDP(devName, fd, flags)
 }
 
-// RemoveXDP removes any xdp from this device.
-func (bpf *Module) RemoveXDP(devName string) error {
-	return bpf.attachXDP(devName, -1)
+// RemoveXDP removes any xdp attached with the mode in flags from this
+// device.
+func (bpf *Module) RemoveXDP(devName string, flags XDPFlags) error {
+	return bpf.attachXDP(devName, -1, flags&^XDPFlagsUpdateIfNoExist)
 }
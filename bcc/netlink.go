@@ -0,0 +1,183 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+)
+
+// ErrInterfaceNotFound is returned when a network interface doesn't
+// exist.
+var ErrInterfaceNotFound = errors.New("network interface not found")
+
+// nlaFNested flags nested netlink attributes.
+const nlaFNested = 0x8000
+
+var nlSeq uint32
+
+// nlRequest builds a netlink route request: a message header, a fixed
+// size body and attributes.
+type nlRequest struct {
+	buf   []byte
+	nests []int
+}
+
+func newNlRequest(msgType, flags uint16, body []byte) *nlRequest {
+	r := &nlRequest{buf: make([]byte, syscall.NLMSG_HDRLEN, 256)}
+	byteOrder.PutUint16(r.buf[4:], msgType)
+	byteOrder.PutUint16(r.buf[6:], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	byteOrder.PutUint32(r.buf[8:], atomic.AddUint32(&nlSeq, 1))
+	r.buf = append(r.buf, body...)
+	return r
+}
+
+func (r *nlRequest) align() {
+	for len(r.buf)%syscall.NLMSG_ALIGNTO != 0 {
+		r.buf = append(r.buf, 0)
+	}
+}
+
+// addAttr adds the attribute typ holding data.
+func (r *nlRequest) addAttr(typ uint16, data []byte) {
+	r.align()
+	hdr := make([]byte, syscall.SizeofRtAttr)
+	byteOrder.PutUint16(hdr, uint16(syscall.SizeofRtAttr+len(data)))
+	byteOrder.PutUint16(hdr[2:], typ)
+	r.buf = append(r.buf, hdr...)
+	r.buf = append(r.buf, data...)
+}
+
+func (r *nlRequest) addUint32(typ uint16, v uint32) {
+	b := make([]byte, 4)
+	byteOrder.PutUint32(b, v)
+	r.addAttr(typ, b)
+}
+
+func (r *nlRequest) addUint16(typ uint16, v uint16) {
+	b := make([]byte, 2)
+	byteOrder.PutUint16(b, v)
+	r.addAttr(typ, b)
+}
+
+func (r *nlRequest) addString(typ uint16, s string) {
+	r.addAttr(typ, append([]byte(s), 0))
+}
+
+// beginNest starts the nested attribute typ, ended by endNest.
+func (r *nlRequest) beginNest(typ uint16) {
+	r.addAttr(typ|nlaFNested, nil)
+	r.nests = append(r.nests, len(r.buf)-syscall.SizeofRtAttr)
+}
+
+func (r *nlRequest) endNest() {
+	start := r.nests[len(r.nests)-1]
+	r.nests = r.nests[:len(r.nests)-1]
+	byteOrder.PutUint16(r.buf[start:], uint16(len(r.buf)-start))
+}
+
+// execute sends the request and waits for its acknowledgment.
+func (r *nlRequest) execute() error {
+	r.align()
+	byteOrder.PutUint32(r.buf, uint32(len(r.buf)))
+	seq := byteOrder.Uint32(r.buf[8:])
+
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("unable to open netlink socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return fmt.Errorf("unable to bind netlink socket: %v", err)
+	}
+	if err := syscall.Sendto(fd, r.buf, 0, sa); err != nil {
+		return fmt.Errorf("unable to send netlink request: %v", err)
+	}
+	rb := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, rb, 0)
+		if err != nil {
+			return fmt.Errorf("unable to receive netlink response: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rb[:n])
+		if err != nil {
+			return fmt.Errorf("unable to parse netlink response: %v", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("short netlink error message")
+			}
+			if errno := int32(byteOrder.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// ifInfoMsg returns a struct ifinfomsg for the interface index.
+func ifInfoMsg(index int) []byte {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	byteOrder.PutUint32(b[4:], uint32(index))
+	return b
+}
+
+// interfaceIndex returns the index of the network interface ifName.
+func interfaceIndex(ifName string) (int, error) {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", ifName, ErrInterfaceNotFound)
+	}
+	return iface.Index, nil
+}
+
+// offloadDevice returns the name and index of the network device given
+// by name or index, or both if they agree, to offload programs and
+// maps to.
+func offloadDevice(ifName string, ifIndex int) (string, int, error) {
+	if ifName != "" {
+		index, err := interfaceIndex(ifName)
+		if err != nil {
+			return "", 0, err
+		}
+		if ifIndex != 0 && ifIndex != index {
+			return "", 0, fmt.Errorf("device %s has index %d, not %d", ifName, index, ifIndex)
+		}
+		return ifName, index, nil
+	}
+	iface, err := net.InterfaceByIndex(ifIndex)
+	if err != nil {
+		return "", 0, fmt.Errorf("index %d: %w", ifIndex, ErrInterfaceNotFound)
+	}
+	return iface.Name, ifIndex, nil
+}
+
+// isOffloadNotSupported reports whether err, from loading a program or
+// creating a map for a device, means that the device or the kernel
+// doesn't support offload (Linux 4.16).
+func isOffloadNotSupported(err error) bool {
+	switch err {
+	case syscall.EOPNOTSUPP, errnoENOTSUPP, syscall.EINVAL, syscall.E2BIG:
+		return true
+	}
+	return false
+}
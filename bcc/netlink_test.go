@@ -0,0 +1,52 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestNlRequestAttrs(t *testing.T) {
+	r := newNlRequest(syscall.RTM_SETLINK, 0, ifInfoMsg(7))
+	r.beginNest(43)
+	r.addUint32(1, 0xffffffff)
+	r.addString(2, "abc")
+	r.endNest()
+	r.align()
+
+	body := r.buf[syscall.NLMSG_HDRLEN:]
+	if got := int32(byteOrder.Uint32(body[4:])); got != 7 {
+		t.Fatalf("unexpected interface index %d", got)
+	}
+	attrs := body[syscall.SizeofIfInfomsg:]
+	// nest header, u32 attribute, "abc\0" attribute
+	want := syscall.SizeofRtAttr + (syscall.SizeofRtAttr + 4) + (syscall.SizeofRtAttr + 4)
+	if len(attrs) != want {
+		t.Fatalf("unexpected attributes length %d, expected %d", len(attrs), want)
+	}
+	if l := byteOrder.Uint16(attrs); int(l) != want {
+		t.Fatalf("unexpected nest length %d, expected %d", l, want)
+	}
+	if typ := byteOrder.Uint16(attrs[2:]); typ != 43|nlaFNested {
+		t.Fatalf("unexpected nest type 0x%x", typ)
+	}
+	if l := byteOrder.Uint16(attrs[12:]); l != syscall.SizeofRtAttr+4 {
+		t.Fatalf("unexpected string attribute length %d", l)
+	}
+	if s := string(attrs[16:19]); s != "abc" {
+		t.Fatalf("unexpected string attribute %q", s)
+	}
+}
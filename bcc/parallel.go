@@ -0,0 +1,353 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <errno.h>
+#include <string.h>
+#include <bcc/bpf_common.h>
+#include <bcc/libbpf.h>
+
+// gobpf_lookup_keys looks up the n keys of the array keys in the map fd,
+// into the array leaves. Keys deleted since they were read are counted
+// in dropped and removed, the others being moved down along with their
+// leaves, and the number of entries found is returned. The lookups stop
+// at the first other error, err being set to its errno and the failed
+// key being the one following the returned entries.
+static int gobpf_lookup_keys(int fd, void *keys, size_t key_size,
+			     void *leaves, size_t leaf_size, int n,
+			     int *dropped, int *err)
+{
+	int filled = 0;
+	int i;
+
+	*dropped = 0;
+	*err = 0;
+	for (i = 0; i < n; i++) {
+		char *k = (char *)keys + (size_t)filled * key_size;
+		char *l = (char *)leaves + (size_t)filled * leaf_size;
+
+		if (i != filled)
+			memmove(k, (char *)keys + (size_t)i * key_size, key_size);
+		if (bpf_lookup_elem(fd, k, l) != 0) {
+			if (errno == ENOENT) {
+				(*dropped)++;
+				continue;
+			}
+			*err = errno;
+			break;
+		}
+		filled++;
+	}
+	return filled;
+}
+*/
+import "C"
+
+// parallelChunk is the number of keys handed at once to an IterParallel
+// worker.
+const parallelChunk = 256
+
+// IterParallel is like IterBytes but looks up the values with workers
+// goroutines, for very large tables where reading them dominates.
+// Entries are yielded in no particular order. workers below 1 are
+// taken as 1.
+//
+// The indexes of array and per-cpu array tables are split among the
+// workers, which scales with their number. The keys of other tables
+// can only be walked in order: a single goroutine walks them and hands
+// them to the workers in chunks of 256, so the speedup is bounded by
+// the walk, which takes about one syscall per key rather than two.
+//
+// Each key is yielded exactly once if the table is not modified
+// meanwhile. Otherwise, the guarantees are those of Iter: entries
+// deleted before their value is looked up are skipped, entries added
+// during the walk may be missed, and the walk of a hash table restarts
+// from its first key when the current key is deleted, which may yield
+// keys again (see SnapshotKeys). Values reflect updates made up to
+// their lookup.
+//
+// If the module has been closed, the returned channel is closed
+// without yielding any entries. The channel is also closed on errors,
+// once the workers are done with the entries already looked up, and
+// when the table is closed. If the receiver stops reading, the workers
+// block until then: use IterParallelContext to stop earlier and to get
+// the error that stopped the iteration.
+func (table *Table) IterParallel(workers int) <-chan RawEntry {
+	return table.IterParallelContext(context.Background(), workers).C
+}
+
+// ParallelIter is an iteration of IterParallelContext.
+type ParallelIter struct {
+	// C yields the entries, and is closed at the end of the iteration.
+	C <-chan RawEntry
+
+	err error
+}
+
+// Err returns the error that stopped the iteration, if any, once C is
+// closed: ctx.Err() if ctx was done, ErrModuleClosed if the table was
+// closed.
+func (it *ParallelIter) Err() error {
+	return it.err
+}
+
+// IterParallelContext is like IterParallel but also stops iterating and
+// closes the channel once ctx is done, even if the receiver stopped
+// reading, and returns the error that stopped the iteration.
+func (table *Table) IterParallelContext(ctx context.Context, workers int) *ParallelIter {
+	ch := make(chan RawEntry, 128)
+	it := &ParallelIter{C: ch}
+	src, err := table.parallelSource()
+	if err != nil {
+		warnf("table %s: iteration stopped: %v", table.Name(), err)
+		it.err = err
+		close(ch)
+		return it
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	chunks := make(chan []byte, workers)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	halt := func(err error) {
+		stopOnce.Do(func() {
+			it.err = err
+			close(stop)
+		})
+	}
+	fail := func(err error) {
+		halt(err)
+		warnf("table %s: iteration stopped: %v", table.Name(), err)
+	}
+
+	// Stop the walker and the workers once ctx is done or the table
+	// closed, until they are done.
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			halt(ctx.Err())
+		case <-table.closing():
+			halt(ErrModuleClosed)
+		case <-done:
+		}
+	}()
+
+	go func() {
+		defer close(chunks)
+		err := src.walk(func(chunk []byte) bool {
+			select {
+			case chunks <- chunk:
+				return true
+			case <-stop:
+				return false
+			}
+		})
+		if err != nil {
+			fail(err)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for keys := range chunks {
+				entries, err := table.lookupKeys(src.fd, keys, src.keySize, src.leafSize)
+				for _, e := range entries {
+					select {
+					case ch <- e:
+					case <-stop:
+						return
+					}
+				}
+				if err != nil {
+					fail(err)
+					return
+				}
+				select {
+				case <-stop:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+		// it.err is set for good once the watcher is done.
+		<-watched
+		close(ch)
+	}()
+	return it
+}
+
+// parallelSource produces the keys of a table for IterParallel.
+type parallelSource struct {
+	fd       C.int
+	keySize  int
+	leafSize int
+	// walk passes the keys to emit in chunks of up to parallelChunk
+	// keys, until it returns false.
+	walk func(emit func(chunk []byte) bool) error
+}
+
+// parallelSource returns the source of the keys of the table: its
+// indexes for arrays, or a cursor over its keys.
+func (table *Table) parallelSource() (*parallelSource, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opLookup); err != nil {
+		return nil, err
+	}
+	desc := table.Desc()
+	switch desc.MapType {
+	case MapTypeArray, MapTypePercpuArray:
+		if desc.KeySize != 4 {
+			break
+		}
+		leafSize, err := table.leafBufSize()
+		if err != nil {
+			return nil, err
+		}
+		max, err := table.MaxEntries()
+		if err != nil {
+			return nil, err
+		}
+		src := &parallelSource{fd: C.int(desc.FD), keySize: 4, leafSize: leafSize}
+		src.walk = func(emit func([]byte) bool) error {
+			for i := uint64(0); i < max; i += parallelChunk {
+				n := max - i
+				if n > parallelChunk {
+					n = parallelChunk
+				}
+				chunk := make([]byte, n*4)
+				for j := uint64(0); j < n; j++ {
+					*(*uint32)(unsafe.Pointer(&chunk[j*4])) = uint32(i + j)
+				}
+				if !emit(chunk) {
+					return nil
+				}
+			}
+			return nil
+		}
+		return src, nil
+	}
+
+	cur, err := table.newCursor()
+	if err != nil {
+		return nil, err
+	}
+	cur.keysOnly = true
+	src := &parallelSource{fd: cur.fd, keySize: len(cur.key), leafSize: len(cur.leaf)}
+	src.walk = func(emit func([]byte) bool) error {
+		chunk := make([]byte, 0, parallelChunk*src.keySize)
+		for cur.next() {
+			chunk = append(chunk, cur.key...)
+			if len(chunk) < cap(chunk) {
+				continue
+			}
+			if !emit(chunk) {
+				return nil
+			}
+			chunk = make([]byte, 0, parallelChunk*src.keySize)
+		}
+		if cur.err != nil {
+			return cur.err
+		}
+		if len(chunk) > 0 {
+			emit(chunk)
+		}
+		return nil
+	}
+	return src, nil
+}
+
+// lookupKeys looks up keys, an array of keys of keySize bytes, in the
+// map fd and returns the entries found, which share the memory of keys
+// and of a single array of leaves. Keys deleted since they were read
+// are skipped. The entries looked up before an error are returned along
+// with it.
+func (table *Table) lookupKeys(fd C.int, keys []byte, keySize, leafSize int) ([]RawEntry, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	n := len(keys) / keySize
+	leaves := make([]byte, n*leafSize)
+	var found int
+	var err error
+	if table.retryPolicy.Load() == nil {
+		var dropped, errno C.int
+		found = int(C.gobpf_lookup_keys(fd, unsafe.Pointer(&keys[0]), C.size_t(keySize),
+			unsafe.Pointer(&leaves[0]), C.size_t(leafSize), C.int(n), &dropped, &errno))
+		if dropped > 0 {
+			debugf("table %s: %d keys deleted while iterating, skipped", table.Name(), dropped)
+		}
+		if errno != 0 {
+			err = syscall.Errno(errno)
+		}
+	} else {
+		// Look up each key in Go to retry as the policy says.
+		for i := 0; i < n; i++ {
+			k := keys[i*keySize : (i+1)*keySize]
+			if i != found {
+				copy(keys[found*keySize:], k)
+				k = keys[found*keySize : (found+1)*keySize]
+			}
+			err = table.lookupElem(int(fd), unsafe.Pointer(&k[0]), unsafe.Pointer(&leaves[found*leafSize]))
+			if err == syscall.ENOENT {
+				debugf("table %s: key %x deleted while iterating, skipped", table.Name(), k)
+				err = nil
+				continue
+			}
+			if err != nil {
+				break
+			}
+			found++
+		}
+	}
+	entries := make([]RawEntry, found)
+	for i := range entries {
+		entries[i] = RawEntry{
+			Key:   keys[i*keySize : (i+1)*keySize : (i+1)*keySize],
+			Value: leaves[i*leafSize : (i+1)*leafSize : (i+1)*leafSize],
+		}
+	}
+	if err != nil {
+		k := keys[found*keySize : (found+1)*keySize]
+		return entries, fmt.Errorf("unable to lookup element (%x): %w", k, mapErrno(err))
+	}
+	return entries, nil
+}
@@ -0,0 +1,386 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/iovisor/gobpf/pkg/cpupossible"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <errno.h>
+#include <string.h>
+#include <bcc/bpf_common.h>
+#include <bcc/libbpf.h>
+
+// gobpf_sum_entries reads up to n keys of the per-cpu map fd following
+// key, or starting with it if first is set, into the array keys, and
+// the sums of the u64 values of the ncpus CPUs of each into sums, using
+// values as the buffer of a lookup. It returns the number of keys read,
+// like gobpf_next_entries, with which it shares the handling of key,
+// dropped, err and failed_lookup.
+static int gobpf_sum_entries(int fd, void *key, size_t key_size, int first,
+			     void *keys, __u64 *sums, __u64 *values,
+			     int ncpus, int n, int *dropped, int *err,
+			     int *failed_lookup)
+{
+	int filled = 0;
+	int i;
+
+	*dropped = 0;
+	*err = 0;
+	*failed_lookup = 0;
+	while (filled < n) {
+		char *k = (char *)keys + (size_t)filled * key_size;
+		__u64 sum = 0;
+
+		if (first) {
+			memcpy(k, key, key_size);
+			first = 0;
+		} else {
+			if (bpf_get_next_key(fd, key, k) != 0) {
+				*err = errno;
+				break;
+			}
+			memcpy(key, k, key_size);
+		}
+		if (bpf_lookup_elem(fd, k, values) != 0) {
+			if (errno == ENOENT) {
+				(*dropped)++;
+				continue;
+			}
+			*err = errno;
+			*failed_lookup = 1;
+			break;
+		}
+		for (i = 0; i < ncpus; i++)
+			sum += values[i];
+		sums[filled++] = sum;
+	}
+	return filled;
+}
+*/
+import "C"
+
+// IsPerCPU reports whether maps of type mt hold one value per possible
+// CPU for each key.
+func (mt MapType) IsPerCPU() bool {
+	switch mt {
+	case MapTypePercpuHash, MapTypePercpuArray, MapTypeLRUPercpuHash, MapTypePercpuCgroupStorage:
+		return true
+	}
+	return false
+}
+
+// numPossibleCPUs returns the number of possible CPUs, which is the
+// number of values the kernel stores per key in per-cpu maps.
+// cpupossible.Get caches them, as they are fixed at boot.
+func numPossibleCPUs() (int, error) {
+	cpus, err := cpupossible.Get()
+	if err != nil {
+		return 0, fmt.Errorf("failed to determine possible cpus: %v", err)
+	}
+	return len(cpus), nil
+}
+
+// perCPUStride returns the size of a single CPU's value in the buffer of
+// a per-cpu lookup: the kernel aligns each value to 8 bytes.
+func perCPUStride(leafSize int) int {
+	return (leafSize + 7) &^ 7
+}
+
+// leafBufSize returns the size of the buffer needed to look up a
+// value in the table. For per-cpu tables, the buffer holds the values of
+// all possible CPUs, each aligned to 8 bytes.
+func (table *Table) leafBufSize() (int, error) {
+	desc := table.Desc()
+	if !desc.MapType.IsPerCPU() {
+		return int(desc.LeafSize), nil
+	}
+	n, err := numPossibleCPUs()
+	if err != nil {
+		return 0, err
+	}
+	return perCPUStride(int(desc.LeafSize)) * n, nil
+}
+
+// GetPerCPU takes a raw key and returns the raw value of each possible
+// CPU of a per-cpu table.
+func (table *Table) GetPerCPU(key []byte) ([][]byte, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opLookup); err != nil {
+		return nil, err
+	}
+	if mt := table.Type(); !mt.IsPerCPU() {
+		return nil, fmt.Errorf("Table.GetPerCPU: %v table %s is not a per-cpu table: %w", mt, table.Name(), ErrOperationNotSupported)
+	}
+	buf, err := table.GetBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	return table.splitPerCPU(buf), nil
+}
+
+// SetPerCPU sets a raw key to the given raw values, one per possible
+// CPU, of a per-cpu table.
+func (table *Table) SetPerCPU(key []byte, values [][]byte) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opUpdate); err != nil {
+		return err
+	}
+	desc := table.Desc()
+	if !desc.MapType.IsPerCPU() {
+		return fmt.Errorf("Table.SetPerCPU: %v table %s is not a per-cpu table: %w", desc.MapType, desc.Name, ErrOperationNotSupported)
+	}
+	n, err := numPossibleCPUs()
+	if err != nil {
+		return err
+	}
+	if len(values) != n {
+		return fmt.Errorf("Table.SetPerCPU: got %d values for table %s, expected one per possible cpu (%d)", len(values), desc.Name, n)
+	}
+	stride := perCPUStride(int(desc.LeafSize))
+	buf := make([]byte, stride*n)
+	for cpu, value := range values {
+		if len(value) != int(desc.LeafSize) {
+			return fmt.Errorf("Table.SetPerCPU: leaf size mismatch for cpu %d of table %s: got %d bytes, expected %d", cpu, desc.Name, len(value), desc.LeafSize)
+		}
+		copy(buf[cpu*stride:], value)
+	}
+	return table.SetBytes(key, buf)
+}
+
+// splitPerCPU splits the buffer of a per-cpu lookup into the values of
+// each CPU.
+func (table *Table) splitPerCPU(buf []byte) [][]byte {
+	leafSize := int(table.Desc().LeafSize)
+	stride := perCPUStride(leafSize)
+	values := make([][]byte, len(buf)/stride)
+	for cpu := range values {
+		values[cpu] = buf[cpu*stride : cpu*stride+leafSize : cpu*stride+leafSize]
+	}
+	return values
+}
+
+// expandPerCPU returns a per-cpu lookup buffer with leaf as the value of
+// every possible CPU.
+func (table *Table) expandPerCPU(leaf []byte) ([]byte, error) {
+	n, err := numPossibleCPUs()
+	if err != nil {
+		return nil, err
+	}
+	stride := perCPUStride(len(leaf))
+	buf := make([]byte, stride*n)
+	for cpu := 0; cpu < n; cpu++ {
+		copy(buf[cpu*stride:], leaf)
+	}
+	return buf, nil
+}
+
+// formatLeaf formats the looked up value of a table entry. For per-cpu
+// tables, the value of each CPU is formatted separately and the values
+// are also returned as a list formatted like `[ v0 v1 ... ]`.
+func (table *Table) formatLeaf(strBuf []byte, leaf []byte) (string, []string, []byte, error) {
+	if !table.Type().IsPerCPU() {
+		s, strBuf, err := table.leafToString(strBuf, unsafe.Pointer(&leaf[0]))
+		return s, nil, strBuf, err
+	}
+	values := table.splitPerCPU(leaf)
+	perCPU := make([]string, len(values))
+	for cpu, value := range values {
+		var err error
+		perCPU[cpu], strBuf, err = table.leafToString(strBuf, unsafe.Pointer(&value[0]))
+		if err != nil {
+			return "", nil, strBuf, fmt.Errorf("cpu %d: %w", cpu, err)
+		}
+	}
+	return "[ " + strings.Join(perCPU, " ") + " ]", perCPU, strBuf, nil
+}
+
+// SumPerCPU takes a raw key and returns the sum of the values of all
+// CPUs of a per-cpu table. The values must be unsigned integers of 1, 2,
+// 4 or 8 bytes in host byte order.
+func (table *Table) SumPerCPU(key []byte) (uint64, error) {
+	if err := table.rlock(); err != nil {
+		return 0, err
+	}
+	defer table.runlock()
+	if err := table.checkSummable(); err != nil {
+		return 0, err
+	}
+	values, err := table.GetPerCPU(key)
+	if err != nil {
+		return 0, err
+	}
+	return sumValues(values), nil
+}
+
+// SumAll returns, for each entry of a per-cpu table, the sum of the
+// values of all CPUs keyed by the formatted key. The values must be
+// unsigned integers of 1, 2, 4 or 8 bytes in host byte order. Values of
+// 8 bytes are looked up and summed in C, in batches of 256 keys, so
+// that only the sums cross over to Go. As with Iterator, the walk
+// restarts from the first key when the current key is deleted
+// concurrently; the keys visited again are looked up again and their
+// sums replaced, not added to.
+func (table *Table) SumAll() (map[string]uint64, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkSummable(); err != nil {
+		return nil, err
+	}
+	// Lookups retried as the policy says are made from Go.
+	if table.Desc().LeafSize == 8 && table.retryPolicy.Load() == nil {
+		sums := make(map[string]uint64)
+		batched, err := table.sumAllBatched(sums)
+		if err != nil {
+			return nil, fmt.Errorf("Table.SumAll: %w", err)
+		}
+		if batched {
+			return sums, nil
+		}
+	}
+	return table.sumAll()
+}
+
+// sumAll is SumAll looking up the entries with a cursor and summing the
+// values in Go.
+func (table *Table) sumAll() (map[string]uint64, error) {
+	cur, err := table.newCursor()
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]uint64)
+	keyStr := make([]byte, len(cur.key)*8)
+	for cur.next() {
+		var k string
+		k, keyStr, err = table.keyToString(keyStr, cur.keyP)
+		if err != nil {
+			return nil, fmt.Errorf("Table.SumAll: unable to format key (%x): %w", cur.key, err)
+		}
+		sums[k] = sumValues(table.splitPerCPU(cur.leaf))
+	}
+	if cur.err != nil {
+		return nil, fmt.Errorf("Table.SumAll: %w", cur.err)
+	}
+	return sums, nil
+}
+
+// sumAllBatched stores the sums of SumAll into sums, for a per-cpu table
+// of u64 values, with gobpf_sum_entries. It returns false, leaving sums
+// empty, without NULL key support (Linux < 4.12): the keys are then
+// walked by a cursor, which makes sure none is visited twice.
+func (table *Table) sumAllBatched(sums map[string]uint64) (bool, error) {
+	desc := table.Desc()
+	// gobpf_sum_entries reads the values as the u64 slots of a per-cpu
+	// lookup, which smaller values only partly fill.
+	if desc.LeafSize != 8 {
+		return false, fmt.Errorf("table %s has a leaf size of %d bytes, expected 8", desc.Name, desc.LeafSize)
+	}
+	ncpus, err := numPossibleCPUs()
+	if err != nil {
+		return false, err
+	}
+	fd := C.int(desc.FD)
+	keySize := int(desc.KeySize)
+	key := make([]byte, keySize)
+	ok, legacy, err := table.firstKey(fd, key)
+	if legacy {
+		return false, nil
+	}
+	if err != nil || !ok {
+		return err == nil, err
+	}
+	keys := make([]byte, maxCursorBatch*keySize)
+	batch := make([]uint64, maxCursorBatch)
+	values := make([]uint64, ncpus)
+	keyStr := make([]byte, keySize*8)
+	first := C.int(1)
+	for {
+		var dropped, errno, failedLookup C.int
+		n := C.gobpf_sum_entries(fd, unsafe.Pointer(&key[0]), C.size_t(keySize), first,
+			unsafe.Pointer(&keys[0]), (*C.__u64)(unsafe.Pointer(&batch[0])), (*C.__u64)(unsafe.Pointer(&values[0])),
+			C.int(ncpus), C.int(len(batch)), &dropped, &errno, &failedLookup)
+		first = 0
+		if dropped > 0 {
+			debugf("table %s: %d keys deleted while iterating, skipped", desc.Name, dropped)
+		}
+		for i := 0; i < int(n); i++ {
+			var k string
+			k, keyStr, err = table.keyToString(keyStr, unsafe.Pointer(&keys[i*keySize]))
+			if err != nil {
+				return false, fmt.Errorf("unable to format key (%x): %w", keys[i*keySize:(i+1)*keySize], err)
+			}
+			sums[k] = batch[i]
+		}
+		switch err := syscall.Errno(errno); {
+		case err == 0:
+		case failedLookup != 0:
+			return false, fmt.Errorf("unable to lookup element (%x): %w", key, mapErrno(err))
+		case err == syscall.ENOENT:
+			return true, nil
+		default:
+			return false, fmt.Errorf("unable to get next key: %w", mapErrno(err))
+		}
+	}
+}
+
+// checkSummable returns an error unless the table is a per-cpu table
+// with integer values.
+func (table *Table) checkSummable() error {
+	if err := table.checkOp(opLookup); err != nil {
+		return err
+	}
+	desc := table.Desc()
+	if !desc.MapType.IsPerCPU() {
+		return fmt.Errorf("%v table %s is not a per-cpu table: %w", desc.MapType, desc.Name, ErrOperationNotSupported)
+	}
+	switch desc.LeafSize {
+	case 1, 2, 4, 8:
+		return nil
+	}
+	return fmt.Errorf("table %s has a leaf size of %d bytes, expected an integer of 1, 2, 4 or 8 bytes", desc.Name, desc.LeafSize)
+}
+
+func sumValues(values [][]byte) uint64 {
+	var sum uint64
+	for _, v := range values {
+		switch len(v) {
+		case 1:
+			sum += uint64(v[0])
+		case 2:
+			sum += uint64(byteOrder.Uint16(v))
+		case 4:
+			sum += uint64(byteOrder.Uint32(v))
+		case 8:
+			sum += byteOrder.Uint64(v)
+		}
+	}
+	return sum
+}
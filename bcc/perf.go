@@ -66,6 +66,14 @@ func init() {
 	}
 }
 
+// GetHostByteOrder returns the byte order of the host, which BPF
+// programs and the kernel use for map keys and values. Fields such as
+// ports and addresses are often stored in network (big endian) order
+// instead, see the `bpf:"be"` struct tag of GetStruct and TypedTable.
+func GetHostByteOrder() binary.ByteOrder {
+	return byteOrder
+}
+
 func registerCallback(data *callbackData) uint64 {
 	mu.Lock()
 	defer mu.Unlock()
@@ -101,16 +109,33 @@ func callback_to_go(cbCookie unsafe.Pointer, raw unsafe.Pointer, rawSize C.int)
 	}()
 }
 
-// InitPerfMap initializes a perf map with a receiver channel.
+// InitPerfMap initializes a perf map with a receiver channel. The
+// table must be a perf event array, declared with BPF_PERF_OUTPUT; a
+// perf buffer is opened for each online cpu and set in the slot of
+// the cpu, as open_perf_buffer does in bcc. Other tables return an
+// error wrapping ErrOperationNotSupported.
 func InitPerfMap(table *Table, receiverChan chan []byte) (*PerfMap, error) {
-	fd := table.Config()["fd"].(int)
-	keySize := table.Config()["key_size"].(uint64)
-	leafSize := table.Config()["leaf_size"].(uint64)
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	desc := table.Desc()
+	if desc.MapType != MapTypePerfEventArray {
+		return nil, fmt.Errorf("InitPerfMap: %v table %s is not a perf event array: %w", desc.MapType, desc.Name, ErrOperationNotSupported)
+	}
+	fd := desc.FD
+	keySize := desc.KeySize
+	leafSize := desc.LeafSize
 
 	if keySize != 4 || leafSize != 4 {
 		return nil, fmt.Errorf("passed table has wrong size")
 	}
 
+	cpus, err := cpuonline.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine online cpus: %v", err)
+	}
+
 	callbackDataIndex := registerCallback(&callbackData{
 		receiverChan,
 	})
@@ -121,32 +146,31 @@ func InitPerfMap(table *Table, receiverChan chan []byte) (*PerfMap, error) {
 	leafP := unsafe.Pointer(&leaf[0])
 
 	readers := []*C.struct_perf_reader{}
-
-	cpus, err := cpuonline.Get()
-	if err != nil {
-		return nil, fmt.Errorf("failed to determine online cpus: %v", err)
+	fail := func(err error) (*PerfMap, error) {
+		for _, reader := range readers {
+			C.perf_reader_free(unsafe.Pointer(reader))
+		}
+		unregisterCallback(callbackDataIndex)
+		return nil, err
 	}
 
 	for _, cpu := range cpus {
 		cpuC := C.int(cpu)
 		reader, err := C.bpf_open_perf_buffer((C.perf_reader_raw_cb)(unsafe.Pointer(C.callback_to_go)), unsafe.Pointer(uintptr(callbackDataIndex)), -1, cpuC, BPF_PERF_READER_PAGE_CNT)
 		if reader == nil {
-			return nil, fmt.Errorf("failed to open perf buffer: %v", err)
+			return fail(fmt.Errorf("failed to open perf buffer: %v", err))
 		}
 
 		perfFd := C.perf_reader_fd((*C.struct_perf_reader)(reader))
 
 		readers = append(readers, (*C.struct_perf_reader)(reader))
 
+		byteOrder.PutUint32(key, uint32(cpu))
 		byteOrder.PutUint32(leaf, uint32(perfFd))
 
 		r, err := C.bpf_update_elem(C.int(fd), keyP, leafP, 0)
 		if r != 0 {
-			return nil, fmt.Errorf("unable to initialize perf map: %v", err)
-		}
-		r = C.bpf_get_next_key(C.int(fd), keyP, keyP)
-		if r != 0 {
-			break
+			return fail(fmt.Errorf("unable to initialize perf map: %v", err))
 		}
 	}
 	return &PerfMap{
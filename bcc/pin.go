@@ -0,0 +1,186 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <stdlib.h>
+#include <unistd.h>
+#include <bcc/bpf_common.h>
+#include <bcc/libbpf.h>
+*/
+import "C"
+
+// Pin pins the table to path, which must be on a mounted bpf
+// filesystem. The map then outlives the module and can be opened
+// again with NewTableFromPinned.
+func (table *Table) Pin(path string) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkModule(); err != nil {
+		return err
+	}
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+	r, err := C.bpf_obj_pin(C.int(table.Desc().FD), pathC)
+	if r != 0 {
+		return fmt.Errorf("error pinning table %s to %q: %v", table.Name(), path, err)
+	}
+	return nil
+}
+
+// Unpin removes the pin at path. The map is freed once no program,
+// module or table references it anymore.
+func (table *Table) Unpin(path string) error {
+	if err := syscall.Unlink(path); err != nil {
+		return fmt.Errorf("error unpinning %q: %v", path, err)
+	}
+	return nil
+}
+
+// NewTableFromPinned opens the table pinned at path.
+//
+// The returned table is not backed by a module: it has no key and
+// leaf descriptions, so only the byte level operations (GetBytes,
+// SetBytes, DeleteBytes, IterBytes, ...) are available. The string
+// based ones return ErrNoModule. The table must be closed with Close.
+func NewTableFromPinned(path string) (*Table, error) {
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+	fd, err := C.bpf_obj_get(pathC)
+	if fd < 0 {
+		return nil, fmt.Errorf("error opening pinned table %q: %v", path, err)
+	}
+	table, err := newTableFromFD(int(fd), filepath.Base(path))
+	if err != nil {
+		C.close(fd)
+		return nil, fmt.Errorf("error opening pinned table %q: %v", path, err)
+	}
+	return table, nil
+}
+
+// newTableFromFD returns a table not backed by a module for the map
+// fd. The table takes ownership of fd on success.
+func newTableFromFD(fd int, name string) (*Table, error) {
+	info, err := GetMapInfo(fd)
+	if err != nil {
+		return nil, err
+	}
+	table := &Table{ownFD: true, done: make(chan struct{})}
+	table.desc.Store(&TableDesc{
+		Name:     name,
+		FD:       fd,
+		KeySize:  uint64(info.KeySize),
+		LeafSize: uint64(info.ValueSize),
+		MapType:  info.Type,
+	})
+	return table, nil
+}
+
+// Close releases the file descriptor of a table that is not backed by
+// a module. For module tables it is a no-op, the module owns the map.
+func (table *Table) Close() error {
+	if table == nil || !table.ownFD {
+		return nil
+	}
+	table.fdMu.Lock()
+	defer table.fdMu.Unlock()
+	if table.closed {
+		return nil
+	}
+	table.closed = true
+	close(table.done)
+	if err := syscall.Close(table.desc.Load().FD); err != nil && err != syscall.EBADF {
+		return err
+	}
+	return nil
+}
+
+// bpfObjKind returns the kind of the bpf object fd, "bpf-prog",
+// "bpf-map", "bpf-link"..., from its anonymous inode.
+func bpfObjKind(fd int) (string, error) {
+	target, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(target, "anon_inode:"), nil
+}
+
+// pinError returns the error for a failed pin or open of path.
+func pinError(op, path string, err error) error {
+	if err == syscall.EPERM {
+		return fmt.Errorf("error %s %q: bpffs not mounted or permissions: %v", op, path, err)
+	}
+	return fmt.Errorf("error %s %q: %v", op, path, err)
+}
+
+// PinProgram pins the program fd to path, which must be on a mounted
+// bpf filesystem. The program then outlives the process, e.g. attached
+// to tc or XDP, and can be opened again with LoadPinnedProgram.
+func PinProgram(fd int, path string) error {
+	if kind, err := bpfObjKind(fd); err != nil || kind != "bpf-prog" {
+		return fmt.Errorf("error pinning program to %q: fd %d is not a BPF program", path, fd)
+	}
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+	if r, err := C.bpf_obj_pin(C.int(fd), pathC); r != 0 {
+		return pinError("pinning program to", path, err)
+	}
+	return nil
+}
+
+// LoadPinnedProgram opens the program pinned at path and returns a new
+// fd for it, e.g. to replace it. The caller owns the fd: modules don't
+// close it unless given with TakeOwnership.
+func LoadPinnedProgram(path string) (int, error) {
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+	fd, err := C.bpf_obj_get(pathC)
+	if fd < 0 {
+		return -1, pinError("opening pinned program", path, err)
+	}
+	if kind, err := bpfObjKind(int(fd)); err != nil || kind != "bpf-prog" {
+		C.close(fd)
+		if err != nil {
+			return -1, fmt.Errorf("error opening pinned program %q: %v", path, err)
+		}
+		return -1, fmt.Errorf("error opening pinned program %q: %s is not a program", path, kind)
+	}
+	return int(fd), nil
+}
+
+// TakeOwnership makes the module close fd on Close, e.g. for a program
+// opened with LoadPinnedProgram.
+func (bpf *Module) TakeOwnership(fd int) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	bpf.ownedFDs = append(bpf.ownedFDs, fd)
+	return nil
+}
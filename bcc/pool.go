@@ -0,0 +1,63 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// bufPools pools scratch buffers by size class: buffers of class c
+// have a capacity of 1<<c bytes. Buffers larger than the largest class
+// are not pooled.
+var bufPools [21]sync.Pool
+
+// sizeClass returns the class of the buffers that fit n bytes.
+func sizeClass(n int) int {
+	if n <= 1 {
+		return 0
+	}
+	return bits.Len(uint(n - 1))
+}
+
+// getBuf returns a zeroed buffer of n bytes: sscanf doesn't write the
+// padding of structs, which must not carry the bytes of previous keys.
+// Release it with putBuf once neither it nor anything sliced from it
+// is used.
+func getBuf(n int) *[]byte {
+	c := sizeClass(n)
+	if c >= len(bufPools) {
+		b := make([]byte, n)
+		return &b
+	}
+	if p, ok := bufPools[c].Get().(*[]byte); ok {
+		*p = (*p)[:n]
+		clear(*p)
+		return p
+	}
+	b := make([]byte, n, 1<<c)
+	return &b
+}
+
+// putBuf returns a buffer of getBuf to its pool. Buffers replaced by
+// one of another capacity, e.g. grown by formatTo, are pooled if their
+// capacity is that of a class.
+func putBuf(p *[]byte) {
+	c := sizeClass(cap(*p))
+	if c >= len(bufPools) || cap(*p) != 1<<c {
+		return
+	}
+	bufPools[c].Put(p)
+}
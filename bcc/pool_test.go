@@ -0,0 +1,65 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import "testing"
+
+func TestBufPool(t *testing.T) {
+	for _, tt := range []struct {
+		n, class int
+	}{
+		{0, 0}, {1, 0}, {2, 1}, {3, 2}, {4, 2}, {5, 3}, {4096, 12}, {4097, 13},
+	} {
+		if got := sizeClass(tt.n); got != tt.class {
+			t.Errorf("sizeClass(%d) = %d, expected %d", tt.n, got, tt.class)
+		}
+	}
+
+	p := getBuf(20)
+	if len(*p) != 20 || cap(*p) != 32 {
+		t.Fatalf("got len %d cap %d, expected 20 and 32", len(*p), cap(*p))
+	}
+	for i := range *p {
+		(*p)[i] = 0xff
+	}
+	putBuf(p)
+	// Reused buffers are zeroed.
+	for i := 0; i < 10; i++ {
+		p := getBuf(24)
+		for _, b := range *p {
+			if b != 0 {
+				t.Fatalf("buffer not zeroed: %x", *p)
+			}
+		}
+		putBuf(p)
+	}
+
+	// Buffers replaced by one of a capacity other than a class's are
+	// dropped.
+	p = getBuf(8)
+	*p = make([]byte, 10)
+	putBuf(p)
+
+	if n := len(*getBuf(len(bufPools) << 20)); n != len(bufPools)<<20 {
+		t.Fatalf("got %d bytes, expected %d", n, len(bufPools)<<20)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		putBuf(getBuf(100))
+	})
+	if allocs > 0 {
+		t.Errorf("got %v allocations per reused buffer, expected none", allocs)
+	}
+}
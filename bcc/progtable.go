@@ -0,0 +1,84 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+)
+
+// ProgTable wraps a BPF_PROG_ARRAY table, holding the programs that
+// bpf_tail_call() jumps to.
+type ProgTable struct {
+	*Table
+}
+
+// NewProgTable returns a ProgTable for table.
+func NewProgTable(table *Table) *ProgTable {
+	return &ProgTable{table}
+}
+
+func (pt *ProgTable) check(op mapOp) error {
+	if err := pt.checkArray(op); err != nil {
+		return err
+	}
+	desc := pt.Desc()
+	if desc.MapType != MapTypeProgArray {
+		return fmt.Errorf("%v table %s is not a program array: %w", desc.MapType, desc.Name, ErrOperationNotSupported)
+	}
+	if desc.LeafSize != 4 {
+		return fmt.Errorf("program array %s has a leaf size of %d bytes, expected 4", desc.Name, desc.LeafSize)
+	}
+	return nil
+}
+
+// SetProg stores the program progFD at index, as returned by the Load*
+// functions of Module. Programs stored in a program array must have the
+// type of the program doing the tail call.
+func (pt *ProgTable) SetProg(index uint32, progFD int) error {
+	if err := pt.rlock(); err != nil {
+		return err
+	}
+	defer pt.runlock()
+	if err := pt.check(opUpdate); err != nil {
+		return err
+	}
+	leaf := make([]byte, 4)
+	byteOrder.PutUint32(leaf, uint32(progFD))
+	return pt.SetAt(index, leaf)
+}
+
+// DeleteProg removes the program at index. Tail calls to index then
+// fall through.
+func (pt *ProgTable) DeleteProg(index uint32) error {
+	if err := pt.rlock(); err != nil {
+		return err
+	}
+	defer pt.runlock()
+	if err := pt.check(opDelete); err != nil {
+		return err
+	}
+	key := make([]byte, 4)
+	byteOrder.PutUint32(key, index)
+	return pt.DeleteBytes(key)
+}
+
+// progID returns the id of the program fd.
+func progID(fd int) (uint32, error) {
+	info, err := GetProgInfo(fd)
+	if err != nil {
+		return 0, err
+	}
+	return info.ID, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import "fmt"
+
+// ProgramType is the type of a BPF program (BPF_PROG_TYPE_*).
+type ProgramType uint32
+
+const (
+	ProgramTypeUnspec ProgramType = iota
+	ProgramTypeSocketFilter
+	ProgramTypeKprobe
+	ProgramTypeSchedCLS
+	ProgramTypeSchedACT
+	ProgramTypeTracepoint
+	ProgramTypeXDP
+	ProgramTypePerfEvent
+	ProgramTypeCgroupSKB
+	ProgramTypeCgroupSock
+	ProgramTypeLWTIn
+	ProgramTypeLWTOut
+	ProgramTypeLWTXmit
+	ProgramTypeSockOps
+	ProgramTypeSKSKB
+	ProgramTypeCgroupDevice
+	ProgramTypeSKMsg
+	ProgramTypeRawTracepoint
+	ProgramTypeCgroupSockAddr
+	ProgramTypeLWTSeg6Local
+	ProgramTypeLircMode2
+	ProgramTypeSKReuseport
+	ProgramTypeFlowDissector
+	ProgramTypeCgroupSysctl
+	ProgramTypeRawTracepointWritable
+	ProgramTypeCgroupSockopt
+	ProgramTypeTracing
+	ProgramTypeStructOps
+	ProgramTypeExt
+	ProgramTypeLSM
+	ProgramTypeSKLookup
+)
+
+var programTypeNames = [...]string{
+	ProgramTypeUnspec:                "unspec",
+	ProgramTypeSocketFilter:          "socket_filter",
+	ProgramTypeKprobe:                "kprobe",
+	ProgramTypeSchedCLS:              "sched_cls",
+	ProgramTypeSchedACT:              "sched_act",
+	ProgramTypeTracepoint:            "tracepoint",
+	ProgramTypeXDP:                   "xdp",
+	ProgramTypePerfEvent:             "perf_event",
+	ProgramTypeCgroupSKB:             "cgroup_skb",
+	ProgramTypeCgroupSock:            "cgroup_sock",
+	ProgramTypeLWTIn:                 "lwt_in",
+	ProgramTypeLWTOut:                "lwt_out",
+	ProgramTypeLWTXmit:               "lwt_xmit",
+	ProgramTypeSockOps:               "sock_ops",
+	ProgramTypeSKSKB:                 "sk_skb",
+	ProgramTypeCgroupDevice:          "cgroup_device",
+	ProgramTypeSKMsg:                 "sk_msg",
+	ProgramTypeRawTracepoint:         "raw_tracepoint",
+	ProgramTypeCgroupSockAddr:        "cgroup_sock_addr",
+	ProgramTypeLWTSeg6Local:          "lwt_seg6local",
+	ProgramTypeLircMode2:             "lirc_mode2",
+	ProgramTypeSKReuseport:           "sk_reuseport",
+	ProgramTypeFlowDissector:         "flow_dissector",
+	ProgramTypeCgroupSysctl:          "cgroup_sysctl",
+	ProgramTypeRawTracepointWritable: "raw_tracepoint_writable",
+	ProgramTypeCgroupSockopt:         "cgroup_sockopt",
+	ProgramTypeTracing:               "tracing",
+	ProgramTypeStructOps:             "struct_ops",
+	ProgramTypeExt:                   "ext",
+	ProgramTypeLSM:                   "lsm",
+	ProgramTypeSKLookup:              "sk_lookup",
+}
+
+func (pt ProgramType) String() string {
+	if int(pt) < len(programTypeNames) {
+		return programTypeNames[pt]
+	}
+	return fmt.Sprintf("ProgramType(%d)", uint32(pt))
+}
@@ -0,0 +1,174 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+/*
+#include <bcc/libbpf.h>
+*/
+import "C"
+
+// elemOps runs the element commands of bpf(2) on the map fd, returning
+// the errno of failed commands. Tables run the commands themselves
+// unless testElems returns other elemOps for them.
+type elemOps interface {
+	lookup(fd int, key, leaf unsafe.Pointer) error
+	update(fd int, key, leaf unsafe.Pointer, flags uint64) error
+	delete(fd int, key unsafe.Pointer) error
+}
+
+// testElems, set by tests only, returns the element commands faking the
+// map of a table or injecting errors, or nil.
+var testElems func(table *Table) elemOps
+
+func lookupElem(fd int, key, leaf unsafe.Pointer) error {
+	if r, err := C.bpf_lookup_elem(C.int(fd), key, leaf); r != 0 {
+		return err
+	}
+	return nil
+}
+
+func updateElem(fd int, key, leaf unsafe.Pointer, flags uint64) error {
+	if r, err := C.bpf_update_elem(C.int(fd), key, leaf, C.ulonglong(flags)); r != 0 {
+		return err
+	}
+	return nil
+}
+
+func deleteElem(fd int, key unsafe.Pointer) error {
+	if r, err := C.bpf_delete_elem(C.int(fd), key); r != 0 {
+		return err
+	}
+	return nil
+}
+
+// RetryPolicy retries the element operations of a table failing with
+// EAGAIN or EBUSY, which the kernel returns transiently under load,
+// e.g. when updating LRU maps. Other errors, such as a missing or an
+// existing key, are never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts of an operation,
+	// including the first one. 0 or 1 disables retries.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled before
+	// each following one. Zero retries immediately.
+	Backoff time.Duration
+	// MaxBackoff, if set, caps the delay between retries.
+	MaxBackoff time.Duration
+}
+
+// SetRetryPolicy sets the retry policy of the element operations of the
+// table: Get, GetEntry, GetBytes, GetInto, GetAt, Set, SetWithFlags,
+// SetBytes, SetFrom, SetAt, Delete, DeleteBytes and GetAndDelete, and
+// the lookups, updates and deletes of Iter, Iterator, Entries and their
+// variants, IterParallel, SumAll and the element-wise paths of
+// Snapshot, DeleteAll and ZeroAll. With a policy, the iterations and
+// SumAll look up each entry from Go rather than in batches from C. The
+// batch commands, those of GetBatch, SetBatch, DeleteBatch and of the
+// batch paths of Snapshot, DrainAll, DeleteAll and ZeroAll (see
+// SetBatchOps), are not retried. Tables don't retry by default.
+func (table *Table) SetRetryPolicy(policy RetryPolicy) {
+	if policy.MaxAttempts <= 1 {
+		table.retryPolicy.Store(nil)
+		return
+	}
+	table.retryPolicy.Store(&policy)
+}
+
+// isTransient reports whether err is retried by retry policies.
+func isTransient(err error) bool {
+	return err == syscall.EAGAIN || err == syscall.EBUSY
+}
+
+// retry runs op again, after it failed with err, until it doesn't fail
+// with a transient errno, as allowed by the retry policy of the table.
+// Callers check err first, so that operations that succeed don't
+// allocate op.
+func (table *Table) retry(err error, op func() error) error {
+	policy := table.retryPolicy.Load()
+	if policy == nil {
+		return err
+	}
+	backoff := policy.Backoff
+	for attempt := 1; attempt < policy.MaxAttempts && isTransient(err); attempt++ {
+		if backoff > 0 {
+			time.Sleep(backoff)
+			if backoff *= 2; policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
+		}
+		err = op()
+	}
+	return err
+}
+
+// elemLookup, elemUpdate and elemDelete run an element command once,
+// calling the syscall directly unless testElems is set.
+
+func (table *Table) elemLookup(fd int, key, leaf unsafe.Pointer) error {
+	if testElems != nil {
+		if elems := testElems(table); elems != nil {
+			return elems.lookup(fd, key, leaf)
+		}
+	}
+	return lookupElem(fd, key, leaf)
+}
+
+func (table *Table) elemUpdate(fd int, key, leaf unsafe.Pointer, flags uint64) error {
+	if testElems != nil {
+		if elems := testElems(table); elems != nil {
+			return elems.update(fd, key, leaf, flags)
+		}
+	}
+	return updateElem(fd, key, leaf, flags)
+}
+
+func (table *Table) elemDelete(fd int, key unsafe.Pointer) error {
+	if testElems != nil {
+		if elems := testElems(table); elems != nil {
+			return elems.delete(fd, key)
+		}
+	}
+	return deleteElem(fd, key)
+}
+
+func (table *Table) lookupElem(fd int, key, leaf unsafe.Pointer) error {
+	err := table.elemLookup(fd, key, leaf)
+	if err == nil {
+		return nil
+	}
+	return table.retry(err, func() error { return table.elemLookup(fd, key, leaf) })
+}
+
+func (table *Table) updateElem(fd int, key, leaf unsafe.Pointer, flags uint64) error {
+	err := table.elemUpdate(fd, key, leaf, flags)
+	if err == nil {
+		return nil
+	}
+	return table.retry(err, func() error { return table.elemUpdate(fd, key, leaf, flags) })
+}
+
+func (table *Table) deleteElem(fd int, key unsafe.Pointer) error {
+	err := table.elemDelete(fd, key)
+	if err == nil {
+		return nil
+	}
+	return table.retry(err, func() error { return table.elemDelete(fd, key) })
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// failingElems are element commands failing with the errnos errs, then
+// succeeding. They count the calls in n.
+type failingElems struct {
+	errs []error
+	n    int
+}
+
+func (f *failingElems) call() error {
+	f.n++
+	if f.n <= len(f.errs) {
+		return f.errs[f.n-1]
+	}
+	return nil
+}
+
+func (f *failingElems) lookup(fd int, key, leaf unsafe.Pointer) error {
+	return f.call()
+}
+
+func (f *failingElems) update(fd int, key, leaf unsafe.Pointer, flags uint64) error {
+	return f.call()
+}
+
+func (f *failingElems) delete(fd int, key unsafe.Pointer) error {
+	return f.call()
+}
+
+func TestRetryPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		policy RetryPolicy
+		errs   []error
+		want   error
+		calls  int
+	}{
+		{"off", RetryPolicy{}, []error{syscall.EAGAIN}, syscall.EAGAIN, 1},
+		{"retried", RetryPolicy{MaxAttempts: 3}, []error{syscall.EAGAIN, syscall.EBUSY}, nil, 3},
+		{"bounded", RetryPolicy{MaxAttempts: 2}, []error{syscall.EBUSY, syscall.EBUSY, syscall.EBUSY}, syscall.EBUSY, 2},
+		{"backoff", RetryPolicy{MaxAttempts: 4, Backoff: time.Microsecond, MaxBackoff: 2 * time.Microsecond}, []error{syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN}, nil, 4},
+		{"not found", RetryPolicy{MaxAttempts: 3}, []error{syscall.ENOENT}, syscall.ENOENT, 1},
+		{"exists", RetryPolicy{MaxAttempts: 3}, []error{syscall.EEXIST}, syscall.EEXIST, 1},
+		{"transient then exists", RetryPolicy{MaxAttempts: 3}, []error{syscall.EAGAIN, syscall.EEXIST}, syscall.EEXIST, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			elems := &failingElems{errs: tt.errs}
+			table := newFakeTable(elems)
+			table.SetRetryPolicy(tt.policy)
+			if err := table.updateElem(-1, nil, nil, 0); err != tt.want {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+			if elems.n != tt.calls {
+				t.Errorf("got %d calls, want %d", elems.n, tt.calls)
+			}
+		})
+	}
+}
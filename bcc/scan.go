@@ -0,0 +1,246 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// scanToken is a token of a key or leaf string: a brace or a bracket
+// of a struct or an array, or a value, either a number or a quoted
+// string.
+type scanToken struct {
+	delim  byte
+	value  string
+	quoted bool
+}
+
+func (t scanToken) String() string {
+	switch {
+	case t.delim != 0:
+		return string(t.delim)
+	case t.quoted:
+		return `"` + t.value + `"`
+	}
+	return t.value
+}
+
+// scanTokens splits a key or leaf string into tokens. As for the
+// sscanf of bcc, strings end at the first double quote.
+func scanTokens(s string) ([]scanToken, error) {
+	var tokens []scanToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; c {
+		case ' ', '\t', '\n', '\r', '\v', '\f':
+			i++
+		case '{', '}', '[', ']':
+			tokens = append(tokens, scanToken{delim: c})
+			i++
+		case '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string %s", s[i:])
+			}
+			tokens = append(tokens, scanToken{value: s[i+1 : i+1+end], quoted: true})
+			i += end + 2
+		default:
+			end := strings.IndexAny(s[i:], " \t\n\r\v\f{}[]\"")
+			if end < 0 {
+				end = len(s) - i
+			}
+			tokens = append(tokens, scanToken{value: s[i : i+end]})
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+// checkScanned checks that the key or leaf string input scanned by
+// bcc, formatted back as formatted, holds exactly its values: sscanf
+// ignores the input left after the last value, such as a missing
+// closing brace or trailing garbage, and silently truncates numbers
+// too large for their field. desc is the key or leaf description, naming
+// the values in errors.
+func checkScanned(input, formatted, desc string) error {
+	in, err := scanTokens(input)
+	if err != nil {
+		return err
+	}
+	out, err := scanTokens(formatted)
+	if err != nil {
+		return fmt.Errorf("unable to check the input against %s: %v", formatted, err)
+	}
+	value := 0
+	name := func() string {
+		// Padding and merged bitfields of the scanned type don't line
+		// up with the description: fall back to positions.
+		if names := descValueNames(desc); len(names) == countValues(out) && value < len(names) {
+			return names[value]
+		}
+		return fmt.Sprintf("#%d", value+1)
+	}
+	for i, want := range out {
+		if i >= len(in) {
+			if want.delim != 0 {
+				return fmt.Errorf("missing %s", want)
+			}
+			return fmt.Errorf("missing field %s", name())
+		}
+		got := in[i]
+		switch {
+		case want.delim != 0:
+			if got.delim != want.delim {
+				return fmt.Errorf("expected %s, got %s", want, got)
+			}
+			continue
+		case got.delim != 0:
+			return fmt.Errorf("field %s: expected a value, got %s", name(), got)
+		case want.quoted:
+			if !got.quoted || got.value != want.value {
+				return fmt.Errorf("field %s: string %s does not fit, or is not a string", name(), got)
+			}
+		case got.quoted:
+			return fmt.Errorf("field %s: expected a number, got %s", name(), got)
+		default:
+			if err := checkNumber(got.value, want.value); err != nil {
+				return fmt.Errorf("field %s: %v", name(), err)
+			}
+		}
+		value++
+	}
+	if len(in) > len(out) {
+		return fmt.Errorf("unexpected %s after the last field", in[len(out)])
+	}
+	return nil
+}
+
+func countValues(tokens []scanToken) int {
+	n := 0
+	for _, t := range tokens {
+		if t.delim == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// checkNumber checks that the number s was scanned whole, as the value
+// formatted in hex: it fits in the bits of the field.
+func checkNumber(s, formatted string) error {
+	got, err := strconv.ParseUint(formatted, 0, 64)
+	if err != nil {
+		// Not an integer, e.g. a float: nothing to check.
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		u, uerr := strconv.ParseUint(s, 0, 64)
+		if uerr != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		if u == got {
+			return nil
+		}
+		return fmt.Errorf("number %s out of range", s)
+	}
+	for _, bits := range []uint{8, 16, 32, 64} {
+		mask := uint64(1)<<bits - 1
+		if bits == 64 {
+			mask = ^uint64(0)
+		}
+		fits := bits == 64 || (v >= -(1<<(bits-1)) && v <= int64(mask))
+		if fits && uint64(v)&mask == got {
+			return nil
+		}
+	}
+	return fmt.Errorf("number %s out of range", s)
+}
+
+// descValueNames returns the names of the values of a key or leaf
+// string of the description desc, e.g. "pid" and "comm" for a struct
+// of an integer and a char array, or nil if desc can't be parsed.
+func descValueNames(desc string) []string {
+	var d interface{}
+	if json.Unmarshal([]byte(desc), &d) != nil {
+		return nil
+	}
+	var names []string
+	if !appendValueNames(&names, d, "") {
+		return nil
+	}
+	if len(names) == 1 && names[0] == "" {
+		names[0] = "value"
+	}
+	return names
+}
+
+// isCharType reports whether arrays of the type t are scanned as
+// strings by bcc, as arrays of i8.
+func isCharType(t interface{}) bool {
+	switch t {
+	case "char", "signed char", "unsigned char":
+		return true
+	}
+	return false
+}
+
+func appendValueNames(names *[]string, d interface{}, prefix string) bool {
+	st, ok := d.([]interface{})
+	if !ok {
+		*names = append(*names, prefix)
+		return true
+	}
+	if len(st) < 2 {
+		return false
+	}
+	members, ok := st[1].([]interface{})
+	if !ok {
+		return false
+	}
+	if prefix != "" {
+		prefix += "."
+	}
+	for _, m := range members {
+		f, ok := m.([]interface{})
+		if !ok || len(f) < 2 {
+			return false
+		}
+		name, _ := f[0].(string)
+		var dims []interface{}
+		if len(f) > 2 {
+			dims, _ = f[2].([]interface{})
+		}
+		if dims == nil || isCharType(f[1]) {
+			if !appendValueNames(names, f[1], prefix+name) {
+				return false
+			}
+			continue
+		}
+		n := 1
+		for _, dim := range dims {
+			d, _ := dim.(float64)
+			n *= int(d)
+		}
+		for i := 0; i < n; i++ {
+			if !appendValueNames(names, f[1], fmt.Sprintf("%s%s[%d]", prefix, name, i)) {
+				return false
+			}
+		}
+	}
+	return true
+}
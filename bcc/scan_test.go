@@ -0,0 +1,257 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+const scanKeyDesc = `["key_t",[["pid","unsigned int"],["ids","unsigned short",[2]],["comm","char",[8]]],"struct"]`
+
+func TestCheckScanned(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		input     string
+		formatted string
+		desc      string
+		err       string
+	}{
+		{
+			name:      "scalar",
+			input:     "42",
+			formatted: "0x2a",
+			desc:      `"int"`,
+		},
+		{
+			name:      "negative",
+			input:     "-1",
+			formatted: "0xffffffff",
+			desc:      `"int"`,
+		},
+		{
+			name:      "struct",
+			input:     `{ 0x10 [ 1 2 ] "bash" }`,
+			formatted: `{ 0x10 [ 0x1 0x2 ] "bash" }`,
+			desc:      scanKeyDesc,
+		},
+		{
+			name:      "compact",
+			input:     `{0x10[1 2]"bash"}`,
+			formatted: `{ 0x10 [ 0x1 0x2 ] "bash" }`,
+			desc:      scanKeyDesc,
+		},
+		{
+			name:      "trailing garbage",
+			input:     "42 43",
+			formatted: "0x2a",
+			desc:      `"int"`,
+			err:       "unexpected 43 after the last field",
+		},
+		{
+			name:      "missing closing brace",
+			input:     `{ 0x10 [ 1 2 ] "bash"`,
+			formatted: `{ 0x10 [ 0x1 0x2 ] "bash" }`,
+			desc:      scanKeyDesc,
+			err:       "missing }",
+		},
+		{
+			name:      "missing field",
+			input:     `{ 0x10 [ 1`,
+			formatted: `{ 0x10 [ 0x1 0x2 ] "bash" }`,
+			desc:      scanKeyDesc,
+			err:       "missing field ids[1]",
+		},
+		{
+			name:      "out of range",
+			input:     `{ 0x10 [ 1 65536 ] "bash" }`,
+			formatted: `{ 0x10 [ 0x1 0x0 ] "bash" }`,
+			desc:      scanKeyDesc,
+			err:       "field ids[1]: number 65536 out of range",
+		},
+		{
+			name:      "invalid number",
+			input:     `{ 16abc [ 1 2 ] "bash" }`,
+			formatted: `{ 0x10 [ 0x1 0x2 ] "bash" }`,
+			desc:      scanKeyDesc,
+			err:       `field pid: invalid number "16abc"`,
+		},
+		{
+			name:      "string too long",
+			input:     `{ 0x10 [ 1 2 ] "bash-completion" }`,
+			formatted: `{ 0x10 [ 0x1 0x2 ] "bash-co" }`,
+			desc:      scanKeyDesc,
+			err:       "field comm: string",
+		},
+		{
+			name:      "number for a string",
+			input:     `{ 0x10 [ 1 2 ] 7 }`,
+			formatted: `{ 0x10 [ 0x1 0x2 ] "" }`,
+			desc:      scanKeyDesc,
+			err:       "field comm: string 7 does not fit",
+		},
+		{
+			name:      "unterminated string",
+			input:     `{ 0x10 [ 1 2 ] "bash }`,
+			formatted: `{ 0x10 [ 0x1 0x2 ] "bash" }`,
+			desc:      scanKeyDesc,
+			err:       "unterminated string",
+		},
+		{
+			name:      "padding",
+			input:     `{ 1 2 "" }`,
+			formatted: `{ 0x1 0x0 "" }`,
+			desc:      `["s",[["a","char"],["b","int"]],"struct"]`,
+			err:       "field #2: number 2 out of range",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkScanned(tt.input, tt.formatted, tt.desc)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, expected %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDescValueNames(t *testing.T) {
+	got := strings.Join(descValueNames(scanKeyDesc), ",")
+	if want := "pid,ids[0],ids[1],comm"; got != want {
+		t.Fatalf("got %s, expected %s", got, want)
+	}
+	got = strings.Join(descValueNames(`["v",[["n","int"],["pad","unsigned char",[3]]],"struct"]`), ",")
+	if want := "n,pad"; got != want {
+		t.Fatalf("got %s, expected %s", got, want)
+	}
+	if got := descValueNames(`"int"`); len(got) != 1 || got[0] != "value" {
+		t.Fatalf("got %q, expected [value]", got)
+	}
+}
+
+func FuzzCheckScanned(f *testing.F) {
+	f.Add("42", "0x2a", `"int"`)
+	f.Add(`{ 0x10 [ 1 2 ] "bash" }`, `{ 0x10 [ 0x1 0x2 ] "bash" }`, scanKeyDesc)
+	f.Add(`{ 1 [ 2`, `{ 0x10 [ 0x1 0x2 ] "bash" }`, scanKeyDesc)
+	f.Add(`{"a" }`, `{ "" 0x0 }`, `["s",[["a","char",[4]],["b","int"]],"struct"]`)
+	f.Fuzz(func(t *testing.T, input, formatted, desc string) {
+		err := checkScanned(input, formatted, desc)
+		if input != formatted || err == nil {
+			return
+		}
+		// The output of snprintf always checks against itself.
+		tokens, terr := scanTokens(formatted)
+		if terr != nil {
+			return
+		}
+		for _, tok := range tokens {
+			if !strings.HasPrefix(tok.value, "0x") && !tok.quoted && tok.delim == 0 {
+				return
+			}
+		}
+		t.Fatalf("%q does not check against itself: %v", formatted, err)
+	})
+}
+
+// fakeSscanf scans the NUL-terminated decimal string s into the uint32
+// at p, as bcc's sscanf does for unsigned int keys.
+func fakeSscanf(s, p unsafe.Pointer) bool {
+	var v uint32
+	n := 0
+	for ; *(*byte)(unsafe.Add(s, n)) != 0; n++ {
+		c := *(*byte)(unsafe.Add(s, n))
+		if c < '0' || c > '9' {
+			return false
+		}
+		v = v*10 + uint32(c-'0')
+	}
+	*(*uint32)(p) = v
+	return n > 0
+}
+
+// fakeToString formats the uint32 at p in hexadecimal, as bcc does.
+func fakeToString(buf []byte, p unsafe.Pointer) (string, []byte, error) {
+	buf = strconv.AppendUint(append(buf[:0], "0x"...), uint64(*(*uint32)(p)), 16)
+	return string(buf), buf, nil
+}
+
+// TestScanToConcurrent scans distinct strings from several goroutines,
+// sharing the pooled buffers that hold the strings passed to sscanf.
+// Run it with -race.
+func TestScanToConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			key := make([]byte, 4)
+			for i := 0; i < 1000; i++ {
+				// Vary the lengths to share buffers of several sizes.
+				want := uint32(g*1000+i) * uint32(1+i%7*1000)
+				if err := scanTo("key", key, strconv.FormatUint(uint64(want), 10), `"unsigned int"`, fakeSscanf, fakeToString); err != nil {
+					t.Error(err)
+					return
+				}
+				if got := *(*uint32)(unsafe.Pointer(&key[0])); got != want {
+					t.Errorf("scanned %d, expected %d", got, want)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	key := make([]byte, 4)
+	if err := scanTo("key", key, "0x10", `"unsigned int"`, fakeSscanf, fakeToString); err == nil {
+		t.Fatal("expected an error scanning 0x10 with the fake sscanf")
+	}
+	if err := scanTo("key", key, "1\x002", `"unsigned int"`, fakeSscanf, fakeToString); err == nil || !strings.Contains(err.Error(), "NUL byte at offset 1") {
+		t.Fatalf("got error %v, expected a NUL byte error", err)
+	}
+}
+
+// BenchmarkScanTo measures the allocations of scanning strings, sscanf
+// and formatting being faked.
+func BenchmarkScanTo(b *testing.B) {
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		key := make([]byte, 4)
+		for i := 0; i < b.N; i++ {
+			if err := scanTo("key", key, "12345", `"unsigned int"`, fakeSscanf, fakeToString); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			key := make([]byte, 4)
+			for pb.Next() {
+				if err := scanTo("key", key, "12345", `"unsigned int"`, fakeSscanf, fakeToString); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <bcc/bpf_common.h>
+#include <bcc/libbpf.h>
+*/
+import "C"
+
+// maxSnapshotBatch bounds the number of entries read per batch lookup
+// by Snapshot, and maxSnapshotBatchBytes the size of their values, and
+// so the memory used by a single syscall.
+const (
+	maxSnapshotBatch      = 4096
+	maxSnapshotBatchBytes = 1 << 20
+)
+
+// SnapshotBytes returns the raw entries of the table.
+//
+// Unlike Iter, the keys are all read before any value: BPF programs
+// keep updating the table meanwhile, so the snapshot is not atomic,
+// but the window is narrowed from the whole iteration to the time it
+// takes to look up the values. Entries added after the keys are read
+// are missing, entries deleted after that are skipped, and values may
+// reflect updates made up to the lookup of each. On kernels supporting
+// BPF_MAP_LOOKUP_BATCH (Linux 5.6) and for map types supporting it,
+// keys and values are read together, up to 4096 entries or 1 MiB of
+// values per syscall (fewer entries of per-cpu tables on hosts with
+// many CPUs), each batch being consistent with respect to the deletion
+// of its keys.
+// Otherwise, SnapshotBytes falls back to reading them one by one, which
+// SetBatchOps(false) forces.
+func (table *Table) SnapshotBytes() ([]RawEntry, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opLookup); err != nil {
+		return nil, err
+	}
+	var entries []RawEntry
+	err := table.dispatchBatch("SnapshotBytes", cmdLookupBatch, func() error {
+		var err error
+		entries, err = table.getBatch("SnapshotBytes", cmdLookupBatch, table.batchSize())
+		return err
+	}, func() error {
+		var err error
+		entries, err = table.snapshotBytes()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// snapshotBytes reads the keys of the table, then their values one by
+// one.
+func (table *Table) snapshotBytes() ([]RawEntry, error) {
+	cur, err := table.newCursor()
+	if err != nil {
+		return nil, err
+	}
+	cur.keysOnly = true
+	var keys [][]byte
+	for cur.next() {
+		keys = append(keys, append([]byte(nil), cur.key...))
+	}
+	if cur.err != nil {
+		return nil, fmt.Errorf("Table.SnapshotBytes: %w", cur.err)
+	}
+	entries := make([]RawEntry, 0, len(keys))
+	for _, key := range keys {
+		leaf := make([]byte, len(cur.leaf))
+		if err := table.lookupElem(int(cur.fd), unsafe.Pointer(&key[0]), unsafe.Pointer(&leaf[0])); err != nil {
+			if err == syscall.ENOENT {
+				continue
+			}
+			return nil, fmt.Errorf("Table.SnapshotBytes: unable to lookup element (%x): %w", key, mapErrno(err))
+		}
+		entries = append(entries, RawEntry{Key: key, Value: leaf})
+	}
+	return entries, nil
+}
+
+// Snapshot returns the entries of the table read as for SnapshotBytes,
+// formatted and keyed by their formatted key.
+func (table *Table) Snapshot() (map[string]string, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkFormat(); err != nil {
+		return nil, err
+	}
+	entries, err := table.SnapshotBytes()
+	if err != nil {
+		return nil, err
+	}
+	desc := table.Desc()
+	keyStr := make([]byte, desc.KeySize*8)
+	leafStr := make([]byte, desc.LeafSize*8)
+	snapshot := make(map[string]string, len(entries))
+	for _, e := range entries {
+		var k, v string
+		k, keyStr, err = table.keyToString(keyStr, unsafe.Pointer(&e.Key[0]))
+		if err != nil {
+			return nil, fmt.Errorf("Table.Snapshot: unable to format key (%x): %w", e.Key, err)
+		}
+		v, _, leafStr, err = table.formatLeaf(leafStr, e.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Table.Snapshot: unable to format leaf of (%s): %w", k, err)
+		}
+		snapshot[k] = v
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+// soAttachBPF is SO_ATTACH_BPF, missing from package syscall.
+const soAttachBPF = 50
+
+// LoadSocketFilter loads a program of type BPF_PROG_TYPE_SOCKET_FILTER.
+func (bpf *Module) LoadSocketFilter(name string) (int, error) {
+	return bpf.Load(name, ProgramTypeSocketFilter, 0, 0)
+}
+
+// htons converts a short from host to network byte order.
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return byteOrder.Uint16(b)
+}
+
+// AttachSocketFilter opens a non-blocking packet socket receiving all
+// the packets of the network interface ifName, attaches the socket
+// filter progFD to it and returns the socket fd. The caller owns the
+// socket and closes it when done, which detaches the filter.
+func AttachSocketFilter(ifName string, progFD int) (int, error) {
+	index, err := interfaceIndex(ifName)
+	if err != nil {
+		return -1, err
+	}
+	proto := htons(syscall.ETH_P_ALL)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return -1, fmt.Errorf("unable to open packet socket: %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: index}); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("unable to bind packet socket to %s: %v", ifName, err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soAttachBPF, progFD); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("failed to attach BPF socket filter to %s: %v", ifName, err)
+	}
+	return fd, nil
+}
+
+// DetachSocketFilter detaches the socket filter from the socket
+// socketFD, which stays open.
+func DetachSocketFilter(socketFD int) error {
+	if err := syscall.SetsockoptInt(socketFD, syscall.SOL_SOCKET, syscall.SO_DETACH_FILTER, 0); err != nil {
+		return fmt.Errorf("failed to detach BPF socket filter: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// SockAttachType is the hook of a sockmap or sockhash a program is
+// attached to (BPF_SK_SKB_* and BPF_SK_MSG_VERDICT).
+type SockAttachType uint32
+
+const (
+	// SockSKBStreamParser parses the messages of the TCP streams of
+	// the sockets, for SockSKBStreamVerdict.
+	SockSKBStreamParser SockAttachType = 4
+	// SockSKBStreamVerdict decides on the messages parsed, e.g.
+	// redirecting them to another socket of the map.
+	SockSKBStreamVerdict SockAttachType = 5
+	// SockMsgVerdict decides on the messages sent by the sockets, for
+	// sk_msg programs.
+	SockMsgVerdict SockAttachType = 7
+	// SockSKBVerdict decides on the data received by the sockets,
+	// without a parser (Linux 5.13).
+	SockSKBVerdict SockAttachType = 38
+)
+
+// sockAttachment is a program attached to a sockmap through a module.
+type sockAttachment struct {
+	mapFD      int
+	progFD     int
+	attachType SockAttachType
+}
+
+// LoadSkSkb loads a program of type BPF_PROG_TYPE_SK_SKB.
+func (bpf *Module) LoadSkSkb(name string) (int, error) {
+	return bpf.Load(name, ProgramTypeSKSKB, 0, 0)
+}
+
+// LoadSkMsg loads a program of type BPF_PROG_TYPE_SK_MSG.
+func (bpf *Module) LoadSkMsg(name string) (int, error) {
+	return bpf.Load(name, ProgramTypeSKMsg, 0, 0)
+}
+
+// isSockMap reports whether maps of type mt hold sockets.
+func isSockMap(mt MapType) bool {
+	return mt == MapTypeSockmap || mt == MapTypeSockhash
+}
+
+// AttachSockProg attaches a sk_skb or sk_msg program fd to the hook
+// attachType of the sockmap or sockhash mapFD, e.g. the fd of a table
+// declared with BPF_SOCKMAP, running it on the sockets of the map. The
+// error wraps ErrOperationNotSupported if mapFD isn't a sockmap or
+// sockhash, and ErrNotSupported if the kernel lacks the hook. Close
+// detaches the program.
+func (bpf *Module) AttachSockProg(mapFD, progFD int, attachType SockAttachType) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	id := fmt.Sprintf("%d:%d:%d", mapFD, attachType, progFD)
+	if attached, err := bpf.checkAttached(AttachmentSockProg, id, progFD); attached {
+		return err
+	}
+	info, err := GetMapInfo(mapFD)
+	if err != nil {
+		return fmt.Errorf("failed to attach BPF sock program: %v", err)
+	}
+	if !isSockMap(info.Type) {
+		return fmt.Errorf("failed to attach BPF sock program: %v map %s: %w", info.Type, info.Name, ErrOperationNotSupported)
+	}
+	if err := progAttach(mapFD, progFD, uint32(attachType), 0); err != nil {
+		if err == syscall.EINVAL {
+			return fmt.Errorf("failed to attach BPF sock program to map %s: %v: %w", info.Name, err, ErrNotSupported)
+		}
+		return fmt.Errorf("failed to attach BPF sock program to map %s: %v", info.Name, err)
+	}
+	bpf.sockAttachments = append(bpf.sockAttachments, sockAttachment{
+		mapFD:      mapFD,
+		progFD:     progFD,
+		attachType: attachType,
+	})
+	bpf.recordAttachment(AttachmentSockProg, id, fmt.Sprintf("map fd %d", mapFD), progFD)
+	return nil
+}
+
+// detachSockProg detaches the i-th sockmap attachment. Callers must
+// hold bpf.mu.
+func (bpf *Module) detachSockProg(i int) error {
+	a := bpf.sockAttachments[i]
+	bpf.sockAttachments = append(bpf.sockAttachments[:i], bpf.sockAttachments[i+1:]...)
+	bpf.forgetAttachment(AttachmentSockProg, fmt.Sprintf("%d:%d:%d", a.mapFD, a.attachType, a.progFD))
+	if err := progDetach(a.mapFD, a.progFD, uint32(a.attachType)); err != nil {
+		return fmt.Errorf("failed to detach BPF sock program from map fd %d: %v", a.mapFD, err)
+	}
+	return nil
+}
+
+// DetachSockProg detaches a program fd attached by AttachSockProg.
+func (bpf *Module) DetachSockProg(mapFD, progFD int, attachType SockAttachType) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	for i, a := range bpf.sockAttachments {
+		if a.mapFD == mapFD && a.progFD == progFD && a.attachType == attachType {
+			return bpf.detachSockProg(i)
+		}
+	}
+	return fmt.Errorf("no sock program attached to map fd %d", mapFD)
+}
+
+// UpdateSocket sets the socket socketFD, e.g. of a connected TCP
+// socket, at key in a sockmap or sockhash table. The map holds a
+// reference to the socket itself, and socketFD can be closed after.
+// Other tables return an error wrapping ErrOperationNotSupported.
+// Entries are deleted with DeleteBytes.
+func (table *Table) UpdateSocket(key []byte, socketFD int) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkModule(); err != nil {
+		return err
+	}
+	desc := table.Desc()
+	if !isSockMap(desc.MapType) {
+		return fmt.Errorf("Table.UpdateSocket: %v table %s is not a sockmap: %w", desc.MapType, desc.Name, ErrOperationNotSupported)
+	}
+	leaf := make([]byte, desc.LeafSize)
+	switch len(leaf) {
+	case 4:
+		byteOrder.PutUint32(leaf, uint32(socketFD))
+	case 8:
+		byteOrder.PutUint64(leaf, uint64(socketFD))
+	default:
+		return fmt.Errorf("Table.UpdateSocket: sockmap %s has a leaf size of %d bytes, expected 4 or 8", desc.Name, len(leaf))
+	}
+	if err := table.SetBytes(key, leaf); err != nil {
+		return fmt.Errorf("Table.UpdateSocket: socket fd %d: %w", socketFD, err)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// StackTable wraps a BPF_STACK_TRACE table, which maps the stack ids
+// returned by bpf_get_stackid() to instruction pointers.
+type StackTable struct {
+	*Table
+}
+
+// NewStackTable returns a StackTable for table.
+func NewStackTable(table *Table) *StackTable {
+	return &StackTable{table}
+}
+
+func (st *StackTable) check(op mapOp) error {
+	if err := st.checkOp(op); err != nil {
+		return err
+	}
+	desc := st.Desc()
+	if desc.MapType != MapTypeStackTrace {
+		return fmt.Errorf("%v table %s is not a stack trace table: %w", desc.MapType, desc.Name, ErrOperationNotSupported)
+	}
+	if desc.KeySize != 4 || desc.LeafSize%8 != 0 {
+		return fmt.Errorf("stack trace table %s has unexpected key or leaf size (%d, %d)", desc.Name, desc.KeySize, desc.LeafSize)
+	}
+	return nil
+}
+
+// GetStack returns the instruction pointers of the stack stackID,
+// innermost frame first.
+func (st *StackTable) GetStack(stackID int) ([]uint64, error) {
+	if err := st.rlock(); err != nil {
+		return nil, err
+	}
+	defer st.runlock()
+	if err := st.check(opLookup); err != nil {
+		return nil, err
+	}
+	if stackID < 0 {
+		// bpf_get_stackid() returns a negative errno on failure.
+		return nil, fmt.Errorf("invalid stack id %d: %v", stackID, syscall.Errno(-stackID))
+	}
+	key := make([]byte, 4)
+	byteOrder.PutUint32(key, uint32(stackID))
+	leaf, err := st.GetBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []uint64
+	for i := 0; i+8 <= len(leaf); i += 8 {
+		addr := byteOrder.Uint64(leaf[i:])
+		if addr == 0 {
+			break
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// GetStackSymbols returns the symbols of the stack stackID. Kernel
+// addresses are resolved with /proc/kallsyms. For user stacks, pass
+// the pid of the process: addresses are then resolved to the symbols
+// of the files it maps, as "symbol [file]", or to the mapped file and
+// the offset into it, according to /proc/<pid>/maps, if these have no
+// symbol there. Pass a negative pid for kernel stacks. Unresolved
+// addresses are returned as "[unknown]". Kernel symbols are looked up
+// in cache if given, in a cache shared by the package otherwise; user
+// symbols are read for each call.
+func (st *StackTable) GetStackSymbols(stackID int, pid int, cache ...*KSymCache) ([]string, error) {
+	addrs, err := st.GetStack(stackID)
+	if err != nil {
+		return nil, err
+	}
+	ksyms := &kernelSymbols
+	if len(cache) > 0 && cache[0] != nil {
+		ksyms = cache[0]
+	}
+	var (
+		maps  []procMap
+		usyms *userSymbols
+	)
+	if pid >= 0 {
+		if maps, err = readProcMaps(pid); err != nil {
+			return nil, err
+		}
+		usyms = newUserSymbols(pid)
+		defer usyms.close()
+	}
+	syms := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if m, ok := findProcMap(maps, addr); ok {
+			if name, module, ok := usyms.resolve(addr); ok {
+				syms[i] = fmt.Sprintf("%s [%s]", name, module)
+				continue
+			}
+			syms[i] = fmt.Sprintf("%s+0x%x", m.path, addr-m.start+m.offset)
+			continue
+		}
+		sym, ok, err := ksyms.resolve(addr)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !ok:
+			syms[i] = "[unknown]"
+		case sym.module != "":
+			syms[i] = fmt.Sprintf("%s [%s]", sym.name, sym.module)
+		default:
+			syms[i] = sym.name
+		}
+	}
+	return syms, nil
+}
+
+// ClearAll deletes all stacks. Stack tables are fixed size, and
+// bpf_get_stackid() fails once they are full.
+func (st *StackTable) ClearAll() error {
+	if err := st.rlock(); err != nil {
+		return err
+	}
+	defer st.runlock()
+	if err := st.check(opDelete); err != nil {
+		return err
+	}
+	return st.DeleteAll()
+}
+
+// procMap is a file mapping of a process.
+type procMap struct {
+	start, end, offset uint64
+	path               string
+}
+
+// readProcMaps returns the file mappings of process pid.
+func readProcMaps(pid int) ([]procMap, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var maps []procMap
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 7f0e3c600000-7f0e3c628000 r--p 00000000 fd:01 1234 /usr/lib/libc.so.6
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		bounds := strings.SplitN(fields[0], "-", 2)
+		if len(bounds) != 2 {
+			continue
+		}
+		start, err1 := strconv.ParseUint(bounds[0], 16, 64)
+		end, err2 := strconv.ParseUint(bounds[1], 16, 64)
+		offset, err3 := strconv.ParseUint(fields[2], 16, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		maps = append(maps, procMap{start: start, end: end, offset: offset, path: fields[5]})
+	}
+	return maps, scanner.Err()
+}
+
+func findProcMap(maps []procMap, addr uint64) (procMap, bool) {
+	for _, m := range maps {
+		if addr >= m.start && addr < m.end {
+			return m, true
+		}
+	}
+	return procMap{}, false
+}
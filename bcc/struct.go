@@ -0,0 +1,131 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"reflect"
+)
+
+// checkFixedSize returns an error unless v, or what it points to, can
+// be encoded with encoding/binary into a fixed number of bytes.
+func checkFixedSize(v interface{}) error {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return fmt.Errorf("cannot encode nil, pass a pointer to a fixed size value")
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.String, reflect.Map:
+		return fmt.Errorf("%v is not a fixed size type, use an array or implement BinaryKey/BinaryValue", t)
+	}
+	if binary.Size(v) < 0 {
+		return fmt.Errorf("%v is not a fixed size type, implement BinaryKey/BinaryValue to encode it", t)
+	}
+	return nil
+}
+
+// encodeSized encodes v and checks that it takes size bytes. what
+// names v in errors.
+func encodeSized(v interface{}, size uint64, what string) ([]byte, error) {
+	if !hasBPFMarshaler(v) {
+		if err := checkFixedSize(v); err != nil {
+			return nil, fmt.Errorf("%s: %v", what, err)
+		}
+	}
+	b, err := marshalBPF(v, byteOrder)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", what, err)
+	}
+	if len(b) != int(size) {
+		return nil, fmt.Errorf("%s %T is %d bytes, expected %d", what, v, len(b), size)
+	}
+	return b, nil
+}
+
+// checkStructTable returns an error for tables GetStruct and SetStruct
+// don't support.
+func (table *Table) checkStructTable(op mapOp) error {
+	if err := table.checkOp(op); err != nil {
+		return err
+	}
+	if mt := table.Type(); mt.IsPerCPU() {
+		return fmt.Errorf("%v table %s: use GetPerCPU and SetPerCPU: %w", mt, table.Name(), ErrOperationNotSupported)
+	}
+	return nil
+}
+
+// GetStruct looks up key and decodes the value into valueOut, which
+// must be a pointer. Keys and values are encoded with encoding/binary
+// in host byte order, unless they implement BinaryKey or BinaryValue:
+// structs, integers and arrays of fixed size work, and must be laid out
+// like the C types, including any padding (use blank fields). Their
+// sizes must match the key and leaf sizes of the table. Struct fields
+// tagged `bpf:"be"` are encoded in big endian byte order.
+func (table *Table) GetStruct(key interface{}, valueOut interface{}) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkStructTable(opLookup); err != nil {
+		return err
+	}
+	if v := reflect.ValueOf(valueOut); v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("Table.GetStruct: value must be a non-nil pointer, got %T", valueOut)
+	}
+	desc := table.Desc()
+	k, err := encodeSized(key, desc.KeySize, "Table.GetStruct: key")
+	if err != nil {
+		return err
+	}
+	if !hasBPFMarshaler(valueOut) {
+		if err := checkFixedSize(valueOut); err != nil {
+			return fmt.Errorf("Table.GetStruct: value: %v", err)
+		}
+		if size := binary.Size(valueOut); size != int(desc.LeafSize) {
+			return fmt.Errorf("Table.GetStruct: value %T is %d bytes, expected %d", valueOut, size, desc.LeafSize)
+		}
+	}
+	leaf, err := table.GetBytes(k)
+	if err != nil {
+		return err
+	}
+	return unmarshalBPF(leaf, valueOut, byteOrder)
+}
+
+// SetStruct encodes key and value as for GetStruct and sets the value
+// of key.
+func (table *Table) SetStruct(key, value interface{}) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkStructTable(opUpdate); err != nil {
+		return err
+	}
+	desc := table.Desc()
+	k, err := encodeSized(key, desc.KeySize, "Table.SetStruct: key")
+	if err != nil {
+		return err
+	}
+	leaf, err := encodeSized(value, desc.LeafSize, "Table.SetStruct: value")
+	if err != nil {
+		return err
+	}
+	return table.SetBytes(k, leaf)
+}
@@ -15,8 +15,12 @@
 package bcc
 
 import (
+	"debug/elf"
+	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"unsafe"
 )
@@ -31,6 +35,10 @@ extern void foreach_symbol_callback(char*, uint64_t);
 */
 import "C"
 
+// ErrSymbolNotFound is returned when a symbol can't be resolved in a
+// binary or library.
+var ErrSymbolNotFound = errors.New("symbol not found")
+
 type symbolAddress struct {
 	name string
 	addr uint64
@@ -54,6 +62,48 @@ type bccSymbol struct {
 	offset       C.ulonglong
 }
 
+// userSymbols resolves the addresses of a process with a bcc symbol
+// cache, which reads the symbols of its mapped files.
+type userSymbols struct {
+	pid   int
+	cache unsafe.Pointer
+}
+
+// newUserSymbols returns the symbols of process pid, or nil if bcc
+// can't read them.
+func newUserSymbols(pid int) *userSymbols {
+	cache := C.bcc_symcache_new(C.int(pid), nil)
+	if cache == nil {
+		return nil
+	}
+	return &userSymbols{pid: pid, cache: cache}
+}
+
+// resolve returns the demangled name of the symbol at addr and the
+// path of the file mapping it.
+func (u *userSymbols) resolve(addr uint64) (name, module string, ok bool) {
+	if u == nil {
+		return "", "", false
+	}
+	var sym C.struct_bcc_symbol
+	if C.bcc_symcache_resolve(u.cache, C.uint64_t(addr), &sym) != 0 {
+		return "", "", false
+	}
+	defer C.bcc_symbol_free_demangle_name(&sym)
+	if sym.demangle_name != nil {
+		name = C.GoString(sym.demangle_name)
+	} else {
+		name = C.GoString(sym.name)
+	}
+	return name, C.GoString(sym.module), name != ""
+}
+
+func (u *userSymbols) close() {
+	if u != nil {
+		C.bcc_free_symcache(u.cache, C.int(u.pid))
+	}
+}
+
 // resolveSymbolPath returns the file and offset to locate symname in module
 func resolveSymbolPath(module string, symname string, addr uint64, pid int) (string, uint64, error) {
 	symbol := &bccSymbol{}
@@ -72,7 +122,45 @@ func resolveSymbolPath(module string, symname string, addr uint64, pid int) (str
 		return C.GoString(symbolC.module), (uint64)(symbolC.offset), nil
 	}
 
-	return "", 0, fmt.Errorf("unable to locate symbol %s in module %s: %v", symname, module, err)
+	return "", 0, fmt.Errorf("unable to locate symbol %s in module %s (%v): %w", symname, module, err, ErrSymbolNotFound)
+}
+
+// resolveSymbolOffset is like resolveSymbolPath for symbols given as
+// "symbol" or "symbol+offset", the offset being decimal or hexadecimal
+// with a 0x prefix.
+func resolveSymbolOffset(module string, symname string, pid int) (string, uint64, error) {
+	var off uint64
+	if i := strings.LastIndexByte(symname, '+'); i > 0 {
+		var err error
+		if off, err = strconv.ParseUint(symname[i+1:], 0, 64); err != nil {
+			return "", 0, fmt.Errorf("invalid offset in symbol %s: %v", symname, err)
+		}
+		symname = symname[:i]
+	}
+	path, addr, err := resolveSymbolPath(module, symname, 0x0, pid)
+	if err != nil {
+		return "", 0, err
+	}
+	return path, addr + off, nil
+}
+
+// checkExecOffset returns an error if offset doesn't lie within an
+// executable segment of the ELF file at path.
+func checkExecOffset(path string, offset uint64) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to read ELF file %s: %v", path, err)
+	}
+	defer f.Close()
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Flags&elf.PF_X == 0 {
+			continue
+		}
+		if offset >= prog.Off && offset < prog.Off+prog.Filesz {
+			return nil
+		}
+	}
+	return fmt.Errorf("offset 0x%x is not within an executable segment of %s", offset, path)
 }
 
 // getUserSymbolsAndAddresses finds a list of symbols associated with a module,
@@ -0,0 +1,61 @@
+// Copyright 2017 Louis McCormack
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"debug/elf"
+	"os"
+	"testing"
+)
+
+func TestCheckExecOffset(t *testing.T) {
+	path, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var text, data *elf.Prog
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Filesz == 0 {
+			continue
+		}
+		if prog.Flags&elf.PF_X != 0 && text == nil {
+			text = prog
+		} else if prog.Flags&elf.PF_X == 0 && prog.Flags&elf.PF_W != 0 && data == nil {
+			data = prog
+		}
+	}
+	if text == nil {
+		t.Fatal("no executable segment in test binary")
+	}
+	if err := checkExecOffset(path, text.Off+text.Filesz/2); err != nil {
+		t.Fatal(err)
+	}
+	if data != nil {
+		if err := checkExecOffset(path, data.Off); err == nil {
+			t.Fatalf("expected error for offset 0x%x in data segment", data.Off)
+		}
+	}
+	if err := checkExecOffset(path, 1<<62); err == nil {
+		t.Fatal("expected error for offset past the end of the file")
+	}
+	if err := checkExecOffset("/nonexistent", 0); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
@@ -0,0 +1,448 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+/*
+#include <linux/types.h>
+#include <linux/unistd.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+
+// Commands of the bpf(2) syscall that aren't wrapped by libbcc. The
+// values are part of the kernel ABI; they are defined here since the
+// linux/bpf.h shipped with bcc may predate them.
+#define GOBPF_MAP_CREATE 0
+#define GOBPF_PROG_LOAD 5
+#define GOBPF_PROG_ATTACH 8
+#define GOBPF_PROG_DETACH 9
+#define GOBPF_PROG_TEST_RUN 10
+#define GOBPF_MAP_GET_FD_BY_ID 14
+#define GOBPF_RAW_TRACEPOINT_OPEN 17
+#define GOBPF_MAP_LOOKUP_AND_DELETE_ELEM 21
+#define GOBPF_MAP_LOOKUP_BATCH 24
+#define GOBPF_MAP_LOOKUP_AND_DELETE_BATCH 25
+#define GOBPF_MAP_UPDATE_BATCH 26
+#define GOBPF_MAP_DELETE_BATCH 27
+#define GOBPF_LINK_CREATE 28
+#define GOBPF_ITER_CREATE 33
+
+static __u64 gobpf_ptr_to_u64(const void *ptr)
+{
+	return (__u64) (unsigned long) ptr;
+}
+
+// from struct used by BPF_MAP_CREATE command in union bpf_attr, up to
+// map_name
+struct gobpf_map_create_attr {
+	__u32 map_type;
+	__u32 key_size;
+	__u32 value_size;
+	__u32 max_entries;
+	__u32 map_flags;
+	__u32 inner_map_fd;
+	__u32 numa_node;
+	char map_name[16];
+	__u32 map_ifindex;
+};
+
+static int gobpf_map_create(__u32 map_type, __u32 key_size, __u32 value_size,
+			    __u32 max_entries, __u32 map_flags, const char *name,
+			    __u32 ifindex, __u32 inner_map_fd)
+{
+	struct gobpf_map_create_attr attr;
+	memset(&attr, 0, sizeof(attr));
+	attr.map_type = map_type;
+	attr.key_size = key_size;
+	attr.value_size = value_size;
+	attr.max_entries = max_entries;
+	attr.map_flags = map_flags;
+	attr.inner_map_fd = inner_map_fd;
+	if (name)
+		strncpy(attr.map_name, name, sizeof(attr.map_name) - 1);
+	attr.map_ifindex = ifindex;
+	return syscall(__NR_bpf, GOBPF_MAP_CREATE, &attr, sizeof(attr));
+}
+
+// from struct used by BPF_MAP_*_ELEM commands in union bpf_attr
+struct gobpf_elem_attr {
+	__u32 map_fd;
+	__u64 key __attribute__((aligned(8)));
+	__u64 value __attribute__((aligned(8)));
+	__u64 flags __attribute__((aligned(8)));
+};
+
+static int gobpf_map_lookup_and_delete_elem(int fd, void *key, void *value)
+{
+	struct gobpf_elem_attr attr;
+	memset(&attr, 0, sizeof(attr));
+	attr.map_fd = fd;
+	attr.key = gobpf_ptr_to_u64(key);
+	attr.value = gobpf_ptr_to_u64(value);
+	return syscall(__NR_bpf, GOBPF_MAP_LOOKUP_AND_DELETE_ELEM, &attr, sizeof(attr));
+}
+
+// from struct used by BPF_*_GET_*_ID commands in union bpf_attr
+struct gobpf_id_attr {
+	__u32 id;
+	__u32 next_id;
+	__u32 open_flags;
+};
+
+static int gobpf_map_get_fd_by_id(__u32 id)
+{
+	struct gobpf_id_attr attr;
+	memset(&attr, 0, sizeof(attr));
+	attr.id = id;
+	return syscall(__NR_bpf, GOBPF_MAP_GET_FD_BY_ID, &attr, sizeof(attr));
+}
+
+// from struct used by BPF_PROG_LOAD command in union bpf_attr, up to
+// attach_prog_fd
+struct gobpf_prog_load_attr {
+	__u32 prog_type;
+	__u32 insn_cnt;
+	__u64 insns __attribute__((aligned(8)));
+	__u64 license __attribute__((aligned(8)));
+	__u32 log_level;
+	__u32 log_size;
+	__u64 log_buf __attribute__((aligned(8)));
+	__u32 kern_version;
+	__u32 prog_flags;
+	char prog_name[16];
+	__u32 prog_ifindex;
+	__u32 expected_attach_type;
+	__u32 prog_btf_fd;
+	__u32 func_info_rec_size;
+	__u64 func_info __attribute__((aligned(8)));
+	__u32 func_info_cnt;
+	__u32 line_info_rec_size;
+	__u64 line_info __attribute__((aligned(8)));
+	__u32 line_info_cnt;
+	__u32 attach_btf_id;
+	__u32 attach_prog_fd;
+};
+
+static int gobpf_prog_load_btf(__u32 prog_type, const void *insns, __u32 insn_cnt,
+			       const char *license, __u32 kern_version,
+			       __u32 log_level, char *log_buf, __u32 log_size,
+			       __u32 expected_attach_type, __u32 attach_btf_id)
+{
+	struct gobpf_prog_load_attr attr;
+	memset(&attr, 0, sizeof(attr));
+	attr.prog_type = prog_type;
+	attr.insns = gobpf_ptr_to_u64(insns);
+	attr.insn_cnt = insn_cnt;
+	attr.license = gobpf_ptr_to_u64(license);
+	attr.kern_version = kern_version;
+	attr.log_level = log_level;
+	attr.log_buf = gobpf_ptr_to_u64(log_buf);
+	attr.log_size = log_size;
+	attr.expected_attach_type = expected_attach_type;
+	attr.attach_btf_id = attach_btf_id;
+	return syscall(__NR_bpf, GOBPF_PROG_LOAD, &attr, sizeof(attr));
+}
+
+// from struct used by BPF_PROG_ATTACH/DETACH commands in union bpf_attr
+struct gobpf_attach_attr {
+	__u32 target_fd;
+	__u32 attach_bpf_fd;
+	__u32 attach_type;
+	__u32 attach_flags;
+};
+
+static int gobpf_prog_attach(int cmd, int target_fd, int prog_fd, __u32 type, __u32 flags)
+{
+	struct gobpf_attach_attr attr;
+	memset(&attr, 0, sizeof(attr));
+	attr.target_fd = target_fd;
+	attr.attach_bpf_fd = prog_fd;
+	attr.attach_type = type;
+	attr.attach_flags = flags;
+	return syscall(__NR_bpf, cmd, &attr, sizeof(attr));
+}
+
+// from struct used by BPF_PROG_TEST_RUN command in union bpf_attr, up
+// to duration
+struct gobpf_test_run_attr {
+	__u32 prog_fd;
+	__u32 retval;
+	__u32 data_size_in;
+	__u32 data_size_out;
+	__u64 data_in __attribute__((aligned(8)));
+	__u64 data_out __attribute__((aligned(8)));
+	__u32 repeat;
+	__u32 duration;
+};
+
+static int gobpf_prog_test_run(int prog_fd, const void *data, __u32 data_size,
+			       void *data_out, __u32 *data_size_out, __u32 repeat,
+			       __u32 *retval, __u32 *duration)
+{
+	struct gobpf_test_run_attr attr;
+	int ret;
+
+	memset(&attr, 0, sizeof(attr));
+	attr.prog_fd = prog_fd;
+	attr.data_in = gobpf_ptr_to_u64(data);
+	attr.data_size_in = data_size;
+	attr.data_out = gobpf_ptr_to_u64(data_out);
+	attr.data_size_out = *data_size_out;
+	attr.repeat = repeat;
+	ret = syscall(__NR_bpf, GOBPF_PROG_TEST_RUN, &attr, sizeof(attr));
+	*data_size_out = attr.data_size_out;
+	*retval = attr.retval;
+	*duration = attr.duration;
+	return ret;
+}
+
+// from struct used by BPF_RAW_TRACEPOINT_OPEN command in union bpf_attr
+struct gobpf_raw_tracepoint_attr {
+	__u64 name __attribute__((aligned(8)));
+	__u32 prog_fd;
+};
+
+static int gobpf_raw_tracepoint_open(const char *name, int prog_fd)
+{
+	struct gobpf_raw_tracepoint_attr attr;
+	memset(&attr, 0, sizeof(attr));
+	attr.name = gobpf_ptr_to_u64(name);
+	attr.prog_fd = prog_fd;
+	return syscall(__NR_bpf, GOBPF_RAW_TRACEPOINT_OPEN, &attr, sizeof(attr));
+}
+
+// from struct used by BPF_LINK_CREATE command in union bpf_attr, up to
+// flags
+struct gobpf_link_create_attr {
+	__u32 prog_fd;
+	__u32 target_fd;
+	__u32 attach_type;
+	__u32 flags;
+};
+
+static int gobpf_link_create(int prog_fd, int target_fd, __u32 attach_type)
+{
+	struct gobpf_link_create_attr attr;
+	memset(&attr, 0, sizeof(attr));
+	attr.prog_fd = prog_fd;
+	attr.target_fd = target_fd;
+	attr.attach_type = attach_type;
+	return syscall(__NR_bpf, GOBPF_LINK_CREATE, &attr, sizeof(attr));
+}
+
+// from struct used by BPF_ITER_CREATE command in union bpf_attr
+struct gobpf_iter_create_attr {
+	__u32 link_fd;
+	__u32 flags;
+};
+
+static int gobpf_iter_create(int link_fd)
+{
+	struct gobpf_iter_create_attr attr;
+	memset(&attr, 0, sizeof(attr));
+	attr.link_fd = link_fd;
+	return syscall(__NR_bpf, GOBPF_ITER_CREATE, &attr, sizeof(attr));
+}
+
+// from struct used by BPF_MAP_*_BATCH commands in union bpf_attr
+struct gobpf_batch_attr {
+	__u64 in_batch __attribute__((aligned(8)));
+	__u64 out_batch __attribute__((aligned(8)));
+	__u64 keys __attribute__((aligned(8)));
+	__u64 values __attribute__((aligned(8)));
+	__u32 count;
+	__u32 map_fd;
+	__u64 elem_flags;
+	__u64 flags;
+};
+
+static int gobpf_map_batch(int cmd, int fd, void *in_batch, void *out_batch,
+			   void *keys, void *values, __u32 *count, __u64 elem_flags)
+{
+	struct gobpf_batch_attr attr;
+	int ret;
+
+	memset(&attr, 0, sizeof(attr));
+	attr.map_fd = fd;
+	attr.in_batch = gobpf_ptr_to_u64(in_batch);
+	attr.out_batch = gobpf_ptr_to_u64(out_batch);
+	attr.keys = gobpf_ptr_to_u64(keys);
+	attr.values = gobpf_ptr_to_u64(values);
+	attr.count = *count;
+	attr.elem_flags = elem_flags;
+	ret = syscall(__NR_bpf, cmd, &attr, sizeof(attr));
+	*count = attr.count;
+	return ret;
+}
+*/
+import "C"
+
+// batchCmd is a BPF_MAP_*_BATCH command of the bpf(2) syscall.
+type batchCmd C.int
+
+const (
+	cmdLookupBatch          batchCmd = C.GOBPF_MAP_LOOKUP_BATCH
+	cmdLookupAndDeleteBatch batchCmd = C.GOBPF_MAP_LOOKUP_AND_DELETE_BATCH
+	cmdUpdateBatch          batchCmd = C.GOBPF_MAP_UPDATE_BATCH
+	cmdDeleteBatch          batchCmd = C.GOBPF_MAP_DELETE_BATCH
+)
+
+// mapBatch runs a batch command on the map fd. inBatch and outBatch
+// may be nil, keys and values hold count keys and values back to back.
+// It returns the number of elements processed.
+func mapBatch(cmd batchCmd, fd int, inBatch, outBatch, keys, values []byte, count int, elemFlags uint64) (int, error) {
+	n := C.__u32(count)
+	r, err := C.gobpf_map_batch(C.int(cmd), C.int(fd), bytesPointer(inBatch), bytesPointer(outBatch), bytesPointer(keys), bytesPointer(values), &n, C.__u64(elemFlags))
+	if r != 0 {
+		return int(n), err
+	}
+	return int(n), nil
+}
+
+// bytesPointer returns a pointer to the first byte of b, or nil if b is
+// empty.
+func bytesPointer(b []byte) unsafe.Pointer {
+	if len(b) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(&b[0])
+}
+
+// lookupAndDeleteElem looks up key in the map fd, stores its value in
+// leaf and deletes it in a single BPF_MAP_LOOKUP_AND_DELETE_ELEM call.
+func lookupAndDeleteElem(fd int, key, leaf []byte) error {
+	r, err := C.gobpf_map_lookup_and_delete_elem(C.int(fd), unsafe.Pointer(&key[0]), unsafe.Pointer(&leaf[0]))
+	if r != 0 {
+		return err
+	}
+	return nil
+}
+
+// mapCreate creates a map with BPF_MAP_CREATE and returns its fd. The
+// name is truncated to 15 bytes, and dropped on kernels not supporting
+// map names (Linux 4.15). A non-zero ifindex binds the map to the
+// network device for offload. innerMapFD is the fd of the template of
+// the inner maps of maps of maps.
+func mapCreate(mapType MapType, keySize, valueSize, maxEntries, flags uint32, name string, ifindex, innerMapFD uint32) (int, error) {
+	var nameCS *C.char
+	if name != "" {
+		nameCS = C.CString(name)
+		defer C.free(unsafe.Pointer(nameCS))
+	}
+	fd, err := C.gobpf_map_create(C.__u32(mapType), C.__u32(keySize), C.__u32(valueSize), C.__u32(maxEntries), C.__u32(flags), nameCS, C.__u32(ifindex), C.__u32(innerMapFD))
+	if fd < 0 && nameCS != nil && (err == syscall.E2BIG || err == syscall.EINVAL) {
+		fd, err = C.gobpf_map_create(C.__u32(mapType), C.__u32(keySize), C.__u32(valueSize), C.__u32(maxEntries), C.__u32(flags), nil, C.__u32(ifindex), C.__u32(innerMapFD))
+	}
+	if fd < 0 {
+		return -1, err
+	}
+	return int(fd), nil
+}
+
+// mapGetFDByID returns a new fd for the map with the given id.
+func mapGetFDByID(id uint32) (int, error) {
+	fd, err := C.gobpf_map_get_fd_by_id(C.__u32(id))
+	if fd < 0 {
+		return -1, err
+	}
+	return int(fd), nil
+}
+
+// rawTracepointOpen attaches the program progFD to the raw tracepoint
+// name and returns the fd holding the attachment.
+// An empty name attaches a tracing program to its BTF target.
+func rawTracepointOpen(name string, progFD int) (int, error) {
+	var nameCS *C.char
+	if name != "" {
+		nameCS = C.CString(name)
+		defer C.free(unsafe.Pointer(nameCS))
+	}
+	fd, err := C.gobpf_raw_tracepoint_open(nameCS, C.int(progFD))
+	if fd < 0 {
+		return -1, err
+	}
+	return int(fd), nil
+}
+
+// linkCreate attaches the program progFD to targetFD with
+// BPF_LINK_CREATE and returns the fd of the link.
+func linkCreate(progFD, targetFD int, attachType uint32) (int, error) {
+	fd, err := C.gobpf_link_create(C.int(progFD), C.int(targetFD), C.__u32(attachType))
+	if fd < 0 {
+		return -1, err
+	}
+	return int(fd), nil
+}
+
+// iterCreate creates an instance of the iterator link linkFD with
+// BPF_ITER_CREATE and returns its fd, reading it running the program.
+func iterCreate(linkFD int) (int, error) {
+	fd, err := C.gobpf_iter_create(C.int(linkFD))
+	if fd < 0 {
+		return -1, err
+	}
+	return int(fd), nil
+}
+
+// progAttach attaches the program progFD to targetFD with BPF_PROG_ATTACH.
+func progAttach(targetFD, progFD int, attachType, flags uint32) error {
+	r, err := C.gobpf_prog_attach(C.GOBPF_PROG_ATTACH, C.int(targetFD), C.int(progFD), C.__u32(attachType), C.__u32(flags))
+	if r != 0 {
+		return err
+	}
+	return nil
+}
+
+// progDetach detaches the program progFD from targetFD with
+// BPF_PROG_DETACH.
+func progDetach(targetFD, progFD int, attachType uint32) error {
+	r, err := C.gobpf_prog_attach(C.GOBPF_PROG_DETACH, C.int(targetFD), C.int(progFD), C.__u32(attachType), 0)
+	if r != 0 {
+		return err
+	}
+	return nil
+}
+
+// progLoadBTF loads the program insns of type progType with
+// BPF_PROG_LOAD, attached to the kernel BTF type attachBTFID with the
+// attach type expectedAttachType. The verifier log is written to
+// logbuf.
+func progLoadBTF(progType ProgramType, insns unsafe.Pointer, insnCnt int, license *C.char, kernVersion uint32, logLevel int, logbuf []byte, expectedAttachType, attachBTFID uint32) (int, error) {
+	fd, err := C.gobpf_prog_load_btf(C.__u32(progType), insns, C.__u32(insnCnt), license, C.__u32(kernVersion), C.__u32(logLevel), (*C.char)(bytesPointer(logbuf)), C.__u32(len(logbuf)), C.__u32(expectedAttachType), C.__u32(attachBTFID))
+	if fd < 0 {
+		return -1, err
+	}
+	return int(fd), nil
+}
+
+// progTestRun runs the program progFD repeat times on data with
+// BPF_PROG_TEST_RUN. The data output by the program is written to
+// dataOut. It returns the return value of the program, the size of the
+// data output, which may exceed that of dataOut if the call fails with
+// ENOSPC, and the average duration of a run in nanoseconds.
+func progTestRun(progFD int, data, dataOut []byte, repeat int) (retval uint32, sizeOut int, duration uint32, err error) {
+	n := C.__u32(len(dataOut))
+	var r, d C.__u32
+	ret, err := C.gobpf_prog_test_run(C.int(progFD), bytesPointer(data), C.__u32(len(data)), bytesPointer(dataOut), &n, C.__u32(repeat), &r, &d)
+	if ret != 0 {
+		return 0, int(n), 0, err
+	}
+	return uint32(r), int(n), uint32(d), nil
+}
@@ -16,204 +16,2023 @@ package bcc
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"iter"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"unsafe"
 )
 
 /*
 #cgo CFLAGS: -I/usr/include/bcc/compat
 #cgo LDFLAGS: -lbcc
+#include <errno.h>
+#include <string.h>
 #include <bcc/bpf_common.h>
 #include <bcc/libbpf.h>
+
+// gobpf_next_entries reads up to n entries following key in the map fd
+// with get_next_key and lookup, into the arrays keys and leaves, and
+// returns their number, or only the keys if leaves is NULL. key is
+// updated to the last key read, entries deleted between the two calls
+// being counted in dropped and skipped.
+// The iteration stops early on errors, err being set to their errno
+// (ENOENT at the end of the map) and failed_lookup telling whether the
+// lookup of key failed.
+static int gobpf_next_entries(int fd, void *key, size_t key_size,
+			      void *keys, void *leaves, size_t leaf_size,
+			      int n, int *dropped, int *err,
+			      int *failed_lookup)
+{
+	int filled = 0;
+
+	*dropped = 0;
+	*err = 0;
+	*failed_lookup = 0;
+	while (filled < n) {
+		char *k = (char *)keys + (size_t)filled * key_size;
+		char *l = leaves ? (char *)leaves + (size_t)filled * leaf_size : NULL;
+
+		if (bpf_get_next_key(fd, key, k) != 0) {
+			*err = errno;
+			break;
+		}
+		memcpy(key, k, key_size);
+		if (l && bpf_lookup_elem(fd, k, l) != 0) {
+			if (errno == ENOENT) {
+				(*dropped)++;
+				continue;
+			}
+			*err = errno;
+			*failed_lookup = 1;
+			break;
+		}
+		filled++;
+	}
+	return filled;
+}
 */
 import "C"
 
+var (
+	// ErrKeyNotFound is returned when a key is not present in a table.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrModuleClosed is returned when a table is used after its
+	// module has been closed.
+	ErrModuleClosed = errors.New("module closed")
+	// ErrKeyExists is returned when an update that must not replace
+	// an existing key finds it in the table.
+	ErrKeyExists = errors.New("key already exists")
+	// ErrOperationNotSupported is returned when an operation is not
+	// valid for the type of a table.
+	ErrOperationNotSupported = errors.New("operation not supported")
+	// ErrNoModule is returned by operations that need the key and leaf
+	// descriptions of a bcc module, when used on a table that is not
+	// backed by one (e.g. a pinned table).
+	ErrNoModule = errors.New("table is not backed by a bcc module")
+	// ErrTableNotFound is returned when a module has no table of the
+	// given name.
+	ErrTableNotFound = errors.New("table not found")
+	// ErrTableFull is returned when an element can't be added to a
+	// table that has reached its maximum number of entries.
+	ErrTableFull = errors.New("table full")
+	// ErrPermission is returned when the process lacks the privileges
+	// for an operation on a table, e.g. CAP_BPF or CAP_SYS_ADMIN.
+	ErrPermission = errors.New("permission denied")
+	// ErrFormat is returned when bcc fails to format a key or leaf
+	// that was read from a table, e.g. because the output doesn't fit
+	// in the largest buffer tried.
+	ErrFormat = errors.New("unable to format")
+)
+
+// errnoError is the error of a failed operation on a table, matching
+// both its errno and the sentinel error for it with errors.Is.
+type errnoError struct {
+	errno    syscall.Errno
+	sentinel error
+}
+
+func (e *errnoError) Error() string {
+	return e.sentinel.Error()
+}
+
+func (e *errnoError) Unwrap() []error {
+	return []error{e.sentinel, e.errno}
+}
+
+// mapErrno returns the error for err, the errno of a failed operation
+// on a table: ENOENT matches ErrKeyNotFound, EEXIST ErrKeyExists, E2BIG
+// ErrTableFull and EPERM and EACCES ErrPermission, besides the errno.
+// Other errors are returned as is.
+func mapErrno(err error) error {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return err
+	}
+	var sentinel error
+	switch errno {
+	case syscall.ENOENT:
+		sentinel = ErrKeyNotFound
+	case syscall.EEXIST:
+		sentinel = ErrKeyExists
+	case syscall.E2BIG:
+		sentinel = ErrTableFull
+	case syscall.EPERM, syscall.EACCES:
+		sentinel = ErrPermission
+	default:
+		return errno
+	}
+	return &errnoError{errno: errno, sentinel: sentinel}
+}
+
+// Table is a BPF table. A Table may be used from multiple goroutines,
+// also while its module is being closed: operations then either
+// complete before Close or return ErrModuleClosed.
 type Table struct {
 	id     C.size_t
 	module *Module
+
+	// desc caches the table properties, read without locking once
+	// set. descMu serializes setting it.
+	descMu sync.Mutex
+	desc   atomic.Pointer[TableDesc]
+
+	// ownFD is set for tables not backed by a module, which own the
+	// file descriptor of their map. closed is set once it is closed,
+	// under fdMu, and done closed with it.
+	ownFD  bool
+	closed bool
+	fdMu   sync.RWMutex
+	done   chan struct{}
+
+	// incMu serializes Increment.
+	incMu sync.Mutex
+
+	// retryPolicy is set by SetRetryPolicy, and entryFormatter by
+	// SetEntryFormatter.
+	retryPolicy    atomic.Pointer[RetryPolicy]
+	entryFormatter atomic.Pointer[EntryFormatter]
+
+	// batchCaps caches whether batch commands are supported, by
+	// batchCap. noBatchOps is set by SetBatchOps(false).
+	batchCaps  sync.Map
+	noBatchOps atomic.Bool
+}
+
+// MapType is the type of a BPF map (BPF_MAP_TYPE_*).
+type MapType uint32
+
+const (
+	MapTypeUnspec MapType = iota
+	MapTypeHash
+	MapTypeArray
+	MapTypeProgArray
+	MapTypePerfEventArray
+	MapTypePercpuHash
+	MapTypePercpuArray
+	MapTypeStackTrace
+	MapTypeCgroupArray
+	MapTypeLRUHash
+	MapTypeLRUPercpuHash
+	MapTypeLPMTrie
+	MapTypeArrayOfMaps
+	MapTypeHashOfMaps
+	MapTypeDevmap
+	MapTypeSockmap
+	MapTypeCpumap
+	MapTypeXskmap
+	MapTypeSockhash
+	MapTypeCgroupStorage
+	MapTypeReuseportSockarray
+	MapTypePercpuCgroupStorage
+	MapTypeQueue
+	MapTypeStack
+	MapTypeSkStorage
+	MapTypeDevmapHash
+	MapTypeStructOps
+	MapTypeRingbuf
+)
+
+var mapTypeNames = [...]string{
+	MapTypeUnspec:              "unspec",
+	MapTypeHash:                "hash",
+	MapTypeArray:               "array",
+	MapTypeProgArray:           "prog_array",
+	MapTypePerfEventArray:      "perf_event_array",
+	MapTypePercpuHash:          "percpu_hash",
+	MapTypePercpuArray:         "percpu_array",
+	MapTypeStackTrace:          "stack_trace",
+	MapTypeCgroupArray:         "cgroup_array",
+	MapTypeLRUHash:             "lru_hash",
+	MapTypeLRUPercpuHash:       "lru_percpu_hash",
+	MapTypeLPMTrie:             "lpm_trie",
+	MapTypeArrayOfMaps:         "array_of_maps",
+	MapTypeHashOfMaps:          "hash_of_maps",
+	MapTypeDevmap:              "devmap",
+	MapTypeSockmap:             "sockmap",
+	MapTypeCpumap:              "cpumap",
+	MapTypeXskmap:              "xskmap",
+	MapTypeSockhash:            "sockhash",
+	MapTypeCgroupStorage:       "cgroup_storage",
+	MapTypeReuseportSockarray:  "reuseport_sockarray",
+	MapTypePercpuCgroupStorage: "percpu_cgroup_storage",
+	MapTypeQueue:               "queue",
+	MapTypeStack:               "stack",
+	MapTypeSkStorage:           "sk_storage",
+	MapTypeDevmapHash:          "devmap_hash",
+	MapTypeStructOps:           "struct_ops",
+	MapTypeRingbuf:             "ringbuf",
+}
+
+func (mt MapType) String() string {
+	if int(mt) < len(mapTypeNames) {
+		return mapTypeNames[mt]
+	}
+	return fmt.Sprintf("MapType(%d)", uint32(mt))
+}
+
+type mapOp int
+
+const (
+	opLookup mapOp = iota
+	opUpdate
+	opDelete
+)
+
+func (op mapOp) String() string {
+	switch op {
+	case opLookup:
+		return "lookup"
+	case opUpdate:
+		return "update"
+	default:
+		return "delete"
+	}
 }
 
-// New tables returns a refernce to a BPF table.
-func NewTable(id C.size_t, module *Module) *Table {
+// supports reports whether op can be performed on single elements of
+// maps of type mt from user space. Lookups in program arrays and maps
+// of maps return the id of the program or map stored in the slot.
+func (mt MapType) supports(op mapOp) bool {
+	switch mt {
+	case MapTypeRingbuf, MapTypeStructOps:
+		return false
+	case MapTypeArray, MapTypePercpuArray, MapTypeQueue, MapTypeStack:
+		return op != opDelete
+	case MapTypePerfEventArray:
+		// The slots hold perf event fds, set up by InitPerfMap.
+		return false
+	}
+	return true
+}
+
+// TableDesc describes a table.
+type TableDesc struct {
+	Name     string
+	FD       int
+	KeySize  uint64
+	LeafSize uint64
+	KeyDesc  string
+	LeafDesc string
+	MapType  MapType
+}
+
+// NewTable returns a reference to the BPF table with the given id in
+// module.
+func NewTable(id uint64, module *Module) *Table {
 	return &Table{
-		id:     id,
+		id:     C.size_t(id),
 		module: module,
 	}
 }
 
+// checkModule returns ErrModuleClosed if the module backing the table
+// is gone, or if a table not backed by a module has been closed.
+func (table *Table) checkModule() error {
+	if table == nil {
+		return ErrModuleClosed
+	}
+	if table.ownFD {
+		if table.closed {
+			return ErrModuleClosed
+		}
+		return nil
+	}
+	if table.module == nil || table.module.p == nil {
+		return ErrModuleClosed
+	}
+	return nil
+}
+
+// closeMu returns the lock guarding the table against Close: that of
+// its module, or its own for tables not backed by a module.
+func (table *Table) closeMu() *sync.RWMutex {
+	if table.ownFD {
+		return &table.fdMu
+	}
+	return &table.module.closeMu
+}
+
+// rlock read-locks the table against Close, returning ErrModuleClosed
+// without blocking if it's closed or being closed. Table methods hold
+// the lock while they use the module or the map fd, but never while
+// calling back into user code, so that closing from there or from
+// another goroutine doesn't deadlock. Calls may nest.
+func (table *Table) rlock() error {
+	if table == nil || (!table.ownFD && table.module == nil) {
+		return ErrModuleClosed
+	}
+	mu := table.closeMu()
+	// Blocking in RLock on a pending Close would deadlock nested calls.
+	if !mu.TryRLock() {
+		return ErrModuleClosed
+	}
+	if err := table.checkModule(); err != nil {
+		mu.RUnlock()
+		return err
+	}
+	return nil
+}
+
+// closing returns a channel closed once the table, or its module, is
+// closed, or nil if it has none.
+func (table *Table) closing() <-chan struct{} {
+	if table.ownFD {
+		return table.done
+	}
+	if table.module == nil {
+		return nil
+	}
+	return table.module.done
+}
+
+// runlock releases the lock taken by rlock.
+func (table *Table) runlock() {
+	table.closeMu().RUnlock()
+}
+
+// checkFormat is like checkModule but also returns ErrNoModule if the
+// table has no module to format and scan its keys and leaves.
+func (table *Table) checkFormat() error {
+	if err := table.checkModule(); err != nil {
+		return err
+	}
+	if table.module == nil {
+		return fmt.Errorf("%s: %w", table.Name(), ErrNoModule)
+	}
+	return table.checkSizes()
+}
+
+// checkSizes returns an error if the table reports a key or leaf size
+// of zero, as tables of an invalid id do, rather than letting buffers
+// of that size be passed to C.
+func (table *Table) checkSizes() error {
+	desc := table.Desc()
+	name := desc.Name
+	if name == "" {
+		name = fmt.Sprintf("#%d", table.ID())
+	}
+	switch {
+	case desc.KeySize == 0:
+		return fmt.Errorf("table %s reports key_size=0; invalid table id or unsupported map type", name)
+	case desc.LeafSize == 0:
+		return fmt.Errorf("table %s reports leaf_size=0; invalid table id or unsupported map type", name)
+	}
+	return nil
+}
+
+// NewTableByName returns a reference to the BPF table with the given
+// name in module. See Module.TableByName to check that it exists: the
+// operations on a missing table report an invalid table id, and those
+// on a table of a closed module return ErrModuleClosed.
+func NewTableByName(name string, module *Module) *Table {
+	table, err := module.TableByName(name)
+	if err != nil {
+		return NewTable(module.TableSize(), module)
+	}
+	return table
+}
+
+// checkOp returns an error if the module backing the table is gone
+// or if op is invalid for the type of the table.
+func (table *Table) checkOp(op mapOp) error {
+	if err := table.checkModule(); err != nil {
+		return err
+	}
+	if mt := table.Type(); !mt.supports(op) {
+		if mt == MapTypePerfEventArray {
+			return fmt.Errorf("%v on %v table %s, read it with InitPerfMap: %w", op, mt, table.Name(), ErrOperationNotSupported)
+		}
+		return fmt.Errorf("%v on %v table %s: %w", op, mt, table.Name(), ErrOperationNotSupported)
+	}
+	return table.checkSizes()
+}
+
 // ID returns the table id.
-func (table *Table) ID() string {
-	return C.GoString(C.bpf_table_name(table.module.p, table.id))
+func (table *Table) ID() uint64 {
+	return uint64(table.id)
 }
 
 // Name returns the table name.
 func (table *Table) Name() string {
-	return C.GoString(C.bpf_table_name(table.module.p, table.id))
+	return table.Desc().Name
+}
+
+// Desc returns the table properties. The properties are read from the
+// module once and cached, the map type being the kernel's if it
+// supports BPF_OBJ_GET_INFO_BY_FD. For tables not backed by a module,
+// KeyDesc and LeafDesc are empty.
+func (table *Table) Desc() TableDesc {
+	if desc := table.desc.Load(); desc != nil {
+		return *desc
+	}
+	table.descMu.Lock()
+	defer table.descMu.Unlock()
+	desc := table.desc.Load()
+	if desc == nil {
+		if table.rlock() != nil {
+			return TableDesc{}
+		}
+		defer table.runlock()
+		mod := table.module.p
+		desc = &TableDesc{
+			Name:     C.GoString(C.bpf_table_name(mod, table.id)),
+			FD:       int(C.bpf_table_fd_id(mod, table.id)),
+			KeySize:  uint64(C.bpf_table_key_size_id(mod, table.id)),
+			LeafSize: uint64(C.bpf_table_leaf_size_id(mod, table.id)),
+			KeyDesc:  C.GoString(C.bpf_table_key_desc_id(mod, table.id)),
+			LeafDesc: C.GoString(C.bpf_table_leaf_desc_id(mod, table.id)),
+			MapType:  MapType(C.bpf_table_type_id(mod, table.id)),
+		}
+		if info, err := GetMapInfo(desc.FD); err == nil {
+			desc.MapType = info.Type
+		}
+		table.desc.Store(desc)
+	}
+	return *desc
+}
+
+// Type returns the map type of the table.
+func (table *Table) Type() MapType {
+	return table.Desc().MapType
 }
 
 // Config returns the table properties (name, fd, ...).
+//
+// Deprecated: use Desc instead.
 func (table *Table) Config() map[string]interface{} {
-	mod := table.module.p
+	desc := table.Desc()
 	return map[string]interface{}{
-		"name":      C.GoString(C.bpf_table_name(mod, table.id)),
-		"fd":        int(C.bpf_table_fd_id(mod, table.id)),
-		"key_size":  uint64(C.bpf_table_key_size_id(mod, table.id)),
-		"leaf_size": uint64(C.bpf_table_leaf_size_id(mod, table.id)),
-		"key_desc":  C.GoString(C.bpf_table_key_desc_id(mod, table.id)),
-		"leaf_desc": C.GoString(C.bpf_table_leaf_desc_id(mod, table.id)),
+		"name":      desc.Name,
+		"fd":        desc.FD,
+		"key_size":  desc.KeySize,
+		"leaf_size": desc.LeafSize,
+		"key_desc":  desc.KeyDesc,
+		"leaf_desc": desc.LeafDesc,
 	}
 }
 
 func (table *Table) keyToBytes(keyStr string) ([]byte, error) {
-	mod := table.module.p
-	key_size := C.bpf_table_key_size_id(mod, table.id)
-	key := make([]byte, key_size)
-	keyP := unsafe.Pointer(&key[0])
-	keyCS := C.CString(keyStr)
-	defer C.free(unsafe.Pointer(keyCS))
-	r := C.bpf_table_key_sscanf(mod, table.id, keyCS, keyP)
-	if r != 0 {
-		return nil, fmt.Errorf("error scanning key (%v) from string", keyStr)
+	key := make([]byte, table.Desc().KeySize)
+	if err := table.scanKey(key, keyStr); err != nil {
+		return nil, err
 	}
 	return key, nil
 }
 
 func (table *Table) leafToBytes(leafStr string) ([]byte, error) {
-	mod := table.module.p
-	leaf_size := C.bpf_table_leaf_size_id(mod, table.id)
-	leaf := make([]byte, leaf_size)
-	leafP := unsafe.Pointer(&leaf[0])
-	leafCS := C.CString(leafStr)
-	defer C.free(unsafe.Pointer(leafCS))
-	r := C.bpf_table_leaf_sscanf(mod, table.id, leafCS, leafP)
-	if r != 0 {
-		return nil, fmt.Errorf("error scanning leaf (%v) from string", leafStr)
+	leaf := make([]byte, table.Desc().LeafSize)
+	if err := table.scanLeaf(leaf, leafStr); err != nil {
+		return nil, err
 	}
 	return leaf, nil
 }
 
+// scanKey scans the key string keyStr into key, of the key size.
+func (table *Table) scanKey(key []byte, keyStr string) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkFormat(); err != nil {
+		return err
+	}
+	mod := table.module.p
+	return scanTo("key", key, keyStr, table.Desc().KeyDesc, func(s, p unsafe.Pointer) bool {
+		return C.bpf_table_key_sscanf(mod, table.id, (*C.char)(s), p) == 0
+	}, table.keyToString)
+}
+
+// scanLeaf scans the leaf string leafStr into leaf, of the leaf size.
+func (table *Table) scanLeaf(leaf []byte, leafStr string) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkFormat(); err != nil {
+		return err
+	}
+	mod := table.module.p
+	return scanTo("leaf", leaf, leafStr, table.Desc().LeafDesc, func(s, p unsafe.Pointer) bool {
+		return C.bpf_table_leaf_sscanf(mod, table.id, (*C.char)(s), p) == 0
+	}, table.leafToString)
+}
+
+// scanTo runs sscanf on the key or leaf string s of the description
+// desc, storing the result into buf, and checks the result formatted
+// back with toString against s (see checkScanned). kind names the
+// string in errors. Rather than a C.CString, sscanf gets a copy of s
+// NUL-terminated in a pooled buffer, sparing a malloc and a free per
+// call; it reports whether the string was scanned.
+func scanTo(kind string, buf []byte, s, desc string, sscanf func(s, p unsafe.Pointer) bool, toString func([]byte, unsafe.Pointer) (string, []byte, error)) error {
+	// A C string would end at the first NUL.
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		return fmt.Errorf("error scanning %s (%q) from string: NUL byte at offset %d, use the bytes API for binary data", kind, s, i)
+	}
+	cs := getBuf(len(s) + 1)
+	defer putBuf(cs)
+	copy(*cs, s)
+	(*cs)[len(s)] = 0
+	p := unsafe.Pointer(&buf[0])
+	if !sscanf(unsafe.Pointer(&(*cs)[0]), p) {
+		return fmt.Errorf("error scanning %s (%v) from string", kind, s)
+	}
+	strBuf := getBuf(len(buf)*8 + len(s))
+	formatted, grown, err := toString(*strBuf, p)
+	*strBuf = grown
+	putBuf(strBuf)
+	if err != nil {
+		return err
+	}
+	if err := checkScanned(s, formatted, desc); err != nil {
+		return fmt.Errorf("error scanning %s (%v) from string: %v", kind, s, err)
+	}
+	return nil
+}
+
+// maxFormatBufSize caps the buffer used to format keys and leaves.
+const maxFormatBufSize = 1 << 20
+
+// formatTo runs snprintf on buf, doubling the buffer until the
+// NUL-terminated output fits, up to maxFormatBufSize: bcc's snprintf
+// fails on short buffers rather than returning the size needed, and
+// formatted structs of small fields can be many times their size. It
+// returns the formatted string together with the (possibly grown)
+// buffer so that callers can reuse it.
+func formatTo(buf []byte, snprintf func(*C.char, C.size_t) (C.int, error)) (string, []byte, error) {
+	if len(buf) == 0 {
+		buf = make([]byte, 64)
+	}
+	for {
+		r, err := snprintf((*C.char)(unsafe.Pointer(&buf[0])), C.size_t(len(buf)))
+		if r == 0 {
+			if n := bytes.IndexByte(buf, 0); n >= 0 {
+				return string(buf[:n]), buf, nil
+			}
+		}
+		if len(buf)*2 > maxFormatBufSize {
+			if err != nil {
+				return "", buf, fmt.Errorf("%w: output needs more than %d bytes: %w", ErrFormat, len(buf), err)
+			}
+			return "", buf, fmt.Errorf("%w: output needs more than %d bytes", ErrFormat, len(buf))
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+}
+
+func (table *Table) keyToString(buf []byte, keyP unsafe.Pointer) (string, []byte, error) {
+	if err := table.rlock(); err != nil {
+		return "", buf, err
+	}
+	defer table.runlock()
+	if err := table.checkFormat(); err != nil {
+		return "", buf, err
+	}
+	mod := table.module.p
+	s, buf, err := formatTo(buf, func(p *C.char, n C.size_t) (C.int, error) {
+		r, err := C.bpf_table_key_snprintf(mod, table.id, p, n, keyP)
+		return r, err
+	})
+	if err != nil {
+		return "", buf, fmt.Errorf("table %s: key: %w", table.Name(), err)
+	}
+	return s, buf, nil
+}
+
+func (table *Table) leafToString(buf []byte, leafP unsafe.Pointer) (string, []byte, error) {
+	if err := table.rlock(); err != nil {
+		return "", buf, err
+	}
+	defer table.runlock()
+	if err := table.checkFormat(); err != nil {
+		return "", buf, err
+	}
+	mod := table.module.p
+	s, buf, err := formatTo(buf, func(p *C.char, n C.size_t) (C.int, error) {
+		r, err := C.bpf_table_leaf_snprintf(mod, table.id, p, n, leafP)
+		return r, err
+	})
+	if err != nil {
+		return "", buf, fmt.Errorf("table %s: leaf: %w", table.Name(), err)
+	}
+	return s, buf, nil
+}
+
 // Entry represents a table entry.
 type Entry struct {
 	Key   string
 	Value string
+	// PerCPU holds the formatted value of each possible CPU for
+	// per-cpu tables, in which case Value is the list of them.
+	PerCPU []string
+	// KeyBytes and ValueBytes hold the raw key and value. For per-cpu
+	// tables, ValueBytes holds the values of all possible CPUs, each
+	// aligned to 8 bytes (see GetPerCPU).
+	KeyBytes   []byte
+	ValueBytes []byte
+
+	formatter *EntryFormatter
 }
 
 // Get takes a key and returns the value or nil, and an 'ok' style indicator.
+// Use GetEntry to tell a missing key from a failed lookup or a leaf
+// that can't be formatted.
 func (table *Table) Get(keyStr string) (interface{}, bool) {
-	mod := table.module.p
-	fd := C.bpf_table_fd_id(mod, table.id)
-	leaf_size := C.bpf_table_leaf_size_id(mod, table.id)
-	key, err := table.keyToBytes(keyStr)
+	entry, err := table.GetEntry(keyStr)
 	if err != nil {
 		return nil, false
 	}
-	leaf := make([]byte, leaf_size)
+	return entry, true
+}
+
+// GetEntry takes a key and returns the matching entry. If the key is
+// not present in the table, the returned error wraps ErrKeyNotFound; if
+// its leaf was found but can't be formatted, it wraps ErrFormat. Use
+// GetBytes for raw binary keys, keyStr can't hold NUL bytes.
+func (table *Table) GetEntry(keyStr string) (Entry, error) {
+	if err := table.rlock(); err != nil {
+		return Entry{}, err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opLookup); err != nil {
+		return Entry{}, err
+	}
+	desc := table.Desc()
+	key, err := table.keyToBytes(keyStr)
+	if err != nil {
+		return Entry{}, err
+	}
+	leafBufSize, err := table.leafBufSize()
+	if err != nil {
+		return Entry{}, err
+	}
+	leaf := make([]byte, leafBufSize)
 	keyP := unsafe.Pointer(&key[0])
 	leafP := unsafe.Pointer(&leaf[0])
-	r := C.bpf_lookup_elem(fd, keyP, leafP)
-	if r != 0 {
-		return nil, false
+	if err := table.lookupElem(desc.FD, keyP, leafP); err != nil {
+		if err == syscall.ENOENT {
+			return Entry{}, fmt.Errorf("Table.GetEntry: %s: %w", keyStr, mapErrno(err))
+		}
+		return Entry{}, fmt.Errorf("Table.GetEntry: unable to lookup element (%s): %w", keyStr, mapErrno(err))
 	}
-	leafStr := make([]byte, leaf_size*8)
-	leafStrP := (*C.char)(unsafe.Pointer(&leafStr[0]))
-	r = C.bpf_table_leaf_snprintf(mod, table.id, leafStrP, C.size_t(len(leafStr)), leafP)
-	if r != 0 {
-		return nil, false
+	strBuf := getBuf(int(desc.LeafSize) * 8)
+	leafStr, perCPU, grown, err := table.formatLeaf(*strBuf, leaf)
+	*strBuf = grown
+	putBuf(strBuf)
+	if err != nil {
+		return Entry{}, fmt.Errorf("Table.GetEntry: unable to format leaf of (%s): %w", keyStr, err)
 	}
 	return Entry{
-		Key:   keyStr,
-		Value: string(leafStr[:bytes.IndexByte(leafStr, 0)]),
-	}, true
+		Key:        keyStr,
+		Value:      leafStr,
+		PerCPU:     perCPU,
+		KeyBytes:   key,
+		ValueBytes: leaf,
+		formatter:  table.entryFormatter.Load(),
+	}, nil
 }
 
-// Set a key to a value.
+// UpdateFlag controls how updates treat existing keys.
+type UpdateFlag uint64
+
+const (
+	// UpdateAny creates a new element or updates an existing one.
+	UpdateAny UpdateFlag = C.BPF_ANY
+	// UpdateNoExist only creates a new element.
+	UpdateNoExist UpdateFlag = C.BPF_NOEXIST
+	// UpdateExist only updates an existing element.
+	UpdateExist UpdateFlag = C.BPF_EXIST
+)
+
+// Set a key to a value. For per-cpu tables, the value is set for
+// every CPU. Keys and values are strings in the format bcc prints them
+// in and can't hold NUL bytes: use SetBytes for raw binary ones.
 func (table *Table) Set(keyStr, leafStr string) error {
-	if table == nil || table.module.p == nil {
-		panic("table is nil")
+	return table.SetWithFlags(keyStr, leafStr, UpdateAny)
+}
+
+// SetWithFlags sets a key to a value like Set, with flags controlling
+// whether the key must or must not exist already. If the update is
+// rejected because of the flags, the returned error wraps ErrKeyExists
+// or ErrKeyNotFound, and ErrTableFull if the table is full.
+func (table *Table) SetWithFlags(keyStr, leafStr string, flags UpdateFlag) error {
+	if err := table.rlock(); err != nil {
+		return err
 	}
-	fd := C.bpf_table_fd_id(table.module.p, table.id)
-	key, err := table.keyToBytes(keyStr)
-	if err != nil {
+	defer table.runlock()
+	if err := table.checkOp(opUpdate); err != nil {
 		return err
 	}
-	leaf, err := table.leafToBytes(leafStr)
-	if err != nil {
+	desc := table.Desc()
+	// The scratch buffers don't outlive the update.
+	keyBuf := getBuf(int(desc.KeySize))
+	defer putBuf(keyBuf)
+	leafBuf := getBuf(int(desc.LeafSize))
+	defer putBuf(leafBuf)
+	key, leaf := *keyBuf, *leafBuf
+	if err := table.scanKey(key, keyStr); err != nil {
+		return err
+	}
+	if err := table.scanLeaf(leaf, leafStr); err != nil {
 		return err
 	}
+	var err error
+	if desc.MapType.IsPerCPU() {
+		if leaf, err = table.expandPerCPU(leaf); err != nil {
+			return err
+		}
+	}
 	keyP := unsafe.Pointer(&key[0])
 	leafP := unsafe.Pointer(&leaf[0])
-	r, err := C.bpf_update_elem(fd, keyP, leafP, 0)
-	if r != 0 {
-		return fmt.Errorf("Table.Set: unable to update element (%s=%s): %v", keyStr, leafStr, err)
+	if err := table.updateElem(desc.FD, keyP, leafP, uint64(flags)); err != nil {
+		return fmt.Errorf("Table.Set: unable to update element (%s=%s): %w", keyStr, leafStr, mapErrno(err))
 	}
 	return nil
 }
 
 // Delete a key.
 func (table *Table) Delete(keyStr string) error {
-	fd := C.bpf_table_fd_id(table.module.p, table.id)
-	key, err := table.keyToBytes(keyStr)
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opDelete); err != nil {
+		return err
+	}
+	desc := table.Desc()
+	keyBuf := getBuf(int(desc.KeySize))
+	defer putBuf(keyBuf)
+	if err := table.scanKey(*keyBuf, keyStr); err != nil {
+		return err
+	}
+	keyP := unsafe.Pointer(&(*keyBuf)[0])
+	if err := table.deleteElem(desc.FD, keyP); err != nil {
+		return fmt.Errorf("Table.Delete: unable to delete element (%s): %w", keyStr, mapErrno(err))
+	}
+	return nil
+}
+
+// GetBytes takes a raw key and returns the raw value. For per-cpu
+// tables, the value holds the values of all possible CPUs, each aligned
+// to 8 bytes (see GetPerCPU).
+func (table *Table) GetBytes(key []byte) ([]byte, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opLookup); err != nil {
+		return nil, err
+	}
+	leafSize, err := table.leafBufSize()
+	if err != nil {
+		return nil, err
+	}
+	leaf := make([]byte, leafSize)
+	if err := table.getInto("GetBytes", key, leaf); err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+// GetInto looks up a raw key like GetBytes, writing the raw value into
+// value, which must be of the size of the values GetBytes returns. It
+// allocates nothing but the error it returns if it fails, for lookups
+// in hot paths.
+func (table *Table) GetInto(key, value []byte) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opLookup); err != nil {
+		return err
+	}
+	return table.getInto("GetInto", key, value)
+}
+
+// getInto looks up key into leaf, method being the name of the caller
+// for errors. Callers must hold the table's read lock.
+func (table *Table) getInto(method string, key, leaf []byte) error {
+	desc := table.Desc()
+	leafSize, err := table.leafBufSize()
 	if err != nil {
 		return err
 	}
+	if len(key) != int(desc.KeySize) {
+		return fmt.Errorf("Table.%s: key size mismatch for table %s: got %d bytes, expected %d", method, desc.Name, len(key), desc.KeySize)
+	}
+	if len(leaf) != leafSize {
+		return fmt.Errorf("Table.%s: leaf size mismatch for table %s: got %d bytes, expected %d", method, desc.Name, len(leaf), leafSize)
+	}
 	keyP := unsafe.Pointer(&key[0])
-	r, err := C.bpf_delete_elem(fd, keyP)
-	if r != 0 {
-		return fmt.Errorf("Table.Delete: unable to delete element (%s): %v", keyStr, err)
+	leafP := unsafe.Pointer(&leaf[0])
+	if err := table.lookupElem(desc.FD, keyP, leafP); err != nil {
+		if err == syscall.ENOENT {
+			return fmt.Errorf("Table.%s: %x: %w", method, key, mapErrno(err))
+		}
+		return fmt.Errorf("Table.%s: unable to lookup element (%x): %w", method, key, mapErrno(err))
 	}
 	return nil
 }
 
-// Iter returns a receiver channel to iterate over all table entries.
-func (table *Table) Iter() <-chan Entry {
-	mod := table.module.p
-	ch := make(chan Entry, 128)
-	go func() {
-		defer close(ch)
-		fd := C.bpf_table_fd_id(mod, table.id)
-		key_size := C.bpf_table_key_size_id(mod, table.id)
-		leaf_size := C.bpf_table_leaf_size_id(mod, table.id)
-		key := make([]byte, key_size)
-		leaf := make([]byte, leaf_size)
-		keyP := unsafe.Pointer(&key[0])
-		leafP := unsafe.Pointer(&leaf[0])
-		alternateKeys := []byte{0xff, 0x55}
-		res := C.bpf_lookup_elem(fd, keyP, leafP)
-		// make sure the start iterator is an invalid key
-		for i := 0; i <= len(alternateKeys); i++ {
-			if res < 0 {
-				break
-			}
-			for j := range key {
-				key[j] = alternateKeys[i]
-			}
-			res = C.bpf_lookup_elem(fd, keyP, leafP)
-		}
-		if res == 0 {
-			return
-		}
-		keyStr := make([]byte, key_size*8)
-		leafStr := make([]byte, leaf_size*8)
-		keyStrP := (*C.char)(unsafe.Pointer(&keyStr[0]))
-		leafStrP := (*C.char)(unsafe.Pointer(&leafStr[0]))
-		for res = C.bpf_get_next_key(fd, keyP, keyP); res == 0; res = C.bpf_get_next_key(fd, keyP, keyP) {
-			r := C.bpf_lookup_elem(fd, keyP, leafP)
-			if r != 0 {
-				continue
-			}
-			r = C.bpf_table_key_snprintf(mod, table.id, keyStrP, C.size_t(len(keyStr)), keyP)
-			if r != 0 {
-				break
-			}
-			r = C.bpf_table_leaf_snprintf(mod, table.id, leafStrP, C.size_t(len(leafStr)), leafP)
-			if r != 0 {
-				break
-			}
-			ch <- Entry{
-				Key:   string(keyStr[:bytes.IndexByte(keyStr, 0)]),
-				Value: string(leafStr[:bytes.IndexByte(leafStr, 0)]),
-			}
-		}
-	}()
+// SetBytes sets a raw key to a raw value. For per-cpu tables, the
+// value must hold the values of all possible CPUs, each aligned to 8
+// bytes (see SetPerCPU).
+func (table *Table) SetBytes(key, leaf []byte) error {
+	return table.SetBytesWithFlags(key, leaf, UpdateAny)
+}
+
+// SetBytesWithFlags sets a raw key to a raw value like SetBytes, with
+// flags as for SetWithFlags.
+func (table *Table) SetBytesWithFlags(key, leaf []byte, flags UpdateFlag) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opUpdate); err != nil {
+		return err
+	}
+	return table.setFrom("SetBytes", key, leaf, flags)
+}
+
+// SetFrom sets a raw key to a raw value like SetBytes. Like GetInto, it
+// allocates nothing but the error it returns if it fails.
+func (table *Table) SetFrom(key, value []byte) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opUpdate); err != nil {
+		return err
+	}
+	return table.setFrom("SetFrom", key, value, UpdateAny)
+}
+
+// setFrom updates key to leaf with flags, method being the name of the
+// caller for errors. Callers must hold the table's read lock.
+func (table *Table) setFrom(method string, key, leaf []byte, flags UpdateFlag) error {
+	desc := table.Desc()
+	leafSize, err := table.leafBufSize()
+	if err != nil {
+		return err
+	}
+	if len(key) != int(desc.KeySize) {
+		return fmt.Errorf("Table.%s: key size mismatch for table %s: got %d bytes, expected %d", method, desc.Name, len(key), desc.KeySize)
+	}
+	if len(leaf) != leafSize {
+		return fmt.Errorf("Table.%s: leaf size mismatch for table %s: got %d bytes, expected %d", method, desc.Name, len(leaf), leafSize)
+	}
+	keyP := unsafe.Pointer(&key[0])
+	leafP := unsafe.Pointer(&leaf[0])
+	if err := table.updateElem(desc.FD, keyP, leafP, uint64(flags)); err != nil {
+		return fmt.Errorf("Table.%s: unable to update element (%x=%x): %w", method, key, leaf, mapErrno(err))
+	}
+	return nil
+}
+
+// DeleteBytes deletes a raw key.
+func (table *Table) DeleteBytes(key []byte) error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opDelete); err != nil {
+		return err
+	}
+	desc := table.Desc()
+	fd := desc.FD
+	keySize := int(desc.KeySize)
+	if len(key) != keySize {
+		return fmt.Errorf("Table.DeleteBytes: key size mismatch for table %s: got %d bytes, expected %d", table.Name(), len(key), keySize)
+	}
+	keyP := unsafe.Pointer(&key[0])
+	if err := table.deleteElem(fd, keyP); err != nil {
+		return fmt.Errorf("Table.DeleteBytes: unable to delete element (%x): %w", key, mapErrno(err))
+	}
+	return nil
+}
+
+// GetAndDelete takes a raw key, deletes it and returns its raw value.
+// It uses BPF_MAP_LOOKUP_AND_DELETE_ELEM so that no update done between
+// the lookup and the delete is lost. On kernels that don't support the
+// command for the type of the table, it falls back to a lookup followed
+// by a delete, which is not atomic.
+func (table *Table) GetAndDelete(key []byte) ([]byte, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opDelete); err != nil {
+		return nil, err
+	}
+	desc := table.Desc()
+	if len(key) != int(desc.KeySize) {
+		return nil, fmt.Errorf("Table.GetAndDelete: key size mismatch for table %s: got %d bytes, expected %d", desc.Name, len(key), desc.KeySize)
+	}
+	leafSize, err := table.leafBufSize()
+	if err != nil {
+		return nil, err
+	}
+	leaf := make([]byte, leafSize)
+	if err = lookupAndDeleteElem(desc.FD, key, leaf); err != nil {
+		err = table.retry(err, func() error { return lookupAndDeleteElem(desc.FD, key, leaf) })
+	}
+	switch err {
+	case nil:
+		return leaf, nil
+	case syscall.ENOENT:
+		return nil, fmt.Errorf("Table.GetAndDelete: %x: %w", key, mapErrno(err))
+	case syscall.EINVAL, syscall.ENOTSUP, syscall.ENOSYS:
+		// not atomic: updates done between the two calls are lost
+		if leaf, err = table.GetBytes(key); err != nil {
+			return nil, err
+		}
+		if err := table.DeleteBytes(key); err != nil {
+			return nil, err
+		}
+		return leaf, nil
+	}
+	return nil, fmt.Errorf("Table.GetAndDelete: unable to lookup and delete element (%x): %w", key, mapErrno(err))
+}
+
+// DrainAll deletes all entries of the table and returns them. Where
+// supported, they are read and deleted with BPF_MAP_LOOKUP_AND_DELETE_BATCH,
+// otherwise one by one: see GetAndDelete.
+func (table *Table) DrainAll() ([]RawEntry, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opDelete); err != nil {
+		return nil, err
+	}
+	var entries []RawEntry
+	err := table.dispatchBatch("DrainAll", cmdLookupAndDeleteBatch, func() error {
+		var err error
+		entries, err = table.getBatch("DrainAll", cmdLookupAndDeleteBatch, table.batchSize())
+		return err
+	}, func() error {
+		// Entries deleted by a batch that failed are kept.
+		drained, err := table.drainAll()
+		entries = append(entries, drained...)
+		return err
+	})
+	return entries, err
+}
+
+// drainAll deletes all entries of the table one by one and returns them.
+func (table *Table) drainAll() ([]RawEntry, error) {
+	desc := table.Desc()
+	fd := C.int(desc.FD)
+	keySize := desc.KeySize
+	key := make([]byte, keySize)
+	next := make([]byte, keySize)
+	var entries []RawEntry
+	ok, _, err := table.firstKey(fd, key)
+	if err != nil {
+		return nil, fmt.Errorf("Table.DrainAll: %w", err)
+	}
+	for ok {
+		// Fetch the next key before deleting the current one, since
+		// get_next_key on a deleted key starts over from the beginning.
+		r, err := C.bpf_get_next_key(fd, unsafe.Pointer(&key[0]), unsafe.Pointer(&next[0]))
+		ok = r == 0
+		if !ok && err != syscall.ENOENT {
+			return entries, fmt.Errorf("Table.DrainAll: unable to get next key: %w", mapErrno(err))
+		}
+		leaf, err := table.GetAndDelete(key)
+		if err == nil {
+			entries = append(entries, RawEntry{
+				Key:   append([]byte(nil), key...),
+				Value: leaf,
+			})
+		} else if !errors.Is(err, ErrKeyNotFound) {
+			return entries, err
+		}
+		key, next = next, key
+	}
+	return entries, nil
+}
+
+// Len returns the number of entries in the table. It only walks the
+// keys and doesn't interfere with concurrent iterations.
+func (table *Table) Len() (int, error) {
+	if err := table.rlock(); err != nil {
+		return 0, err
+	}
+	defer table.runlock()
+	if err := table.checkModule(); err != nil {
+		return 0, err
+	}
+	cur, err := table.newCursor()
+	if err != nil {
+		return 0, err
+	}
+	cur.keysOnly = true
+	n := 0
+	for cur.next() {
+		n++
+	}
+	if cur.err != nil {
+		return 0, fmt.Errorf("Table.Len: %v", cur.err)
+	}
+	return n, nil
+}
+
+// MaxEntries returns the maximum number of entries of the table as
+// reported by the kernel, or by bcc if the kernel doesn't support
+// BPF_OBJ_GET_INFO_BY_FD.
+func (table *Table) MaxEntries() (uint64, error) {
+	if err := table.rlock(); err != nil {
+		return 0, err
+	}
+	defer table.runlock()
+	if err := table.checkModule(); err != nil {
+		return 0, err
+	}
+	info, err := GetMapInfo(table.Desc().FD)
+	if err == nil {
+		return uint64(info.MaxEntries), nil
+	}
+	if table.module == nil {
+		return 0, fmt.Errorf("Table.MaxEntries: %v", err)
+	}
+	return uint64(C.bpf_table_max_entries_id(table.module.p, table.id)), nil
+}
+
+// Map creation flags of RecreateWithFlags (BPF_F_*).
+const (
+	// MapFlagNoPrealloc allocates the entries of hash maps on update
+	// rather than all at creation.
+	MapFlagNoPrealloc = 1 << 0
+	// MapFlagNoCommonLRU gives each CPU its own LRU list in LRU maps.
+	MapFlagNoCommonLRU = 1 << 1
+	// MapFlagRdonlyProg makes the map read-only for programs.
+	MapFlagRdonlyProg = 1 << 7
+	// MapFlagMmapable allows to mmap arrays (Linux 5.5).
+	MapFlagMmapable = 1 << 10
+)
+
+// RecreateWithFlags creates a new empty map with the type, key and leaf
+// sizes of the table, maxEntries entries, or as many as the table if
+// 0, and the MapFlag* flags, e.g. MapFlagNoPrealloc not to preallocate
+// a large hash map. The table then uses the new map for all subsequent
+// operations, and is returned. The module closes the new map on Close.
+//
+// Programs already loaded keep using the old map, the fds of the maps
+// they use being resolved at load time, and so do other Table values
+// for the same table. The new map is thus mostly useful to be pinned,
+// set as an inner map, or given to programs through a map of maps.
+// To create the table of a program with flags, declare it with the
+// BPF_F_TABLE macro of bcc instead.
+func (table *Table) RecreateWithFlags(maxEntries uint32, flags uint32) (*Table, error) {
+	return table.recreate("RecreateWithFlags", maxEntries, flags, "", 0)
+}
+
+// RecreateOnDevice is RecreateWithFlags creating the new map on the
+// network device ifName for hardware offload, for programs loaded for
+// the device with LoadWithOptions. It returns an error wrapping
+// ErrInterfaceNotFound if the device doesn't exist, and ErrNotSupported
+// if it or the kernel lacks offload support.
+func (table *Table) RecreateOnDevice(ifName string, maxEntries uint32, flags uint32) (*Table, error) {
+	ifIndex, err := interfaceIndex(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("Table.RecreateOnDevice: %w", err)
+	}
+	return table.recreate("RecreateOnDevice", maxEntries, flags, ifName, uint32(ifIndex))
+}
+
+// recreate implements RecreateWithFlags and RecreateOnDevice, method
+// being the name of the caller for errors.
+func (table *Table) recreate(method string, maxEntries, flags uint32, ifName string, ifIndex uint32) (*Table, error) {
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if table.module == nil {
+		return nil, fmt.Errorf("Table.%s: %s: %w", method, table.Name(), ErrNoModule)
+	}
+	desc := table.Desc()
+	if maxEntries == 0 {
+		max, err := table.MaxEntries()
+		if err != nil {
+			return nil, err
+		}
+		maxEntries = uint32(max)
+	}
+	fd, err := mapCreate(desc.MapType, uint32(desc.KeySize), uint32(desc.LeafSize), maxEntries, flags, desc.Name, ifIndex, 0)
+	if err != nil {
+		if ifIndex != 0 && isOffloadNotSupported(err) {
+			return nil, fmt.Errorf("Table.%s: unable to create map for %s on device %s: %v: %w", method, desc.Name, ifName, err, ErrNotSupported)
+		}
+		return nil, fmt.Errorf("Table.%s: unable to create map for %s: %v", method, desc.Name, err)
+	}
+	if err := table.module.TakeOwnership(fd); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	desc.FD = fd
+	table.desc.Store(&desc)
+	return table, nil
+}
+
+// Utilization returns the ratio of entries in the table to its maximum
+// number of entries, or 0 if either can't be determined.
+func (table *Table) Utilization() float64 {
+	n, err := table.Len()
+	if err != nil {
+		return 0
+	}
+	max, err := table.MaxEntries()
+	if err != nil || max == 0 {
+		return 0
+	}
+	return float64(n) / float64(max)
+}
+
+// DeleteAll deletes all entries of the table, walking the keys and
+// deleting them with BPF_MAP_DELETE_BATCH where supported, one by one
+// otherwise. Tables that don't support deleting elements (e.g. arrays)
+// have all their values zeroed instead.
+func (table *Table) DeleteAll() error {
+	if err := table.rlock(); err != nil {
+		return err
+	}
+	defer table.runlock()
+	if err := table.checkModule(); err != nil {
+		return err
+	}
+	if err := table.checkSizes(); err != nil {
+		return fmt.Errorf("Table.DeleteAll: %w", err)
+	}
+	return table.dispatchBatch("DeleteAll", cmdDeleteBatch, table.deleteAllBatch, table.deleteAll)
+}
+
+// deleteAll deletes all entries of the table one by one.
+func (table *Table) deleteAll() error {
+	desc := table.Desc()
+	fd := C.int(desc.FD)
+	keySize := desc.KeySize
+	key := make([]byte, keySize)
+	next := make([]byte, keySize)
+	ok, _, err := table.firstKey(fd, key)
+	if err != nil {
+		return fmt.Errorf("Table.DeleteAll: %w", err)
+	}
+	for ok {
+		// Fetch the next key before deleting the current one, since
+		// get_next_key on a deleted key starts over from the beginning.
+		r, err := C.bpf_get_next_key(fd, unsafe.Pointer(&key[0]), unsafe.Pointer(&next[0]))
+		ok = r == 0
+		if !ok && err != syscall.ENOENT {
+			return fmt.Errorf("Table.DeleteAll: unable to get next key: %w", mapErrno(err))
+		}
+		if err := table.deleteElem(int(fd), unsafe.Pointer(&key[0])); err != nil {
+			if err == syscall.EINVAL {
+				_, err := table.zeroAll()
+				return err
+			}
+			if err != syscall.ENOENT {
+				return fmt.Errorf("Table.DeleteAll: unable to delete element (%x): %w", key, mapErrno(err))
+			}
+		}
+		key, next = next, key
+	}
+	return nil
+}
+
+// ZeroAll sets the values of all entries of the table to zero, for
+// every CPU of per-cpu tables, and returns the number of entries
+// zeroed. Keys are kept, and entries are updated with BPF_EXIST so none
+// is created: entries deleted concurrently are skipped. Entries are
+// read and updated with batch commands where supported.
+func (table *Table) ZeroAll() (int, error) {
+	if err := table.rlock(); err != nil {
+		return 0, err
+	}
+	defer table.runlock()
+	if err := table.checkOp(opUpdate); err != nil {
+		return 0, err
+	}
+	var n int
+	err := table.dispatchBatch("ZeroAll", cmdUpdateBatch, func() error {
+		var err error
+		n, err = table.zeroAllBatch()
+		return err
+	}, func() error {
+		var err error
+		if n, err = table.zeroAll(); err != nil {
+			return fmt.Errorf("Table.ZeroAll: %w", err)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// zeroAll sets the values of all entries of the table to zero.
+func (table *Table) zeroAll() (int, error) {
+	cur, err := table.newCursor()
+	if err != nil {
+		return 0, err
+	}
+	cur.keysOnly = true
+	leaf := make([]byte, len(cur.leaf))
+	leafP := unsafe.Pointer(&leaf[0])
+	n := 0
+	for cur.next() {
+		if err := table.updateElem(int(cur.fd), cur.keyP, leafP, uint64(UpdateExist)); err != nil {
+			if err == syscall.ENOENT {
+				continue
+			}
+			return n, fmt.Errorf("unable to zero element (%x): %w", cur.key, mapErrno(err))
+		}
+		n++
+	}
+	return n, cur.err
+}
+
+// probeKeyPatterns are byte patterns tried, in order, to find a key that
+// is not present in a table on kernels without NULL key support.
+var probeKeyPatterns = []byte{0x00, 0xff, 0x55, 0xaa}
+
+// maxRandomProbes is the number of random keys tried after all the
+// probeKeyPatterns turned out to be present in a table.
+const maxRandomProbes = 64
+
+// firstKey stores the first key of the table, in the kernel's
+// iteration order, into key. ok is false if the table is empty (or no
+// start key could be determined). legacy is true if the kernel doesn't
+// support BPF_MAP_GET_NEXT_KEY with a NULL key (Linux < 4.12) and the
+// start key was found by probing for a key that is not in the table;
+// get_next_key on a missing key returns the first key.
+func (table *Table) firstKey(fd C.int, key []byte) (ok, legacy bool, err error) {
+	keyP := unsafe.Pointer(&key[0])
+	r, err := C.bpf_get_next_key(fd, nil, keyP)
+	if r == 0 {
+		return true, false, nil
+	}
+	switch err {
+	case syscall.ENOENT:
+		return false, false, nil
+	case syscall.EFAULT, syscall.EINVAL:
+		// The NULL key is copied from user space by older kernels.
+	default:
+		return false, false, fmt.Errorf("unable to get first key: %w", mapErrno(err))
+	}
+	if !table.probeMissingKey(key) {
+		return false, true, nil
+	}
+	r, err = C.bpf_get_next_key(fd, keyP, keyP)
+	if r != 0 {
+		if err == syscall.ENOENT {
+			return false, true, nil
+		}
+		return false, true, fmt.Errorf("unable to get first key: %w", mapErrno(err))
+	}
+	return true, true, nil
+}
+
+// probeMissingKey stores a key that is not present in the table into
+// key. It tries the probeKeyPatterns first and random keys after that,
+// and returns false if every key tried is present.
+func (table *Table) probeMissingKey(key []byte) bool {
+	fd := C.int(table.Desc().FD)
+	keyP := unsafe.Pointer(&key[0])
+	leafSize, err := table.leafBufSize()
+	if err != nil {
+		return false
+	}
+	leaf := make([]byte, leafSize)
+	leafP := unsafe.Pointer(&leaf[0])
+	for i := 0; i < len(probeKeyPatterns)+maxRandomProbes; i++ {
+		if i < len(probeKeyPatterns) {
+			for j := range key {
+				key[j] = probeKeyPatterns[i]
+			}
+		} else if _, err := rand.Read(key); err != nil {
+			return false
+		}
+		if r, err := C.bpf_lookup_elem(fd, keyP, leafP); r != 0 {
+			return err == syscall.ENOENT
+		}
+	}
+	return false
+}
+
+// cursor walks over the entries of a table with bpf_get_next_key and
+// looks up the leaf of each key. The key and leaf buffers are reused.
+type cursor struct {
+	table   *Table
+	fd      C.int
+	key     []byte
+	leaf    []byte
+	keyP    unsafe.Pointer
+	leafP   unsafe.Pointer
+	seen    map[string]struct{}
+	started bool
+	done    bool
+	dropped int
+	err     error
+	// keysOnly skips looking up the leaf of each key.
+	keysOnly bool
+	// filter, if set, skips the keys it returns false for before
+	// looking up their leaf.
+	filter func(key []byte) bool
+	// snapshot collects all the keys on the first call to next, into
+	// keys, before looking up any leaf.
+	snapshot bool
+	keys     []byte
+	// batch holds the entries read ahead by fillBatch, for cursors
+	// that don't need to handle each key in Go.
+	batch *cursorBatch
+}
+
+// cursorBatch holds entries read ahead in a single cgo call.
+type cursorBatch struct {
+	// resume is the key to read the next batch after, that of the
+	// last entry read by the cursor until the first batch is read.
+	resume  []byte
+	started bool
+	keys    []byte
+	leaves  []byte
+	cap     int
+	len     int
+	pos     int
+	// err is the error that ended the last batch, and end is set if
+	// it ended at the end of the table.
+	err error
+	end bool
+}
+
+// Batches hold up to maxCursorBatch entries, in at most
+// maxCursorBatchBytes of keys and leaves.
+const (
+	maxCursorBatch      = 256
+	maxCursorBatchBytes = 1 << 20
+)
+
+// newCursorBatch returns a batch for entries of keySize and leafSize
+// bytes.
+func newCursorBatch(keySize, leafSize int) *cursorBatch {
+	n := maxCursorBatchBytes / (keySize + leafSize)
+	if n > maxCursorBatch {
+		n = maxCursorBatch
+	}
+	if n < 1 {
+		n = 1
+	}
+	return &cursorBatch{
+		resume: make([]byte, keySize),
+		keys:   make([]byte, n*keySize),
+		leaves: make([]byte, n*leafSize),
+		cap:    n,
+	}
+}
+
+func (table *Table) newCursor() (*cursor, error) {
+	if err := table.checkSizes(); err != nil {
+		return nil, err
+	}
+	desc := table.Desc()
+	leafSize, err := table.leafBufSize()
+	if err != nil {
+		return nil, err
+	}
+	c := &cursor{
+		table: table,
+		fd:    C.int(desc.FD),
+		key:   make([]byte, desc.KeySize),
+		leaf:  make([]byte, leafSize),
+	}
+	c.keyP = unsafe.Pointer(&c.key[0])
+	c.leafP = unsafe.Pointer(&c.leaf[0])
+	return c, nil
+}
+
+// next advances the cursor to the next entry. It returns false when
+// there are no more entries or an error occurred.
+func (c *cursor) next() bool {
+	if c.done {
+		return false
+	}
+	// Lock for each entry rather than for the whole iteration, the
+	// caller may use the entries to close the module.
+	if err := c.table.rlock(); err != nil {
+		c.done = true
+		c.err = err
+		return false
+	}
+	defer c.table.runlock()
+	if c.snapshot {
+		return c.nextSnapshotted()
+	}
+	if c.batch != nil {
+		return c.nextBatched()
+	}
+	for !c.done {
+		if !c.started {
+			c.started = true
+			ok, legacy, err := c.table.firstKey(c.fd, c.key)
+			if !ok {
+				c.done = true
+				c.err = err
+				return false
+			}
+			// get_next_key restarts from the first key when the
+			// current key is deleted concurrently, on all kernels.
+			// Streaming cursors yield the keys seen again (see
+			// SnapshotKeys), but without NULL key support, where
+			// keys are handled one by one anyway: remember them so
+			// none is visited twice.
+			if legacy {
+				c.seen = make(map[string]struct{})
+			}
+			// Read the following entries in batches, unless each
+			// key is handled in Go: filtered, deduplicated or
+			// looked up with retries.
+			if !legacy && c.filter == nil && c.table.retryPolicy.Load() == nil {
+				leafSize := len(c.leaf)
+				if c.keysOnly {
+					leafSize = 0
+				}
+				c.batch = newCursorBatch(len(c.key), leafSize)
+			}
+		} else if r, err := C.bpf_get_next_key(c.fd, c.keyP, c.keyP); r != 0 {
+			c.done = true
+			if err != syscall.ENOENT {
+				c.err = fmt.Errorf("unable to get next key: %w", mapErrno(err))
+			}
+			return false
+		}
+		if c.seen != nil {
+			if _, dup := c.seen[string(c.key)]; dup {
+				debugf("table %s: key %x seen again after a concurrent delete, skipped", c.table.Name(), c.key)
+				continue
+			}
+			c.seen[string(c.key)] = struct{}{}
+		}
+		if c.filter != nil && !c.filter(c.key) {
+			continue
+		}
+		if c.keysOnly || c.lookupLeaf() {
+			return true
+		}
+	}
+	return false
+}
+
+// nextBatched is next for cursors reading entries in batches, after
+// the first one. Callers must hold the table's read lock.
+func (c *cursor) nextBatched() bool {
+	b := c.batch
+	if b.pos == b.len {
+		if b.end || b.err != nil {
+			c.done = true
+			c.err = b.err
+			return false
+		}
+		if !b.started {
+			b.started = true
+			copy(b.resume, c.key)
+		}
+		c.fillBatch()
+		if b.len == 0 {
+			return c.nextBatched()
+		}
+	}
+	copy(c.key, b.keys[b.pos*len(c.key):])
+	if !c.keysOnly {
+		copy(c.leaf, b.leaves[b.pos*len(c.leaf):])
+	}
+	b.pos++
+	return true
+}
+
+// fillBatch reads the entries following b.resume into the batch.
+func (c *cursor) fillBatch() {
+	b := c.batch
+	var dropped, errno, failedLookup C.int
+	n := C.gobpf_next_entries(c.fd, unsafe.Pointer(&b.resume[0]), C.size_t(len(c.key)),
+		unsafe.Pointer(&b.keys[0]), bytesPointer(b.leaves), C.size_t(len(c.leaf)),
+		C.int(b.cap), &dropped, &errno, &failedLookup)
+	b.len, b.pos = int(n), 0
+	if dropped > 0 {
+		c.dropped += int(dropped)
+		debugf("table %s: %d keys deleted while iterating, skipped", c.table.Name(), dropped)
+	}
+	switch err := syscall.Errno(errno); {
+	case err == 0:
+	case failedLookup != 0:
+		b.err = fmt.Errorf("unable to lookup element (%x): %w", b.resume, mapErrno(err))
+	case err == syscall.ENOENT:
+		b.end = true
+	default:
+		b.err = fmt.Errorf("unable to get next key: %w", mapErrno(err))
+	}
+}
+
+// lookupLeaf looks up the leaf of the current key. It returns false if
+// the key was deleted since it was read, or if the lookup failed, which
+// ends the iteration.
+func (c *cursor) lookupLeaf() bool {
+	if err := c.table.lookupElem(int(c.fd), c.keyP, c.leafP); err != nil {
+		if err == syscall.ENOENT {
+			// deleted after get_next_key returned it
+			c.dropped++
+			debugf("table %s: key %x deleted while iterating, skipped", c.table.Name(), c.key)
+			return false
+		}
+		c.done = true
+		c.err = fmt.Errorf("unable to lookup element (%x): %w", c.key, mapErrno(err))
+		return false
+	}
+	return true
+}
+
+// nextSnapshotted is next for cursors over a snapshot of the keys.
+// Callers must hold the table's read lock.
+func (c *cursor) nextSnapshotted() bool {
+	if !c.started {
+		c.started = true
+		if err := c.collectKeys(); err != nil {
+			c.done = true
+			c.err = err
+			return false
+		}
+	}
+	for !c.done && len(c.keys) > 0 {
+		copy(c.key, c.keys)
+		c.keys = c.keys[len(c.key):]
+		if c.filter != nil && !c.filter(c.key) {
+			continue
+		}
+		if c.keysOnly || c.lookupLeaf() {
+			return true
+		}
+	}
+	c.keys = nil
+	c.done = true
+	return false
+}
+
+// collectKeys reads all the keys of the table into c.keys, once each
+// even if get_next_key starts over after a concurrent delete.
+func (c *cursor) collectKeys() error {
+	ok, _, err := c.table.firstKey(c.fd, c.key)
+	if !ok {
+		return err
+	}
+	seen := make(map[string]struct{})
+	for {
+		if _, dup := seen[string(c.key)]; dup {
+			debugf("table %s: key %x seen again after a concurrent delete, skipped", c.table.Name(), c.key)
+		} else {
+			seen[string(c.key)] = struct{}{}
+			c.keys = append(c.keys, c.key...)
+		}
+		if r, err := C.bpf_get_next_key(c.fd, c.keyP, c.keyP); r != 0 {
+			if err != syscall.ENOENT {
+				return fmt.Errorf("unable to get next key: %w", mapErrno(err))
+			}
+			return nil
+		}
+	}
+}
+
+// Iterator iterates over the entries of a table in the caller's
+// goroutine:
+//
+//	it := table.Iterator()
+//	for it.Next() {
+//		e := it.Entry()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	cur     *cursor
+	keyStr  []byte
+	leafStr []byte
+	entry   Entry
+	err     error
+}
+
+// IterOption configures the iterations over table entries.
+type IterOption func(*iterOptions)
+
+type iterOptions struct {
+	snapshotKeys bool
+	filter       func(key []byte) bool
+}
+
+// SnapshotKeys makes iterations read all the keys of the table first,
+// then look up the leaf of each. Streaming iterations, the default,
+// read one key at a time, and on every kernel get_next_key starts over
+// from the first key of a hash table when the current one has been
+// deleted concurrently: streaming iterations can then yield the same
+// entries more than once. Only on kernels without NULL key support
+// (Linux < 4.12), where the walk is probed key by key anyway, do they
+// remember the keys already yielded. With SnapshotKeys every key is
+// yielded at most once, and keys deleted before their lookup are
+// skipped (see Iterator.Dropped), at the cost of holding all the keys
+// in memory.
+func SnapshotKeys() IterOption {
+	return func(o *iterOptions) {
+		o.snapshotKeys = true
+	}
+}
+
+// KeyFilter makes iterations only yield the entries whose raw key pred
+// returns true for, e.g. KeyPrefix. Keys are filtered before their
+// value is looked up and formatted, so skipping entries is cheap. pred
+// must not retain the key slice.
+func KeyFilter(pred func(key []byte) bool) IterOption {
+	return func(o *iterOptions) {
+		o.filter = pred
+	}
+}
+
+// Iterator returns an iterator over all table entries.
+func (table *Table) Iterator(opts ...IterOption) *Iterator {
+	if err := table.rlock(); err != nil {
+		return &Iterator{err: err}
+	}
+	defer table.runlock()
+	if err := table.checkFormat(); err != nil {
+		return &Iterator{err: err}
+	}
+	if err := table.checkOp(opLookup); err != nil {
+		return &Iterator{err: err}
+	}
+	cur, err := table.newCursor()
+	if err != nil {
+		return &Iterator{err: err}
+	}
+	var o iterOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	cur.filter = o.filter
+	cur.snapshot = o.snapshotKeys
+	return &Iterator{
+		cur:     cur,
+		keyStr:  make([]byte, len(cur.key)*8),
+		leafStr: make([]byte, table.Desc().LeafSize*8),
+	}
+}
+
+// Next advances the iterator to the next entry. It returns false when
+// the iteration is complete or stopped because of an error.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.cur.next() {
+		it.err = it.cur.err
+		return false
+	}
+	table := it.cur.table
+	k, keyStr, err := table.keyToString(it.keyStr, it.cur.keyP)
+	if err != nil {
+		it.err = fmt.Errorf("unable to format key (%x): %w", it.cur.key, err)
+		return false
+	}
+	l, perCPU, leafStr, err := table.formatLeaf(it.leafStr, it.cur.leaf)
+	if err != nil {
+		it.err = fmt.Errorf("unable to format leaf of (%s): %w", k, err)
+		return false
+	}
+	it.keyStr, it.leafStr = keyStr, leafStr
+	// The cursor buffers are reused for the next entry.
+	it.entry = Entry{
+		Key:        k,
+		Value:      l,
+		PerCPU:     perCPU,
+		KeyBytes:   append([]byte(nil), it.cur.key...),
+		ValueBytes: append([]byte(nil), it.cur.leaf...),
+		formatter:  table.entryFormatter.Load(),
+	}
+	return true
+}
+
+// Entry returns the current entry.
+func (it *Iterator) Entry() Entry {
+	return it.entry
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Dropped returns the number of entries skipped so far because they
+// were deleted while iterating.
+func (it *Iterator) Dropped() int {
+	if it.cur == nil {
+		return 0
+	}
+	return it.cur.dropped
+}
+
+// Entries returns an iterator over all table entries, for use with
+// range:
+//
+//	for e, err := range table.Entries() {
+//		if err != nil {
+//			...
+//		}
+//	}
+//
+// The iteration runs in the caller's goroutine, breaking out of the
+// loop stops it. An error ends the iteration.
+func (table *Table) Entries(opts ...IterOption) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		it := table.Iterator(opts...)
+		for it.Next() {
+			if !yield(it.Entry(), nil) {
+				return
+			}
+		}
+		if err := it.Err(); err != nil {
+			yield(Entry{}, err)
+		}
+	}
+}
+
+// unsignedTypes are the leaf descriptions of unsigned integers.
+var unsignedTypes = map[string]bool{
+	`"unsigned char"`:      true,
+	`"unsigned short"`:     true,
+	`"unsigned int"`:       true,
+	`"unsigned long"`:      true,
+	`"unsigned long long"`: true,
+}
+
+// SortedEntries is like Entries but yields the entries sorted by key,
+// or by value if byValueNumeric is set, in ascending order. Sorting by
+// value requires the leaf of the table to be an unsigned integer and
+// sorts entries with the same value by key.
+//
+// All entries are read and buffered before the first one is yielded,
+// so it takes memory in O(n) for a table of n entries.
+func (table *Table) SortedEntries(byValueNumeric bool) iter.Seq2[Entry, error] {
+	return func(yield func(Entry, error) bool) {
+		desc := table.Desc()
+		if byValueNumeric && (!unsignedTypes[desc.LeafDesc] || desc.MapType.IsPerCPU()) {
+			yield(Entry{}, fmt.Errorf("Table.SortedEntries: leaf %s of table %s is not an unsigned integer", desc.LeafDesc, desc.Name))
+			return
+		}
+		var (
+			entries []Entry
+			values  []uint64
+		)
+		for e, err := range table.Entries() {
+			if err != nil {
+				yield(Entry{}, err)
+				return
+			}
+			if byValueNumeric {
+				// bcc formats integers in hex, ParseUint handles
+				// both that and decimal.
+				v, err := strconv.ParseUint(e.Value, 0, 64)
+				if err != nil {
+					yield(Entry{}, fmt.Errorf("Table.SortedEntries: invalid value %q of key %s: %v", e.Value, e.Key, err))
+					return
+				}
+				values = append(values, v)
+			}
+			entries = append(entries, e)
+		}
+		order := make([]int, len(entries))
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(i, j int) bool {
+			a, b := order[i], order[j]
+			if byValueNumeric && values[a] != values[b] {
+				return values[a] < values[b]
+			}
+			return entries[a].Key < entries[b].Key
+		})
+		for _, i := range order {
+			if !yield(entries[i], nil) {
+				return
+			}
+		}
+	}
+}
+
+// Iter returns a receiver channel to iterate over all table entries.
+// If the module has been closed, the returned channel is closed
+// without yielding any entries. The channel is also closed on errors,
+// which Entries and Iterator return. Closing the module stops the
+// iteration: each entry is read and formatted under the module's read
+// lock, so Close waits for the entry in progress and the next one
+// fails with ErrModuleClosed.
+//
+// The iteration runs in a goroutine sending to the channel: if the
+// receiver stops reading, it stays blocked until the table or its
+// module is closed. Drain the channel, or use IterContext and cancel
+// it, to stop earlier.
+func (table *Table) Iter(opts ...IterOption) <-chan Entry {
+	return table.IterContext(context.Background(), opts...)
+}
+
+// IterContext is like Iter but also stops iterating and closes the
+// channel once ctx is done, even if the receiver stopped reading.
+func (table *Table) IterContext(ctx context.Context, opts ...IterOption) <-chan Entry {
+	ch := make(chan Entry, 128)
+	go sendEntries(ctx, table, ch, table.Entries(opts...))
+	return ch
+}
+
+// sendEntries sends the entries of seq to ch, then closes it, at the
+// end of seq, on the first error, which is logged, or once ctx is done
+// or the table closed.
+func sendEntries[E any](ctx context.Context, table *Table, ch chan<- E, seq iter.Seq2[E, error]) {
+	defer close(ch)
+	closing := table.closing()
+	for e, err := range seq {
+		if err != nil {
+			warnf("table %s: iteration stopped: %v", table.Name(), err)
+			return
+		}
+		select {
+		case ch <- e:
+		case <-ctx.Done():
+			return
+		case <-closing:
+			return
+		}
+	}
+}
+
+// IterFilter is like Iter but only yields the entries whose raw key
+// pred returns true for, see KeyFilter. Like that of Iter, its goroutine
+// blocks until the table is closed if the receiver stops reading: use
+// IterContext with KeyFilter to stop earlier, and Entries with
+// KeyFilter to get the errors that stop the iteration.
+func (table *Table) IterFilter(pred func(key []byte) bool) <-chan Entry {
+	return table.IterContext(context.Background(), KeyFilter(pred))
+}
+
+// KeyPrefix returns a KeyFilter predicate matching the keys starting
+// with prefix, e.g. the leading fields of struct keys.
+func KeyPrefix(prefix []byte) func(key []byte) bool {
+	prefix = append([]byte(nil), prefix...)
+	return func(key []byte) bool {
+		return bytes.HasPrefix(key, prefix)
+	}
+}
+
+// RawEntry represents a table entry in its binary form.
+type RawEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// TableIterator iterates over the entries of a table in their binary
+// form, in the caller's goroutine and without allocating per entry:
+//
+//	it := table.RawIterator()
+//	for it.Next() {
+//		key, leaf := it.Key(), it.Leaf()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// The key and leaf buffers are reused, copy them to retain them past
+// the next call to Next.
+type TableIterator struct {
+	cur *cursor
+	err error
+}
+
+// RawIterator returns an iterator over all table entries in their
+// binary form.
+func (table *Table) RawIterator() *TableIterator {
+	if err := table.rlock(); err != nil {
+		return &TableIterator{err: err}
+	}
+	defer table.runlock()
+	if err := table.checkOp(opLookup); err != nil {
+		return &TableIterator{err: err}
+	}
+	cur, err := table.newCursor()
+	if err != nil {
+		return &TableIterator{err: err}
+	}
+	return &TableIterator{cur: cur}
+}
+
+// Next advances the iterator to the next entry. It returns false when
+// the iteration is complete or stopped because of an error.
+func (it *TableIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.cur.next() {
+		it.err = it.cur.err
+		return false
+	}
+	return true
+}
+
+// Key returns the key of the current entry, valid until the next call
+// to Next.
+func (it *TableIterator) Key() []byte {
+	if it.cur == nil {
+		return nil
+	}
+	return it.cur.key
+}
+
+// Leaf returns the leaf of the current entry, valid until the next
+// call to Next. The leaf of per-cpu tables holds the values of all
+// possible cpus.
+func (it *TableIterator) Leaf() []byte {
+	if it.cur == nil {
+		return nil
+	}
+	return it.cur.leaf
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *TableIterator) Err() error {
+	return it.err
+}
+
+// Dropped returns the number of entries skipped so far because they
+// were deleted while iterating.
+func (it *TableIterator) Dropped() int {
+	if it.cur == nil {
+		return 0
+	}
+	return it.cur.dropped
+}
+
+// EntriesBytes is like Entries but yields the entries without
+// formatting them. The Key and Value slices of each entry are copies
+// owned by the caller; use RawIterator to avoid copying them.
+func (table *Table) EntriesBytes() iter.Seq2[RawEntry, error] {
+	return func(yield func(RawEntry, error) bool) {
+		it := table.RawIterator()
+		for it.Next() {
+			e := RawEntry{
+				Key:   append([]byte(nil), it.Key()...),
+				Value: append([]byte(nil), it.Leaf()...),
+			}
+			if !yield(e, nil) {
+				return
+			}
+		}
+		if err := it.Err(); err != nil {
+			yield(RawEntry{}, err)
+		}
+	}
+}
+
+// IterBytes returns a receiver channel to iterate over all table
+// entries without formatting them. The Key and Value slices of each
+// entry are copies owned by the receiver. The channel is closed on
+// errors, which EntriesBytes returns.
+func (table *Table) IterBytes() <-chan RawEntry {
+	return table.IterBytesContext(context.Background())
+}
+
+// IterBytesContext is like IterBytes but stops iterating and closes the
+// channel once ctx is done, even if the receiver stopped reading.
+func (table *Table) IterBytesContext(ctx context.Context) <-chan RawEntry {
+	ch := make(chan RawEntry, 128)
+	go sendEntries(ctx, table, ch, table.EntriesBytes())
 	return ch
 }
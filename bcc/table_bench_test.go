@@ -0,0 +1,482 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// The benchmarks of this file run against the maps of bcc modules, and
+// are skipped unless run as root, but for those named Fake: these run
+// against fake element commands (see fakeElems), measuring the Go side
+// of the operations without privileges.
+
+// benchSizes are the numbers of entries of the benchmarked maps.
+var benchSizes = []int{1024, 65536}
+
+// newBenchTable returns the table of a module holding a map of type
+// mapType, e.g. "hash", of u32 keys and u64 values, filled with
+// entries entries of keys 0 to entries-1 and zero values, on every
+// CPU for per-cpu maps.
+func newBenchTable(b *testing.B, mapType string, entries int) (*Module, *Table) {
+	if os.Geteuid() != 0 {
+		b.Skip("loading bcc modules requires root")
+	}
+	m, err := NewModule(fmt.Sprintf(`BPF_TABLE("%s", u32, u64, bench, %d);`, mapType, entries), []string{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	table := NewTableByName("bench", m)
+	leafSize, err := table.leafBufSize()
+	if err != nil {
+		m.Close()
+		b.Fatal(err)
+	}
+	key, value := make([]byte, 4), make([]byte, leafSize)
+	for i := 0; i < entries; i++ {
+		byteOrder.PutUint32(key, uint32(i))
+		if err := table.SetBytes(key, value); err != nil {
+			m.Close()
+			b.Fatal(err)
+		}
+	}
+	return m, table
+}
+
+// benchTables runs fn as a sub-benchmark for tables of each of the
+// mapTypes and benchSizes.
+func benchTables(b *testing.B, mapTypes []string, fn func(b *testing.B, table *Table, entries int)) {
+	for _, mapType := range mapTypes {
+		for _, n := range benchSizes {
+			b.Run(fmt.Sprintf("%s/%d", mapType, n), func(b *testing.B) {
+				m, table := newBenchTable(b, mapType, n)
+				defer m.Close()
+				b.ReportAllocs()
+				b.ResetTimer()
+				fn(b, table, n)
+			})
+		}
+	}
+}
+
+// benchKeys returns up to 1024 of the keys of a table of entries
+// entries, raw and formatted.
+func benchKeys(entries int) ([][]byte, []string) {
+	if entries > 1024 {
+		entries = 1024
+	}
+	raw := make([][]byte, entries)
+	strs := make([]string, entries)
+	for i := range raw {
+		raw[i] = make([]byte, 4)
+		byteOrder.PutUint32(raw[i], uint32(i))
+		strs[i] = strconv.Itoa(i)
+	}
+	return raw, strs
+}
+
+func BenchmarkGet(b *testing.B) {
+	benchTables(b, []string{"hash", "array"}, func(b *testing.B, table *Table, entries int) {
+		_, keys := benchKeys(entries)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := table.GetEntry(keys[i%len(keys)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSet(b *testing.B) {
+	benchTables(b, []string{"hash", "array"}, func(b *testing.B, table *Table, entries int) {
+		_, keys := benchKeys(entries)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := table.Set(keys[i%len(keys)], "1"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkDelete deletes and sets back an entry per iteration, arrays
+// not supporting deletes.
+func BenchmarkDelete(b *testing.B) {
+	benchTables(b, []string{"hash"}, func(b *testing.B, table *Table, entries int) {
+		raw, keys := benchKeys(entries)
+		value := make([]byte, 8)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			k := i % len(keys)
+			if err := table.Delete(keys[k]); err != nil {
+				b.Fatal(err)
+			}
+			if err := table.SetFrom(raw[k], value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkIter walks the table through the channel of Iter, formatting
+// each entry.
+func BenchmarkIter(b *testing.B) {
+	benchTables(b, []string{"hash", "array"}, func(b *testing.B, table *Table, entries int) {
+		for i := 0; i < b.N; i++ {
+			for range table.Iter() {
+			}
+		}
+	})
+}
+
+func BenchmarkGetBytes(b *testing.B) {
+	benchTables(b, []string{"hash", "array"}, func(b *testing.B, table *Table, entries int) {
+		keys, _ := benchKeys(entries)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := table.GetBytes(keys[i%len(keys)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSetBytes(b *testing.B) {
+	benchTables(b, []string{"hash", "array"}, func(b *testing.B, table *Table, entries int) {
+		keys, _ := benchKeys(entries)
+		value := make([]byte, 8)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := table.SetBytes(keys[i%len(keys)], value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkDeleteBytes deletes and sets back an entry per iteration.
+func BenchmarkDeleteBytes(b *testing.B) {
+	benchTables(b, []string{"hash"}, func(b *testing.B, table *Table, entries int) {
+		keys, _ := benchKeys(entries)
+		value := make([]byte, 8)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			k := keys[i%len(keys)]
+			if err := table.DeleteBytes(k); err != nil {
+				b.Fatal(err)
+			}
+			if err := table.SetFrom(k, value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkGetInto(b *testing.B) {
+	benchTables(b, []string{"hash", "array"}, func(b *testing.B, table *Table, entries int) {
+		keys, _ := benchKeys(entries)
+		value := make([]byte, 8)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := table.GetInto(keys[i%len(keys)], value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSetFrom(b *testing.B) {
+	benchTables(b, []string{"hash", "array"}, func(b *testing.B, table *Table, entries int) {
+		keys, _ := benchKeys(entries)
+		value := make([]byte, 8)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := table.SetFrom(keys[i%len(keys)], value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkIterBytes walks the table through the channel of IterBytes.
+func BenchmarkIterBytes(b *testing.B) {
+	benchTables(b, []string{"hash", "array"}, func(b *testing.B, table *Table, entries int) {
+		for i := 0; i < b.N; i++ {
+			for range table.IterBytes() {
+			}
+		}
+	})
+}
+
+// BenchmarkRawIterator walks the table in the benchmark goroutine,
+// reusing the key and leaf buffers.
+func BenchmarkRawIterator(b *testing.B) {
+	benchTables(b, []string{"hash", "array"}, func(b *testing.B, table *Table, entries int) {
+		for i := 0; i < b.N; i++ {
+			it := table.RawIterator()
+			for it.Next() {
+			}
+			if err := it.Err(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkGetBatch reads the table with one syscall per 4096 entries.
+func BenchmarkGetBatch(b *testing.B) {
+	benchTables(b, []string{"hash", "array"}, func(b *testing.B, table *Table, entries int) {
+		if _, err := table.GetBatch(1); errors.Is(err, ErrNotSupported) {
+			b.Skip("kernel doesn't support batch operations")
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := table.GetBatch(4096); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkIterator100k compares iterating over a table of 100k entries
+// read in batches, one cgo call per batch, with reading them one by
+// one, as cursors do with a retry policy: two cgo calls per entry.
+func BenchmarkIterator100k(b *testing.B) {
+	m, table := newBenchTable(b, "hash", 100000)
+	defer m.Close()
+	for _, bb := range []struct {
+		name   string
+		policy RetryPolicy
+	}{
+		{"batched", RetryPolicy{}},
+		{"per-entry", RetryPolicy{MaxAttempts: 2}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			table.SetRetryPolicy(bb.policy)
+			b.Run("RawIterator", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					it := table.RawIterator()
+					n := 0
+					for it.Next() {
+						n++
+					}
+					if err := it.Err(); err != nil {
+						b.Fatal(err)
+					}
+					if n != 100000 {
+						b.Fatalf("got %d entries, expected 100000", n)
+					}
+				}
+			})
+			b.Run("Iterator", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					it := table.Iterator()
+					for it.Next() {
+					}
+					if err := it.Err(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkIterParallel reads tables of 100k entries with IterParallel
+// and growing numbers of workers. Arrays should scale about linearly
+// with them, hashes until the lookups are no longer the bottleneck.
+func BenchmarkIterParallel(b *testing.B) {
+	for _, mapType := range []string{"hash", "array"} {
+		b.Run(mapType, func(b *testing.B) {
+			m, table := newBenchTable(b, mapType, 100000)
+			defer m.Close()
+			for _, workers := range []int{1, 2, 4, 8} {
+				b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+					for i := 0; i < b.N; i++ {
+						n := 0
+						for range table.IterParallel(workers) {
+							n++
+						}
+						if n != 100000 {
+							b.Fatalf("got %d entries, expected 100000", n)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+// BenchmarkMappedArray compares reading the values of an array with a
+// syscall each, with GetAt, to loading them from a MappedArray.
+func BenchmarkMappedArray(b *testing.B) {
+	m, table := newBenchTable(b, "array", 1024)
+	defer m.Close()
+	if _, err := table.RecreateWithFlags(0, MapFlagMmapable); err != nil {
+		b.Skip(err)
+	}
+	b.Run("GetAt", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := table.GetAt(uint32(i % 1024)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ReadUint64", func(b *testing.B) {
+		mapped, err := table.Mmap()
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer mapped.Close()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			mapped.ReadUint64(uint32(i % 1024))
+		}
+	})
+}
+
+// BenchmarkSumAll compares summing the per-cpu values of a table of
+// 100k entries in C, in batches, to looking them up with a cursor and
+// summing them in Go.
+func BenchmarkSumAll(b *testing.B) {
+	m, table := newBenchTable(b, "percpu_hash", 100000)
+	defer m.Close()
+	for _, bb := range []struct {
+		name string
+		sum  func() (map[string]uint64, error)
+	}{
+		{"C", table.SumAll},
+		{"Go", table.sumAll},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				sums, err := bb.sum()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(sums) != 100000 {
+					b.Fatalf("got %d sums, expected 100000", len(sums))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDesc(b *testing.B) {
+	m, table := newBenchTable(b, "hash", 1)
+	defer m.Close()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if table.Desc().KeySize != 4 {
+				b.Fatal("unexpected key size")
+			}
+		}
+	})
+}
+
+// fakeLayouts are the key and value sizes of the benchmarked fake
+// tables.
+var fakeLayouts = []struct{ keySize, leafSize int }{{4, 8}, {4, 64}, {16, 8}, {16, 64}}
+
+// benchFake runs fn as a sub-benchmark for full fake tables of 1024
+// entries of each of the mapTypes and fakeLayouts, with their keys.
+// Arrays only have keys of 4 bytes.
+func benchFake(b *testing.B, mapTypes []MapType, fn func(b *testing.B, table *Table, keys [][]byte)) {
+	for _, mapType := range mapTypes {
+		for _, l := range fakeLayouts {
+			if mapType == MapTypeArray && l.keySize != 4 {
+				continue
+			}
+			b.Run(fmt.Sprintf("%v/%d/%d", mapType, l.keySize, l.leafSize), func(b *testing.B) {
+				elems := newFakeElems(mapType, l.keySize, l.leafSize, 1024)
+				elems.fill()
+				keys := make([][]byte, elems.maxEntries)
+				for i := range keys {
+					keys[i] = elems.fakeKey(i)
+				}
+				table := newFakeTable(elems)
+				b.ReportAllocs()
+				b.ResetTimer()
+				fn(b, table, keys)
+			})
+		}
+	}
+}
+
+func BenchmarkFakeGetBytes(b *testing.B) {
+	benchFake(b, []MapType{MapTypeHash, MapTypeArray}, func(b *testing.B, table *Table, keys [][]byte) {
+		for i := 0; i < b.N; i++ {
+			if _, err := table.GetBytes(keys[i%len(keys)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFakeSetBytes(b *testing.B) {
+	benchFake(b, []MapType{MapTypeHash, MapTypeArray}, func(b *testing.B, table *Table, keys [][]byte) {
+		value := make([]byte, table.Desc().LeafSize)
+		for i := 0; i < b.N; i++ {
+			if err := table.SetBytes(keys[i%len(keys)], value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFakeDeleteBytes(b *testing.B) {
+	benchFake(b, []MapType{MapTypeHash}, func(b *testing.B, table *Table, keys [][]byte) {
+		value := make([]byte, table.Desc().LeafSize)
+		for i := 0; i < b.N; i++ {
+			k := keys[i%len(keys)]
+			if err := table.DeleteBytes(k); err != nil {
+				b.Fatal(err)
+			}
+			if err := table.SetFrom(k, value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFakeGetInto(b *testing.B) {
+	benchFake(b, []MapType{MapTypeHash, MapTypeArray}, func(b *testing.B, table *Table, keys [][]byte) {
+		value := make([]byte, table.Desc().LeafSize)
+		for i := 0; i < b.N; i++ {
+			if err := table.GetInto(keys[i%len(keys)], value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFakeSetFrom(b *testing.B) {
+	benchFake(b, []MapType{MapTypeHash, MapTypeArray}, func(b *testing.B, table *Table, keys [][]byte) {
+		value := make([]byte, table.Desc().LeafSize)
+		for i := 0; i < b.N; i++ {
+			if err := table.SetFrom(keys[i%len(keys)], value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,221 @@
+//go:build integration
+// +build integration
+
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"unsafe"
+)
+
+var simpleHash string = `
+BPF_TABLE("hash", int, int, table1, 16);
+`
+
+func TestProbeMissingKey(t *testing.T) {
+	m, err := NewModule(simpleHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	table := NewTable(m.TableId("table1"), m)
+
+	var keys [][]byte
+	for _, p := range probeKeyPatterns {
+		keys = append(keys, bytes.Repeat([]byte{p}, 4))
+	}
+	keys = append(keys, []byte{0x01, 0x00, 0x00, 0x00}, []byte{0x02, 0x00, 0x00, 0x00})
+	for _, k := range keys {
+		if err := table.SetBytes(k, []byte{0x01, 0x00, 0x00, 0x00}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key := make([]byte, 4)
+	if !table.probeMissingKey(key) {
+		t.Fatal("no missing key found")
+	}
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			t.Fatalf("probed key %x is present in the table", key)
+		}
+	}
+
+	n := 0
+	for range table.Iter() {
+		n++
+	}
+	if n != len(keys) {
+		t.Fatalf("unexpected number of entries. Got %d, expected %d", n, len(keys))
+	}
+}
+
+func TestKallsymsResolve(t *testing.T) {
+	if err := kernelSymbols.load(); err != nil {
+		t.Skip(err)
+	}
+	for _, name := range []string{"schedule", "do_sys_open", "vfs_read"} {
+		var addr uint64
+		for _, sym := range kernelSymbols.syms {
+			if sym.name == name {
+				addr = sym.addr
+				break
+			}
+		}
+		if addr == 0 {
+			continue
+		}
+		for _, a := range []uint64{addr, addr + 1} {
+			sym, ok, err := kernelSymbols.resolve(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok || sym.addr != addr {
+				t.Fatalf("%x: expected %s, got %+v", a, name, sym)
+			}
+		}
+	}
+	if _, ok, _ := kernelSymbols.resolve(0x1000); ok {
+		t.Fatal("expected no symbol for a user space address")
+	}
+}
+
+var progArray string = `
+BPF_PROG_ARRAY(progs, 4);
+int prog1(void *ctx) {
+	return 0;
+}
+int prog2(void *ctx) {
+	return 1;
+}
+`
+
+func TestProgTable(t *testing.T) {
+	m, err := NewModule(progArray, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	progs := NewProgTable(NewTableByName("progs", m))
+
+	for i, name := range []string{"prog1", "prog2"} {
+		fd, err := m.LoadKprobe(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := progs.SetProg(uint32(i), fd); err != nil {
+			t.Fatal(err)
+		}
+		id, err := progID(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := progs.GetAt(uint32(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := byteOrder.Uint32(leaf); got != id {
+			t.Fatalf("slot %d holds program id %d, expected %d", i, got, id)
+		}
+	}
+	if err := progs.DeleteProg(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := progs.GetAt(0); !errors.Is(err, ErrIndexOutOfRange) {
+		t.Fatalf("expected empty slot, got %v", err)
+	}
+	if err := NewProgTable(NewTableByName("progs", m)).SetProg(4, 0); err == nil {
+		t.Fatal("expected error for out of range index")
+	}
+}
+
+var scanHash string = `
+struct key_t {
+	u32 pid;
+	u16 ids[2];
+	char comm[8];
+};
+struct leaf_t {
+	u64 count;
+	s8 delta;
+};
+BPF_HASH(scan, struct key_t, struct leaf_t, 16);
+`
+
+// fuzzScan fuzzes toBytes over the key or leaf strings of the scan
+// table: a scanned string formats back to a string scanning to the
+// same bytes.
+func fuzzScan(f *testing.F, seeds []string, toBytes func(*Table, string) ([]byte, error), toString func(*Table, []byte) (string, error)) {
+	m, err := NewModule(scanHash, []string{})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { m.Close() })
+	table := NewTableByName("scan", m)
+	for _, s := range seeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		b, err := toBytes(table, s)
+		if err != nil {
+			return
+		}
+		formatted, err := toString(table, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b2, err := toBytes(table, formatted)
+		if err != nil {
+			t.Fatalf("%q scanned, but not its formatted %q: %v", s, formatted, err)
+		}
+		if !bytes.Equal(b, b2) {
+			t.Fatalf("%q scanned to %x, its formatted %q to %x", s, b, formatted, b2)
+		}
+	})
+}
+
+func FuzzKeyToBytes(f *testing.F) {
+	fuzzScan(f, []string{
+		`{ 1 [ 2 3 ] "bash" }`,
+		`{ 0xffffffff [ 0 0 ] "" }`,
+		`{ 1 [ 2 3 ] "bash"`,
+		`{ 1 [ 2 ] }`,
+		`{ 1 [ 2 65536 ] "x" }`,
+		`{ 1 [ 2 3 ] "toolongforcomm" }`,
+		`{ 1 [ 2 3 ] "bash" } garbage`,
+		`42`,
+	}, (*Table).keyToBytes, func(table *Table, b []byte) (string, error) {
+		s, _, err := table.keyToString(make([]byte, 64), unsafe.Pointer(&b[0]))
+		return s, err
+	})
+}
+
+func FuzzLeafToBytes(f *testing.F) {
+	fuzzScan(f, []string{
+		`{ 1 -1 }`,
+		`{ 0xffffffffffffffff 127 }`,
+		`{ 1 128 }`,
+		`{ 1 }`,
+		`{ 1 2 3 }`,
+		`{ "1" 2 }`,
+	}, (*Table).leafToBytes, func(table *Table, b []byte) (string, error) {
+		s, _, err := table.leafToString(make([]byte, 64), unsafe.Pointer(&b[0]))
+		return s, err
+	})
+}
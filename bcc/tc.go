@@ -0,0 +1,133 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// TCDirection is the direction of the traffic a tc program is attached
+// to.
+type TCDirection uint32
+
+const (
+	TCIngress TCDirection = 0xfffffff2 // TC_H_MAKE(TC_H_CLSACT, TC_H_MIN_INGRESS)
+	TCEgress  TCDirection = 0xfffffff3 // TC_H_MAKE(TC_H_CLSACT, TC_H_MIN_EGRESS)
+)
+
+func (d TCDirection) String() string {
+	switch d {
+	case TCIngress:
+		return "ingress"
+	case TCEgress:
+		return "egress"
+	default:
+		return fmt.Sprintf("TCDirection(0x%x)", uint32(d))
+	}
+}
+
+const (
+	tcHClsact        = 0xfffffff1
+	tcaKind          = 1
+	tcaOptions       = 2
+	tcaBPFFD         = 6
+	tcaBPFName       = 7
+	tcaBPFFlags      = 8
+	tcaBPFFlagDirect = 1
+	// tcFilterHandle is the handle of the filters added by AttachTC,
+	// so that attaching again replaces the filter.
+	tcFilterHandle = 1
+)
+
+// LoadSchedCls loads a program of type BPF_PROG_TYPE_SCHED_CLS.
+func (bpf *Module) LoadSchedCls(name string) (int, error) {
+	return bpf.Load(name, ProgramTypeSchedCLS, 0, 0)
+}
+
+// LoadSchedAct loads a program of type BPF_PROG_TYPE_SCHED_ACT.
+func (bpf *Module) LoadSchedAct(name string) (int, error) {
+	return bpf.Load(name, ProgramTypeSchedACT, 0, 0)
+}
+
+// tcMsg returns a struct tcmsg.
+func tcMsg(index int, handle, parent, info uint32) []byte {
+	b := make([]byte, 20)
+	byteOrder.PutUint32(b[4:], uint32(index))
+	byteOrder.PutUint32(b[8:], handle)
+	byteOrder.PutUint32(b[12:], parent)
+	byteOrder.PutUint32(b[16:], info)
+	return b
+}
+
+// tcFilterInfo returns the tcm_info of a filter of priority prio
+// matching all protocols.
+func tcFilterInfo(prio int) uint32 {
+	return uint32(prio)<<16 | uint32(htons(syscall.ETH_P_ALL))
+}
+
+// ensureClsact adds a clsact qdisc to the interface if missing.
+func ensureClsact(index int) error {
+	req := newNlRequest(syscall.RTM_NEWQDISC, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, tcMsg(index, 0xffff0000, tcHClsact, 0))
+	req.addString(tcaKind, "clsact")
+	if err := req.execute(); err != nil && err != syscall.EEXIST {
+		return err
+	}
+	return nil
+}
+
+// AttachTC attaches a sched_cls fd in direct action mode to the traffic
+// of a device in the direction parent, with the filter priority
+// priority (1 or more). A clsact qdisc is added to the device if
+// missing. Attaching to the same device, direction and priority again
+// atomically replaces the program. Filters stay attached when the
+// module is closed, remove them with DetachTC.
+func (bpf *Module) AttachTC(devName string, fd int, parent TCDirection, priority int) error {
+	if priority <= 0 || priority > 0xffff {
+		return fmt.Errorf("invalid tc filter priority %d", priority)
+	}
+	index, err := interfaceIndex(devName)
+	if err != nil {
+		return err
+	}
+	if err := ensureClsact(index); err != nil {
+		return fmt.Errorf("failed to add clsact qdisc to device %v: %v", devName, err)
+	}
+	req := newNlRequest(syscall.RTM_NEWTFILTER, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, tcMsg(index, tcFilterHandle, uint32(parent), tcFilterInfo(priority)))
+	req.addString(tcaKind, "bpf")
+	req.beginNest(tcaOptions)
+	req.addUint32(tcaBPFFD, uint32(fd))
+	req.addString(tcaBPFName, fmt.Sprintf("gobpf_%d", fd))
+	req.addUint32(tcaBPFFlags, tcaBPFFlagDirect)
+	req.endNest()
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("failed to attach BPF tc %v filter to device %v: %v", parent, devName, err)
+	}
+	return nil
+}
+
+// DetachTC removes the filters of priority priority from the traffic of
+// a device in the direction parent.
+func (bpf *Module) DetachTC(devName string, parent TCDirection, priority int) error {
+	index, err := interfaceIndex(devName)
+	if err != nil {
+		return err
+	}
+	req := newNlRequest(syscall.RTM_DELTFILTER, 0, tcMsg(index, 0, uint32(parent), tcFilterInfo(priority)))
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("failed to detach BPF tc %v filter from device %v: %v", parent, devName, err)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// TemplateRaw is a template variable substituted verbatim, e.g. a C
+// filter expression.
+type TemplateRaw string
+
+// templateRegexp matches the placeholders and directives of templates:
+// @NAME@, @IF NAME@, @ELSE@ and @ENDIF@.
+var templateRegexp = regexp.MustCompile(`@(?:(IF) ([A-Za-z_][A-Za-z0-9_]*)|(ELSE|ENDIF)|([A-Za-z_][A-Za-z0-9_]*))@`)
+
+// NewModuleFromTemplate compiles the source template src after
+// substituting its placeholders with the variables of vars, as for
+// NewModule. A placeholder @NAME@ is replaced with the value of NAME
+// formatted as a C literal: integers in decimal, strings quoted and
+// escaped, bools as 1 or 0. Values of type TemplateRaw are substituted
+// verbatim.
+//
+// Conditional blocks keep or compile out code depending on a bool
+// variable, and may be nested:
+//
+//	@IF FILTER_PID@
+//	if (pid != @PID@)
+//		return 0;
+//	@ELSE@
+//	...
+//	@ENDIF@
+//
+// It's an error for src to use a variable not in vars, or for vars to
+// have one src doesn't use. Lines are preserved, so that compiler
+// diagnostics refer to the lines of src.
+func NewModuleFromTemplate(src string, vars map[string]interface{}, cflags []string) (*Module, error) {
+	code, err := expandTemplate(src, vars)
+	if err != nil {
+		return nil, err
+	}
+	return NewModule(code, cflags)
+}
+
+// templateBlock is an @IF@ block being expanded.
+type templateBlock struct {
+	name     string
+	cond     bool
+	inElse   bool
+	emitting bool // whether the enclosing block is
+}
+
+func (b templateBlock) active() bool {
+	return b.emitting && b.cond != b.inElse
+}
+
+// expandTemplate returns the source template src expanded with vars.
+func expandTemplate(src string, vars map[string]interface{}) (string, error) {
+	var (
+		out     strings.Builder
+		blocks  []templateBlock
+		used    = make(map[string]bool)
+		missing = make(map[string]bool)
+		last    int
+	)
+	emitting := func() bool {
+		return len(blocks) == 0 || blocks[len(blocks)-1].active()
+	}
+	// write writes s, or only its newlines if it's compiled out.
+	write := func(s string) {
+		if emitting() {
+			out.WriteString(s)
+		} else {
+			out.WriteString(strings.Repeat("\n", strings.Count(s, "\n")))
+		}
+	}
+	line := func(off int) int {
+		return strings.Count(src[:off], "\n") + 1
+	}
+	for _, m := range templateRegexp.FindAllStringSubmatchIndex(src, -1) {
+		write(src[last:m[0]])
+		last = m[1]
+		switch {
+		case m[2] >= 0: // @IF NAME@
+			name := src[m[4]:m[5]]
+			used[name] = true
+			v, ok := vars[name]
+			if !ok {
+				missing[name] = true
+			}
+			cond, isBool := v.(bool)
+			if ok && !isBool {
+				return "", fmt.Errorf("template line %d: @IF %s@: %T variable, expected bool", line(m[0]), name, v)
+			}
+			blocks = append(blocks, templateBlock{name: name, cond: cond, emitting: emitting()})
+		case m[6] >= 0 && src[m[6]:m[7]] == "ELSE":
+			if len(blocks) == 0 || blocks[len(blocks)-1].inElse {
+				return "", fmt.Errorf("template line %d: unexpected @ELSE@", line(m[0]))
+			}
+			blocks[len(blocks)-1].inElse = true
+		case m[6] >= 0: // @ENDIF@
+			if len(blocks) == 0 {
+				return "", fmt.Errorf("template line %d: unexpected @ENDIF@", line(m[0]))
+			}
+			blocks = blocks[:len(blocks)-1]
+		default: // @NAME@
+			name := src[m[8]:m[9]]
+			used[name] = true
+			v, ok := vars[name]
+			if !ok {
+				missing[name] = true
+				continue
+			}
+			lit, err := templateLiteral(v)
+			if err != nil {
+				return "", fmt.Errorf("template line %d: @%s@: %v", line(m[0]), name, err)
+			}
+			write(lit)
+		}
+	}
+	write(src[last:])
+	if len(blocks) > 0 {
+		return "", fmt.Errorf("template: @IF %s@ without @ENDIF@", blocks[len(blocks)-1].name)
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("template: missing variables %s", sortedNames(missing))
+	}
+	unused := make(map[string]bool)
+	for name := range vars {
+		if !used[name] {
+			unused[name] = true
+		}
+	}
+	if len(unused) > 0 {
+		return "", fmt.Errorf("template: unused variables %s", sortedNames(unused))
+	}
+	return out.String(), nil
+}
+
+func sortedNames(names map[string]bool) string {
+	s := make([]string, 0, len(names))
+	for name := range names {
+		s = append(s, name)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ", ")
+}
+
+// templateLiteral returns v formatted as a C literal.
+func templateLiteral(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case TemplateRaw:
+		return string(v), nil
+	case string:
+		return cQuote(v), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := rv.Int()
+		switch {
+		case n == math.MinInt64:
+			// -9223372036854775808LL would negate an out of
+			// range literal.
+			return "(-9223372036854775807LL - 1)", nil
+		case n < math.MinInt32 || n > math.MaxInt32:
+			return fmt.Sprintf("%dLL", n), nil
+		}
+		return fmt.Sprintf("%d", n), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := rv.Uint()
+		if n > math.MaxUint32 {
+			return fmt.Sprintf("%dULL", n), nil
+		}
+		return fmt.Sprintf("%dU", n), nil
+	}
+	return "", fmt.Errorf("unsupported type %T", v)
+}
+
+// cQuote returns s as a C string literal.
+func cQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				// Octal escapes are at most 3 digits, unlike hex
+				// ones which would swallow following digits.
+				fmt.Fprintf(&b, `\%03o`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,117 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"strings"
+	"testing"
+)
+
+const testTemplate = `int prog(void *ctx) {
+	u32 pid = bpf_get_current_pid_tgid() >> 32;
+@IF FILTER_PID@
+	if (pid != @PID@)
+		return 0;
+@ELSE@
+	@IF NESTED@
+	never();
+	@ENDIF@
+@ENDIF@
+	bpf_trace_printk(@MSG@, @LIMIT@);
+	return @FILTER@;
+}
+`
+
+func TestExpandTemplate(t *testing.T) {
+	vars := map[string]interface{}{
+		"FILTER_PID": true,
+		"NESTED":     true,
+		"PID":        1234,
+		"MSG":        "a \"b\"\n\x01",
+		"LIMIT":      uint64(1 << 40),
+		"FILTER":     TemplateRaw("pid > 1"),
+	}
+	code, err := expandTemplate(testTemplate, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `int prog(void *ctx) {
+	u32 pid = bpf_get_current_pid_tgid() >> 32;
+
+	if (pid != 1234)
+		return 0;
+
+
+
+
+
+	bpf_trace_printk("a \"b\"\n\001", 1099511627776ULL);
+	return pid > 1;
+}
+`
+	if code != expected {
+		t.Fatalf("unexpected code:\n%s\nexpected:\n%s", code, expected)
+	}
+	if strings.Count(code, "\n") != strings.Count(testTemplate, "\n") {
+		t.Fatal("expected lines to be preserved")
+	}
+
+	vars["FILTER_PID"] = false
+	code, err = expandTemplate(testTemplate, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(code, "1234") || !strings.Contains(code, "never();") {
+		t.Fatalf("unexpected code:\n%s", code)
+	}
+}
+
+func TestExpandTemplateErrors(t *testing.T) {
+	for _, tt := range []struct {
+		src  string
+		vars map[string]interface{}
+		err  string
+	}{
+		{"@A@ @B@", map[string]interface{}{"A": 1}, "missing variables B"},
+		{"@A@", map[string]interface{}{"A": 1, "B": 2, "C": 3}, "unused variables B, C"},
+		{"@IF A@", map[string]interface{}{"A": true}, "without @ENDIF@"},
+		{"@ENDIF@", nil, "unexpected @ENDIF@"},
+		{"@IF A@@ELSE@@ELSE@@ENDIF@", map[string]interface{}{"A": true}, "unexpected @ELSE@"},
+		{"@IF A@@ENDIF@", map[string]interface{}{"A": 1}, "expected bool"},
+		{"@A@", map[string]interface{}{"A": 1.5}, "unsupported type float64"},
+	} {
+		if _, err := expandTemplate(tt.src, tt.vars); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: expected error %q, got %v", tt.src, tt.err, err)
+		}
+	}
+}
+
+func TestTemplateLiteral(t *testing.T) {
+	for _, tt := range []struct {
+		v        interface{}
+		expected string
+	}{
+		{-1, "-1"},
+		{int64(-1 << 40), "-1099511627776LL"},
+		{int64(-1 << 63), "(-9223372036854775807LL - 1)"},
+		{uint8(255), "255U"},
+		{false, "0"},
+		{"1\x002", `"1\0002"`},
+	} {
+		if lit, err := templateLiteral(tt.v); err != nil || lit != tt.expected {
+			t.Errorf("%#v: expected %s, got %s (%v)", tt.v, tt.expected, lit, err)
+		}
+	}
+}
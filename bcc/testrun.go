@@ -0,0 +1,72 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// testRunHeadroom is the room given to programs to grow the data in
+// TestRun. Kernels before Linux 5.1 ignore the size of the output
+// buffer, it must be large enough.
+const testRunHeadroom = 4096
+
+// TestRunResult is the result of TestRun.
+type TestRunResult struct {
+	// ReturnValue is the return value of the program, e.g. the XDP
+	// action.
+	ReturnValue uint32
+	// DataOut is the data after the run, modified by the program.
+	DataOut []byte
+	// Duration is the average duration of a run.
+	Duration time.Duration
+}
+
+// TestRun runs the program progFD repeat times on the packet data with
+// BPF_PROG_TEST_RUN (Linux 4.12), without attaching it, to test it.
+// For XDP, socket filter and tc programs, data must start with an
+// Ethernet header. It returns an error wrapping ErrNotSupported if the
+// kernel can't run programs of the type of progFD.
+func (bpf *Module) TestRun(progFD int, data []byte, repeat int) (TestRunResult, error) {
+	if bpf.p == nil {
+		return TestRunResult{}, ErrModuleClosed
+	}
+	if repeat < 1 {
+		repeat = 1
+	}
+	dataOut := make([]byte, len(data)+testRunHeadroom)
+	retval, sizeOut, duration, err := progTestRun(progFD, data, dataOut, repeat)
+	if err == syscall.ENOSPC && sizeOut > len(dataOut) {
+		// The program grew the data more than expected.
+		dataOut = make([]byte, sizeOut)
+		retval, sizeOut, duration, err = progTestRun(progFD, data, dataOut, repeat)
+	}
+	if err != nil {
+		if err == errnoENOTSUPP || err == syscall.EOPNOTSUPP {
+			return TestRunResult{}, fmt.Errorf("failed to test run BPF program: %v: %w", err, ErrNotSupported)
+		}
+		return TestRunResult{}, fmt.Errorf("failed to test run BPF program: %v", err)
+	}
+	if sizeOut > len(dataOut) {
+		sizeOut = len(dataOut)
+	}
+	return TestRunResult{
+		ReturnValue: retval,
+		DataOut:     dataOut[:sizeOut],
+		Duration:    time.Duration(duration),
+	}, nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrTracepointNotFound is returned when attaching to a tracepoint the
+// kernel doesn't have.
+var ErrTracepointNotFound = errors.New("tracepoint not found")
+
+// maxClosestTracepoints is the number of closest matching tracepoints
+// named in the error of a missing tracepoint.
+const maxClosestTracepoints = 3
+
+// splitTracepoint splits a tracepoint name "category:name".
+func splitTracepoint(tp string) (category, name string, err error) {
+	parts := strings.SplitN(tp, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid tracepoint name %q, expected \"category:name\"", tp)
+	}
+	return parts[0], parts[1], nil
+}
+
+// TracepointExists reports whether the kernel has the tracepoint
+// name of category, e.g. "sched" and "sched_switch".
+func TracepointExists(category, name string) bool {
+	if category == "" || name == "" || strings.ContainsRune(category, '/') || strings.ContainsRune(name, '/') ||
+		category == ".." || name == ".." {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(tracingDir(), "events", category, name, "format"))
+	return err == nil
+}
+
+// ListTracepoints returns the tracepoints of the categories matching
+// categoryGlob, in the syntax of filepath.Match, as sorted
+// "category:name" strings. An empty categoryGlob matches all the
+// categories.
+func ListTracepoints(categoryGlob string) ([]string, error) {
+	if categoryGlob == "" {
+		categoryGlob = "*"
+	}
+	if strings.ContainsRune(categoryGlob, '/') {
+		return nil, fmt.Errorf("invalid category pattern %q", categoryGlob)
+	}
+	eventsDir := filepath.Join(tracingDir(), "events")
+	if _, err := os.Stat(eventsDir); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(eventsDir, categoryGlob, "*", "format"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid category pattern %q: %v", categoryGlob, err)
+	}
+	tps := make([]string, 0, len(paths))
+	for _, path := range paths {
+		event := filepath.Dir(path)
+		tps = append(tps, filepath.Base(filepath.Dir(event))+":"+filepath.Base(event))
+	}
+	sort.Strings(tps)
+	return tps, nil
+}
+
+// checkTracepoint returns an error wrapping ErrTracepointNotFound and
+// naming the closest matching tracepoints if the tracepoint tp,
+// "category:name", doesn't exist.
+func checkTracepoint(tp string) error {
+	category, name, err := splitTracepoint(tp)
+	if err != nil {
+		return err
+	}
+	if TracepointExists(category, name) {
+		return nil
+	}
+	tps, err := ListTracepoints("")
+	if err != nil {
+		return fmt.Errorf("%s: %w (%v)", tp, ErrTracepointNotFound, err)
+	}
+	closest := closestTracepoints(tp, tps, maxClosestTracepoints)
+	if len(closest) == 0 {
+		return fmt.Errorf("%s: %w", tp, ErrTracepointNotFound)
+	}
+	return fmt.Errorf("%s: %w, closest matches: %s", tp, ErrTracepointNotFound, strings.Join(closest, ", "))
+}
+
+// closestTracepoints returns at most n of tps closest to tp by edit
+// distance, closest first, leaving out those too far to be a typo.
+func closestTracepoints(tp string, tps []string, n int) []string {
+	maxDist := len(tp)/3 + 1
+	type match struct {
+		tp   string
+		dist int
+	}
+	var matches []match
+	for _, t := range tps {
+		if d := editDistance(tp, t); d <= maxDist {
+			matches = append(matches, match{t, d})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].dist < matches[j].dist
+	})
+	var closest []string
+	for i := 0; i < len(matches) && i < n; i++ {
+		closest = append(closest, matches[i].tp)
+	}
+	return closest
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// withTracingDir makes the tracing functions use a fake tracefs in a
+// temporary directory with the tracepoints tps.
+func withTracingDir(t *testing.T, tps []string) {
+	dir, err := ioutil.TempDir("", "gobpf-tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tp := range tps {
+		category, name, _ := splitTracepoint(tp)
+		eventDir := filepath.Join(dir, "events", category, name)
+		if err := os.MkdirAll(eventDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(eventDir, "format"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := tracingDirs
+	tracingDirs = []string{filepath.Join(dir, "missing"), dir}
+	t.Cleanup(func() {
+		tracingDirs = saved
+		os.RemoveAll(dir)
+	})
+}
+
+func TestTracepoints(t *testing.T) {
+	withTracingDir(t, []string{"sched:sched_switch", "sched:sched_wakeup", "syscalls:sys_enter_open", "syscalls:sys_enter_openat"})
+
+	if !TracepointExists("sched", "sched_switch") {
+		t.Fatal("expected sched:sched_switch to exist")
+	}
+	for _, tp := range [][2]string{{"sched", "sched_swich"}, {"sched", ""}, {"", "sched"}, {"sched/..", "sched"}} {
+		if TracepointExists(tp[0], tp[1]) {
+			t.Fatalf("expected %s:%s not to exist", tp[0], tp[1])
+		}
+	}
+
+	tps, err := ListTracepoints("sys*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"syscalls:sys_enter_open", "syscalls:sys_enter_openat"}
+	if !reflect.DeepEqual(tps, expected) {
+		t.Fatalf("expected %v, got %v", expected, tps)
+	}
+	if tps, err = ListTracepoints(""); err != nil || len(tps) != 4 {
+		t.Fatalf("expected 4 tracepoints, got %v (%v)", tps, err)
+	}
+	if _, err := ListTracepoints("["); err == nil {
+		t.Fatal("expected error listing with an invalid pattern")
+	}
+
+	if err := checkTracepoint("sched:sched_switch"); err != nil {
+		t.Fatal(err)
+	}
+	err = checkTracepoint("sched:sched_swich")
+	if !errors.Is(err, ErrTracepointNotFound) || !strings.Contains(err.Error(), "closest matches: sched:sched_switch") {
+		t.Fatalf("expected error naming sched:sched_switch, got %v", err)
+	}
+	if err := checkTracepoint("sched_switch"); err == nil || errors.Is(err, ErrTracepointNotFound) {
+		t.Fatalf("expected invalid name error, got %v", err)
+	}
+}
+
+func TestClosestTracepoints(t *testing.T) {
+	tps := []string{"syscalls:sys_enter_open", "syscalls:sys_enter_openat", "syscalls:sys_exit_open", "sched:sched_switch"}
+	for _, test := range []struct {
+		tp       string
+		expected []string
+	}{
+		{"syscall:sys_enter_open", []string{"syscalls:sys_enter_open", "syscalls:sys_enter_openat", "syscalls:sys_exit_open"}},
+		{"sched:sched_swtich", []string{"sched:sched_switch"}},
+		{"net:netif_rx", nil},
+	} {
+		if closest := closestTracepoints(test.tp, tps, 3); !reflect.DeepEqual(closest, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.tp, test.expected, closest)
+		}
+	}
+	if d := editDistance("kitten", "sitting"); d != 3 {
+		t.Fatalf("expected distance 3, got %d", d)
+	}
+}
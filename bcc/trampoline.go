@@ -0,0 +1,130 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <bcc/bpf_common.h>
+#include <bcc/libbpf.h>
+*/
+import "C"
+
+// Attach types of tracing programs (BPF_TRACE_*).
+const (
+	attachTraceFentry = 24
+	attachTraceFexit  = 25
+	attachTraceIter   = 28
+)
+
+// LoadFentry loads the function name as a fentry program of the kernel
+// function attachFn, run on entry of attachFn with its arguments, and
+// returns its fd. It returns an error wrapping ErrNotSupported if the
+// kernel lacks BTF or trampolines (Linux 5.5), so that callers can fall
+// back to kprobes, and ErrSymbolNotFound if attachFn isn't in the
+// kernel BTF.
+func (bpf *Module) LoadFentry(name, attachFn string) (int, error) {
+	return bpf.loadTracing(name, attachFn, attachTraceFentry)
+}
+
+// LoadFexit is like LoadFentry for a fexit program, run on return of
+// attachFn with its arguments and return value.
+func (bpf *Module) LoadFexit(name, attachFn string) (int, error) {
+	return bpf.loadTracing(name, attachFn, attachTraceFexit)
+}
+
+func (bpf *Module) loadTracing(name, attachFn string, attachType uint32) (int, error) {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return -1, ErrModuleClosed
+	}
+	if fd, ok := bpf.funcs[name]; ok {
+		return fd, nil
+	}
+	btfID, err := kernelBTFFuncID(attachFn)
+	if err != nil {
+		return -1, err
+	}
+	nameCS := C.CString(name)
+	defer C.free(unsafe.Pointer(nameCS))
+	start := C.bpf_function_start(bpf.p, nameCS)
+	size := int(C.bpf_function_size(bpf.p, nameCS))
+	if start == nil {
+		return -1, fmt.Errorf("Module: unable to find %s", name)
+	}
+	license := C.bpf_module_license(bpf.p)
+	version := uint32(C.bpf_module_kern_version(bpf.p))
+	logbuf := make([]byte, bpf.verifierLogSize(0))
+	fd, err := progLoadBTF(ProgramTypeTracing, start, size/8, license, version, 1, logbuf, attachType, btfID)
+	bpf.setVerifierLog(name, logbuf)
+	if err != nil {
+		if err == syscall.EINVAL && logbuf[0] == 0 {
+			// Rejected before reaching the verifier.
+			return -1, fmt.Errorf("error loading BPF program %s (%v): %v: %w", name, ProgramTypeTracing, err, ErrNotSupported)
+		}
+		return -1, loadError(name, ProgramTypeTracing, logbuf, err)
+	}
+	bpf.funcs[name] = fd
+	return fd, nil
+}
+
+// AttachTrampoline attaches a fentry or fexit fd to its kernel
+// function. Close detaches it.
+func (bpf *Module) AttachTrampoline(fd int) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	id := strconv.Itoa(fd)
+	if attached, err := bpf.checkAttached(AttachmentTrampoline, id, fd); attached {
+		return err
+	}
+	linkFD, err := rawTracepointOpen("", fd)
+	if err != nil {
+		if err == syscall.EINVAL {
+			return fmt.Errorf("failed to attach BPF trampoline: %v: %w", err, ErrNotSupported)
+		}
+		return fmt.Errorf("failed to attach BPF trampoline: %v", err)
+	}
+	bpf.trampolines[fd] = linkFD
+	bpf.recordAttachment(AttachmentTrampoline, id, bpf.funcName(fd), fd)
+	return nil
+}
+
+// DetachTrampoline detaches a fentry or fexit fd attached by
+// AttachTrampoline.
+func (bpf *Module) DetachTrampoline(fd int) error {
+	bpf.mu.Lock()
+	defer bpf.mu.Unlock()
+	if bpf.p == nil {
+		return ErrModuleClosed
+	}
+	linkFD, ok := bpf.trampolines[fd]
+	if !ok {
+		return fmt.Errorf("no trampoline attached for program fd %d", fd)
+	}
+	delete(bpf.trampolines, fd)
+	bpf.forgetAttachment(AttachmentTrampoline, strconv.Itoa(fd))
+	return syscall.Close(linkFD)
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// TypedTable gives access to a table with Go typed keys and values,
+// encoded with encoding/binary. K and V must be fixed size types laid
+// out like the C key and leaf types, including any padding, or
+// implement BinaryKey and BinaryValue (on their pointer types, if the
+// methods have pointer receivers). Struct fields tagged `bpf:"be"` are
+// encoded in big endian byte order, whatever the table byte order.
+type TypedTable[K any, V any] struct {
+	table *Table
+	order binary.ByteOrder
+}
+
+// TypedEntry is an entry of a TypedTable.
+type TypedEntry[K any, V any] struct {
+	Key   K
+	Value V
+}
+
+// TypedOption configures a TypedTable.
+type TypedOption func(*typedOptions)
+
+type typedOptions struct {
+	order binary.ByteOrder
+}
+
+// WithByteOrder sets the byte order keys and values are encoded with.
+// The default is the host byte order, which BPF programs use.
+func WithByteOrder(order binary.ByteOrder) TypedOption {
+	return func(o *typedOptions) {
+		o.order = order
+	}
+}
+
+// NewTypedTable returns a TypedTable for table. It returns an error if
+// the sizes of K and V don't match the key and leaf sizes of the table.
+// The size of types implementing BinaryKey or BinaryValue is checked
+// when they are marshaled instead.
+// Per-cpu tables are not supported, use GetPerCPU and SetPerCPU.
+func NewTypedTable[K any, V any](table *Table, opts ...TypedOption) (*TypedTable[K, V], error) {
+	o := typedOptions{order: byteOrder}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := table.rlock(); err != nil {
+		return nil, err
+	}
+	defer table.runlock()
+	if err := table.checkModule(); err != nil {
+		return nil, err
+	}
+	desc := table.Desc()
+	if desc.MapType.IsPerCPU() {
+		return nil, fmt.Errorf("NewTypedTable: %v table %s: %w", desc.MapType, desc.Name, ErrOperationNotSupported)
+	}
+	var (
+		key        K
+		value      V
+		mismatches []string
+	)
+	if size := binary.Size(key); !hasBPFMarshaler(&key) && size != int(desc.KeySize) {
+		mismatches = append(mismatches, fmt.Sprintf("key %T is %d bytes, expected %d", key, size, desc.KeySize))
+	}
+	if size := binary.Size(value); !hasBPFMarshaler(&value) && size != int(desc.LeafSize) {
+		mismatches = append(mismatches, fmt.Sprintf("value %T is %d bytes, expected %d", value, size, desc.LeafSize))
+	}
+	if len(mismatches) > 0 {
+		return nil, fmt.Errorf("NewTypedTable: size mismatch for table %s: %s", desc.Name, strings.Join(mismatches, ", "))
+	}
+	return &TypedTable[K, V]{table: table, order: o.order}, nil
+}
+
+// Table returns the underlying table.
+func (t *TypedTable[K, V]) Table() *Table {
+	return t.table
+}
+
+func (t *TypedTable[K, V]) encode(v interface{}) ([]byte, error) {
+	return marshalBPF(v, t.order)
+}
+
+func (t *TypedTable[K, V]) decode(b []byte, v interface{}) error {
+	return unmarshalBPF(b, v, t.order)
+}
+
+// Get returns the value of key. It returns an error wrapping
+// ErrKeyNotFound if key isn't in the table.
+func (t *TypedTable[K, V]) Get(key K) (V, error) {
+	var value V
+	k, err := t.encode(&key)
+	if err != nil {
+		return value, err
+	}
+	leaf, err := t.table.GetBytes(k)
+	if err != nil {
+		return value, err
+	}
+	if err := t.decode(leaf, &value); err != nil {
+		return value, err
+	}
+	return value, nil
+}
+
+// Set sets the value of key.
+func (t *TypedTable[K, V]) Set(key K, value V) error {
+	k, err := t.encode(&key)
+	if err != nil {
+		return err
+	}
+	leaf, err := t.encode(&value)
+	if err != nil {
+		return err
+	}
+	return t.table.SetBytes(k, leaf)
+}
+
+// Delete deletes key.
+func (t *TypedTable[K, V]) Delete(key K) error {
+	k, err := t.encode(&key)
+	if err != nil {
+		return err
+	}
+	return t.table.DeleteBytes(k)
+}
+
+// Iter returns a receiver channel to iterate over the decoded entries
+// of the table.
+func (t *TypedTable[K, V]) Iter() <-chan TypedEntry[K, V] {
+	ch := make(chan TypedEntry[K, V], 128)
+	go func() {
+		defer close(ch)
+		for raw := range t.table.IterBytes() {
+			var e TypedEntry[K, V]
+			if t.decode(raw.Key, &e.Key) != nil || t.decode(raw.Value, &e.Value) != nil {
+				continue
+			}
+			ch <- e
+		}
+	}()
+	return ch
+}
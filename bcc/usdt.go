@@ -0,0 +1,152 @@
+// Copyright 2016 PLUMgrid
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bcc
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <stdlib.h>
+#include <bcc/bcc_usdt.h>
+extern void foreach_usdt_uprobe_callback(char *, char *, uint64_t, int);
+*/
+import "C"
+
+// USDTContext holds the USDT probes of a process or binary to enable in
+// a module. Pass it to NewModule to compile in the code fetching the
+// probe arguments, then call AttachUSDT on the module.
+type USDTContext struct {
+	mu sync.Mutex
+	p  unsafe.Pointer
+}
+
+// usdtUprobe is a location to attach a uprobe to for an enabled probe.
+type usdtUprobe struct {
+	binPath string
+	fnName  string
+	addr    uint64
+	pid     int
+}
+
+// usdtUprobes collects the locations reported by bcc_usdt_foreach_uprobe,
+// which doesn't take a cookie for its callback.
+var usdtUprobes = struct {
+	sync.Mutex
+	uprobes []usdtUprobe
+}{}
+
+// NewUSDTContext returns a USDTContext for the probes of the process
+// pid and the libraries it has loaded.
+func NewUSDTContext(pid int) (*USDTContext, error) {
+	p, err := C.bcc_usdt_new_frompid(C.int(pid), nil)
+	if p == nil {
+		return nil, fmt.Errorf("unable to read USDT probes of pid %d: %v", pid, err)
+	}
+	return &USDTContext{p: p}, nil
+}
+
+// NewUSDTContextFromPath returns a USDTContext for the probes of the
+// binary or library at path, for all processes.
+func NewUSDTContextFromPath(path string) (*USDTContext, error) {
+	pathCS := C.CString(path)
+	defer C.free(unsafe.Pointer(pathCS))
+	p, err := C.bcc_usdt_new_frompath(pathCS)
+	if p == nil {
+		return nil, fmt.Errorf("unable to read USDT probes of %s: %v", path, err)
+	}
+	return &USDTContext{p: p}, nil
+}
+
+// EnableProbe enables the probe, calling the function fnName of the
+// module when it fires. The probe can be given as "provider:name" to
+// disambiguate it.
+func (u *USDTContext) EnableProbe(probe, fnName string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.p == nil {
+		return ErrModuleClosed
+	}
+	probeCS := C.CString(probe)
+	defer C.free(unsafe.Pointer(probeCS))
+	fnNameCS := C.CString(fnName)
+	defer C.free(unsafe.Pointer(fnNameCS))
+	if C.bcc_usdt_enable_probe(u.p, probeCS, fnNameCS) != 0 {
+		return fmt.Errorf("unable to enable USDT probe %s: %w", probe, ErrSymbolNotFound)
+	}
+	return nil
+}
+
+// Close releases the context. A module compiled with it closes it when
+// it is closed itself.
+func (u *USDTContext) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.p != nil {
+		C.bcc_usdt_close(u.p)
+		u.p = nil
+	}
+}
+
+// usdtGenArgs returns the code fetching the arguments of the probes
+// enabled in contexts.
+func usdtGenArgs(contexts []*USDTContext) (string, error) {
+	ctxs := make([]unsafe.Pointer, len(contexts))
+	for i, u := range contexts {
+		if u.p == nil {
+			return "", ErrModuleClosed
+		}
+		ctxs[i] = u.p
+	}
+	code := C.bcc_usdt_genargs((*unsafe.Pointer)(unsafe.Pointer(&ctxs[0])), C.int(len(ctxs)))
+	if code == nil {
+		return "", fmt.Errorf("unable to generate USDT argument code")
+	}
+	return C.GoString(code), nil
+}
+
+// uprobes returns the locations to attach uprobes to for the enabled
+// probes.
+func (u *USDTContext) uprobes() []usdtUprobe {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.p == nil {
+		return nil
+	}
+	usdtUprobes.Lock()
+	defer usdtUprobes.Unlock()
+	usdtUprobes.uprobes = nil
+	C.bcc_usdt_foreach_uprobe(u.p, (C.bcc_usdt_uprobe_cb)(unsafe.Pointer(C.foreach_usdt_uprobe_callback)))
+	uprobes := usdtUprobes.uprobes
+	usdtUprobes.uprobes = nil
+	return uprobes
+}
+
+// foreach_usdt_uprobe_callback is a gateway function that will be
+// exported to C so that it can be referenced as a function pointer
+//
+//export foreach_usdt_uprobe_callback
+func foreach_usdt_uprobe_callback(binPath *C.char, fnName *C.char, addr C.uint64_t, pid C.int) {
+	usdtUprobes.uprobes = append(usdtUprobes.uprobes, usdtUprobe{
+		binPath: C.GoString(binPath),
+		fnName:  C.GoString(fnName),
+		addr:    uint64(addr),
+		pid:     int(pid),
+	})
+}
@@ -17,13 +17,30 @@
 package bpf
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/iovisor/gobpf/bcc"
 	"github.com/iovisor/gobpf/elf"
 	"github.com/iovisor/gobpf/pkg/bpffs"
+	"github.com/iovisor/gobpf/pkg/cpupossible"
 )
 
 var simple1 string = `
@@ -33,6 +50,236 @@ int func1(void *ctx) {
 }
 `
 
+var wideLeaf string = `
+struct byte_t {
+	u8 v;
+};
+struct wide_t {
+	struct byte_t f[32];
+};
+BPF_TABLE("hash", int, struct wide_t, wide, 10);
+int func1(void *ctx) {
+	return 0;
+}
+`
+
+var largeHash string = `
+BPF_TABLE("hash", int, int, large, 4096);
+int func1(void *ctx) {
+	return 0;
+}
+`
+
+var mmapArrays string = `
+BPF_F_TABLE("array", u32, u64, freq, 16, BPF_F_MMAPABLE);
+BPF_F_TABLE("array", u32, u32, small, 3, BPF_F_MMAPABLE);
+BPF_ARRAY(plain, u64, 4);
+BPF_PERCPU_ARRAY(pcpu, u64, 4);
+int func1(void *ctx) {
+	return 0;
+}
+`
+
+var percpuCounters string = `
+BPF_TABLE("percpu_hash", u32, u64, counts, 1024);
+int func1(void *ctx) {
+	return 0;
+}
+`
+
+var percpuHash string = `
+BPF_TABLE("percpu_hash", u32, u32, counts, 10);
+int func1(void *ctx) {
+	return 0;
+}
+`
+
+var mapOfMaps string = `
+BPF_TABLE("hash", int, int, inner1, 10);
+BPF_TABLE("hash", int, int, inner2, 10);
+BPF_HASH_OF_MAPS(outer, "inner1", 4);
+int func1(void *ctx) {
+	return 0;
+}
+`
+
+var stackTrace string = `
+BPF_STACK_TRACE(stacks, 16);
+int func1(struct pt_regs *ctx) {
+	stacks.get_stackid(ctx, 0);
+	return 0;
+}
+`
+
+var userStackTrace string = `
+BPF_STACK_TRACE(stacks, 16);
+int func1(struct pt_regs *ctx) {
+	stacks.get_stackid(ctx, BPF_F_USER_STACK);
+	return 0;
+}
+`
+
+var histogram string = `
+BPF_HISTOGRAM(dist);
+int func1(void *ctx) {
+	return 0;
+}
+`
+
+var structHash string = `
+struct key_t {
+	u32 pid;
+	u16 port;
+	u16 pad;
+};
+struct value_t {
+	u64 count;
+	u8 flag;
+	u8 pad[7];
+};
+BPF_TABLE("hash", struct key_t, struct value_t, stats, 10);
+int func1(void *ctx) {
+	return 0;
+}
+`
+
+var mixedStruct string = `
+struct mixed_t {
+	u8 a;
+	u16 b;
+	u32 c;
+	u64 d;
+	u8 e;
+};
+BPF_TABLE("hash", u32, struct mixed_t, mixed, 10);
+int func1(void *ctx) {
+	return 0;
+}
+`
+
+var counters string = `
+BPF_TABLE("hash", u32, u64, counters, 10);
+int func1(void *ctx) {
+	return 0;
+}
+`
+
+var countGetpid string = `
+BPF_TABLE("hash", u32, u64, counts, 1);
+int count(void *ctx) {
+	u32 key = 0;
+	u64 one = 1;
+	u64 *val = counts.lookup(&key);
+	if (val) {
+		__sync_fetch_and_add(val, 1);
+	} else {
+		counts.update(&key, &one);
+	}
+	return 0;
+}
+`
+
+var xdpPass string = `
+int xdp_pass(struct xdp_md *ctx) {
+	return 2;
+}
+int xdp_pass2(struct xdp_md *ctx) {
+	return 2;
+}
+`
+
+var xdpMark string = `
+int xdp_mark(struct xdp_md *ctx) {
+	void *data = (void *)(long)ctx->data;
+	void *data_end = (void *)(long)ctx->data_end;
+	if (data + 1 > data_end)
+		return 0;
+	*(u8 *)data = 0x42;
+	return 1;
+}
+`
+
+var perfOutput string = `
+BPF_PERF_OUTPUT(events);
+int send(void *ctx) {
+	u32 pid = bpf_get_current_pid_tgid() >> 32;
+	events.perf_submit(ctx, &pid, sizeof(pid));
+	return 0;
+}
+`
+
+var taskIter string = `
+BPF_ITER(task) {
+	struct seq_file *seq = ctx->meta->seq;
+	struct task_struct *task = ctx->task;
+	if (task == (void *)0)
+		return 0;
+	BPF_SEQ_PRINTF(seq, "%d\n", task->pid);
+	return 0;
+}
+`
+
+var sockMap string = `
+BPF_SOCKMAP(sock_map, 2);
+int parser(struct __sk_buff *skb) {
+	return skb->len;
+}
+int verdict(struct __sk_buff *skb) {
+	return SK_PASS;
+}
+`
+
+var flowDissector string = `
+int dissect(struct __sk_buff *skb) {
+	return BPF_DROP;
+}
+`
+
+var socketFilter string = `
+BPF_TABLE("hash", u32, u64, counts, 1);
+int count_packets(struct __sk_buff *skb) {
+	u32 key = 0;
+	u64 one = 1;
+	u64 *val = counts.lookup(&key);
+	if (val) {
+		__sync_fetch_and_add(val, 1);
+	} else {
+		counts.update(&key, &one);
+	}
+	return 0;
+}
+`
+
+var tcPass string = `
+int tc_pass(struct __sk_buff *skb) {
+	return 0;
+}
+int tc_pass2(struct __sk_buff *skb) {
+	return 0;
+}
+`
+
+var cgroupSkb string = `
+int allow(struct __sk_buff *skb) {
+	return 1;
+}
+`
+
+var fentryCount string = `
+BPF_TABLE("hash", u32, u64, counts, 1);
+int count(u64 *ctx) {
+	u32 key = 0;
+	u64 one = 1;
+	u64 *val = counts.lookup(&key);
+	if (val) {
+		__sync_fetch_and_add(val, 1);
+	} else {
+		counts.update(&key, &one);
+	}
+	return 0;
+}
+`
+
 var kernelVersion uint32
 
 var (
@@ -50,15 +297,3284 @@ func init() {
 }
 
 func TestModuleLoadBCC(t *testing.T) {
-	b := bcc.NewModule(simple1, []string{})
-	if b == nil {
-		t.Fatal("prog is nil")
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	_, err = b.LoadKprobe("func1")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleAttachKprobe(t *testing.T) {
+	b, err := bcc.NewModule(countGetpid, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadKprobe("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachKprobe("getpid", fd, 0, bcc.KprobeSyscall); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		syscall.Getpid()
+	}
+	table := bcc.NewTableByName("counts", b)
+	leaf, err := table.GetBytes([]byte{0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bcc.GetHostByteOrder().Uint64(leaf); n < 10 {
+		t.Fatalf("expected at least 10 events, got %d", n)
+	}
+	fnName := b.GetSyscallFnName("getpid")
+	if err := b.DetachKprobe(fnName); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DetachKprobe("getpid", bcc.KprobeSyscall); err == nil {
+		t.Fatal("expected error detaching a detached kprobe")
+	}
+	if err := b.AttachKprobe("gobpf_no_such_module:foo", fd, 0); !errors.Is(err, bcc.ErrKernelModuleNotLoaded) {
+		t.Fatalf("expected ErrKernelModuleNotLoaded, got %v", err)
+	}
+}
+
+func TestModuleAttachKprobesMatching(t *testing.T) {
+	b, err := bcc.NewModule(countGetpid, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadKprobe("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AttachKprobesMatching("^vfs_", fd, 1); err == nil {
+		t.Fatal("expected error above the maximum number of functions")
+	}
+	attached, err := b.AttachKprobesMatching("^vfs_read$|^vfs_write$", fd, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attached) != 2 {
+		t.Fatalf("expected vfs_read and vfs_write, got %v", attached)
+	}
+	if err := b.DetachKprobes(attached); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleKprobeMissCount(t *testing.T) {
+	b, err := bcc.NewModule(countGetpid, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadKprobe("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.KprobeMissCount("vfs_read"); err == nil {
+		t.Fatal("expected error for a function not probed")
+	}
+	if err := b.AttachKretprobe("vfs_read", fd, 64); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.KprobeMissCount("vfs_read"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleAttachUprobe(t *testing.T) {
+	b, err := bcc.NewModule(countGetpid, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadUprobe("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachUprobe("c", "no_such_symbol_gobpf", fd, -1); !errors.Is(err, bcc.ErrSymbolNotFound) {
+		t.Fatalf("expected ErrSymbolNotFound, got %v", err)
+	}
+	if err := b.AttachUprobe("c", "strlen", fd, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachUretprobe("c", "strlen", fd, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachUprobe("c", "strlen+0x1", fd, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DetachUprobe("c", "strlen", -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DetachUprobe("c", "strlen", -1); err == nil {
+		t.Fatal("expected error detaching a detached uprobe")
+	}
+	if err := b.DetachUretprobe("c", "strlen", -1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleAttachRawTracepoint(t *testing.T) {
+	b, err := bcc.NewModule(countGetpid, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadRawTracepoint("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachRawTracepoint("sys_enter", fd); errors.Is(err, bcc.ErrNotSupported) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		syscall.Getpid()
+	}
+	table := bcc.NewTableByName("counts", b)
+	leaf, err := table.GetBytes([]byte{0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bcc.GetHostByteOrder().Uint64(leaf); n < 10 {
+		t.Fatalf("expected at least 10 events, got %d", n)
+	}
+	if err := b.DetachRawTracepoint("sys_enter"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DetachRawTracepoint("sys_enter"); err == nil {
+		t.Fatal("expected error detaching a detached raw tracepoint")
+	}
+}
+
+func TestModuleAttachTracepoint(t *testing.T) {
+	if !bcc.TracepointExists("raw_syscalls", "sys_enter") {
+		t.Skip("no raw_syscalls:sys_enter tracepoint")
+	}
+	tps, err := bcc.ListTracepoints("raw_sys*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := sort.SearchStrings(tps, "raw_syscalls:sys_enter"); i == len(tps) || tps[i] != "raw_syscalls:sys_enter" {
+		t.Fatalf("raw_syscalls:sys_enter not listed in %v", tps)
+	}
+	b, err := bcc.NewModule(countGetpid, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadTracepoint("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.AttachTracepoint("raw_syscalls:sys_entr", fd)
+	if !errors.Is(err, bcc.ErrTracepointNotFound) || !strings.Contains(err.Error(), "raw_syscalls:sys_enter") {
+		t.Fatalf("expected error naming raw_syscalls:sys_enter, got %v", err)
+	}
+	if err := b.AttachTracepoint("raw_syscalls:sys_enter", fd); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		syscall.Getpid()
+	}
+	table := bcc.NewTableByName("counts", b)
+	leaf, err := table.GetBytes([]byte{0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bcc.GetHostByteOrder().Uint64(leaf); n < 10 {
+		t.Fatalf("expected at least 10 events, got %d", n)
+	}
+	if err := b.DetachTracepoint("raw_syscalls:sys_enter"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DetachTracepoint("raw_syscalls:sys_enter"); err == nil {
+		t.Fatal("expected error detaching a detached tracepoint")
+	}
+}
+
+func TestModuleAttachments(t *testing.T) {
+	b, err := bcc.NewModuleWithOptions(countGetpid, []string{}, bcc.ModuleOptions{ErrorOnReattach: true})
+	if err != nil {
+		t.Fatal(err)
 	}
 	defer b.Close()
-	_, err := b.LoadKprobe("func1")
+	fd, err := b.LoadKprobe("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := b.GetSyscallFnName("getpid")
+	if err := b.AttachKprobe(fn, fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachKretprobe(fn, fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachKprobe(fn, fd, 0); !errors.Is(err, bcc.ErrAlreadyAttached) {
+		t.Fatalf("expected ErrAlreadyAttached attaching again, got %v", err)
+	}
+	attachments, err := b.Attachments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 2 {
+		t.Fatalf("expected 2 attachments, got %v", attachments)
+	}
+	for i, kind := range []bcc.AttachmentKind{bcc.AttachmentKprobe, bcc.AttachmentKretprobe} {
+		a := attachments[i]
+		if a.Kind != kind || a.Target != fn || a.FD != fd || a.AttachedAt.IsZero() {
+			t.Fatalf("unexpected attachment %d: %+v", i, a)
+		}
+	}
+	if err := b.DetachAll(); err != nil {
+		t.Fatal(err)
+	}
+	if attachments, err := b.Attachments(); err != nil || len(attachments) != 0 {
+		t.Fatalf("expected no attachments after DetachAll, got %v, %v", attachments, err)
+	}
+	// The program is still loaded and can be attached again.
+	if err := b.AttachKprobe(fn, fd, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleReattach(t *testing.T) {
+	b, err := bcc.NewModule(countGetpid, []string{})
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer b.Close()
+	fd, err := b.LoadKprobe("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachKprobe("getpid", fd, 0, bcc.KprobeSyscall); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachKprobe("getpid", fd, 0, bcc.KprobeSyscall); err != nil {
+		t.Fatalf("expected attaching again to do nothing, got %v", err)
+	}
+	if attachments, _ := b.Attachments(); len(attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %v", attachments)
+	}
+	b2, err := bcc.NewModule(countGetpid, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	other, err := b2.LoadKprobe("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachKprobe("getpid", other, 0, bcc.KprobeSyscall); !errors.Is(err, bcc.ErrAlreadyAttached) {
+		t.Fatalf("expected ErrAlreadyAttached attaching another program, got %v", err)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	if !bcc.SupportsMapType(bcc.MapTypeHash) {
+		t.Fatal("expected hash maps to be supported")
+	}
+	if !bcc.SupportsProgramType(bcc.ProgramTypeKprobe) {
+		t.Fatal("expected kprobes to be supported")
+	}
+	if bcc.SupportsMapType(bcc.MapTypeStructOps) {
+		t.Fatal("expected struct_ops maps not to be probed")
+	}
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	_, err = bcc.NewTableByName("table1", b).GetBatch(16)
+	if supported := bcc.SupportsBatchOps(); supported != !errors.Is(err, bcc.ErrNotSupported) {
+		t.Fatalf("SupportsBatchOps() = %v, GetBatch returned %v", supported, err)
+	}
+	t.Logf("raw tracepoints: %v, ring buffers: %v, batch ops: %v", bcc.SupportsRawTracepoints(), bcc.SupportsRingBuf(), bcc.SupportsBatchOps())
+}
+
+func TestTableGetBatch(t *testing.T) {
+	b, err := bcc.NewModule(largeHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("large", b)
+	order := bcc.GetHostByteOrder()
+	key := make([]byte, 4)
+	for i := 0; i < 4096; i++ {
+		order.PutUint32(key, uint32(i))
+		if err := table.SetFrom(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A full table has buckets of several entries, which batches of
+	// one entry don't hold.
+	entries, err := table.GetBatch(1)
+	if errors.Is(err, bcc.ErrNotSupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4096 {
+		t.Fatalf("got %d entries, expected 4096", len(entries))
+	}
+	for _, e := range entries {
+		if !bytes.Equal(e.Key, e.Value) {
+			t.Fatalf("key %x: got value %x", e.Key, e.Value)
+		}
+	}
+}
+
+func TestModuleAttachPerfEvent(t *testing.T) {
+	b, err := bcc.NewModule(countGetpid, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadPerfEvent("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachPerfEvent(bcc.PerfTypeSoftware, bcc.PerfCountSWCPUClock, 0, 99, -1, -1, -1, fd); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachPerfEvent(bcc.PerfTypeSoftware, bcc.PerfCountSWCPUClock, 0, 99, -1, -1, -1, fd); err == nil {
+		t.Fatal("expected error attaching twice")
+	}
+	table := bcc.NewTableByName("counts", b)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := table.GetBytes([]byte{0, 0, 0, 0}); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no perf event sample")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := b.DetachPerfEvent(bcc.PerfTypeSoftware, bcc.PerfCountSWCPUClock); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DetachPerfEvent(bcc.PerfTypeSoftware, bcc.PerfCountSWCPUClock); err == nil {
+		t.Fatal("expected error detaching a detached perf event")
+	}
+}
+
+// setupVeth creates a veth pair and returns the name of one end.
+func setupVeth(t *testing.T) string {
+	name := fmt.Sprintf("gobpf%d", os.Getpid()%10000)
+	if out, err := exec.Command("ip", "link", "add", name, "type", "veth", "peer", "name", name+"p").CombinedOutput(); err != nil {
+		t.Skipf("unable to create veth pair: %v: %s", err, out)
+	}
+	t.Cleanup(func() {
+		exec.Command("ip", "link", "del", name).Run()
+	})
+	return name
+}
+
+func TestModuleAttachXDP(t *testing.T) {
+	b, err := bcc.NewModule(xdpPass, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd1, err := b.Load("xdp_pass", bcc.ProgramTypeXDP, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd2, err := b.Load("xdp_pass2", bcc.ProgramTypeXDP, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachXDP("gobpf-missing0", fd1, bcc.XDPFlagsSKBMode); !errors.Is(err, bcc.ErrInterfaceNotFound) {
+		t.Fatalf("expected ErrInterfaceNotFound, got %v", err)
+	}
+	dev := setupVeth(t)
+	if err := b.AttachXDP(dev, fd1, bcc.XDPFlagsSKBMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachXDP(dev, fd2, bcc.XDPFlagsSKBMode|bcc.XDPFlagsUpdateIfNoExist); err == nil {
+		t.Fatal("expected error replacing with XDPFlagsUpdateIfNoExist")
+	}
+	if err := b.AttachXDP(dev, fd2, bcc.XDPFlagsSKBMode); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RemoveXDP(dev, bcc.XDPFlagsSKBMode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleTestRun(t *testing.T) {
+	b, err := bcc.NewModule(xdpMark, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.Load("xdp_mark", bcc.ProgramTypeXDP, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 64)
+	res, err := b.TestRun(fd, data, 10)
+	if errors.Is(err, bcc.ErrNotSupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ReturnValue != 1 {
+		t.Fatalf("expected XDP_DROP, got %d", res.ReturnValue)
+	}
+	if len(res.DataOut) != len(data) || res.DataOut[0] != 0x42 {
+		t.Fatalf("unexpected data out %x", res.DataOut)
+	}
+	if data[0] != 0 {
+		t.Fatal("expected data in to be left unchanged")
+	}
+}
+
+func TestSocketFilter(t *testing.T) {
+	b, err := bcc.NewModule(socketFilter, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadSocketFilter("count_packets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bcc.AttachSocketFilter("gobpf-missing0", fd); !errors.Is(err, bcc.ErrInterfaceNotFound) {
+		t.Fatalf("expected ErrInterfaceNotFound, got %v", err)
+	}
+	sock, err := bcc.AttachSocketFilter("lo", fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(sock)
+
+	conn, err := net.Dial("udp", "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("gobpf"))
+	conn.Close()
+
+	table := bcc.NewTableByName("counts", b)
+	if _, err := table.GetBytes([]byte{0, 0, 0, 0}); err != nil {
+		t.Fatalf("no packet counted: %v", err)
+	}
+	if err := bcc.DetachSocketFilter(sock); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleAttachTC(t *testing.T) {
+	b, err := bcc.NewModule(tcPass, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd1, err := b.LoadSchedCls("tc_pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd2, err := b.LoadSchedCls("tc_pass2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := setupVeth(t)
+	for _, dir := range []bcc.TCDirection{bcc.TCIngress, bcc.TCEgress} {
+		if err := b.AttachTC(dev, fd1, dir, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.AttachTC(dev, fd2, dir, 1); err != nil {
+			t.Fatalf("replace: %v", err)
+		}
+		if err := b.DetachTC(dev, dir, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.DetachTC(dev, dir, 1); err == nil {
+			t.Fatal("expected error detaching a detached filter")
+		}
+	}
+}
+
+func TestModuleAttachCgroup(t *testing.T) {
+	b, err := bcc.NewModule(cgroupSkb, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadCgroupSkb("allow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachCgroup(fd, bcc.CgroupInetIngress, "/proc", 0); !errors.Is(err, bcc.ErrNotCgroup2) {
+		t.Fatalf("expected ErrNotCgroup2, got %v", err)
+	}
+	const root = "/sys/fs/cgroup"
+	if err := b.AttachCgroup(fd, bcc.CgroupInetIngress, root, bcc.CgroupAllowMulti); errors.Is(err, bcc.ErrNotCgroup2) {
+		t.Skipf("%s is not a cgroup2 mount", root)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachCgroup(fd, bcc.CgroupInetEgress, root, bcc.CgroupAllowMulti); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DetachCgroup(fd, bcc.CgroupInetIngress, root); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DetachCgroup(fd, bcc.CgroupInetIngress, root); err == nil {
+		t.Fatal("expected error detaching a detached program")
+	}
+	// The egress program is detached by Close.
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleAttachTrampoline(t *testing.T) {
+	b, err := bcc.NewModule(fentryCount, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := b.LoadFentry("count", "no_such_function_gobpf"); errors.Is(err, bcc.ErrNotSupported) {
+		t.Skip(err)
+	} else if !errors.Is(err, bcc.ErrSymbolNotFound) {
+		t.Fatalf("expected ErrSymbolNotFound, got %v", err)
+	}
+	fd, err := b.LoadFentry("count", "vfs_read")
+	if errors.Is(err, bcc.ErrNotSupported) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachTrampoline(fd); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := os.ReadFile("/proc/self/stat"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	table := bcc.NewTableByName("counts", b)
+	leaf, err := table.GetBytes([]byte{0, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bcc.GetHostByteOrder().Uint64(leaf); n < 10 {
+		t.Fatalf("expected at least 10 events, got %d", n)
+	}
+	if err := b.DetachTrampoline(fd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleIter(t *testing.T) {
+	b, err := bcc.NewModule(taskIter, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadIter("bpf_iter__task")
+	if errors.Is(err, bcc.ErrNotSupported) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	linkFD, err := b.AttachIter(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := b.OpenIter(linkFD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := strconv.Itoa(os.Getpid())
+	found := false
+	for _, line := range strings.Split(string(out), "\n") {
+		if line == pid {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("pid %s not in iterator output %q", pid, out)
+	}
+	if err := b.DetachIter(linkFD); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.OpenIter(linkFD); err == nil {
+		t.Fatal("expected error opening a detached iterator")
+	}
+}
+
+func TestModuleSockMap(t *testing.T) {
+	b, err := bcc.NewModule(sockMap, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	parser, err := b.LoadSkSkb("parser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verdict, err := b.LoadSkSkb("verdict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := bcc.NewTableByName("sock_map", b)
+	mapFD := table.Desc().FD
+	if err := b.AttachSockProg(mapFD, parser, bcc.SockSKBStreamParser); errors.Is(err, bcc.ErrNotSupported) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachSockProg(mapFD, verdict, bcc.SockSKBStreamVerdict); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	f, err := server.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := table.UpdateSocket([]byte{0, 0, 0, 0}, int(f.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected ping through the verdict program, got %q (%v)", buf, err)
+	}
+	if err := table.DeleteBytes([]byte{0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DetachSockProg(mapFD, verdict, bcc.SockSKBStreamVerdict); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DetachSockProg(mapFD, verdict, bcc.SockSKBStreamVerdict); err == nil {
+		t.Fatal("expected error detaching a detached program")
+	}
+
+	b2, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	hash := bcc.NewTableByName("table1", b2)
+	if err := hash.UpdateSocket([]byte{0, 0, 0, 0}, int(f.Fd())); !errors.Is(err, bcc.ErrOperationNotSupported) {
+		t.Fatalf("expected ErrOperationNotSupported, got %v", err)
+	}
+	if err := b.AttachSockProg(hash.Desc().FD, verdict, bcc.SockSKBStreamVerdict); !errors.Is(err, bcc.ErrOperationNotSupported) {
+		t.Fatalf("expected ErrOperationNotSupported, got %v", err)
+	}
+}
+
+func setupNetns(t *testing.T) string {
+	name := fmt.Sprintf("gobpf%d", os.Getpid()%10000)
+	if out, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		t.Skipf("unable to create network namespace: %v: %s", err, out)
+	}
+	t.Cleanup(func() {
+		exec.Command("ip", "netns", "del", name).Run()
+	})
+	return filepath.Join("/var/run/netns", name)
+}
+
+func TestModuleAttachFlowDissector(t *testing.T) {
+	netns := setupNetns(t)
+	b, err := bcc.NewModule(flowDissector, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadFlowDissector("dissect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachFlowDissector(fd, netns); errors.Is(err, bcc.ErrNotSupported) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	b2, err := bcc.NewModule(flowDissector, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	fd2, err := b2.LoadFlowDissector("dissect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b2.AttachFlowDissector(fd2, netns); err == nil || !strings.Contains(err.Error(), "only one") {
+		t.Fatalf("expected error attaching a second flow dissector, got %v", err)
+	}
+
+	if err := b.DetachFlowDissector(netns); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DetachFlowDissector(netns); err == nil {
+		t.Fatal("expected error detaching a detached flow dissector")
+	}
+	if err := b2.AttachFlowDissector(fd2, netns); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModuleTablesFunctions(t *testing.T) {
+	b, err := bcc.NewModule(mapOfMaps[:strings.Index(mapOfMaps, "BPF_HASH_OF_MAPS")]+`
+int func1(void *ctx) {
+	return 0;
+}
+int func2(void *ctx) {
+	return 0;
+}
+`, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := b.LoadKprobe("func2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tables, err := b.Tables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, table := range tables {
+		names = append(names, table.Name())
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "inner1,inner2" {
+		t.Fatalf("unexpected tables %v", names)
+	}
+
+	funcs, err := b.Functions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := map[string]bool{}
+	for _, f := range funcs {
+		if f.Size == 0 {
+			t.Fatalf("function %s has zero size", f.Name)
+		}
+		loaded[f.Name] = f.Loaded
+	}
+	if len(loaded) != 2 || loaded["func1"] || !loaded["func2"] {
+		t.Fatalf("unexpected functions %+v", funcs)
+	}
+}
+
+func TestModuleTableByName(t *testing.T) {
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	table, err := b.TableByName("table1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Name() != "table1" {
+		t.Fatalf("unexpected table name %q", table.Name())
+	}
+	if _, err := b.TableByName("missing"); !errors.Is(err, bcc.ErrTableNotFound) {
+		t.Fatalf("expected ErrTableNotFound, got %v", err)
+	}
+
+	// Run with -race: lookups racing with Close must not use the
+	// freed module.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			if _, err := b.TableByName("table1"); err != nil {
+				if !errors.Is(err, bcc.ErrModuleClosed) {
+					t.Errorf("expected ErrModuleClosed, got %v", err)
+				}
+				return
+			}
+		}
+	}()
+	b.Close()
+	wg.Wait()
+
+	// The other accessors don't use the freed module either.
+	if n := b.TableSize(); n != 0 {
+		t.Fatalf("got %d tables after Close, expected 0", n)
+	}
+	if id := b.TableId("table1"); id != 0 {
+		t.Fatalf("got table id %d after Close, expected 0", id)
+	}
+	if desc := b.TableDesc(0); desc != nil {
+		t.Fatalf("got table desc %v after Close, expected nil", desc)
+	}
+	for desc := range b.TableIter() {
+		t.Fatalf("got table desc %v after Close", desc)
+	}
+	if _, err := bcc.NewTableByName("table1", b).GetBytes(make([]byte, 4)); !errors.Is(err, bcc.ErrModuleClosed) {
+		t.Fatalf("expected ErrModuleClosed, got %v", err)
+	}
+}
+
+func TestProgMapInfo(t *testing.T) {
+	b, err := bcc.NewModule(countGetpid, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadKprobe("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, err := bcc.GetProgInfo(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.ID == 0 || prog.Type != bcc.ProgramTypeKprobe || prog.Name != "count" || prog.InsnCount == 0 {
+		t.Fatalf("unexpected program info %+v", prog)
+	}
+	table := bcc.NewTableByName("counts", b)
+	m, err := bcc.GetMapInfo(table.Desc().FD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != bcc.MapTypeHash || m.Name != "counts" || m.KeySize != 4 || m.ValueSize != 8 || m.MaxEntries != 1 {
+		t.Fatalf("unexpected map info %+v", m)
+	}
+	if len(prog.MapIDs) != 1 || prog.MapIDs[0] != m.ID {
+		t.Fatalf("expected program to use map %d, got %v", m.ID, prog.MapIDs)
+	}
+}
+
+func TestModuleUSDT(t *testing.T) {
+	u, err := bcc.NewUSDTContext(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.EnableProbe("gobpf:no_such_probe", "func1"); !errors.Is(err, bcc.ErrSymbolNotFound) {
+		t.Fatalf("expected ErrSymbolNotFound, got %v", err)
+	}
+	b, err := bcc.NewModule(simple1, []string{}, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachUSDT(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.EnableProbe("gobpf:no_such_probe", "func1"); !errors.Is(err, bcc.ErrModuleClosed) {
+		t.Fatalf("expected ErrModuleClosed after module Close, got %v", err)
+	}
+}
+
+func TestModuleLoadVerifierLog(t *testing.T) {
+	b, err := bcc.NewModule(`
+int bad(struct pt_regs *ctx) {
+	return ((char *)ctx)[1 << 20];
+}
+`, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	_, err = b.Load("bad", bcc.ProgramTypeKprobe, 1, 0)
+	if err == nil {
+		t.Fatal("expected verifier rejection")
+	}
+	if !strings.Contains(err.Error(), "invalid bpf_context access") {
+		t.Fatalf("expected verifier log in error, got %v", err)
+	}
+	if _, err := b.Load("missing", bcc.ProgramTypeKprobe, 0, 0); err == nil {
+		t.Fatal("expected error loading missing function")
+	}
+}
+
+func TestModuleWithOptions(t *testing.T) {
+	b, err := bcc.NewModuleWithOptions(simple1, []string{}, bcc.ModuleOptions{
+		VerifierLogSize:  1 << 20,
+		VerifierLogLevel: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := b.VerifierLog("func1"); err == nil {
+		t.Fatal("expected error for a function not loaded")
+	}
+	if _, err := b.LoadKprobe("func1"); err != nil {
+		t.Fatal(err)
+	}
+	log, err := b.VerifierLog("func1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log, "processed") {
+		t.Fatalf("expected verifier log of successful load, got %q", log)
+	}
+	b.Close()
+	if _, err := b.VerifierLog("func1"); err != bcc.ErrModuleClosed {
+		t.Fatalf("expected ErrModuleClosed, got %v", err)
+	}
+}
+
+func TestModuleCompileError(t *testing.T) {
+	b, err := bcc.NewModule("int func0(void *ctx) {\n\treturn 0;\n}\nint func1(void *ctx) {\n\treturn undefined_var;\n}\n", []string{})
+	if err == nil {
+		b.Close()
+		t.Fatal("expected compile error")
+	}
+	if !strings.Contains(err.Error(), ":5:") || !strings.Contains(err.Error(), "undefined_var") {
+		t.Fatalf("expected diagnostics in error, got %v", err)
+	}
+	var compileErr *bcc.CompileError
+	if !errors.As(err, &compileErr) {
+		t.Fatalf("expected a CompileError, got %T", err)
+	}
+	var found bool
+	for _, d := range compileErr.Diagnostics {
+		if d.Severity == "error" && d.Line == 5 && strings.Contains(d.Message, "undefined_var") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected an error at line 5, got %+v", compileErr.Diagnostics)
+	}
+}
+
+func TestModuleFromFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "gobpf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "simple1.c")
+	if err := os.WriteFile(path, []byte(simple1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := bcc.NewModuleFromFile(path, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := b.LoadKprobe("func1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bcc.NewModuleFromFile(filepath.Join(dir, "missing.c"), nil); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+}
+
+func TestModuleFromTemplate(t *testing.T) {
+	b, err := bcc.NewModuleFromTemplate(`
+BPF_TABLE("hash", int, int, table1, @SIZE@);
+int func1(void *ctx) {
+@IF FILTER@
+	if ((bpf_get_current_pid_tgid() >> 32) != @PID@)
+		return 0;
+@ENDIF@
+	return 0;
+}
+`, map[string]interface{}{"SIZE": 20, "FILTER": true, "PID": os.Getpid()}, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if max, err := bcc.NewTableByName("table1", b).MaxEntries(); err != nil || max != 20 {
+		t.Fatalf("expected 20 entries, got %d (%v)", max, err)
+	}
+	if _, err := b.LoadKprobe("func1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTableModuleClosed(t *testing.T) {
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := bcc.NewTable(b.TableId("table1"), b)
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if _, err := b.LoadKprobe("func1"); !errors.Is(err, bcc.ErrModuleClosed) {
+		t.Fatalf("LoadKprobe: expected ErrModuleClosed, got %v", err)
+	}
+
+	if _, err := table.GetEntry("1"); !errors.Is(err, bcc.ErrModuleClosed) {
+		t.Fatalf("GetEntry: expected ErrModuleClosed, got %v", err)
+	}
+	if _, ok := table.Get("1"); ok {
+		t.Fatal("Get: expected failure on closed module")
+	}
+	if err := table.Set("1", "1"); !errors.Is(err, bcc.ErrModuleClosed) {
+		t.Fatalf("Set: expected ErrModuleClosed, got %v", err)
+	}
+	if err := table.Delete("1"); !errors.Is(err, bcc.ErrModuleClosed) {
+		t.Fatalf("Delete: expected ErrModuleClosed, got %v", err)
+	}
+	for range table.Iter() {
+		t.Fatal("Iter: expected no entries on closed module")
+	}
+}
+
+// TestTableConcurrentClose is meant to be run with -race.
+func TestTableConcurrentClose(t *testing.T) {
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := bcc.NewTableByName("table1", b)
+	for i := 0; i < 10; i++ {
+		if err := table.Set(fmt.Sprint(i), "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(op string, err error) bool {
+		if errors.Is(err, bcc.ErrModuleClosed) {
+			return false
+		}
+		if err != nil && !errors.Is(err, bcc.ErrKeyNotFound) && !errors.Is(err, bcc.ErrKeyExists) {
+			t.Errorf("%s: %v", op, err)
+			return false
+		}
+		return true
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for {
+				_, err := table.GetEntry("1")
+				if !check("GetEntry", err) {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				if !check("Set", table.Set("2", "2")) {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				it := table.Iterator()
+				for it.Next() {
+				}
+				if !check("Iterator", it.Err()) {
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+// TestTableCloseDuringIter closes the module while entries are being
+// formatted, from the iterating goroutine and from others. Run it with
+// -race: iterations must stop with ErrModuleClosed, not use the freed
+// module.
+func TestTableCloseDuringIter(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		b, err := bcc.NewModule(largeHash, []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		table := bcc.NewTableByName("large", b)
+		for i := 0; i < 1024; i++ {
+			if err := table.Set(strconv.Itoa(i), "1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for range table.Iter() {
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for _, err := range table.Entries() {
+				if err != nil {
+					if !errors.Is(err, bcc.ErrModuleClosed) {
+						t.Errorf("Entries: %v", err)
+					}
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			n := 0
+			for _, err := range table.Entries() {
+				if err != nil {
+					if !errors.Is(err, bcc.ErrModuleClosed) {
+						t.Errorf("Entries: %v", err)
+					}
+					return
+				}
+				// Close from the iterating goroutine, mid-iteration.
+				if n++; n == 100+round*10 {
+					if err := b.Close(); err != nil {
+						t.Errorf("Close: %v", err)
+					}
+				}
+			}
+		}()
+		time.Sleep(time.Duration(round%5) * time.Millisecond)
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+	}
+}
+
+func TestTableRecreateWithFlags(t *testing.T) {
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("table1", b)
+	if err := table.Set("1", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.RecreateWithFlags(100, bcc.MapFlagNoPrealloc); err != nil {
+		t.Fatal(err)
+	}
+	info, err := bcc.GetMapInfo(table.Desc().FD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MaxEntries != 100 || info.Flags&bcc.MapFlagNoPrealloc == 0 || info.Type != bcc.MapTypeHash {
+		t.Fatalf("unexpected map info %+v", info)
+	}
+	if n, err := table.Len(); err != nil || n != 0 {
+		t.Fatalf("expected an empty table, got %d entries (%v)", n, err)
+	}
+	if err := table.Set("2", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := table.GetEntry("2"); err != nil || e.Value != "0x2" {
+		t.Fatalf("unexpected entry %+v (%v)", e, err)
+	}
+}
+
+func TestTableSumAll(t *testing.T) {
+	for _, src := range []struct {
+		source    string
+		valueSize int
+	}{
+		{percpuCounters, 8},
+		{percpuHash, 4},
+	} {
+		t.Run(fmt.Sprintf("u%d", src.valueSize*8), func(t *testing.T) {
+			b, err := bcc.NewModule(src.source, []string{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			table := bcc.NewTableByName("counts", b)
+			cpus, err := cpupossible.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			order := bcc.GetHostByteOrder()
+			for i := 0; i < 300; i++ {
+				key := make([]byte, 4)
+				order.PutUint32(key, uint32(i))
+				values := make([][]byte, len(cpus))
+				for cpu := range values {
+					values[cpu] = make([]byte, src.valueSize)
+					values[cpu][0] = byte(cpu + 1)
+				}
+				if err := table.SetPerCPU(key, values); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := uint64(len(cpus) * (len(cpus) + 1) / 2)
+
+			sums, err := table.SumAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Lookups retried by a policy are summed in Go.
+			table.SetRetryPolicy(bcc.RetryPolicy{MaxAttempts: 2})
+			goSums, err := table.SumAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sums) != 300 || !reflect.DeepEqual(sums, goSums) {
+				t.Fatalf("got %d sums, expected 300 equal to those summed in Go", len(sums))
+			}
+			// And to those of the values of each CPU, walked by a cursor.
+			entrySums := make(map[string]uint64)
+			for e, err := range table.Entries() {
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, v := range e.PerCPU {
+					n, err := strconv.ParseUint(v, 0, 64)
+					if err != nil {
+						t.Fatalf("key %s: %v", e.Key, err)
+					}
+					entrySums[e.Key] += n
+				}
+			}
+			if !reflect.DeepEqual(sums, entrySums) {
+				t.Fatalf("got sums %v, expected %v summed from the entries", sums, entrySums)
+			}
+			for k, sum := range sums {
+				if sum != want {
+					t.Fatalf("key %s: got sum %d, expected %d", k, sum, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTableMmap(t *testing.T) {
+	b, err := bcc.NewModule(mmapArrays, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	table := bcc.NewTableByName("freq", b)
+	m, err := table.Mmap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.Len() != 16 {
+		t.Fatalf("got %d values, expected 16", m.Len())
+	}
+	if err := table.Set("3", "42"); err != nil {
+		t.Fatal(err)
+	}
+	if v := m.ReadUint64(3); v != 42 {
+		t.Fatalf("got %d at index 3, expected 42", v)
+	}
+	m.StoreUint64(5, 7)
+	if v, err := table.GetAt(5); err != nil || bcc.GetHostByteOrder().Uint64(v) != 7 {
+		t.Fatalf("got %x (%v) at index 5, expected 7", v, err)
+	}
+	if v := m.At(5); len(v) != 8 || bcc.GetHostByteOrder().Uint64(v) != 7 {
+		t.Fatalf("unexpected view %x of index 5", v)
+	}
+
+	// Values of 4 bytes are laid out 8 bytes apart.
+	small, err := bcc.NewTableByName("small", b).Mmap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small.Close()
+	if err := bcc.NewTableByName("small", b).Set("2", "9"); err != nil {
+		t.Fatal(err)
+	}
+	if v := small.At(2); len(v) != 4 || bcc.GetHostByteOrder().Uint32(v) != 9 {
+		t.Fatalf("unexpected view %x of index 2", v)
+	}
+
+	for _, name := range []string{"plain", "pcpu"} {
+		if _, err := bcc.NewTableByName(name, b).Mmap(); !errors.Is(err, bcc.ErrOperationNotSupported) {
+			t.Fatalf("%s: got error %v, expected ErrOperationNotSupported", name, err)
+		}
+	}
+
+	// The mapping outlives the module.
+	b.Close()
+	if v := m.ReadUint64(3); v != 42 {
+		t.Fatalf("got %d at index 3 after Close, expected 42", v)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTablePerfEventArray(t *testing.T) {
+	b, err := bcc.NewModule(perfOutput, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("events", b)
+	if mt := table.Type(); mt != bcc.MapTypePerfEventArray {
+		t.Fatalf("expected a perf event array, got %v", mt)
+	}
+	if _, err := table.GetEntry("0"); !errors.Is(err, bcc.ErrOperationNotSupported) {
+		t.Fatalf("expected ErrOperationNotSupported, got %v", err)
+	}
+	if err := table.Set("0", "1"); !errors.Is(err, bcc.ErrOperationNotSupported) {
+		t.Fatalf("expected ErrOperationNotSupported, got %v", err)
+	}
+	for _, err := range table.Entries() {
+		if !errors.Is(err, bcc.ErrOperationNotSupported) {
+			t.Fatalf("expected ErrOperationNotSupported, got %v", err)
+		}
+	}
+
+	ch := make(chan []byte)
+	perfMap, err := bcc.InitPerfMap(table, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := b.LoadKprobe("send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachKprobe("getpid", fd, 0, bcc.KprobeSyscall); err != nil {
+		t.Fatal(err)
+	}
+	perfMap.Start()
+	defer perfMap.Stop()
+	syscall.Getpid()
+	select {
+	case data := <-ch:
+		if len(data) < 4 {
+			t.Fatalf("unexpected event %x", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no perf event received")
+	}
+
+	b2, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	if _, err := bcc.InitPerfMap(bcc.NewTableByName("table1", b2), ch); !errors.Is(err, bcc.ErrOperationNotSupported) {
+		t.Fatalf("expected ErrOperationNotSupported, got %v", err)
+	}
+}
+
+func TestModuleLoadOffload(t *testing.T) {
+	b, err := bcc.NewModule(xdpMark, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	_, err = b.LoadWithOptions("xdp_mark", bcc.ProgramTypeXDP, bcc.LoadOptions{IfName: "gobpf-no-such-dev"})
+	if !errors.Is(err, bcc.ErrInterfaceNotFound) {
+		t.Fatalf("expected ErrInterfaceNotFound, got %v", err)
+	}
+	// The loopback device has no offload support.
+	_, err = b.LoadWithOptions("xdp_mark", bcc.ProgramTypeXDP, bcc.LoadOptions{IfName: "lo"})
+	if !errors.Is(err, bcc.ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+
+	b2, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	table := bcc.NewTableByName("table1", b2)
+	if _, err := table.RecreateOnDevice("lo", 0, 0); !errors.Is(err, bcc.ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestTableErrno(t *testing.T) {
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("table1", b)
+	key := func(i int) []byte {
+		k := make([]byte, 4)
+		bcc.GetHostByteOrder().PutUint32(k, uint32(i))
+		return k
+	}
+	leaf := make([]byte, 4)
+
+	_, err = table.GetBytes(key(1))
+	if !errors.Is(err, bcc.ErrKeyNotFound) || !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("expected ErrKeyNotFound and ENOENT, got %v", err)
+	}
+	if _, err := table.GetEntry("1"); !errors.Is(err, bcc.ErrKeyNotFound) || !errors.Is(err, syscall.ENOENT) || errors.Is(err, bcc.ErrFormat) {
+		t.Fatalf("expected ErrKeyNotFound and ENOENT, got %v", err)
+	}
+	if err := table.DeleteBytes(key(1)); !errors.Is(err, bcc.ErrKeyNotFound) || !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("expected ErrKeyNotFound and ENOENT, got %v", err)
+	}
+
+	// table1 has 10 entries.
+	for i := 0; i < 10; i++ {
+		if err := table.SetBytes(key(i), leaf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = table.SetBytes(key(10), leaf)
+	if !errors.Is(err, bcc.ErrTableFull) || !errors.Is(err, syscall.E2BIG) {
+		t.Fatalf("expected ErrTableFull and E2BIG, got %v", err)
+	}
+	err = table.SetBytesWithFlags(key(0), leaf, bcc.UpdateNoExist)
+	if !errors.Is(err, bcc.ErrKeyExists) || !errors.Is(err, syscall.EEXIST) {
+		t.Fatalf("expected ErrKeyExists and EEXIST, got %v", err)
+	}
+}
+
+// TestTableErrnoNonRoot runs TestTableErrnoNonRootHelper as nobody.
+func TestTableGetIntoSetFrom(t *testing.T) {
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("table1", b)
+	key := make([]byte, 4)
+	value := make([]byte, 4)
+	bcc.GetHostByteOrder().PutUint32(key, 1)
+	bcc.GetHostByteOrder().PutUint32(value, 42)
+	if err := table.SetFrom(key, value); err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, 4)
+	if err := table.GetInto(key, out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, value) {
+		t.Fatalf("got %x, expected %x", out, value)
+	}
+	if err := table.GetInto(key, make([]byte, 8)); err == nil {
+		t.Fatal("expected a leaf size mismatch")
+	}
+	allocs := testing.AllocsPerRun(1000, func() {
+		if err := table.SetFrom(key, value); err != nil {
+			t.Fatal(err)
+		}
+		if err := table.GetInto(key, out); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("got %v allocations per SetFrom and GetInto, expected none", allocs)
+	}
+}
+
+func TestTableErrnoNonRoot(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.v", "-test.run=^TestTableErrnoNonRootHelper$")
+	cmd.Env = append(os.Environ(), "GOBPF_TEST_NONROOT=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: 65534, Gid: 65534},
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Skipf("unable to run the test binary as nobody: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%v: %s", err, out.Bytes())
+	}
+	if strings.Contains(out.String(), "--- SKIP") {
+		t.Skip(out.String())
+	}
+}
+
+func TestTableErrnoNonRootHelper(t *testing.T) {
+	if os.Getenv("GOBPF_TEST_NONROOT") == "" {
+		t.Skip("run by TestTableErrnoNonRoot")
+	}
+	table, err := bcc.CreateMap(bcc.MapSpec{Type: bcc.MapTypeHash, KeySize: 4, ValueSize: 4, MaxEntries: 1})
+	if err == nil {
+		table.Close()
+		t.Skip("unprivileged BPF enabled")
+	}
+	if !errors.Is(err, bcc.ErrPermission) || !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("expected ErrPermission and EPERM, got %v", err)
+	}
+}
+
+func TestTableWideLeaf(t *testing.T) {
+	b, err := bcc.NewModule(wideLeaf, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTable(b.TableId("wide"), b)
+
+	key := make([]byte, 4)
+	leaf := make([]byte, 32)
+	for i := range leaf {
+		leaf[i] = 0xff
+	}
+	if err := table.SetBytes(key, leaf); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := table.GetEntry("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(entry.Value, "0xff") != len(leaf) {
+		t.Fatalf("unexpected leaf string %q", entry.Value)
+	}
+	n := 0
+	for e := range table.Iter() {
+		if e.Value != entry.Value {
+			t.Fatalf("unexpected leaf string from Iter %q", e.Value)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("unexpected number of entries. Got %d, expected 1", n)
+	}
+}
+
+func TestTableIterProbeKeys(t *testing.T) {
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTable(b.TableId("table1"), b)
+
+	keys := [][]byte{
+		{0x00, 0x00, 0x00, 0x00},
+		{0xff, 0xff, 0xff, 0xff},
+		{0x55, 0x55, 0x55, 0x55},
+		{0xaa, 0xaa, 0xaa, 0xaa},
+		{0x01, 0x00, 0x00, 0x00},
+		{0x02, 0x00, 0x00, 0x00},
+	}
+	for _, k := range keys {
+		if err := table.SetBytes(k, []byte{0x01, 0x00, 0x00, 0x00}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := map[string]bool{}
+	for e := range table.Iter() {
+		if seen[e.Key] {
+			t.Fatalf("key %q returned twice", e.Key)
+		}
+		seen[e.Key] = true
+	}
+	if len(seen) != len(keys) {
+		t.Fatalf("unexpected number of entries. Got %d, expected %d", len(seen), len(keys))
+	}
+}
+
+func TestTableIterContextCancel(t *testing.T) {
+	b, err := bcc.NewModule(largeHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTable(b.TableId("large"), b)
+
+	for i := 0; i < 4096; i++ {
+		if err := table.Set(strconv.Itoa(i), "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		iter func(ctx context.Context) func()
+	}{
+		{"IterContext", func(ctx context.Context) func() {
+			ch := table.IterContext(ctx)
+			return func() { <-ch }
+		}},
+		{"KeyFilter", func(ctx context.Context) func() {
+			ch := table.IterContext(ctx, bcc.KeyFilter(func(key []byte) bool { return key[0]%2 == 0 }))
+			return func() { <-ch }
+		}},
+		{"IterBytesContext", func(ctx context.Context) func() {
+			ch := table.IterBytesContext(ctx)
+			return func() { <-ch }
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			baseline := runtime.NumGoroutine()
+			ctx, cancel := context.WithCancel(context.Background())
+			recv := tt.iter(ctx)
+			for i := 0; i < 3; i++ {
+				recv()
+			}
+			cancel()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for runtime.NumGoroutine() > baseline {
+				if time.Now().After(deadline) {
+					t.Fatal("iteration goroutine didn't exit after cancellation")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestTableIterAbandoned(t *testing.T) {
+	b, err := bcc.NewModule(largeHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("large", b)
+	for i := 0; i < 4096; i++ {
+		if err := table.Set(strconv.Itoa(i), "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The goroutines of channels no longer read stop on Close.
+	baseline := runtime.NumGoroutine()
+	for _, ch := range []<-chan bcc.Entry{
+		table.Iter(),
+		table.IterFilter(func(key []byte) bool { return true }),
+	} {
+		for i := 0; i < 3; i++ {
+			<-ch
+		}
+	}
+	<-table.IterBytes()
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatal("iteration goroutines didn't exit after Close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTableIterSnapshotKeys(t *testing.T) {
+	b, err := bcc.NewModule(largeHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("large", b)
+	for i := 0; i < 4096; i++ {
+		if err := table.Set(strconv.Itoa(i), "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := table.Iterator(bcc.SnapshotKeys())
+	seen := make(map[string]bool)
+	deleted := false
+	for it.Next() {
+		e := it.Entry()
+		if seen[e.Key] {
+			t.Fatalf("key %s seen twice", e.Key)
+		}
+		seen[e.Key] = true
+		if !deleted {
+			// Delete the even keys, including the current one.
+			for i := 0; i < 4096; i += 2 {
+				table.Delete(strconv.Itoa(i))
+			}
+			deleted = true
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 4096; i += 2 {
+		if !seen[fmt.Sprintf("0x%x", i)] {
+			t.Fatalf("key %d not seen", i)
+		}
+	}
+	if want := 2048 - 1; it.Dropped() != want && it.Dropped() != want+1 {
+		t.Fatalf("got %d entries dropped, expected about %d", it.Dropped(), want)
+	}
+}
+
+func TestTableIterParallel(t *testing.T) {
+	b, err := bcc.NewModule(largeHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("large", b)
+	order := bcc.GetHostByteOrder()
+	key := make([]byte, 4)
+	value := make([]byte, 4)
+	for i := 0; i < 4096; i++ {
+		order.PutUint32(key, uint32(i))
+		order.PutUint32(value, uint32(i*2))
+		if err := table.SetFrom(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, workers := range []int{0, 1, 4} {
+		seen := make(map[uint32]bool)
+		for e := range table.IterParallel(workers) {
+			key := order.Uint32(e.Key)
+			if seen[key] {
+				t.Fatalf("workers=%d: key %d seen twice", workers, key)
+			}
+			seen[key] = true
+			if v := order.Uint32(e.Value); v != key*2 {
+				t.Fatalf("workers=%d: key %d: got value %d, expected %d", workers, key, v, key*2)
+			}
+		}
+		if len(seen) != 4096 {
+			t.Fatalf("workers=%d: got %d entries, expected 4096", workers, len(seen))
+		}
+	}
+
+	h, err := bcc.NewModule(histogram, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	dist := bcc.NewTableByName("dist", h)
+	n := 0
+	for e := range dist.IterParallel(4) {
+		if len(e.Key) != 4 || len(e.Value) != 8 {
+			t.Fatalf("unexpected entry sizes %d and %d", len(e.Key), len(e.Value))
+		}
+		n++
+	}
+	if n != 64 {
+		t.Fatalf("got %d array entries, expected 64", n)
+	}
+
+	it := table.IterParallelContext(context.Background(), 4)
+	n = 0
+	for range it.C {
+		n++
+	}
+	if n != 4096 || it.Err() != nil {
+		t.Fatalf("got %d entries and error %v, expected 4096 and none", n, it.Err())
+	}
+
+	// Workers blocked on a channel no longer read stop on cancellation.
+	baseline := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	it = table.IterParallelContext(ctx, 4)
+	for i := 0; i < 3; i++ {
+		<-it.C
+	}
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatal("iteration goroutines didn't exit after cancellation")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for range it.C {
+	}
+	if !errors.Is(it.Err(), context.Canceled) {
+		t.Fatalf("got error %v, expected context.Canceled", it.Err())
+	}
+
+	b.Close()
+	it = table.IterParallelContext(context.Background(), 4)
+	for e := range it.C {
+		t.Fatalf("unexpected entry %v after Close", e)
+	}
+	if !errors.Is(it.Err(), bcc.ErrModuleClosed) {
+		t.Fatalf("got error %v after Close, expected ErrModuleClosed", it.Err())
+	}
+}
+
+// forBatchOps runs fn as a subtest with batch commands enabled, where
+// supported, and as another with them disabled to force the
+// element-wise path.
+func forBatchOps(t *testing.T, fn func(t *testing.T, batch bool)) {
+	for _, batch := range []bool{true, false} {
+		t.Run(fmt.Sprintf("batch=%v", batch), func(t *testing.T) {
+			fn(t, batch)
+		})
+	}
+}
+
+// strategyLogger records the messages of the package, to check the
+// strategy that the batch helpers log.
+type strategyLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *strategyLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// expectStrategy runs fn, op of table, and checks that it used batch
+// commands if batch is set and the kernel supports them, element-wise
+// operations otherwise.
+func expectStrategy(t *testing.T, table *bcc.Table, op string, batch bool, fn func()) {
+	t.Helper()
+	var l strategyLogger
+	bcc.SetLogger(&l)
+	defer bcc.SetLogger(nil)
+	fn()
+	want := "element-wise operations"
+	if batch && bcc.SupportsBatchOps() {
+		want = "batch commands"
+	}
+	want = fmt.Sprintf("bcc: debug: table %s: %s: using %s", table.Name(), op, want)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if line == want {
+			return
+		}
+	}
+	t.Fatalf("%s didn't log %q, got %q", op, want, l.lines)
+}
+
+func TestTableDeleteAll(t *testing.T) {
+	forBatchOps(t, func(t *testing.T, batch bool) {
+		b, err := bcc.NewModule(largeHash, []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		table := bcc.NewTable(b.TableId("large"), b)
+		table.SetBatchOps(batch)
+
+		for i := 0; i < 300; i++ {
+			if err := table.Set(strconv.Itoa(i), "1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expectStrategy(t, table, "DeleteAll", batch, func() {
+			if err := table.DeleteAll(); err != nil {
+				t.Fatal(err)
+			}
+		})
+		for e := range table.Iter() {
+			t.Fatalf("unexpected entry %v after DeleteAll", e)
+		}
+	})
+}
+
+func TestTableDeleteAllArray(t *testing.T) {
+	forBatchOps(t, func(t *testing.T, batch bool) {
+		b, err := bcc.NewModule(histogram, []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		table := bcc.NewTableByName("dist", b)
+		table.SetBatchOps(batch)
+
+		if err := table.Set("3", "7"); err != nil {
+			t.Fatal(err)
+		}
+		// Arrays can't delete elements, so they are zeroed.
+		if err := table.DeleteAll(); err != nil {
+			t.Fatal(err)
+		}
+		v, ok := table.Get("3")
+		if !ok {
+			t.Fatal("entry 3 missing after DeleteAll")
+		}
+		if n, _ := strconv.ParseUint(v.(string), 0, 64); n != 0 {
+			t.Fatalf("entry 3 not zeroed: %v", v)
+		}
+	})
+}
+
+func TestTableDrainAll(t *testing.T) {
+	forBatchOps(t, func(t *testing.T, batch bool) {
+		b, err := bcc.NewModule(largeHash, []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		table := bcc.NewTableByName("large", b)
+		table.SetBatchOps(batch)
+
+		order := bcc.GetHostByteOrder()
+		for i := 0; i < 300; i++ {
+			if err := table.Set(strconv.Itoa(i), strconv.Itoa(i+1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := table.DrainAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[uint32]bool)
+		for _, e := range entries {
+			key := order.Uint32(e.Key)
+			if seen[key] {
+				t.Fatalf("key %d drained twice", key)
+			}
+			seen[key] = true
+			if v := order.Uint32(e.Value); v != key+1 {
+				t.Fatalf("key %d: got value %d, expected %d", key, v, key+1)
+			}
+		}
+		if len(seen) != 300 {
+			t.Fatalf("got %d entries drained, expected 300", len(seen))
+		}
+		for e := range table.Iter() {
+			t.Fatalf("unexpected entry %v after DrainAll", e)
+		}
+	})
+}
+
+func TestTableByName(t *testing.T) {
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	byID := bcc.NewTable(b.TableId("table1"), b)
+	byName := bcc.NewTableByName("table1", b)
+	if byID.ID() != byName.ID() {
+		t.Fatalf("table ids differ: %d != %d", byID.ID(), byName.ID())
+	}
+	if byName.Name() != "table1" {
+		t.Fatalf("unexpected table name %q", byName.Name())
+	}
+	if byID.Name() != byName.Name() {
+		t.Fatalf("table names differ: %q != %q", byID.Name(), byName.Name())
+	}
+}
+
+func TestTableIterator(t *testing.T) {
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("table1", b)
+	for i := 1; i <= 3; i++ {
+		if err := table.Set(strconv.Itoa(i), strconv.Itoa(i*10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := table.Iterator()
+	n := 0
+	for it.Next() {
+		e := it.Entry()
+		v, ok := table.Get(e.Key)
+		if !ok || v != e.Value {
+			t.Fatalf("key %s: got value %s, table holds %v", e.Key, e.Value, v)
+		}
+		n++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("got %d entries, expected 3", n)
+	}
+
+	// Errors stop the iteration and are returned by Err.
+	b.Close()
+	it = table.Iterator()
+	if it.Next() {
+		t.Fatalf("unexpected entry %v after Close", it.Entry())
+	}
+	if !errors.Is(it.Err(), bcc.ErrModuleClosed) {
+		t.Fatalf("expected ErrModuleClosed, got %v", it.Err())
+	}
+}
+
+func TestTableLen(t *testing.T) {
+	b, err := bcc.NewModule(counters, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("counters", b)
+
+	if n, err := table.Len(); err != nil || n != 0 {
+		t.Fatalf("Len of empty table: got %d, %v", n, err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := table.Set(strconv.Itoa(i), "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := table.Len(); err != nil || n != 5 {
+		t.Fatalf("Len: got %d, %v, expected 5", n, err)
+	}
+	if max, err := table.MaxEntries(); err != nil || max != 10 {
+		t.Fatalf("MaxEntries: got %d, %v, expected 10", max, err)
+	}
+	if u := table.Utilization(); u != 0.5 {
+		t.Fatalf("Utilization: got %v, expected 0.5", u)
+	}
+
+	b.Close()
+	if _, err := table.Len(); !errors.Is(err, bcc.ErrModuleClosed) {
+		t.Fatalf("expected ErrModuleClosed, got %v", err)
+	}
+	if u := table.Utilization(); u != 0 {
+		t.Fatalf("Utilization after Close: got %v, expected 0", u)
+	}
+}
+
+func TestTableType(t *testing.T) {
+	b, err := bcc.NewModule(histogram, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	dist := bcc.NewTableByName("dist", b)
+	if typ := dist.Type(); typ != bcc.MapTypeArray || typ.String() != "array" {
+		t.Fatalf("dist: got map type %v, expected array", typ)
+	}
+	// Array slots can't be deleted.
+	key := make([]byte, 4)
+	if err := dist.DeleteBytes(key); !errors.Is(err, bcc.ErrOperationNotSupported) {
+		t.Fatalf("expected ErrOperationNotSupported, got %v", err)
+	}
+
+	b2, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	table1 := bcc.NewTableByName("table1", b2)
+	if typ := table1.Type(); typ != bcc.MapTypeHash || typ.String() != "hash" {
+		t.Fatalf("table1: got map type %v, expected hash", typ)
+	}
+	if s := bcc.MapType(1000).String(); s != "MapType(1000)" {
+		t.Fatalf("unexpected name %q for unknown map type", s)
+	}
+}
+
+func TestTableArrayAccess(t *testing.T) {
+	b, err := bcc.NewModule(histogram, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	dist := bcc.NewTableByName("dist", b)
+	order := bcc.GetHostByteOrder()
+
+	leaf := make([]byte, 8)
+	order.PutUint64(leaf, 7)
+	if err := dist.SetAt(3, leaf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := dist.GetAt(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := order.Uint64(got); v != 7 {
+		t.Fatalf("GetAt(3): got %d, expected 7", v)
+	}
+	values, err := dist.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 64 {
+		t.Fatalf("All: got %d slots, expected 64", len(values))
+	}
+	for i, value := range values {
+		want := uint64(0)
+		if i == 3 {
+			want = 7
+		}
+		if v := order.Uint64(value); v != want {
+			t.Fatalf("slot %d: got %d, expected %d", i, v, want)
+		}
+	}
+
+	if _, err := dist.GetAt(64); !errors.Is(err, bcc.ErrIndexOutOfRange) {
+		t.Fatalf("GetAt(64): expected ErrIndexOutOfRange, got %v", err)
+	}
+	if err := dist.SetAt(64, leaf); !errors.Is(err, bcc.ErrIndexOutOfRange) {
+		t.Fatalf("SetAt(64): expected ErrIndexOutOfRange, got %v", err)
+	}
+	if err := dist.SetAt(0, leaf[:4]); err == nil {
+		t.Fatal("SetAt with a short leaf didn't fail")
+	}
+
+	b2, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	table1 := bcc.NewTableByName("table1", b2)
+	if _, err := table1.GetAt(0); !errors.Is(err, bcc.ErrOperationNotSupported) {
+		t.Fatalf("GetAt on a hash: expected ErrOperationNotSupported, got %v", err)
+	}
+}
+
+func TestTableGetAndDelete(t *testing.T) {
+	b, err := bcc.NewModule(counters, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("counters", b)
+	order := bcc.GetHostByteOrder()
+
+	for i := uint32(1); i <= 3; i++ {
+		key := make([]byte, 4)
+		leaf := make([]byte, 8)
+		order.PutUint32(key, i)
+		order.PutUint64(leaf, uint64(i*10))
+		if err := table.SetBytes(key, leaf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key := make([]byte, 4)
+	order.PutUint32(key, 2)
+	leaf, err := table.GetAndDelete(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := order.Uint64(leaf); v != 20 {
+		t.Fatalf("GetAndDelete: got %d, expected 20", v)
+	}
+	if _, err := table.GetAndDelete(key); !errors.Is(err, bcc.ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	entries, err := table.DrainAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("DrainAll: got %d entries, expected 2", len(entries))
+	}
+	for _, e := range entries {
+		k := order.Uint32(e.Key)
+		if k != 1 && k != 3 {
+			t.Fatalf("DrainAll: unexpected key %d", k)
+		}
+		if v := order.Uint64(e.Value); v != uint64(k*10) {
+			t.Fatalf("key %d: got value %d, expected %d", k, v, k*10)
+		}
+	}
+	if n, err := table.Len(); err != nil || n != 0 {
+		t.Fatalf("Len after DrainAll: got %d, %v", n, err)
+	}
+}
+
+func TestTablePerCPU(t *testing.T) {
+	b, err := bcc.NewModule(percpuHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTable(b.TableId("counts"), b)
+
+	cpus, err := cpupossible.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte{1, 0, 0, 0}
+	values := make([][]byte, len(cpus))
+	for i := range values {
+		values[i] = []byte{byte(i), 0, 0, 0}
+	}
+	if err := table.SetPerCPU(key, values); err != nil {
+		t.Fatal(err)
+	}
+	got, err := table.GetPerCPU(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(values) {
+		t.Fatalf("unexpected number of values. Got %d, expected %d", len(got), len(values))
+	}
+	for i := range values {
+		if !bytes.Equal(got[i], values[i]) {
+			t.Fatalf("unexpected value for cpu %d: %x, expected %x", i, got[i], values[i])
+		}
+	}
+	for e := range table.Iter() {
+		if len(e.PerCPU) != len(cpus) {
+			t.Fatalf("unexpected number of per-cpu values in entry %v", e)
+		}
+	}
+}
+
+func TestTableSetWithFlags(t *testing.T) {
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTable(b.TableId("table1"), b)
+
+	if err := table.SetWithFlags("1", "1", bcc.UpdateExist); !errors.Is(err, bcc.ErrKeyNotFound) {
+		t.Fatalf("UpdateExist on missing key: expected ErrKeyNotFound, got %v", err)
+	}
+	if err := table.SetWithFlags("1", "1", bcc.UpdateNoExist); err != nil {
+		t.Fatalf("UpdateNoExist on missing key: %v", err)
+	}
+	if err := table.SetWithFlags("1", "2", bcc.UpdateNoExist); !errors.Is(err, bcc.ErrKeyExists) {
+		t.Fatalf("UpdateNoExist on existing key: expected ErrKeyExists, got %v", err)
+	}
+	if err := table.SetWithFlags("1", "3", bcc.UpdateExist); err != nil {
+		t.Fatalf("UpdateExist on existing key: %v", err)
+	}
+	if err := table.SetWithFlags("1", "4", bcc.UpdateAny); err != nil {
+		t.Fatalf("UpdateAny on existing key: %v", err)
+	}
+	if err := table.SetWithFlags("2", "4", bcc.UpdateAny); err != nil {
+		t.Fatalf("UpdateAny on missing key: %v", err)
+	}
+	for _, key := range []string{"1", "2"} {
+		e, err := table.GetEntry(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := strconv.ParseInt(e.Value, 0, 64); v != 4 {
+			t.Fatalf("unexpected value %q for key %s", e.Value, key)
+		}
+	}
+}
+
+func TestTablePinned(t *testing.T) {
+	if err := bpffs.Mount(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := bcc.NewTable(b.TableId("table1"), b)
+	key := []byte{1, 0, 0, 0}
+	if err := table.SetBytes(key, []byte{42, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(bpffs.BPFFSPath, fmt.Sprintf("gobpf-test-%d", os.Getpid()))
+	if err := table.Pin(path); err != nil {
+		t.Fatal(err)
+	}
+	defer table.Unpin(path)
+	b.Close()
+
+	pinned, err := bcc.NewTableFromPinned(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pinned.Close()
+	if desc := pinned.Desc(); desc.KeySize != 4 || desc.LeafSize != 4 || desc.MapType != bcc.MapTypeHash {
+		t.Fatalf("unexpected desc %+v", desc)
+	}
+	leaf, err := pinned.GetBytes(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(leaf, []byte{42, 0, 0, 0}) {
+		t.Fatalf("unexpected leaf %v", leaf)
+	}
+	if _, err := pinned.GetEntry("1"); !errors.Is(err, bcc.ErrNoModule) {
+		t.Fatalf("expected ErrNoModule, got %v", err)
+	}
+}
+
+func TestCreateMap(t *testing.T) {
+	table, err := bcc.CreateMap(bcc.MapSpec{
+		Type:       bcc.MapTypeHash,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 16,
+		Name:       "gobpf_scratch",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := bcc.GetMapInfo(table.Desc().FD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != bcc.MapTypeHash || info.KeySize != 4 || info.ValueSize != 8 || info.MaxEntries != 16 {
+		t.Fatalf("unexpected map info %+v", info)
+	}
+	if info.Name != "" && info.Name != "gobpf_scratch" {
+		t.Fatalf("unexpected map name %q", info.Name)
+	}
+	key := []byte{1, 0, 0, 0}
+	if err := table.SetBytes(key, []byte{1, 2, 3, 4, 5, 6, 7, 8}); err != nil {
+		t.Fatal(err)
+	}
+	if leaf, err := table.GetBytes(key); err != nil || !bytes.Equal(leaf, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatalf("unexpected leaf %v (%v)", leaf, err)
+	}
+	if err := table.Set("1", "1"); !errors.Is(err, bcc.ErrNoModule) {
+		t.Fatalf("expected ErrNoModule, got %v", err)
+	}
+	if err := table.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.GetBytes(key); !errors.Is(err, bcc.ErrModuleClosed) {
+		t.Fatalf("expected ErrModuleClosed after Close, got %v", err)
+	}
+
+	if _, err := bcc.CreateMap(bcc.MapSpec{Type: bcc.MapTypeHash, KeySize: 4}); err == nil {
+		t.Fatal("expected error creating a map without values")
+	}
+}
+
+func TestProgramPinned(t *testing.T) {
+	if err := bpffs.Mount(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := b.LoadKprobe("func1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(bpffs.BPFFSPath, fmt.Sprintf("gobpf-test-prog-%d", os.Getpid()))
+	if err := bcc.PinProgram(fd, path); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	table := bcc.NewTableByName("table1", b)
+	if err := bcc.PinProgram(table.Desc().FD, path+"-map"); err == nil {
+		t.Fatal("expected error pinning a map as a program")
+	}
+	mapPath := path + "-table"
+	if err := table.Pin(mapPath); err != nil {
+		t.Fatal(err)
+	}
+	defer table.Unpin(mapPath)
+	info, err := bcc.GetProgInfo(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	pinned, err := bcc.LoadPinnedProgram(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(pinned)
+	pinnedInfo, err := bcc.GetProgInfo(pinned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinnedInfo.ID != info.ID {
+		t.Fatalf("expected program %d, got %d", info.ID, pinnedInfo.ID)
+	}
+	if _, err := bcc.LoadPinnedProgram(mapPath); err == nil {
+		t.Fatal("expected error opening a pinned map as a program")
+	}
+}
+
+func TestTableInnerMap(t *testing.T) {
+	b, err := bcc.NewModule(mapOfMaps, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	outer := bcc.NewTableByName("outer", b)
+	inner2 := bcc.NewTableByName("inner2", b)
+	if err := inner2.SetBytes([]byte{1, 0, 0, 0}, []byte{2, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	key := []byte{0, 0, 0, 0}
+	if _, err := outer.GetInnerMap(key); !errors.Is(err, bcc.ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	if err := outer.SetInnerMap(key, inner2); err != nil {
+		t.Fatal(err)
+	}
+	inner, err := outer.GetInnerMap(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	leaf, err := inner.GetBytes([]byte{1, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(leaf, []byte{2, 0, 0, 0}) {
+		t.Fatalf("unexpected leaf %v", leaf)
+	}
+	if err := inner2.SetInnerMap(key, inner2); !errors.Is(err, bcc.ErrOperationNotSupported) {
+		t.Fatalf("expected ErrOperationNotSupported, got %v", err)
+	}
+}
+
+func TestStackTable(t *testing.T) {
+	b, err := bcc.NewModule(stackTrace, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadKprobe("func1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AttachKprobe("do_sys_open", fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open("/proc/self/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	stacks := bcc.NewStackTable(bcc.NewTableByName("stacks", b))
+	found := false
+	for e := range stacks.IterBytes() {
+		id := int(e.Key[0]) | int(e.Key[1])<<8 | int(e.Key[2])<<16 | int(e.Key[3])<<24
+		syms, err := stacks.GetStackSymbols(id, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(syms) > 0 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("no stack recorded")
+	}
+	if err := stacks.ClearAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stacks.GetStack(-14); err == nil {
+		t.Fatal("expected error for negative stack id")
+	}
+}
+
+// stackTarget is the function of the test binary whose user stack
+// TestStackTableUserSymbols records.
+//
+//go:noinline
+func stackTarget() int {
+	return os.Getpid()
+}
+
+func TestStackTableUserSymbols(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := bcc.NewModule(userStackTrace, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	fd, err := b.LoadUprobe("func1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const target = "github.com/iovisor/gobpf_test.stackTarget"
+	if err := b.AttachUprobe(exe, target, fd, os.Getpid()); err != nil {
+		t.Fatal(err)
+	}
+	stackTarget()
+
+	stacks := bcc.NewStackTable(bcc.NewTableByName("stacks", b))
+	var all [][]string
+	for e := range stacks.IterBytes() {
+		id := int(bcc.GetHostByteOrder().Uint32(e.Key))
+		syms, err := stacks.GetStackSymbols(id, os.Getpid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The file may be reported through /proc/<pid>/root.
+		if len(syms) > 0 && strings.HasPrefix(syms[0], target+" [") {
+			return
+		}
+		all = append(all, syms)
+	}
+	t.Fatalf("no stack starting with %s, got %q", target, all)
+}
+
+func TestHistogram(t *testing.T) {
+	b, err := bcc.NewModule(histogram, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("dist", b)
+	for slot, count := range map[byte]byte{1: 3, 3: 5} {
+		if err := table.SetBytes([]byte{slot, 0, 0, 0}, []byte{count, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hist := bcc.NewHistogram(table, "usecs")
+	buckets, err := hist.Buckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []bcc.Bucket{{Low: 0, High: 1, Count: 3}, {Low: 2, High: 3, Count: 0}, {Low: 4, High: 7, Count: 5}}
+	if len(buckets) != len(expected) {
+		t.Fatalf("unexpected buckets %v", buckets)
+	}
+	for i := range expected {
+		if buckets[i] != expected[i] {
+			t.Fatalf("unexpected bucket %d: %+v, expected %+v", i, buckets[i], expected[i])
+		}
+	}
+	var buf bytes.Buffer
+	if err := hist.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "4 -> 7") {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+}
+
+type statsKey struct {
+	Pid  uint32
+	Port uint16
+	Pad  uint16
+}
+
+type statsValue struct {
+	Count uint64
+	Flag  uint8
+	Pad   [7]uint8
+}
+
+func TestTypedTable(t *testing.T) {
+	b, err := bcc.NewModule(structHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("stats", b)
+
+	if _, err := bcc.NewTypedTable[uint32, statsValue](table); err == nil {
+		t.Fatal("expected size mismatch error")
+	}
+	typed, err := bcc.NewTypedTable[statsKey, statsValue](table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := statsKey{Pid: 42, Port: 8080}
+	value := statsValue{Count: 7, Flag: 1}
+	if err := typed.Set(key, value); err != nil {
+		t.Fatal(err)
+	}
+	got, err := typed.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != value {
+		t.Fatalf("unexpected value %+v, expected %+v", got, value)
+	}
+	n := 0
+	for e := range typed.Iter() {
+		if e.Key != key || e.Value != value {
+			t.Fatalf("unexpected entry %+v", e)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("unexpected number of entries. Got %d, expected 1", n)
+	}
+	if err := typed.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := typed.Get(key); !errors.Is(err, bcc.ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+// mixed mirrors struct mixed_t, with the padding clang inserts.
+type mixed struct {
+	A uint8
+	_ uint8
+	B uint16
+	C uint32
+	D uint64
+	E uint8
+	_ [7]uint8
+}
+
+func TestTableStruct(t *testing.T) {
+	b, err := bcc.NewModule(mixedStruct, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("mixed", b)
+
+	value := mixed{A: 1, B: 2, C: 3, D: 4, E: 5}
+	if err := table.SetStruct(uint32(7), &value); err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := table.GetBytes([]byte{7, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off, want := range map[int]byte{0: 1, 2: 2, 4: 3, 8: 4, 16: 5} {
+		if leaf[off] != want {
+			t.Fatalf("unexpected byte %d at offset %d of %x, expected %d", leaf[off], off, leaf, want)
+		}
+	}
+	var got mixed
+	if err := table.GetStruct(uint32(7), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != value {
+		t.Fatalf("unexpected value %+v, expected %+v", got, value)
+	}
+	if err := table.GetStruct(uint32(7), got); err == nil {
+		t.Fatal("expected error for non-pointer value")
+	}
+	if err := table.SetStruct(uint64(7), &value); err == nil {
+		t.Fatal("expected error for key size mismatch")
+	}
+	if err := table.SetStruct("7", &value); err == nil {
+		t.Fatal("expected error for string key")
+	}
+}
+
+func TestTableDumpJSON(t *testing.T) {
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTable(b.TableId("table1"), b)
+	for i := 1; i <= 3; i++ {
+		if err := table.Set(strconv.Itoa(i), strconv.Itoa(i*10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := table.DumpJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var entries []map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("unexpected number of entries in %q", buf.String())
+	}
+	for _, e := range entries {
+		k, _ := strconv.ParseInt(e["key"], 0, 64)
+		v, _ := strconv.ParseInt(e["value"], 0, 64)
+		if v != k*10 {
+			t.Fatalf("unexpected entry %v", e)
+		}
+	}
+
+	buf.Reset()
+	if err := table.DumpJSON(&buf, bcc.DumpHex()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"key":"01000000"`) {
+		t.Fatalf("unexpected hex dump %q", buf.String())
+	}
+}
+
+func TestTableDumpCSV(t *testing.T) {
+	b, err := bcc.NewModule(structHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("stats", b)
+	if err := table.SetStruct(&statsKey{Pid: 42, Port: 80}, &statsValue{Count: 3, Flag: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := table.DumpCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected CSV %q", buf.String())
+	}
+	if lines[0] != "pid,port,pad,count,flag,pad" {
+		t.Fatalf("unexpected header %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "0x2a,0x50,0x0,0x3,0x1,") {
+		t.Fatalf("unexpected row %q", lines[1])
+	}
+
+	buf.Reset()
+	if err := table.DumpCSV(&buf, bcc.DumpHeader(false), bcc.DumpSeparator(';')); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "0x2a;0x50;") {
+		t.Fatalf("unexpected CSV %q", buf.String())
+	}
+}
+
+func TestTableSnapshot(t *testing.T) {
+	forBatchOps(t, func(t *testing.T, batch bool) {
+		b, err := bcc.NewModule(simple1, []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		table := bcc.NewTable(b.TableId("table1"), b)
+		table.SetBatchOps(batch)
+		for i := 1; i <= 5; i++ {
+			if err := table.Set(strconv.Itoa(i), strconv.Itoa(i*10)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		raw, err := table.SnapshotBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(raw) != 5 {
+			t.Fatalf("unexpected number of raw entries %d", len(raw))
+		}
+		snapshot, err := table.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshot) != 5 {
+			t.Fatalf("unexpected snapshot %v", snapshot)
+		}
+		for k, v := range snapshot {
+			key, _ := strconv.ParseInt(k, 0, 64)
+			value, _ := strconv.ParseInt(v, 0, 64)
+			if value != key*10 {
+				t.Fatalf("unexpected entry %s: %s", k, v)
+			}
+		}
+	})
+}
+
+func TestTableEntries(t *testing.T) {
+	b, err := bcc.NewModule(largeHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := bcc.NewTable(b.TableId("large"), b)
+	for i := 0; i < 100; i++ {
+		if err := table.Set(strconv.Itoa(i), "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := 0
+	for _, err := range table.Entries() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 100 {
+		t.Fatalf("unexpected number of entries. Got %d, expected 100", n)
+	}
+
+	baseline := runtime.NumGoroutine()
+	n = 0
+	for e, err := range table.EntriesBytes() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(e.Key) != 4 {
+			t.Fatalf("unexpected key %x", e.Key)
+		}
+		if n++; n == 3 {
+			break
+		}
+	}
+	if runtime.NumGoroutine() > baseline {
+		t.Fatal("iteration leaked a goroutine")
+	}
+
+	b.Close()
+	for _, err := range table.Entries() {
+		if !errors.Is(err, bcc.ErrModuleClosed) {
+			t.Fatalf("expected ErrModuleClosed, got %v", err)
+		}
+	}
+}
+
+func TestTableRawIterator(t *testing.T) {
+	b, err := bcc.NewModule(largeHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := bcc.NewTable(b.TableId("large"), b)
+	for i := 0; i < 100; i++ {
+		if err := table.Set(strconv.Itoa(i), strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	byteOrder := bcc.GetHostByteOrder()
+	seen := make(map[uint32]bool)
+	it := table.RawIterator()
+	var key []byte
+	for it.Next() {
+		k := byteOrder.Uint32(it.Key())
+		if v := byteOrder.Uint32(it.Leaf()); v != k {
+			t.Fatalf("unexpected leaf %d of key %d", v, k)
+		}
+		if key != nil && &key[0] != &it.Key()[0] {
+			t.Fatal("expected the key buffer to be reused")
+		}
+		key = it.Key()
+		seen[k] = true
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 100 {
+		t.Fatalf("unexpected number of entries. Got %d, expected 100", len(seen))
+	}
+
+	b.Close()
+	it = table.RawIterator()
+	if it.Next() || !errors.Is(it.Err(), bcc.ErrModuleClosed) {
+		t.Fatalf("expected ErrModuleClosed, got %v", it.Err())
+	}
+}
+
+func TestTableFields(t *testing.T) {
+	b, err := bcc.NewModule(mixedStruct, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("mixed", b)
+	keyFields, err := table.KeyFields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyFields) != 1 || keyFields[0].Name != "" || keyFields[0].Size != 4 {
+		t.Fatalf("unexpected key fields %+v", keyFields)
+	}
+	leafFields, err := table.LeafFields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range leafFields {
+		got = append(got, fmt.Sprintf("%s@%d:%d", f.Name, f.Offset, f.Size))
+	}
+	if want := []string{"a@0:1", "b@2:2", "c@4:4", "d@8:8", "e@16:1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected leaf fields %v, expected %v", got, want)
+	}
+}
+
+func TestTableInvalidID(t *testing.T) {
+	b, err := bcc.NewModule(structHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTable(1000, b)
+	key := []byte{}
+	for name, op := range map[string]func() error{
+		"GetEntry":      func() error { _, err := table.GetEntry("1"); return err },
+		"Set":           func() error { return table.Set("1", "1") },
+		"Delete":        func() error { return table.Delete("1") },
+		"GetBytes":      func() error { _, err := table.GetBytes(key); return err },
+		"SetBytes":      func() error { return table.SetBytes(key, key) },
+		"DeleteBytes":   func() error { return table.DeleteBytes(key) },
+		"GetAndDelete":  func() error { _, err := table.GetAndDelete(key); return err },
+		"GetAt":         func() error { _, err := table.GetAt(0); return err },
+		"SetAt":         func() error { return table.SetAt(0, key) },
+		"All":           func() error { _, err := table.All(); return err },
+		"GetBatch":      func() error { _, err := table.GetBatch(16); return err },
+		"GetPerCPU":     func() error { _, err := table.GetPerCPU(key); return err },
+		"SumAll":        func() error { _, err := table.SumAll(); return err },
+		"DeleteAll":     table.DeleteAll,
+		"ZeroAll":       func() error { _, err := table.ZeroAll(); return err },
+		"DrainAll":      func() error { _, err := table.DrainAll(); return err },
+		"Snapshot":      func() error { _, err := table.Snapshot(); return err },
+		"SnapshotBytes": func() error { _, err := table.SnapshotBytes(); return err },
+		"KeyFields":     func() error { _, err := table.KeyFields(); return err },
+		"GetStruct":     func() error { var v uint32; return table.GetStruct(uint32(1), &v) },
+		"Increment":     func() error { return table.Increment(key, 1) },
+		"Iterator": func() error {
+			it := table.Iterator()
+			for it.Next() {
+			}
+			return it.Err()
+		},
+		"RawIterator": func() error {
+			it := table.RawIterator()
+			for it.Next() {
+			}
+			return it.Err()
+		},
+		"EntriesBytes": func() error {
+			for _, err := range table.EntriesBytes() {
+				return err
+			}
+			return nil
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("panic: %v", r)
+				}
+			}()
+			if err := op(); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+	for range table.Iter() {
+		t.Fatal("unexpected entry")
+	}
+}
+
+var smallFields string = `
+struct small_t {
+	u8 f0, f1, f2, f3, f4, f5, f6, f7, f8, f9, f10, f11, f12, f13, f14, f15;
+};
+BPF_TABLE("hash", struct small_t, struct small_t, small, 4);
+`
+
+func TestTableFormatSmallFields(t *testing.T) {
+	b, err := bcc.NewModule(smallFields, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("small", b)
+	all := bytes.Repeat([]byte{0xff}, 16)
+	if err := table.SetBytes(all, all); err != nil {
+		t.Fatal(err)
+	}
+	want := "{" + strings.Repeat(" 0xff", 16) + " }"
+	for e, err := range table.Entries() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Key != want || e.Value != want {
+			t.Fatalf("got key %q value %q, expected %q", e.Key, e.Value, want)
+		}
+	}
+	e, err := table.GetEntry(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Value != want {
+		t.Fatalf("got value %q, expected %q", e.Value, want)
+	}
+}
+
+func TestTableSetValidation(t *testing.T) {
+	b, err := bcc.NewModule(structHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("stats", b)
+	leaf := `{ 1 0 "" }`
+	if err := table.Set(`{ 1 80 0 }`, leaf); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		`{ 1 80 0`:         "missing }",
+		`{ 1 80 0 } 2`:     "unexpected 2",
+		`{ 1 65536 0 }`:    "field port: number 65536 out of range",
+		`{ 1 80abc 0 }`:    "invalid number",
+		`{ 0x1 80 0 } } }`: "unexpected }",
+		"{ 1\x00 80 0 }":   "NUL byte at offset 3",
+	} {
+		err := table.Set(key, leaf)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Set(%q): got error %v, expected %q", key, err, want)
+		}
+	}
+	if err := table.Set(`{ 2 80 0 }`, "{ 1 0 \"a\x00b\" }"); err == nil || !strings.Contains(err.Error(), "NUL byte") {
+		t.Errorf("got error %v, expected a NUL byte in the leaf", err)
+	}
+	if err := table.Set(`{ 2 80 0 }`, `{ 1 256 "" }`); err == nil || !strings.Contains(err.Error(), "field flag") {
+		t.Errorf("got error %v, expected an out of range flag", err)
+	}
+}
+
+func TestTableEntryFormatter(t *testing.T) {
+	b, err := bcc.NewModule(mixedStruct, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("mixed", b)
+	if err := table.Set("1", "{ 1 2 3 4 5 }"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := bcc.NewEntryFormatter(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.SetEntryFormatter(f)
+	e, err := table.GetEntry("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "key=1 a=1 b=2 c=3 d=4 e=5"
+	if got := e.String(); got != want {
+		t.Fatalf("unexpected entry %s, expected %s", got, want)
+	}
+	for e, err := range table.Entries() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(e); got != want {
+			t.Fatalf("unexpected entry %s, expected %s", got, want)
+		}
+	}
+}
+
+func TestTableSortedEntries(t *testing.T) {
+	b, err := bcc.NewModule(counters, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("counters", b)
+	for k, v := range map[string]string{"1": "30", "2": "10", "3": "20", "4": "10"} {
+		if err := table.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	for e, err := range table.SortedEntries(true) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, e.Key)
+	}
+	if strings.Join(keys, ",") != "0x2,0x4,0x3,0x1" {
+		t.Fatalf("unexpected order by value %v", keys)
+	}
+	keys = keys[:0]
+	for e, err := range table.SortedEntries(false) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, e.Key)
+	}
+	if strings.Join(keys, ",") != "0x1,0x2,0x3,0x4" {
+		t.Fatalf("unexpected order by key %v", keys)
+	}
+
+	b2, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	for _, err := range bcc.NewTable(b2.TableId("table1"), b2).SortedEntries(true) {
+		if err == nil {
+			t.Fatal("expected error sorting signed values")
+		}
+	}
+}
+
+func TestTableIterFilter(t *testing.T) {
+	b, err := bcc.NewModule(structHash, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("stats", b)
+	for _, k := range []statsKey{{Pid: 1, Port: 80}, {Pid: 1, Port: 443}, {Pid: 2, Port: 80}} {
+		if err := table.SetStruct(&k, &statsValue{Count: uint64(k.Port)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := 0
+	for e := range table.IterFilter(bcc.KeyPrefix([]byte{1, 0, 0, 0})) {
+		if !strings.HasPrefix(e.Key, "{ 0x1 ") {
+			t.Fatalf("unexpected entry %v", e)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("unexpected number of entries. Got %d, expected 2", n)
+	}
+	for e := range table.IterFilter(func(key []byte) bool { return false }) {
+		t.Fatalf("unexpected entry %v", e)
+	}
+}
+
+func TestTableEntryBytes(t *testing.T) {
+	b, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTable(b.TableId("table1"), b)
+	for i := 1; i <= 3; i++ {
+		if err := table.Set(strconv.Itoa(i), strconv.Itoa(i*10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e, err := table.GetEntry("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(e.KeyBytes, []byte{2, 0, 0, 0}) || !bytes.Equal(e.ValueBytes, []byte{20, 0, 0, 0}) {
+		t.Fatalf("unexpected raw entry %x: %x", e.KeyBytes, e.ValueBytes)
+	}
+	var entries []bcc.Entry
+	for e := range table.Iter() {
+		entries = append(entries, e)
+	}
+	for _, e := range entries {
+		if e.ValueBytes[0] != e.KeyBytes[0]*10 {
+			t.Fatalf("raw bytes of entry %v were overwritten", e)
+		}
+	}
+}
+
+func TestTableIncrement(t *testing.T) {
+	b, err := bcc.NewModule(counters, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	table := bcc.NewTableByName("counters", b)
+
+	const (
+		goroutines = 8
+		increments = 200
+	)
+	key := []byte{1, 0, 0, 0}
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				if err := table.Increment(key, 3); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	leaf, err := table.GetBytes(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bcc.GetHostByteOrder().Uint64(leaf); got != goroutines*increments*3 {
+		t.Fatalf("unexpected sum %d, expected %d", got, goroutines*increments*3)
+	}
+
+	b2, err := bcc.NewModule(simple1, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	if err := bcc.NewTable(b2.TableId("table1"), b2).Increment(key, 1); err == nil {
+		t.Fatal("expected error for 4 byte values")
+	}
+}
+
+func TestTableZeroAll(t *testing.T) {
+	forBatchOps(t, func(t *testing.T, batch bool) {
+		b, err := bcc.NewModule(counters, []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		table := bcc.NewTableByName("counters", b)
+		table.SetBatchOps(batch)
+		for i := 1; i <= 4; i++ {
+			if err := table.Set(strconv.Itoa(i), "42"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var n int
+		expectStrategy(t, table, "ZeroAll", batch, func() {
+			if n, err = table.ZeroAll(); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if n != 4 {
+			t.Fatalf("unexpected number of entries zeroed. Got %d, expected 4", n)
+		}
+		count := 0
+		for e := range table.Iter() {
+			if v, _ := strconv.ParseUint(e.Value, 0, 64); v != 0 {
+				t.Fatalf("entry %v not zeroed", e)
+			}
+			count++
+		}
+		if count != 4 {
+			t.Fatalf("unexpected number of entries. Got %d, expected 4", count)
+		}
+	})
 }
 
 func containsMap(maps []*elf.Map, name string) bool {
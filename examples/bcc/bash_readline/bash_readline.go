@@ -54,7 +54,11 @@ type readlineEvent struct {
 }
 
 func main() {
-	m := bpf.NewModule(source, []string{})
+	m, err := bpf.NewModule(source, []string{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to compile module: %s\n", err)
+		os.Exit(1)
+	}
 	defer m.Close()
 
 	readlineUretprobe, err := m.LoadUprobe("get_return_value")
@@ -81,7 +81,11 @@ type chownEvent struct {
 }
 
 func main() {
-	m := bpf.NewModule(source, []string{})
+	m, err := bpf.NewModule(source, []string{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to compile module: %s\n", err)
+		os.Exit(1)
+	}
 	defer m.Close()
 
 	chownKprobe, err := m.LoadKprobe("kprobe__sys_fchownat")
@@ -90,7 +94,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = m.AttachKprobe("sys_fchownat", chownKprobe)
+	err = m.AttachKprobe("sys_fchownat", chownKprobe, 0)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to attach kprobe__sys_fchownat: %s\n", err)
 		os.Exit(1)
@@ -102,7 +106,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = m.AttachKretprobe("sys_fchownat", chownKretprobe)
+	err = m.AttachKretprobe("sys_fchownat", chownKretprobe, 0)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to attach kretprobe__sys_fchownat: %s\n", err)
 		os.Exit(1)
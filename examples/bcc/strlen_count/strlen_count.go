@@ -70,7 +70,11 @@ func decodeHexInt(raw string) (uint64, error) {
 func main() {
 	pid := flag.Int("pid", -1, "attach to pid, default is all processes")
 	flag.Parse()
-	m := bpf.NewModule(source, []string{})
+	m, err := bpf.NewModule(source, []string{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to compile module: %s\n", err)
+		os.Exit(1)
+	}
 	defer m.Close()
 
 	strlenUprobe, err := m.LoadUprobe("count")
@@ -16,15 +16,6 @@ import (
 	bpf "github.com/iovisor/gobpf/bcc"
 )
 
-/*
-#cgo CFLAGS: -I/usr/include/bcc/compat
-#cgo LDFLAGS: -lbcc
-#include <bcc/bpf_common.h>
-#include <bcc/libbpf.h>
-void perf_reader_free(void *ptr);
-*/
-import "C"
-
 const source string = `
 #define KBUILD_MODNAME "foo"
 #include <uapi/linux/bpf.h>
@@ -125,16 +116,20 @@ func main() {
 	ret := "XDP_DROP"
 	ctxtype := "xdp_md"
 
-	module := bpf.NewModule(source, []string{
+	module, err := bpf.NewModule(source, []string{
 		"-w",
 		"-DRETURNCODE=" + ret,
 		"-DCTXTYPE=" + ctxtype,
 	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to compile module: %v\n", err)
+		os.Exit(1)
+	}
 	defer module.Close()
 
-	fn, err := module.Load("xdp_prog1", C.BPF_PROG_TYPE_XDP)
+	fn, err := module.Load("xdp_prog1", bpf.ProgramTypeXDP, 0, 0)
 
-	err = module.AttachXDP(device, fn)
+	err = module.AttachXDP(device, fn, 0)
 
 	if err != nil {
 		fmt.Println(err)
@@ -142,7 +137,7 @@ func main() {
 	}
 
 	defer func() {
-		if err := module.RemoveXDP(device); err != nil {
+		if err := module.RemoveXDP(device, 0); err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to remove XDP from %s: %v\n", device, err)
 		}
 	}()
@@ -0,0 +1,36 @@
+package cpupossible
+
+import (
+	"io/ioutil"
+	"sync"
+
+	"github.com/iovisor/gobpf/pkg/cpurange"
+)
+
+const cpuPossible = "/sys/devices/system/cpu/possible"
+
+var (
+	possibleMu   sync.Mutex
+	possibleCPUs []uint
+)
+
+// Get returns a slice with the possible CPUs, for example `[0, 1, 2, 3]`.
+// The set of possible CPUs is fixed at boot, so the result is cached
+// once read; failed reads are tried again by the next call.
+func Get() ([]uint, error) {
+	possibleMu.Lock()
+	defer possibleMu.Unlock()
+	if possibleCPUs != nil {
+		return possibleCPUs, nil
+	}
+	buf, err := ioutil.ReadFile(cpuPossible)
+	if err != nil {
+		return nil, err
+	}
+	cpus, err := cpurange.ReadCPURange(string(buf))
+	if err != nil {
+		return nil, err
+	}
+	possibleCPUs = cpus
+	return cpus, nil
+}